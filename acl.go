@@ -0,0 +1,84 @@
+package waffle
+
+import (
+	"crypto/subtle"
+	"errors"
+	"path"
+)
+
+// operations that can be granted on the control api
+const (
+	OpStatus  = "status"
+	OpStart   = "start"
+	OpPurge   = "purge"
+	OpMetrics = "metrics"
+	OpCancel  = "cancel"
+	OpDrain   = "drain"
+	OpBridge  = "bridge"
+	// grants every operation
+	OpAll = "*"
+)
+
+var errDenied = errors.New("operation not permitted")
+
+// ACL maps a token to the operations it is allowed to invoke.  A nil ACL
+// allows everything, so clusters that don't share a deployment don't need to
+// set one up.
+type ACL map[string][]string
+
+func (a ACL) allows(token, op string) bool {
+	if a == nil {
+		return true
+	}
+	for _, allowed := range a[token] {
+		if allowed == op || allowed == OpAll {
+			return true
+		}
+	}
+	return false
+}
+
+// operations that change the job, the ones audited when they go through
+var mutatingOps = map[string]bool{
+	OpStart:   true,
+	OpCancel:  true,
+	OpDrain:   true,
+	OpPurge:   true,
+	OpBridge:  true,
+	"preempt": true,
+}
+
+// check that token may invoke op, auditing denials and the operations that
+// change something, not every status poll.  The job token can do anything,
+// it's what workers make control calls to each other with.
+func (c *Coordinator) authorize(source, token, op string) error {
+	if !c.isJobToken(token) && !c.config.ACL.allows(token, op) {
+		c.audit(op, source, "denied")
+		return errDenied
+	}
+	if mutatingOps[op] {
+		c.audit(op, source, "")
+	}
+	return nil
+}
+
+// like authorize, but a nil ACL grants nothing, only the job token and
+// tokens it lists get through
+func (c *Coordinator) authorizeGranted(source, token, op string) error {
+	if c.config.ACL == nil && !c.isJobToken(token) {
+		c.audit(op, source, "denied")
+		return errDenied
+	}
+	return c.authorize(source, token, op)
+}
+
+func (c *Coordinator) isJobToken(token string) bool {
+	return c.config.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.config.Token)) == 1
+}
+
+// namespace is where everything belonging to this job lives: its zk paths,
+// spill files and the names it reports under.  Jobs are kept apart by tenant
+// first so teams sharing a deployment can reuse job ids.
+func (c *Config) namespace() string {
+	return path.Join(c.Tenant, c.JobId)
+}
@@ -0,0 +1,29 @@
+package waffle
+
+// Vertices that implement Activatable are woken up before they compute
+// whenever they have messages, as Pregel has it, instead of each Compute
+// having to check for messages after voting to halt.
+type Activatable interface {
+	SetActive(bool)
+}
+
+// ActiveBase can be embedded in a vertex to get Active, SetActive and
+// VoteToHalt.  Vertices start out active.
+type ActiveBase struct {
+	Halted bool
+}
+
+func (a *ActiveBase) Active() bool      { return !a.Halted }
+func (a *ActiveBase) SetActive(on bool) { a.Halted = !on }
+func (a *ActiveBase) VoteToHalt()       { a.Halted = true }
+
+// wake v up if it halted and has messages waiting
+func (g *Graph) reactivate(v Vertex, msgs []Message) {
+	if len(msgs) == 0 || v.Active() {
+		return
+	}
+	if a, ok := v.(Activatable); ok {
+		a.SetActive(true)
+		g.Count("vertex.reactivated", 1)
+	}
+}
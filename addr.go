@@ -0,0 +1,36 @@
+package waffle
+
+import (
+	"net"
+	"strings"
+)
+
+// All host:port handling goes through here so that IPv6 literals work
+// whether or not they come bracketed.
+
+// normalizeHost strips brackets off an IPv6 literal and puts IP addresses in
+// their canonical form, leaving names alone
+func normalizeHost(host string) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	zone := ""
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		host, zone = host[:i], host[i:]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	return host + zone
+}
+
+func joinHostPort(host, port string) string {
+	return net.JoinHostPort(normalizeHost(host), port)
+}
+
+// normalizeAddr puts a host:port in canonical form
+func normalizeAddr(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	return joinHostPort(host, port), nil
+}
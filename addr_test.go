@@ -0,0 +1,63 @@
+package waffle
+
+import "testing"
+
+func TestNormalizeHost(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"localhost", "localhost"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+		{"[fe80:0::1%eth0]", "fe80::1%eth0"},
+		{"::ffff:10.0.0.1", "10.0.0.1"},
+	} {
+		if got := normalizeHost(c.in); got != c.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestJoinHostPort(t *testing.T) {
+	for _, c := range []struct{ host, port, want string }{
+		{"localhost", "9000", "localhost:9000"},
+		{"::1", "9000", "[::1]:9000"},
+		{"[::1]", "9000", "[::1]:9000"},
+		{"fe80::1%eth0", "9000", "[fe80::1%eth0]:9000"},
+		{"[fe80::0:1%eth0]", "9000", "[fe80::1%eth0]:9000"},
+	} {
+		if got := joinHostPort(c.host, c.port); got != c.want {
+			t.Errorf("joinHostPort(%q, %q) = %q, want %q", c.host, c.port, got, c.want)
+		}
+	}
+}
+
+func TestNormalizeAddr(t *testing.T) {
+	for _, c := range []struct {
+		in, want string
+		err      bool
+	}{
+		{"localhost:9000", "localhost:9000", false},
+		{"10.0.0.1:9000", "10.0.0.1:9000", false},
+		{"[::1]:9000", "[::1]:9000", false},
+		{"[2001:DB8::0:1]:9000", "[2001:db8::1]:9000", false},
+		{"[fe80::1%eth0]:9000", "[fe80::1%eth0]:9000", false},
+		{"[fe80::1%25eth0]:9000", "[fe80::1%25eth0]:9000", false},
+		{"::1:9000", "", true},
+		{"[::1]", "", true},
+		{"localhost", "", true},
+	} {
+		got, err := normalizeAddr(c.in)
+		if c.err {
+			if err == nil {
+				t.Errorf("normalizeAddr(%q) = %q, want an error", c.in, got)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("normalizeAddr(%q) = %q, %v, want %q", c.in, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package waffle
+
+import (
+	"encoding/json"
+	"math"
+)
+
+// An Aggregator reduces values submitted by vertices during a step into a
+// single value that every vertex can read in the next step.  Each worker
+// keeps its own aggregators, which go out with the step summary (as json, so
+// keep the state in exported fields) and get reduced by every worker once the
+// step barrier is full.
+type Aggregator interface {
+	Submit(float64)
+	// ReduceInto folds this aggregator into into, which is of the same type
+	ReduceInto(into Aggregator)
+	Value() float64
+}
+
+// Jobs that use aggregators list them by name, with a func to make an empty
+// one.
+type AggregatorJob interface {
+	Job
+	Aggregators() map[string]func() Aggregator
+}
+
+type Sum struct{ Total float64 }
+
+func (a *Sum) Submit(v float64)        { a.Total += v }
+func (a *Sum) ReduceInto(b Aggregator) { b.(*Sum).Total += a.Total }
+func (a *Sum) Value() float64          { return a.Total }
+func NewSum() Aggregator               { return &Sum{} }
+
+type Count struct{ N float64 }
+
+func (a *Count) Submit(float64)          { a.N++ }
+func (a *Count) ReduceInto(b Aggregator) { b.(*Count).N += a.N }
+func (a *Count) Value() float64          { return a.N }
+func NewCount() Aggregator               { return &Count{} }
+
+type Mean struct{ Total, N float64 }
+
+func (a *Mean) Submit(v float64) {
+	a.Total += v
+	a.N++
+}
+
+func (a *Mean) ReduceInto(b Aggregator) {
+	m := b.(*Mean)
+	m.Total += a.Total
+	m.N += a.N
+}
+
+func (a *Mean) Value() float64 {
+	if a.N == 0 {
+		return 0
+	}
+	return a.Total / a.N
+}
+
+func NewMean() Aggregator { return &Mean{} }
+
+// Min and Max start out empty, their Value is NaN until something is
+// submitted
+type Min struct {
+	Min float64
+	Set bool
+}
+
+func (a *Min) Submit(v float64) {
+	if !a.Set || v < a.Min {
+		a.Min, a.Set = v, true
+	}
+}
+
+func (a *Min) ReduceInto(b Aggregator) {
+	if a.Set {
+		b.Submit(a.Min)
+	}
+}
+
+func (a *Min) Value() float64 {
+	if !a.Set {
+		return math.NaN()
+	}
+	return a.Min
+}
+
+func NewMin() Aggregator { return &Min{} }
+
+type Max struct {
+	Max float64
+	Set bool
+}
+
+func (a *Max) Submit(v float64) {
+	if !a.Set || v > a.Max {
+		a.Max, a.Set = v, true
+	}
+}
+
+func (a *Max) ReduceInto(b Aggregator) {
+	if a.Set {
+		b.Submit(a.Max)
+	}
+}
+
+func (a *Max) Value() float64 {
+	if !a.Set {
+		return math.NaN()
+	}
+	return a.Max
+}
+
+func NewMax() Aggregator { return &Max{} }
+
+func (g *Graph) newAggregator(name string) Aggregator {
+	if j, ok := g.job.(AggregatorJob); ok {
+		if f, ok := j.Aggregators()[name]; ok {
+			return f()
+		}
+	}
+	return nil
+}
+
+// Aggregate submits v to the named aggregator for this step
+func (g *Graph) Aggregate(name string, v float64) {
+	if g.shadowing() {
+		return
+	}
+	g.localStat.Lock()
+	defer g.localStat.Unlock()
+	a, ok := g.localStat.aggr[name].(Aggregator)
+	if !ok {
+		if a = g.newAggregator(name); a == nil {
+			g.log.Panicf("No aggregator named %s", name)
+		}
+		g.localStat.aggr[name] = a
+	}
+	a.Submit(v)
+}
+
+// Aggregated returns the value of the named aggregator over the whole cluster
+// as of the last step
+func (g *Graph) Aggregated(name string) (float64, bool) {
+	g.globalStat.Lock()
+	defer g.globalStat.Unlock()
+	a, ok := g.globalStat.aggr[name].(Aggregator)
+	if !ok {
+		return 0, false
+	}
+	return a.Value(), true
+}
+
+// reduceAggregators reduces the per worker aggregators in a merged step
+// summary
+func (g *Graph) reduceAggregators(total map[string]interface{}) map[string]interface{} {
+	reduced := make(map[string]interface{})
+	workers, ok := total["aggr"].(map[string]interface{})
+	if !ok {
+		return reduced
+	}
+	for w, v := range workers {
+		for name, state := range v.(map[string]interface{}) {
+			a := g.newAggregator(name)
+			if a == nil {
+				g.log.Printf("Worker %s reported unknown aggregator %s", w, name)
+				continue
+			}
+			// back through json into the concrete type
+			b, _ := json.Marshal(state)
+			if err := json.Unmarshal(b, a); err != nil {
+				g.log.Printf("Could not read aggregator %s from %s: %v", name, w, err)
+				continue
+			}
+			into, ok := reduced[name].(Aggregator)
+			if !ok {
+				into = g.newAggregator(name)
+				reduced[name] = into
+			}
+			a.ReduceInto(into)
+		}
+	}
+	return reduced
+}
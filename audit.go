@@ -0,0 +1,39 @@
+package waffle
+
+import (
+	"encoding/json"
+	"launchpad.net/gozk/zookeeper"
+	"path"
+	"time"
+)
+
+type auditEntry struct {
+	Time   time.Time
+	Node   string
+	Op     string
+	Source string
+	Detail string            `json:",omitempty"`
+	Tags   map[string]string `json:",omitempty"`
+}
+
+// audit records a control operation in the job's audit log in zk, which
+// outlives the workers.  Entries are sequential nodes, so reading the
+// children in order gives the history of the job.
+func (c *Coordinator) audit(op, source, detail string) {
+	e := &auditEntry{
+		Time:   time.Now(),
+		Node:   c.config.NodeId,
+		Op:     op,
+		Source: source,
+		Detail: detail,
+		Tags:   c.config.Tags,
+	}
+	data, _ := json.Marshal(e)
+	c.log.Printf("audit: %s", data)
+	if c.auditPath == "" {
+		return
+	}
+	if _, err := c.zk.Create(path.Join(c.auditPath, "entry-"), string(data), zookeeper.SEQUENCE, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
+		c.log.Printf("Could not write audit entry: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package waffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sync"
+)
+
+// how many bad records a load report keeps as examples
+const badRecordSamples = 10
+
+// LoadReport counts the records read from load paths and the ones that had to
+// be skipped, with a few examples of the latter.
+type LoadReport struct {
+	Records, Bad int
+	Samples      []string
+}
+
+func (r *LoadReport) add(o *LoadReport) {
+	r.Records += o.Records
+	r.Bad += o.Bad
+	for _, s := range o.Samples {
+		if len(r.Samples) < badRecordSamples {
+			r.Samples = append(r.Samples, s)
+		}
+	}
+}
+
+func (r *LoadReport) sample(s string) {
+	if len(r.Samples) < badRecordSamples {
+		r.Samples = append(r.Samples, s)
+	}
+}
+
+// Jobs (or the loaders they embed) that implement LoadReporter have their
+// bad records counted over the whole cluster and checked against
+// Config.MaxBadRecords and Config.MaxBadFraction once loading is done.
+type LoadReporter interface {
+	LoadReport(path string) *LoadReport
+}
+
+type loadReports struct {
+	reports map[string]*LoadReport
+	sync.Mutex
+}
+
+func (l *loadReports) set(path string, r *LoadReport) {
+	l.Lock()
+	defer l.Unlock()
+	if l.reports == nil {
+		l.reports = make(map[string]*LoadReport)
+	}
+	l.reports[path] = r
+}
+
+func (l *loadReports) LoadReport(path string) *LoadReport {
+	l.Lock()
+	defer l.Unlock()
+	return l.reports[path]
+}
+
+// what goes into our load barrier entry for path
+func (c *Coordinator) loadEntry(path string) string {
+	lr, ok := c.graph.job.(LoadReporter)
+	if !ok {
+		return ""
+	}
+	r := lr.LoadReport(path)
+	if r == nil {
+		return ""
+	}
+	data, _ := json.Marshal(r)
+	return string(data)
+}
+
+// add up the load reports in the full load barrier and check them against
+// the limits
+func (c *Coordinator) checkLoadReports(entries []string) error {
+	total := &LoadReport{}
+	for _, e := range entries {
+		data, _, err := c.zk.Get(path.Join(c.barriersPath, "load", e))
+		if err != nil || data == "" {
+			continue
+		}
+		var r LoadReport
+		if err := json.Unmarshal([]byte(data), &r); err != nil {
+			c.log.Printf("Bad load report from %s: %v", e, err)
+			continue
+		}
+		total.add(&r)
+	}
+	c.loadReport = total
+	if total.Bad == 0 {
+		return nil
+	}
+	c.log.Printf("Skipped %d of %d records while loading", total.Bad, total.Records)
+	if max := c.config.MaxBadRecords; max > 0 && total.Bad > max {
+		return fmt.Errorf("%d bad records, more than the %d allowed", total.Bad, max)
+	}
+	if max := c.config.MaxBadFraction; max > 0 && total.Records > 0 && float64(total.Bad)/float64(total.Records) > max {
+		return fmt.Errorf("%d of %d records are bad, more than the %.2f%% allowed", total.Bad, total.Records, 100*max)
+	}
+	return nil
+}
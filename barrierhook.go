@@ -0,0 +1,108 @@
+package waffle
+
+import (
+	"fmt"
+	"github.com/dforsyth/donut"
+	"path"
+	"strconv"
+)
+
+// A barrier hook keeps a job in lock step with something outside it, a
+// parameter server or another job, say.  It runs at every step barrier with
+// the step's stats, and nobody moves on until it returns.  There is no
+// master, so workers say in their step summaries whether they have a hook,
+// the first of those by partition runs it for everyone and the rest wait for
+// its answer in a sync barrier.  The hook can take as long as it likes, an
+// error from it fails the run on every worker.
+
+// A BarrierHookFn runs once per step barrier, after any MasterComputeFn, and
+// returns once the outside world is ready for the next step.
+type BarrierHookFn func(superstep uint64, aggregates map[string]interface{}, stats StepStats) error
+
+// Jobs that implement BarrierHooker have BarrierHook run at every step
+// barrier, unless the runner was given a BarrierHookFn of its own.
+type BarrierHooker interface {
+	BarrierHook(superstep uint64, aggregates map[string]interface{}, stats StepStats) error
+}
+
+// BarrierHookError is what a run returns when its barrier hook fails.
+type BarrierHookError struct {
+	Step   int
+	Worker string
+	Err    string
+}
+
+func (e *BarrierHookError) Error() string {
+	return fmt.Sprintf("barrier hook on %s failed after step %d: %s", e.Worker, e.Step, e.Err)
+}
+
+// SetBarrierHookFn has f run at every step barrier.  It has to be set before
+// the job starts computing, on any one worker or more.
+func (r *Runner) SetBarrierHookFn(f BarrierHookFn) {
+	r.listener.coordinator.barrierHook = f
+}
+
+func (c *Coordinator) barrierHookFn() BarrierHookFn {
+	if c.barrierHook != nil {
+		return c.barrierHook
+	}
+	if h, ok := c.graph.job.(BarrierHooker); ok {
+		return h.BarrierHook
+	}
+	return nil
+}
+
+// the worker that runs the barrier hook after a step, the first one by
+// partition that has one, or nobody
+func (c *Coordinator) hookWorker(total map[string]interface{}) string {
+	hooked, _ := total["hook"].(map[string]interface{})
+	for pid := 0; pid < c.numPartitions(); pid++ {
+		if w := c.worker(pid); hooked[w] != nil {
+			return w
+		}
+	}
+	return ""
+}
+
+// wait for worker to run f after step before calling proceed
+func (c *Coordinator) syncBarrier(step int, worker string, f BarrierHookFn, frontier FrontierStat, topology TopologyChange, vertices int, proceed func()) {
+	name := "sync-" + strconv.Itoa(step)
+	c.createBarrier(name, func(m *donut.SafeMap) {
+		c.onSyncBarrierChange(step, worker, m, proceed)
+	})
+	if worker != c.config.NodeId {
+		return
+	}
+	aggregates, stats := c.stepStats(step, frontier, topology, vertices)
+	go func() {
+		answer := ""
+		if err := f(uint64(step), aggregates, stats); err != nil {
+			c.log.Printf("Barrier hook failed after step %d: %v", step, err)
+			answer = err.Error()
+		}
+		c.enterBarrier(name, c.config.NodeId, answer)
+	}()
+}
+
+func (c *Coordinator) onSyncBarrierChange(step int, w string, m *donut.SafeMap, proceed func()) {
+	if m.Len() == 0 {
+		return
+	}
+	name := "sync-" + strconv.Itoa(step)
+	if kill, ok := c.watchers[name]; ok {
+		kill <- 1
+		delete(c.watchers, name)
+	}
+	answer, _, err := c.zk.Get(path.Join(c.barriersPath, name, w))
+	if err != nil {
+		answer = fmt.Sprintf("could not read its answer: %v", err)
+	}
+	if answer != "" {
+		err := &BarrierHookError{Step: step, Worker: w, Err: answer}
+		c.log.Println(err)
+		c.fail(err)
+		return
+	}
+	c.log.debugf("Barrier hook done after step %d", step)
+	proceed()
+}
@@ -0,0 +1,163 @@
+package waffle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// default number of messages in a batch
+const defaultBatchSize = 1024
+
+// sendBatch collects the gob encoded messages for one partition until there
+// are enough of them to be worth an rpc.  Unlike a spillBuffer it is shipped
+// asynchronously, so every batch gets a fresh buffer.
+type sendBatch struct {
+	buf   *bytes.Buffer
+	enc   *gob.Encoder
+	count int
+	step  int
+	sync.Mutex
+}
+
+func (b *sendBatch) add(m Message, step int) error {
+	if b.enc == nil {
+		// every batch carries its own type information
+		b.buf = new(bytes.Buffer)
+		b.enc = gob.NewEncoder(b.buf)
+		b.step = step
+	}
+	if err := b.enc.Encode(&m); err != nil {
+		return err
+	}
+	b.count++
+	return nil
+}
+
+// take the batch out, leaving an empty one behind
+func (b *sendBatch) take() *MessageBatch {
+	batch := &MessageBatch{Step: b.step, Count: b.count, Data: b.buf.Bytes()}
+	b.buf, b.enc, b.count = nil, nil, 0
+	return batch
+}
+
+type sendBatches struct {
+	m map[int]*sendBatch
+	sync.Mutex
+}
+
+func (s *sendBatches) get(pid int) *sendBatch {
+	s.Lock()
+	defer s.Unlock()
+	if s.m == nil {
+		s.m = make(map[int]*sendBatch)
+	}
+	b, ok := s.m[pid]
+	if !ok {
+		b = &sendBatch{}
+		s.m[pid] = b
+	}
+	return b
+}
+
+func (s *sendBatches) each(f func(pid int, b *sendBatch)) {
+	s.Lock()
+	batches := make(map[int]*sendBatch, len(s.m))
+	for pid, b := range s.m {
+		batches[pid] = b
+	}
+	s.Unlock()
+	for pid, b := range batches {
+		f(pid, b)
+	}
+}
+
+func (c *Config) batchSize() int {
+	if c.BatchSize > 0 {
+		return c.BatchSize
+	}
+	return defaultBatchSize
+}
+
+// add m to the batch for partition pid, shipping the batch once it's full
+func (c *Coordinator) batchMessage(m Message, pid, step int) error {
+	b := c.batches.get(pid)
+	b.Lock()
+	defer b.Unlock()
+	if b.count > 0 && b.step != step {
+		c.shipBatch(pid, b)
+	}
+	var t time.Time
+	timed := false
+	if p := c.graph.prof; p != nil {
+		t, timed = p.encode.start()
+	}
+	err := b.add(m, step)
+	if timed {
+		c.graph.prof.encode.stop(t)
+	}
+	if err != nil {
+		return err
+	}
+	if b.count >= c.config.batchSize() {
+		c.shipBatch(pid, b)
+	}
+	return nil
+}
+
+// send b to partition pid without waiting for the reply, the outbox is
+// drained before the step is flushed.  Expects b to be locked.
+func (c *Coordinator) shipBatch(pid int, b *sendBatch) {
+	if b.count == 0 {
+		return
+	}
+	batch := b.take()
+	codec := c.codecs.get(c.config, CodecMessages)
+	data, err := codec.Compress(batch.Data)
+	if err != nil {
+		c.log.Printf("Could not compress %d messages for partition %d: %v", batch.Count, pid, err)
+		c.outbox.add(batch.Count, err)
+		return
+	}
+	batch.Codec, batch.Data = codec.Name(), data
+	cl := c.client(c.worker(pid))
+	c.outbox.trackN(batch.Count, cl.Go("Coordinator.SubmitMessageBatch", batch, new(int), make(chan *rpc.Call, 1)))
+}
+
+func (c *Coordinator) flushBatches() {
+	c.batches.each(func(pid int, b *sendBatch) {
+		b.Lock()
+		c.shipBatch(pid, b)
+		b.Unlock()
+	})
+}
+
+// streamBatches ships partly filled batches every Config.FlushInterval while
+// a step computes, so receivers aren't left waiting for the barrier.  The
+// returned func stops it.
+func (c *Coordinator) streamBatches() func() {
+	if c.config.FlushInterval <= 0 || c.config.SpillDir != "" {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		t := time.NewTicker(c.config.FlushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				c.flushBatches()
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
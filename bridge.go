@@ -0,0 +1,323 @@
+package waffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"launchpad.net/gozk/zookeeper"
+	"net/rpc"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A Bridge couples two jobs running side by side, on two related graphs say,
+// so they can take turns in an alternating optimization.  Both jobs set up a
+// Bridge with the same Name, each naming the other's JobId as its Peer, and
+// then move through their steps in lock step.  Vertices send messages to the
+// peer's vertices with Graph.SendToPeer, and they are delivered in the peer's
+// next step like any other message.  After every step each job hands the
+// peer the values of the aggregators it lists, which the peer's vertices see
+// through Graph.PeerAggregate during the next step.
+//
+// The exchange rides on the barrier hook: messages for the peer go to one of
+// its workers before the step barrier, which passes them on to their owners.
+// At the barrier the first worker leaves the job's aggregates under the
+// bridge path and waits for the peer to do the same, so neither job starts a
+// step before both have finished the one before it and everything sent
+// across has arrived.  A job that finishes says so, and its peer carries on
+// alone.  Both jobs need the same Tenant, zookeeper and transport settings,
+// and the message types they send each other registered.  Use a new Name for
+// every pair of runs.
+
+// Bridge is set with Runner.SetBridge before the job starts.
+type Bridge struct {
+	Name string
+	// the JobId of the job on the other side
+	Peer string
+	// the aggregators whose values are handed to the peer after every step
+	Aggregators []string
+	// how long to wait for the peer at a step barrier, defaults to 10
+	// minutes
+	Timeout time.Duration
+
+	out     []Message
+	values  map[string]float64
+	clients map[string]*rpc.Client
+	gone    bool
+	sync.Mutex
+}
+
+const (
+	counterBridgeSent = "bridge.sent"
+	// a peer that died without saying it was done never comes back
+	defaultBridgeTimeout = 10 * time.Minute
+)
+
+// what a job leaves for its peer after a step
+type bridgeStep struct {
+	Aggregates map[string]float64
+	Sent       int
+}
+
+// messages from the peer, to deliver in Step
+type BridgeBatch struct {
+	Source    string
+	Token     string
+	Step      int
+	Msgs      []Message
+	Forwarded bool
+}
+
+// SetBridge couples this runner's job with the one b names.
+func (r *Runner) SetBridge(b *Bridge) {
+	r.listener.coordinator.bridge = b
+}
+
+// SendToPeer sends msg to a vertex of the job on the other side of the
+// bridge, to arrive in its next step.
+func (g *Graph) SendToPeer(msg Message) error {
+	b := g.coordinator.bridge
+	if b == nil {
+		return fmt.Errorf("no bridge to send %s over", msg.Destination())
+	}
+	if err := checkSendable("message", msg); err != nil {
+		return err
+	}
+	if g.shadowing() {
+		return nil
+	}
+	g.Count(counterBridgeSent, 1)
+	b.Lock()
+	defer b.Unlock()
+	b.out = append(b.out, msg)
+	return nil
+}
+
+// PeerAggregate is the value of the peer's aggregator name after its last
+// step, if it was handed over.
+func (g *Graph) PeerAggregate(name string) (float64, bool) {
+	b := g.coordinator.bridge
+	if b == nil {
+		return 0, false
+	}
+	b.Lock()
+	defer b.Unlock()
+	v, ok := b.values[name]
+	return v, ok
+}
+
+func (c *Coordinator) SubmitBridge(batch *BridgeBatch, r *int) error {
+	if err := c.authorize(batch.Source, batch.Token, OpBridge); err != nil {
+		return err
+	}
+	*r = 0
+	if batch.Forwarded {
+		for _, m := range batch.Msgs {
+			c.graph.addMessage(m, batch.Step)
+		}
+		return nil
+	}
+	// pass the rest on to their owners before answering, the peer's step
+	// barrier waits on this call
+	fwd := make(map[int]*BridgeBatch)
+	for _, m := range batch.Msgs {
+		p := c.graph.determinePartition(m.Destination())
+		if p == c.graph.partitionId {
+			c.graph.addMessage(m, batch.Step)
+			continue
+		}
+		if fwd[p] == nil {
+			fwd[p] = &BridgeBatch{Source: c.config.NodeId, Token: c.config.Token, Step: batch.Step, Forwarded: true}
+		}
+		fwd[p].Msgs = append(fwd[p].Msgs, m)
+	}
+	for p, f := range fwd {
+		var r int
+		if err := c.client(c.worker(p)).Call("Coordinator.SubmitBridge", f, &r); err != nil {
+			return fmt.Errorf("could not pass %d bridged messages to partition %d: %v", len(f.Msgs), p, err)
+		}
+	}
+	return nil
+}
+
+// where both sides of the bridge leave what they hand over
+func (c *Coordinator) bridgePath(job string) string {
+	return path.Join("/", c.config.Tenant, BridgesPath, c.bridge.Name, job)
+}
+
+// send what this step's vertices sent to the peer, before the step barrier.
+// Each message goes to the peer worker its destination hashes to.
+func (c *Coordinator) flushBridge(step int) {
+	b := c.bridge
+	if b == nil {
+		return
+	}
+	b.Lock()
+	out, gone := b.out, b.gone
+	b.out = nil
+	b.Unlock()
+	if len(out) == 0 {
+		return
+	}
+	if gone {
+		c.log.Printf("Dropping %d messages for %s, it has finished", len(out), b.Peer)
+		return
+	}
+	workersPath := path.Join("/", c.config.Tenant, b.Peer, WorkersPath)
+	workers, _, err := c.zk.Children(workersPath)
+	if err != nil || len(workers) == 0 {
+		c.outbox.add(len(out), fmt.Errorf("could not find the workers of %s: %v", b.Peer, err))
+		return
+	}
+	sort.Strings(workers)
+	batches := make(map[string]*BridgeBatch)
+	for _, m := range out {
+		h := fnv.New32a()
+		h.Write([]byte(m.Destination()))
+		w := workers[int(h.Sum32()%uint32(len(workers)))]
+		if batches[w] == nil {
+			batches[w] = &BridgeBatch{Source: c.config.NodeId, Token: c.config.Token, Step: step + 1}
+		}
+		batches[w].Msgs = append(batches[w].Msgs, m)
+	}
+	for w, batch := range batches {
+		cl, err := c.bridgeClient(path.Join(workersPath, w))
+		if err != nil {
+			c.outbox.add(len(batch.Msgs), err)
+			continue
+		}
+		c.outbox.trackN(0, cl.Go("Coordinator.SubmitBridge", batch, new(int), make(chan *rpc.Call, 1)))
+	}
+}
+
+func (c *Coordinator) bridgeClient(worker string) (*rpc.Client, error) {
+	b := c.bridge
+	b.Lock()
+	defer b.Unlock()
+	if cl, ok := b.clients[worker]; ok {
+		return cl, nil
+	}
+	raw, _, err := c.zk.Get(worker)
+	if err != nil {
+		return nil, err
+	}
+	var info map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &info); err != nil {
+		return nil, fmt.Errorf("bad registration for %s: %v", worker, err)
+	}
+	cl, err := c.dial(info["host"].(string), info["port"].(string))
+	if err != nil {
+		return nil, err
+	}
+	if b.clients == nil {
+		b.clients = make(map[string]*rpc.Client)
+	}
+	b.clients[worker] = cl
+	return cl, nil
+}
+
+// the barrier hook for a bridged job: leave this step's aggregates for the
+// peer and wait for its, then run f if there is one
+func (c *Coordinator) bridgeHook(f BarrierHookFn) BarrierHookFn {
+	return func(superstep uint64, aggregates map[string]interface{}, stats StepStats) error {
+		b := c.bridge
+		step := int(superstep)
+		s := bridgeStep{Aggregates: make(map[string]float64), Sent: int(stats.Counters[counterBridgeSent])}
+		for _, name := range b.Aggregators {
+			if v, ok := aggregates[name].(float64); ok {
+				s.Aggregates[name] = v
+			}
+		}
+		data, _ := json.Marshal(&s)
+		own := c.bridgePath(c.config.JobId)
+		for _, p := range []string{path.Join("/", c.config.Tenant, BridgesPath), path.Dir(own), own} {
+			c.zk.Create(p, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+		}
+		node := path.Join(own, "step-"+strconv.Itoa(step))
+		if _, err := c.zk.Create(node, string(data), 0, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
+			if _, err := c.zk.Set(node, string(data), -1); err != nil {
+				return fmt.Errorf("could not hand step %d over to %s: %v", step, b.Peer, err)
+			}
+		}
+		if err := c.awaitPeer(step); err != nil {
+			return err
+		}
+		if f != nil {
+			return f(superstep, aggregates, stats)
+		}
+		return nil
+	}
+}
+
+// wait until the peer is through step or has finished
+func (c *Coordinator) awaitPeer(step int) error {
+	b := c.bridge
+	peer := c.bridgePath(b.Peer)
+	node, done := path.Join(peer, "step-"+strconv.Itoa(step)), path.Join(peer, "done")
+	wait := b.Timeout
+	if wait <= 0 {
+		wait = defaultBridgeTimeout
+	}
+	timeout := time.After(wait)
+	for {
+		stat, watch, err := c.zk.ExistsW(node)
+		if err != nil {
+			return err
+		}
+		if stat != nil {
+			return nil
+		}
+		stat, doneWatch, err := c.zk.ExistsW(done)
+		if err != nil {
+			return err
+		}
+		if stat != nil {
+			return nil
+		}
+		c.log.debugf("Waiting for %s to finish step %d", b.Peer, step)
+		select {
+		case <-watch:
+		case <-doneWatch:
+		case <-timeout:
+			return fmt.Errorf("%s didn't finish step %d within %v", b.Peer, step, wait)
+		}
+	}
+}
+
+// take what the peer handed over after step, then carry on with proceed.
+// Everyone reads it once the first worker has seen it arrive.
+func (c *Coordinator) bridgeProceed(step int, proceed func()) func() {
+	return func() {
+		b := c.bridge
+		peer := c.bridgePath(b.Peer)
+		data, _, err := c.zk.Get(path.Join(peer, "step-"+strconv.Itoa(step)))
+		if err == nil {
+			var s bridgeStep
+			if err := json.Unmarshal([]byte(data), &s); err != nil {
+				c.log.Printf("Bad handover from %s after step %d: %v", b.Peer, step, err)
+			}
+			b.Lock()
+			b.values = s.Aggregates
+			b.Unlock()
+			// what the peer sent keeps this job going like its own messages
+			c.graph.globalStat.Lock()
+			c.graph.globalStat.msgs += s.Sent
+			c.graph.globalStat.Unlock()
+		} else {
+			b.Lock()
+			if !b.gone {
+				c.log.Printf("%s has finished, carrying on alone", b.Peer)
+			}
+			b.gone = true
+			b.Unlock()
+		}
+		proceed()
+		if atomic.LoadInt32(&c.state) == WriteState && c.graph.partitionId == 0 {
+			c.zk.Create(path.Join(c.bridgePath(c.config.JobId), "done"), "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package waffle
+
+// Jobs whose vertices hold a single float64 can implement BulkFloatJob to have
+// incoming FloatMessages combined and applied per partition in plain slices,
+// rather than handing every message to Compute through the Message interface.
+// Vertices that got messages this way are still computed, with no messages, so
+// that they can send along their new value.
+
+type FloatOp int
+
+const (
+	FloatSum FloatOp = iota
+	FloatMin
+	FloatMax
+)
+
+type FloatMessage interface {
+	Message
+	FloatValue() float64
+}
+
+type FloatVertex interface {
+	Vertex
+	FloatValue() float64
+	SetFloatValue(float64)
+}
+
+type BulkFloatJob interface {
+	Job
+	// how the messages to a single vertex are combined
+	FloatOp() FloatOp
+	// ApplyFloats updates values in place from the combined incoming
+	// messages, both slices are the same length
+	ApplyFloats(values, combined []float64)
+}
+
+func combineFloats(op FloatOp, msgs []Message) float64 {
+	r := msgs[0].(FloatMessage).FloatValue()
+	switch op {
+	case FloatSum:
+		for _, m := range msgs[1:] {
+			r += m.(FloatMessage).FloatValue()
+		}
+	case FloatMin:
+		for _, m := range msgs[1:] {
+			if v := m.(FloatMessage).FloatValue(); v < r {
+				r = v
+			}
+		}
+	case FloatMax:
+		for _, m := range msgs[1:] {
+			if v := m.(FloatMessage).FloatValue(); v > r {
+				r = v
+			}
+		}
+	}
+	return r
+}
+
+func floatMessages(msgs []Message) bool {
+	for _, m := range msgs {
+		if _, ok := m.(FloatMessage); !ok {
+			return false
+		}
+	}
+	return len(msgs) > 0
+}
+
+// apply the messages for this step to every float vertex in bulk, leaving
+// anything that doesn't fit the fast path to Compute
+func (g *Graph) applyFloats(j BulkFloatJob) {
+	var vertices []FloatVertex
+	var values, combined []float64
+	// paged in vertices go back to the cold store once they are set
+	var cold []Vertex
+	op := j.FloatOp()
+	for id, msgs := range g.messages {
+		if !floatMessages(msgs) {
+			continue
+		}
+		v, isCold, _ := g.vertex(id)
+		fv, ok := v.(FloatVertex)
+		if !ok {
+			continue
+		}
+		if isCold {
+			cold = append(cold, v)
+		}
+		vertices = append(vertices, fv)
+		values = append(values, fv.FloatValue())
+		combined = append(combined, combineFloats(op, msgs))
+	}
+	if len(vertices) == 0 {
+		return
+	}
+	j.ApplyFloats(values, combined)
+	for i, fv := range vertices {
+		g.touch(fv.Id())
+		fv.SetFloatValue(values[i])
+		g.messages[fv.Id()] = make([]Message, 0)
+	}
+	for _, v := range cold {
+		g.putVertex(v)
+	}
+}
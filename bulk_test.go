@@ -0,0 +1,89 @@
+package waffle
+
+import (
+	"strconv"
+	"testing"
+)
+
+type benchFloatVertex struct {
+	id    string
+	value float64
+}
+
+func (v *benchFloatVertex) Id() string                { return v.id }
+func (v *benchFloatVertex) Compute(*Graph, []Message) {}
+func (v *benchFloatVertex) Active() bool              { return false }
+func (v *benchFloatVertex) FloatValue() float64       { return v.value }
+func (v *benchFloatVertex) SetFloatValue(f float64)   { v.value = f }
+
+type benchFloatMessage struct {
+	dst   string
+	value float64
+}
+
+func (m *benchFloatMessage) Destination() string { return m.dst }
+func (m *benchFloatMessage) FloatValue() float64 { return m.value }
+
+type benchFloatJob struct{ op FloatOp }
+
+func (j *benchFloatJob) Id() string                            { return "bench" }
+func (j *benchFloatJob) LoadPaths() []string                   { return nil }
+func (j *benchFloatJob) Load(string) ([]Vertex, []Edge, error) { return nil, nil, nil }
+func (j *benchFloatJob) Checkpoint(int) bool                   { return false }
+func (j *benchFloatJob) Write(*Graph) error                    { return nil }
+func (j *benchFloatJob) Persist(*Graph) error                  { return nil }
+func (j *benchFloatJob) FloatOp() FloatOp                      { return j.op }
+
+func (j *benchFloatJob) ApplyFloats(values, combined []float64) {
+	for i := range values {
+		values[i] = 0.15 + 0.85*combined[i]
+	}
+}
+
+// a graph of n float vertices with msgs messages waiting for each
+func benchFloatGraph(n, msgs int) (*Graph, map[string][]Message) {
+	j := &benchFloatJob{op: FloatSum}
+	g := newGraph(j, newCoordinator("bench", &Config{}))
+	inbox := make(map[string][]Message)
+	for i := 0; i < n; i++ {
+		id := strconv.Itoa(i)
+		g.vertices[id] = &benchFloatVertex{id: id}
+		for k := 0; k < msgs; k++ {
+			inbox[id] = append(inbox[id], &benchFloatMessage{dst: id, value: float64(k)})
+		}
+	}
+	return g, inbox
+}
+
+func benchmarkApplyFloats(b *testing.B, n, msgs int) {
+	g, inbox := benchFloatGraph(n, msgs)
+	j := g.job.(BulkFloatJob)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for id, m := range inbox {
+			g.messages[id] = m
+		}
+		b.StartTimer()
+		g.applyFloats(j)
+	}
+}
+
+func BenchmarkApplyFloats1k(b *testing.B)   { benchmarkApplyFloats(b, 1000, 8) }
+func BenchmarkApplyFloats100k(b *testing.B) { benchmarkApplyFloats(b, 100000, 8) }
+
+func benchmarkCombineFloats(b *testing.B, op FloatOp) {
+	msgs := make([]Message, 64)
+	for i := range msgs {
+		msgs[i] = &benchFloatMessage{value: float64(i)}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		combineFloats(op, msgs)
+	}
+}
+
+func BenchmarkCombineFloatsSum(b *testing.B) { benchmarkCombineFloats(b, FloatSum) }
+func BenchmarkCombineFloatsMin(b *testing.B) { benchmarkCombineFloats(b, FloatMin) }
+func BenchmarkCombineFloatsMax(b *testing.B) { benchmarkCombineFloats(b, FloatMax) }
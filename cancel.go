@@ -0,0 +1,103 @@
+package waffle
+
+import (
+	"fmt"
+	"launchpad.net/gozk/zookeeper"
+	"net/http"
+)
+
+// A job can be cancelled from any of its workers, with Runner.Cancel from
+// the process running one, CancelJob over rpc, or a POST to /cancel on the
+// status address.  That drops a cancel node holding the reason into zk, and
+// every worker that sees it gives up on whatever it was doing: its run
+// returns a CancelledError, and Runner.Stats has what was done until then.
+// Closing the runner stops its heartbeats and connections like any other,
+// and takes the cancel node away so the job can be run again.
+
+// CancelledError is what a cancelled run returns.
+type CancelledError struct {
+	Reason string
+}
+
+func (e *CancelledError) Error() string {
+	return fmt.Sprintf("job was cancelled: %s", e.Reason)
+}
+
+type CancelRequest struct {
+	Source string
+	Token  string
+	Reason string
+}
+
+func (c *Coordinator) CancelJob(req *CancelRequest, r *int) error {
+	if err := c.authorize(req.Source, req.Token, OpCancel); err != nil {
+		return err
+	}
+	*r = 0
+	return c.cancel(req.Reason)
+}
+
+func (c *Coordinator) cancel(reason string) error {
+	if _, err := c.zk.Create(c.cancelPath, reason, 0, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil && !zookeeper.IsError(err, zookeeper.ZNODEEXISTS) {
+		return fmt.Errorf("could not create the cancel node: %v", err)
+	}
+	return nil
+}
+
+// Cancel cancels the job this runner is part of, on every worker.
+func (r *Runner) Cancel(reason string) error {
+	c := r.listener.coordinator
+	c.audit(OpCancel, "runner", reason)
+	return c.cancel(reason)
+}
+
+// CancelJob asks the worker listening at host:port to cancel its job.
+func CancelJob(c *Config, host, port, reason string) error {
+	cl, err := (&Coordinator{config: c}).dial(host, port)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	var r int
+	return cl.Call("Coordinator.CancelJob", &CancelRequest{Source: c.NodeId, Token: c.Token, Reason: reason}, &r)
+}
+
+func (c *Coordinator) serveCancel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "cancel with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	// the status port is plain http, so cancelling there takes the job token
+	// or a grant even without an ACL
+	if err := c.authorizeGranted(r.RemoteAddr, r.Header.Get(tokenHeader), OpCancel); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "cancelled over http by " + r.RemoteAddr
+	}
+	if err := c.cancel(reason); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (c *Coordinator) watchCancel() {
+	for {
+		stat, watch, err := c.zk.ExistsW(c.cancelPath)
+		if err != nil {
+			c.log.Printf("Could not watch %s: %v", c.cancelPath, err)
+			return
+		}
+		if stat != nil {
+			reason, _, _ := c.zk.Get(c.cancelPath)
+			err := &CancelledError{Reason: reason}
+			// audited where it was asked for, not by every worker
+			c.log.Println(err)
+			c.timers.stopAll()
+			c.fail(err)
+			return
+		}
+		<-watch
+	}
+}
@@ -0,0 +1,121 @@
+package waffle
+
+import (
+	"sort"
+	"strings"
+)
+
+// Workers advertise what they can do in their registration info, and once
+// everyone has registered each worker works out the subset they all have.
+// Every worker sees the same registrations, so they all come to the same
+// answer without anyone having to decide for them.  Optional features the
+// cluster doesn't have in common are switched off up front rather than
+// failing halfway through a step.
+
+const (
+	// messages go out in batches through SubmitMessageBatch
+	CapBatch = "batch"
+	// vertices can be moved between partitions through SubmitMigration
+	CapMigrate = "migrate"
+	// this worker keeps in-edges, they only work when everyone does
+	CapInEdges = "inedges"
+	// prefix of the codecs a worker can decompress
+	CapCodec = "codec:"
+)
+
+type capabilities map[string]bool
+
+func (c capabilities) has(cap string) bool {
+	return c[cap]
+}
+
+func (c capabilities) list() []string {
+	var l []string
+	for cap := range c {
+		l = append(l, cap)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// what we can do
+func (c *Coordinator) capabilities() []string {
+	caps := []string{CapBatch, CapMigrate}
+	if c.config.InEdges {
+		caps = append(caps, CapInEdges)
+	}
+	codecLock.RLock()
+	for name := range codecs {
+		caps = append(caps, CapCodec+name)
+	}
+	codecLock.RUnlock()
+	sort.Strings(caps)
+	return caps
+}
+
+// what a worker can do by its registration info
+func infoCapabilities(info map[string]interface{}) capabilities {
+	caps := make(capabilities)
+	if l, ok := info["capabilities"].([]interface{}); ok {
+		for _, cap := range l {
+			if s, ok := cap.(string); ok {
+				caps[s] = true
+			}
+		}
+	}
+	return caps
+}
+
+// work out what every worker can do from their registrations, and turn off
+// what some can't.  Workers from before capabilities were advertised can't do
+// any of it.
+func (c *Coordinator) negotiate() {
+	var common capabilities
+	c.clientsLock.RLock()
+	for _, info := range c.cachedWorkerInfo {
+		theirs := infoCapabilities(info)
+		if common == nil {
+			common = theirs
+			continue
+		}
+		for cap := range common {
+			if !theirs[cap] {
+				delete(common, cap)
+			}
+		}
+	}
+	c.clientsLock.RUnlock()
+	if common == nil {
+		common = make(capabilities)
+	}
+	c.caps = common
+
+	cfg := c.config
+	if name := cfg.MessageCodec; name != "" && name != "none" && !common.has(CapCodec+name) {
+		c.log.Printf("Not every worker has the %s codec, sending messages uncompressed", name)
+		cfg.MessageCodec = "none"
+		c.codecs.Lock()
+		delete(c.codecs.codecs, CodecMessages)
+		c.codecs.Unlock()
+	}
+	if name := cfg.CheckpointCodec; name != "" && name != "none" && !common.has(CapCodec+name) {
+		c.log.Printf("Not every worker has the %s codec, writing checkpoints uncompressed", name)
+		cfg.CheckpointCodec = "none"
+		c.codecs.Lock()
+		delete(c.codecs.codecs, CodecCheckpoints)
+		c.codecs.Unlock()
+	}
+	if !common.has(CapBatch) {
+		c.log.Printf("Not every worker takes message batches, sending messages one at a time")
+	}
+	if cfg.InEdges && !common.has(CapInEdges) {
+		c.log.Printf("Not every worker keeps in-edges, turning them and pull steps off")
+		cfg.InEdges = false
+		cfg.PullFraction = 0
+	}
+	if (cfg.RebalanceSkew > 0 || cfg.RepartitionSkew > 0) && !common.has(CapMigrate) {
+		c.log.Printf("Not every worker can take migrated vertices, turning rebalancing off")
+		cfg.RebalanceSkew, cfg.RepartitionSkew = 0, 0
+	}
+	c.log.debugf("Cluster capabilities: %s", strings.Join(common.list(), ", "))
+}
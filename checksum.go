@@ -0,0 +1,131 @@
+package waffle
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"hash"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// Mirror checks and delta checkpoints compare vertices by checksum, so two
+// copies of a vertex have to sum the same wherever they are.  Gob can't be
+// used for that since it writes maps in whatever order it finds them.  The
+// checksum covers what gob would send, the exported fields, with map entries
+// sorted by key.  Vertices that know better can implement Checksummer.
+
+// Checksummer is implemented by vertices that sum themselves up.
+type Checksummer interface {
+	Checksum() uint64
+}
+
+func vertexSum(v Vertex) uint64 {
+	if cs, ok := v.(Checksummer); ok {
+		return cs.Checksum()
+	}
+	h := fnv.New64a()
+	writeCanonical(h, reflect.ValueOf(v))
+	return h.Sum64()
+}
+
+var (
+	binaryMarshaler = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+	gobEncoder      = reflect.TypeOf((*gob.GobEncoder)(nil)).Elem()
+)
+
+// write v to h the same way for equal values
+func writeCanonical(h hash.Hash64, v reflect.Value) {
+	var n [8]byte
+	putUint := func(u uint64) {
+		binary.LittleEndian.PutUint64(n[:], u)
+		h.Write(n[:])
+	}
+	if !v.IsValid() {
+		putUint(0)
+		return
+	}
+	// types with their own encoding, time.Time say, are summed by it
+	if v.CanInterface() && (v.Type().Implements(gobEncoder) || v.Type().Implements(binaryMarshaler)) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			putUint(0)
+			return
+		}
+		var b []byte
+		var err error
+		if e, ok := v.Interface().(gob.GobEncoder); ok {
+			b, err = e.GobEncode()
+		} else {
+			b, err = v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		}
+		if err == nil {
+			putUint(uint64(len(b)))
+			h.Write(b)
+			return
+		}
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			putUint(1)
+		} else {
+			putUint(0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		putUint(uint64(v.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		putUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		putUint(math.Float64bits(v.Float()))
+	case reflect.Complex64, reflect.Complex128:
+		putUint(math.Float64bits(real(v.Complex())))
+		putUint(math.Float64bits(imag(v.Complex())))
+	case reflect.String:
+		putUint(uint64(v.Len()))
+		h.Write([]byte(v.String()))
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			putUint(0)
+			return
+		}
+		putUint(1)
+		if v.Kind() == reflect.Interface {
+			h.Write([]byte(v.Elem().Type().String()))
+		}
+		writeCanonical(h, v.Elem())
+	case reflect.Slice, reflect.Array:
+		putUint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			writeCanonical(h, v.Index(i))
+		}
+	case reflect.Map:
+		// sum each key on its own and go through them in that order
+		type entry struct {
+			key uint64
+			v   reflect.Value
+		}
+		entries := make([]entry, 0, v.Len())
+		for _, k := range v.MapKeys() {
+			kh := fnv.New64a()
+			writeCanonical(kh, k)
+			entries = append(entries, entry{kh.Sum64(), v.MapIndex(k)})
+		}
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		putUint(uint64(len(entries)))
+		for _, e := range entries {
+			putUint(e.key)
+			writeCanonical(h, e.v)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).PkgPath != "" {
+				// gob leaves unexported fields behind too
+				continue
+			}
+			writeCanonical(h, v.Field(i))
+		}
+	}
+}
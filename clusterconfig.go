@@ -0,0 +1,173 @@
+package waffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"launchpad.net/gozk/zookeeper"
+	"path"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// A ClusterConfig is pushed into a job's zk path with PushConfig, and every
+// worker applies it on top of its own Config when it starts: the defaults
+// first, then the settings for its Config.Class, then the ones for its node
+// id.  Values are Config field names mapped to their values, durations can be
+// given as strings like "10s".
+type ClusterConfig struct {
+	Defaults map[string]interface{}
+	Classes  map[string]map[string]interface{}
+	Workers  map[string]map[string]interface{}
+}
+
+// fields that only affect the worker they are set on, these can differ from
+// worker to worker
+var localFields = map[string]bool{
+	"MemoryBudget":     true,
+	"GCPercent":        true,
+	"SpillDir":         true,
+	"ResidentVertices": true,
+	"EvictIdleSteps":   true,
+	"DiskQuotas":       true,
+	"LogLevel":         true,
+	"ProgressInterval": true,
+	"Profile":          true,
+	"BatchSize":        true,
+	"FlushInterval":    true,
+	"WarmUp":           true,
+	"Simulate":         true,
+	"WireFormat":       true,
+	"JoinTimeout":      true,
+}
+
+// fields that every worker needs to agree on, these can only be defaults
+var clusterFields = map[string]bool{
+	"VertexTimeout":         true,
+	"NumPartitions":         true,
+	"Elastic":               true,
+	"LoadTimeout":           true,
+	"StepTimeout":           true,
+	"WriteTimeout":          true,
+	"HeartbeatInterval":     true,
+	"SuspectTimeout":        true,
+	"PhiThreshold":          true,
+	"MissedBeats":           true,
+	"RebalanceSkew":         true,
+	"RepartitionSkew":       true,
+	"MaxMutationsPerVertex": true,
+	"MaxGrowth":             true,
+	"KeepCheckpoints":       true,
+	"CheckpointMaxAge":      true,
+	"MaxBadRecords":         true,
+	"MaxBadFraction":        true,
+}
+
+func (cc *ClusterConfig) check() error {
+	for name := range cc.Defaults {
+		if !localFields[name] && !clusterFields[name] {
+			return fmt.Errorf("%s can't be pushed", name)
+		}
+	}
+	for _, overrides := range []map[string]map[string]interface{}{cc.Classes, cc.Workers} {
+		for who, fields := range overrides {
+			for name := range fields {
+				if !localFields[name] {
+					return fmt.Errorf("%s can't be set for %s alone", name, who)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// PushConfig stores cc for the job c runs, for the workers that start after.
+func PushConfig(c *Config, cc *ClusterConfig) error {
+	if err := cc.check(); err != nil {
+		return err
+	}
+	b, err := json.Marshal(cc)
+	if err != nil {
+		return err
+	}
+	zk, _, err := zookeeper.Dial(c.ZKServers, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer zk.Close()
+	base := path.Join("/", c.namespace())
+	if c.Tenant != "" {
+		zk.Create(path.Dir(base), "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+	}
+	zk.Create(base, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+	p := path.Join(base, ConfigPath)
+	if _, err := zk.Set(p, string(b), -1); err == nil {
+		return nil
+	}
+	_, err = zk.Create(p, string(b), 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+	return err
+}
+
+// read the pushed config, if there is one, and apply it to our own
+func (c *Coordinator) applyClusterConfig() {
+	data, _, err := c.zk.Get(path.Join(c.basePath, ConfigPath))
+	if err != nil {
+		// nothing pushed
+		return
+	}
+	var cc ClusterConfig
+	if err := json.Unmarshal([]byte(data), &cc); err != nil {
+		c.log.Printf("Ignoring the pushed config: %v", err)
+		return
+	}
+	if err := cc.check(); err != nil {
+		c.log.Printf("Ignoring the pushed config: %v", err)
+		return
+	}
+	for _, fields := range []map[string]interface{}{cc.Defaults, cc.Classes[c.config.Class], cc.Workers[c.config.NodeId]} {
+		if err := c.config.apply(fields, c.log); err != nil {
+			c.log.Printf("Could not apply the pushed config: %v", err)
+		}
+	}
+	tuneGC(c.config)
+	c.log.level = c.config.LogLevel
+	c.progress = newProgress(c.config.ProgressInterval, c.log)
+	// nothing has been reserved yet, the quotas can just start over
+	c.disk = newDiskUsage(c.config.DiskQuotas)
+}
+
+// set the named fields of c
+func (c *Config) apply(fields map[string]interface{}, l *logger) error {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	v := reflect.ValueOf(c).Elem()
+	for _, name := range names {
+		f := v.FieldByName(name)
+		if !f.IsValid() {
+			return fmt.Errorf("no config field %s", name)
+		}
+		value := fields[name]
+		if s, ok := value.(string); ok && f.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			value = d
+		}
+		// back through json into the field's own type
+		b, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		p := reflect.New(f.Type())
+		if err := json.Unmarshal(b, p.Interface()); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		f.Set(p.Elem())
+		l.debugf("Pushed config sets %s to %v", name, p.Elem().Interface())
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package waffle
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Codec compresses blocks of data.  gzip, deflate, snappy and none are
+// built in, others (zstd, lz4, ...) can be added with RegisterCodec.
+type Codec interface {
+	Name() string
+	Compress([]byte) ([]byte, error)
+	Decompress([]byte) ([]byte, error)
+}
+
+// StreamCodec is implemented by codecs that can compress as the data is
+// written, so a big block like a checkpoint part doesn't have to be held in
+// memory whole first.  What it writes has to Decompress like a block.
+type StreamCodec interface {
+	Codec
+	NewWriter(io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	codecs    = make(map[string]Codec)
+	codecLock sync.RWMutex
+)
+
+func RegisterCodec(c Codec) {
+	codecLock.Lock()
+	defer codecLock.Unlock()
+	codecs[c.Name()] = c
+}
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(deflateCodec{})
+	RegisterCodec(snappyCodec{})
+}
+
+func lookupCodec(name string) (Codec, error) {
+	if name == "" {
+		name = "none"
+	}
+	codecLock.RLock()
+	defer codecLock.RUnlock()
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return c, nil
+}
+
+type noneCodec struct{}
+
+func (noneCodec) Name() string                        { return "none" }
+func (noneCodec) Compress(p []byte) ([]byte, error)   { return p, nil }
+func (noneCodec) Decompress(p []byte) ([]byte, error) { return p, nil }
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) Decompress(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type deflateCodec struct{}
+
+func (deflateCodec) Name() string { return "deflate" }
+
+func (deflateCodec) Compress(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (deflateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (deflateCodec) Decompress(p []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(p))
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// subsystems that pick their codec separately
+const (
+	CodecMessages    = "messages"
+	CodecCheckpoints = "checkpoints"
+	CodecLoad        = "load"
+)
+
+func (c *Config) codecName(subsystem string) string {
+	switch subsystem {
+	case CodecMessages:
+		return c.MessageCodec
+	case CodecCheckpoints:
+		return c.CheckpointCodec
+	case CodecLoad:
+		return c.LoadCodec
+	}
+	return ""
+}
+
+func (c *Config) checkCodecs() error {
+	for _, s := range []string{CodecMessages, CodecCheckpoints, CodecLoad} {
+		if _, err := lookupCodec(c.codecName(s)); err != nil {
+			return fmt.Errorf("%s: %v", s, err)
+		}
+	}
+	return nil
+}
+
+// meteredCodec keeps track of how much a codec saves and what it costs for
+// one subsystem
+type meteredCodec struct {
+	Codec
+	raw, packed int64
+	spent       time.Duration
+	sync.Mutex
+}
+
+func (m *meteredCodec) Compress(p []byte) ([]byte, error) {
+	start := time.Now()
+	out, err := m.Codec.Compress(p)
+	m.record(len(p), len(out), time.Since(start))
+	return out, err
+}
+
+func (m *meteredCodec) Decompress(p []byte) ([]byte, error) {
+	start := time.Now()
+	out, err := m.Codec.Decompress(p)
+	m.record(len(out), len(p), time.Since(start))
+	return out, err
+}
+
+// a writer compressing to w with codec, or nil if the codec only does whole
+// blocks
+func streamWriter(codec Codec, w io.Writer) (io.WriteCloser, error) {
+	mc, metered := codec.(*meteredCodec)
+	if metered {
+		codec = mc.Codec
+	}
+	sc, ok := codec.(StreamCodec)
+	if !ok {
+		return nil, nil
+	}
+	if !metered {
+		return sc.NewWriter(w)
+	}
+	out := &meteredWriter{w: w}
+	cw, err := sc.NewWriter(out)
+	if err != nil {
+		return nil, err
+	}
+	return &meteredStream{WriteCloser: cw, m: mc, out: out}, nil
+}
+
+// counts what comes out of a compressing writer
+type meteredWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += n
+	return n, err
+}
+
+// counts what goes in and the time spent, recorded on Close
+type meteredStream struct {
+	io.WriteCloser
+	m     *meteredCodec
+	out   *meteredWriter
+	raw   int
+	spent time.Duration
+}
+
+func (s *meteredStream) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := s.WriteCloser.Write(p)
+	s.raw += n
+	s.spent += time.Since(start)
+	return n, err
+}
+
+func (s *meteredStream) Close() error {
+	start := time.Now()
+	err := s.WriteCloser.Close()
+	s.m.record(s.raw, s.out.n, s.spent+time.Since(start))
+	return err
+}
+
+func (m *meteredCodec) record(raw, packed int, d time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	m.raw += int64(raw)
+	m.packed += int64(packed)
+	m.spent += d
+}
+
+func (m *meteredCodec) information() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+	info := map[string]interface{}{
+		"codec":  m.Name(),
+		"raw":    m.raw,
+		"packed": m.packed,
+		"cpu":    m.spent.String(),
+	}
+	if m.packed > 0 {
+		info["ratio"] = float64(m.raw) / float64(m.packed)
+	}
+	return info
+}
+
+type codecSet struct {
+	codecs map[string]*meteredCodec
+	sync.Mutex
+}
+
+func (s *codecSet) get(c *Config, subsystem string) Codec {
+	s.Lock()
+	defer s.Unlock()
+	if mc, ok := s.codecs[subsystem]; ok {
+		return mc
+	}
+	codec, err := lookupCodec(c.codecName(subsystem))
+	if err != nil {
+		// checked when the runner was set up
+		panic(err)
+	}
+	if s.codecs == nil {
+		s.codecs = make(map[string]*meteredCodec)
+	}
+	mc := &meteredCodec{Codec: codec}
+	s.codecs[subsystem] = mc
+	return mc
+}
+
+func (s *codecSet) information() map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	info := make(map[string]interface{})
+	for sub, mc := range s.codecs {
+		info[sub] = mc.information()
+	}
+	return info
+}
+
+// Codec returns the codec configured for subsystem, for jobs compressing
+// their own checkpoints (CodecCheckpoints) or reading compressed input
+// (CodecLoad)
+func (g *Graph) Codec(subsystem string) Codec {
+	return g.coordinator.codecs.get(g.coordinator.config, subsystem)
+}
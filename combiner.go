@@ -0,0 +1,61 @@
+package waffle
+
+import (
+	"reflect"
+)
+
+// A Combiner merges messages headed to the same vertex, say by summing them,
+// before they leave the worker.
+type Combiner interface {
+	Combine([]Message) []Message
+}
+
+// Jobs that implement CombinerJob have the remote messages Combiner returns
+// a Combiner for held until the end of compute and combined per destination
+// vertex.  A nil Combiner sends m as it is.
+type CombinerJob interface {
+	Combiner(m Message) Combiner
+}
+
+func (g *Graph) combinerFor(m Message) Combiner {
+	if j, ok := g.job.(CombinerJob); ok {
+		return j.Combiner(m)
+	}
+	return nil
+}
+
+type combineKey struct {
+	dest string
+	typ  reflect.Type
+}
+
+// hold on to a remote message until the end of compute so it can be combined
+// with the others for the same vertex.  Reports false if nothing combines m.
+func (g *Graph) holdMessage(m Message) bool {
+	if g.combinerFor(m) == nil {
+		return false
+	}
+	k := combineKey{m.Destination(), reflect.TypeOf(m)}
+	g.outq[k] = append(g.outq[k], m)
+	return true
+}
+
+// combine and send everything held during compute
+func (g *Graph) flushCombined(step int) {
+	var in, out int
+	for k, msgs := range g.outq {
+		combined := msgs
+		if len(msgs) > 1 {
+			combined = g.combinerFor(msgs[0]).Combine(msgs)
+		}
+		in += len(msgs)
+		out += len(combined)
+		for _, m := range combined {
+			g.sendRemote(m, g.determinePartition(k.dest), step)
+		}
+	}
+	if in > out {
+		g.Count("msgs.combined", float64(in-out))
+	}
+	g.outq = make(map[combineKey][]Message)
+}
@@ -0,0 +1,31 @@
+package waffle
+
+// legacySurfaces lists the older parts of the api the job is relying on,
+// judging by its job type and a sample vertex
+func legacySurfaces(c *Config, j Job, sample Vertex) (legacy []string) {
+	if c.VertexTimeout > 0 && sample != nil {
+		if _, ok := sample.(ContextVertex); !ok {
+			legacy = append(legacy, "Vertex.Compute without ComputeContext, vertices can't be cancelled when they run past VertexTimeout")
+		}
+	}
+	if c.ResidentVertices > 0 {
+		// no telling whether the job calls it, so always say so
+		legacy = append(legacy, "Graph.Vertices only returns the vertices in memory when ResidentVertices is set, use Graph.EachVertex")
+	}
+	if _, ok := j.(StatePersister); !ok && j.Checkpoint(1) {
+		legacy = append(legacy, "Persist without StatePersister, checkpoints can't be resumed from")
+	}
+	return
+}
+
+// warn about legacy api use once the graph is loaded
+func (c *Coordinator) warnLegacy() {
+	var sample Vertex
+	for _, v := range c.graph.vertices {
+		sample = v
+		break
+	}
+	for _, l := range legacySurfaces(c.config, c.graph.job, sample) {
+		c.log.Printf("deprecated: %s", l)
+	}
+}
@@ -3,15 +3,15 @@ package waffle
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/dforsyth/donut"
 	"launchpad.net/gozk/zookeeper"
-	"log"
 	"net"
 	"net/http"
 	"net/rpc"
 	"path"
-	"sort"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -23,6 +23,8 @@ const (
 	LoadState
 	RunState
 	WriteState
+	// registered with a running job, waiting to be admitted
+	JoinState
 )
 
 const (
@@ -38,6 +40,8 @@ type Coordinator struct {
 
 	// config for waffle
 	config *Config
+	// our own log, at the config's level and tagged with its tags
+	log *logger
 
 	// graph partition on this node
 	// TODO: make this a map of partition to graph so that we can pick up partitions from failed workers
@@ -46,61 +50,229 @@ type Coordinator struct {
 	zk                                            *zookeeper.Conn
 	watchers                                      map[string]chan byte
 	basePath, lockPath, barriersPath, workersPath string
+	auditPath, startPath, preemptPath, cancelPath string
+	drainPath                                     string
 
 	state       int32
-	clusterName string
+	quarantined int32
+	preempted   int32
+	draining    int32
+	drains      drains
+	admitLock   sync.Mutex
+	fence       *fence
+	// state we are resuming from, if any
+	resume         *JobState
+	lastCheckpoint int
+	checkpoints    []int // steps checkpointed by this run
+	loadReport     *LoadReport
+	masterCompute  MasterComputeFn
+	barrierHook    BarrierHookFn
+	bridge         *Bridge
+	frontiers      frontierHistory
+	direction      int32
+	topology       topologyHistory
+	repartitioned  int // last step vertex counts were checked for skew
+	paths          []string
+	caps           capabilities // what every worker can do
+	slots          []int        // worker partition of each of Config.NumPartitions
+	timers         phaseTimers
+	clock          jobClock
+	phase          phase
+	retained       retention
+	clusterName    string
 	// needed for CreateWork
 	donutConfig      *donut.Config
 	partitions       map[int]string
 	cachedWorkerInfo map[string]map[string]interface{}
+	// guards partitions, which the rpc handlers, timers, heartbeats and the
+	// status endpoint read while the job's own flow changes it
+	partitionsLock sync.RWMutex
 
-	rpcClients map[string]*rpc.Client
+	// rpc, and the status endpoint when there is one
+	listener, statusListener net.Listener
+	rpcClients               map[string]*rpc.Client
+	// guards rpcClients and cachedWorkerInfo, which heartbeats and status
+	// read while joiners are connected
+	clientsLock sync.RWMutex
+	outbox      *outbox
+	// outbound message buffers by partition when spilling to disk
+	spills map[int]*spillBuffer
+	disk   *diskUsage
+	// outbound message batches by partition when not spilling
+	batches sendBatches
 
-	done chan byte
+	// step summaries pushed to us by the other workers, by step and worker
+	summaries   map[int]map[string]string
+	summaryLock sync.Mutex
+	// summaries from our group members when we lead a summary group
+	groupSummaries map[int]map[string]string
+	// our own summaries for the last couple of steps, in case step work gets
+	// delivered again
+	completed  map[int]*StepSummary
+	stats      *workerStats
+	heartbeats *heartbeats
+	progress   *progress
+	codecs     codecSet
+	// sums of the vector aggregator chunks we own
+	vectorSums vectorSums
+
+	runner *Runner
+}
+
+// outbox tracks the messages that are still in flight to other workers
+type outbox struct {
+	sync.Mutex
+	wg          sync.WaitGroup
+	sent, acked int
+	err         error
+	// over the whole job
+	totalSent, failed int
+}
+
+func (o *outbox) track(call *rpc.Call) {
+	o.trackN(1, call)
+}
+
+// track a call carrying n messages
+func (o *outbox) trackN(n int, call *rpc.Call) {
+	o.Lock()
+	o.sent += n
+	o.totalSent += n
+	o.Unlock()
+	o.wg.Add(1)
+	go func() {
+		defer o.wg.Done()
+		<-call.Done
+		o.Lock()
+		defer o.Unlock()
+		if call.Error != nil {
+			o.err = call.Error
+			o.failed++
+			return
+		}
+		o.acked += n
+	}()
+}
+
+// messages sent but not acked yet
+func (o *outbox) pending() int {
+	o.Lock()
+	defer o.Unlock()
+	return o.sent - o.acked
 }
 
-func newCoordinator(clusterName string, c *Config) *Coordinator {
+// account for n messages that were delivered synchronously
+func (o *outbox) add(n int, err error) {
+	o.Lock()
+	defer o.Unlock()
+	o.sent += n
+	o.totalSent += n
+	if err != nil {
+		o.err = err
+		o.failed++
+		return
+	}
+	o.acked += n
+}
+
+func (o *outbox) totals() (sent, failed int) {
+	o.Lock()
+	defer o.Unlock()
+	return o.totalSent, o.failed
+}
+
+// drain waits for every tracked message to be acked (or fail) and resets the
+// counters for the next step
+func (o *outbox) drain() (sent, acked int, err error) {
+	o.wg.Wait()
+	o.Lock()
+	defer o.Unlock()
+	sent, acked, err = o.sent, o.acked, o.err
+	o.sent, o.acked, o.err = 0, 0, nil
+	return
+}
+
+// the coordinator works on its own copy of the config, which negotiation and
+// pushed config change, so every run starts out from what the caller asked for
+func newCoordinator(clusterName string, config *Config) *Coordinator {
+	cfg := *config
+	l := newLogger(&cfg)
 	return &Coordinator{
+		log:         l,
 		clusterName: clusterName,
 		state:       NewState,
-		config:      c,
+		config:      &cfg,
 		watchers:    make(map[string]chan byte),
 		partitions:  make(map[int]string),
 		workers:     donut.NewSafeMap(nil),
 		rpcClients:  make(map[string]*rpc.Client),
+		outbox:      &outbox{},
+		spills:      make(map[int]*spillBuffer),
+		disk:        newDiskUsage(cfg.DiskQuotas),
+		fence:       &fence{},
+		summaries:   make(map[int]map[string]string),
+
+		groupSummaries: make(map[int]map[string]string),
+		completed:      make(map[int]*StepSummary),
+		stats:          newWorkerStats(),
+		heartbeats:     newHeartbeats(l),
+		progress:       newProgress(cfg.ProgressInterval, l),
 	}
 }
 
 func (c *Coordinator) createPaths() {
-	c.basePath = path.Join("/", c.config.JobId)
+	c.basePath = path.Join("/", c.config.namespace())
 	c.lockPath = path.Join(c.basePath, LockPath)
 	c.workersPath = path.Join(c.basePath, WorkersPath)
 	c.barriersPath = path.Join(c.basePath, BarriersPath)
+	c.auditPath = path.Join(c.basePath, AuditPath)
+	c.startPath = path.Join(c.basePath, StartPath)
+	c.preemptPath = path.Join(c.basePath, PreemptPath)
+	c.cancelPath = path.Join(c.basePath, CancelPath)
+	c.drainPath = path.Join(c.basePath, DrainPath)
 
+	if c.config.Tenant != "" {
+		c.zk.Create(path.Dir(c.basePath), "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+	}
 	c.zk.Create(c.basePath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
 	c.zk.Create(c.workersPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
 	c.zk.Create(c.barriersPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+	c.zk.Create(c.auditPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
 }
 
-func (c *Coordinator) setup() {
+func (c *Coordinator) setup() error {
 	// create the paths for this job
 	c.createPaths()
+	c.applyClusterConfig()
+	c.cleanSpillDir()
 	// start rpc server
-	c.startServer()
+	if err := c.startServer(); err != nil {
+		return fmt.Errorf("could not start the rpc server: %v", err)
+	}
+	c.serveStatus()
 	// watch the workers path
-	watchZKChildren(c.zk, c.workersPath, c.workers, func(m *donut.SafeMap) {
+	_, err := watchZKChildren(c.zk, c.workersPath, c.workers, func(m *donut.SafeMap) {
 		c.onWorkersChange(m)
 	})
+	return err
 }
 
-func (c *Coordinator) startServer() {
-	rpc.Register(c)
-	rpc.HandleHTTP()
-	l, e := net.Listen("tcp", net.JoinHostPort(c.config.RPCHost, c.config.RPCPort))
-	if e != nil {
-		log.Fatal("listen error:", e)
+// each coordinator gets its own rpc server so that a job can be run again in
+// the same process when recovering
+func (c *Coordinator) startServer() error {
+	server := rpc.NewServer()
+	server.Register(c)
+	control := rpc.NewServer()
+	control.RegisterName("Coordinator", controlApi{c})
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, c.rpcHandler(server, control))
+	l, err := c.listen()
+	if err != nil {
+		return err
 	}
-	go http.Serve(l, nil)
+	c.listener = l
+	go http.Serve(l, mux)
+	return nil
 }
 
 func (c *Coordinator) SubmitVertex(v Vertex, r *int) error {
@@ -110,8 +282,11 @@ func (c *Coordinator) SubmitVertex(v Vertex, r *int) error {
 }
 
 func (c *Coordinator) sendVertex(v Vertex, pid int) error {
-	w := c.partitions[pid]
-	cl := c.rpcClients[w]
+	if err := checkSendable("vertex", v); err != nil {
+		return err
+	}
+	w := c.worker(pid)
+	cl := c.client(w)
 	var r int
 	return cl.Call("Coordinator.SubmitVertex", &v, &r)
 }
@@ -123,39 +298,217 @@ func (c *Coordinator) SubmitEdge(e Edge, r *int) error {
 }
 
 func (c *Coordinator) sendEdge(e Edge, pid int) error {
-	w := c.partitions[pid]
-	cl := c.rpcClients[w]
+	if err := checkSendable("edge", e); err != nil {
+		return err
+	}
+	w := c.worker(pid)
+	cl := c.client(w)
 	var r int
 	return cl.Call("Coordinator.SubmitEdge", &e, &r)
 }
 
-func (c *Coordinator) SubmitMessage(m Message, r *int) error {
-	c.graph.addMessage(m)
+// a message along with the step it should be delivered in
+type StepMessage struct {
+	Step int
+	Msg  Message
+}
+
+func (c *Coordinator) SubmitMessage(sm *StepMessage, r *int) error {
+	c.graph.addMessage(sm.Msg, sm.Step)
+	*r = 0
+	return nil
+}
+
+func (c *Coordinator) sendMessage(m Message, pid, step int) error {
+	if c.isQuarantined() {
+		return errQuarantined
+	}
+	if err := checkSendable("message", m); err != nil {
+		return err
+	}
+	if c.config.SpillDir != "" && c.caps.has(CapBatch) {
+		return c.spillMessage(m, pid, step)
+	}
+	if c.caps.has(CapBatch) {
+		return c.batchMessage(m, pid, step)
+	}
+	w := c.worker(pid)
+	cl := c.client(w)
+	// don't wait for the reply here, the outbox is drained before we tell
+	// everyone else that this step has been flushed
+	c.outbox.track(cl.Go("Coordinator.SubmitMessage", &StepMessage{Step: step, Msg: m}, new(int), make(chan *rpc.Call, 1)))
+	return nil
+}
+
+type MirrorRequest struct {
+	Step int
+	Ids  []string
+}
+
+func (c *Coordinator) FetchMirrors(req *MirrorRequest, r *map[string]Vertex) error {
+	*r = c.graph.mirrors.snapshot(req.Step, req.Ids)
+	return nil
+}
+
+func (c *Coordinator) fetchMirrors(pid, step int, ids []string) (map[string]Vertex, error) {
+	w := c.worker(pid)
+	cl := c.client(w)
+	var r map[string]Vertex
+	err := cl.Call("Coordinator.FetchMirrors", &MirrorRequest{Step: step, Ids: ids}, &r)
+	return r, err
+}
+
+type StepSummary struct {
+	Step   int
+	Worker string
+	Data   string
+}
+
+func (c *Coordinator) SubmitSummary(s *StepSummary, r *int) error {
+	c.gatherSummary(s)
+	*r = 0
+	return nil
+}
+
+// every summary for a step, by worker
+type StepSummaries struct {
+	Step int
+	Data map[string]string
+}
+
+func (c *Coordinator) SubmitSummaries(s *StepSummaries, r *int) error {
+	c.summaryLock.Lock()
+	defer c.summaryLock.Unlock()
+	if _, ok := c.summaries[s.Step]; !ok {
+		c.summaries[s.Step] = make(map[string]string)
+	}
+	for w, data := range s.Data {
+		c.summaries[s.Step][w] = data
+	}
 	*r = 0
 	return nil
 }
 
-func (c *Coordinator) sendMessage(m Message, pid int) error {
-	w := c.partitions[pid]
-	cl := c.rpcClients[w]
+func (c *Coordinator) takeSummaries(step int) map[string]string {
+	c.summaryLock.Lock()
+	defer c.summaryLock.Unlock()
+	r := c.summaries[step]
+	delete(c.summaries, step)
+	return r
+}
+
+// Step summaries are gathered by the worker holding partition 0, which hands
+// the whole set to everyone once the last one is in, so a step costs a couple
+// of rpcs per worker instead of one per pair of workers.  The last push
+// doesn't return until the set is out, so nobody sees the barrier fill up
+// without the summaries in hand, otherwise they have to go back to zk for
+// them.
+func (c *Coordinator) pushSummary(s *StepSummary) {
+	w := c.worker(0)
+	if w == c.config.NodeId {
+		c.gatherSummary(s)
+		return
+	}
 	var r int
-	return cl.Call("Coordinator.SubmitMessage", &m, &r)
+	if err := c.client(w).Call("Coordinator.SubmitSummary", s, &r); err != nil {
+		c.log.Printf("Could not push step %d summary to %s: %v", s.Step, w, err)
+	}
 }
 
-func (c *Coordinator) register() {
+// keep a summary pushed to us, handing out the set with the last one
+func (c *Coordinator) gatherSummary(s *StepSummary) {
+	c.summaryLock.Lock()
+	if _, ok := c.summaries[s.Step]; !ok {
+		c.summaries[s.Step] = make(map[string]string)
+	}
+	c.summaries[s.Step][s.Worker] = s.Data
+	var all *StepSummaries
+	if len(c.summaries[s.Step]) == c.barrierSize() {
+		all = &StepSummaries{Step: s.Step, Data: make(map[string]string)}
+		for w, data := range c.summaries[s.Step] {
+			all.Data[w] = data
+		}
+	}
+	c.summaryLock.Unlock()
+
+	if all == nil {
+		return
+	}
+	var calls []*rpc.Call
+	for w, cl := range c.clients() {
+		if w == c.config.NodeId {
+			continue
+		}
+		calls = append(calls, cl.Go("Coordinator.SubmitSummaries", all, new(int), make(chan *rpc.Call, 1)))
+	}
+	for _, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			c.log.Printf("Could not hand out step %d summaries: %v", s.Step, call.Error)
+		}
+	}
+}
+
+func (c *Coordinator) submitSummary(s *StepSummary) {
+	c.clock.stepSubmitted(s.Step)
+	if c.config.SummaryGroupSize > 0 {
+		c.submitToGroup(s)
+	} else {
+		c.pushSummary(s)
+		c.enterBarrier("superstep-"+strconv.Itoa(s.Step), c.config.NodeId, s.Data)
+	}
+}
+
+// Hand out the summary of a step we already finished again instead of
+// running it twice.  If the step is still running there is nothing to do.
+func (c *Coordinator) replayStep(step int) {
+	c.summaryLock.Lock()
+	s, ok := c.completed[step]
+	c.summaryLock.Unlock()
+	if !ok {
+		return
+	}
+	c.log.Printf("Replaying summary for step %d", step)
+	c.submitSummary(s)
+}
+
+func (c *Coordinator) register() error {
 	for {
-		if _, err := c.zk.Create(c.lockPath, "", zookeeper.EPHEMERAL, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
+		if _, err := c.zk.Create(c.lockPath, "", zookeeper.EPHEMERAL, zookeeper.WorldACL(zookeeper.PERM_ALL)); err == nil {
 			defer c.zk.Delete(c.lockPath, -1)
-			if c.workers.Len() < c.config.InitialWorkers {
+			started := false
+			if stat, err := c.zk.Exists(c.startPath); err == nil && stat != nil {
+				if !c.config.Elastic {
+					return errors.New("this job has already been started")
+				}
+				started = true
+			}
+			if stat, err := c.zk.Exists(c.cancelPath); err == nil && stat != nil {
+				return errors.New("this job has been cancelled")
+			}
+			if c.workers.Len() < c.config.InitialWorkers && !started {
+				if err := c.checkVersions(); err != nil {
+					return err
+				}
 				info := c.info()
 				if _, err := c.zk.Create(path.Join(c.workersPath, c.config.NodeId), info, zookeeper.EPHEMERAL, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
-					log.Fatalln(err)
+					return err
 				}
-				return
+				return nil
 			}
-			log.Fatalln("InitialWorkers has been met for this job, exiting")
+			if c.config.Elastic {
+				return c.join()
+			}
+			return errors.New("InitialWorkers has been met for this job")
+		}
+		// someone else is registering, try again as soon as they let go
+		stat, watch, err := c.zk.ExistsW(c.lockPath)
+		if err != nil {
+			return err
+		}
+		if stat != nil {
+			<-watch
 		}
-		time.Sleep(time.Second)
 	}
 }
 
@@ -163,23 +516,36 @@ func (c *Coordinator) createBarrier(name string, onChange func(*donut.SafeMap))
 	bPath := path.Join(c.barriersPath, name)
 	if _, ok := c.watchers[bPath]; !ok {
 		if _, err := c.zk.Create(bPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL)); err == nil {
-			log.Printf("Created barrier %s", bPath)
+			c.log.debugf("Created barrier %s", bPath)
 		} else {
 			// XXX should check to make sure its a "node already exists error"
-			log.Printf("Failed to create barrier %s: %v", bPath, err)
+			c.log.Printf("Failed to create barrier %s: %v", bPath, err)
 		}
 		kill, err := watchZKChildren(c.zk, bPath, donut.NewSafeMap(make(map[string]interface{})), onChange)
 		if err != nil {
-			log.Fatalln(err)
+			c.fail(fmt.Errorf("could not watch barrier %s: %v", name, err))
+			return
 		}
 		c.watchers[name] = kill
 	}
 }
 
+// remove a node that belongs to this run only, if it's there
+func (c *Coordinator) removeNode(p string) {
+	if err := c.zk.Delete(p, -1); err != nil && !zookeeper.IsError(err, zookeeper.ZNONODE) {
+		c.log.Printf("Could not remove %s: %v", p, err)
+	}
+}
+
 func (c *Coordinator) enterBarrier(name, entry, data string) {
-	log.Printf("Entering barrier %s as %s", name, entry)
-	if _, err := c.zk.Create(path.Join(c.barriersPath, name, entry), data, zookeeper.EPHEMERAL, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
-		log.Fatalf("Error on barrier entry (%s entering %s): %v", entry, name, err)
+	ePath := path.Join(c.barriersPath, name, entry)
+	if stat, err := c.zk.Exists(ePath); err == nil && stat != nil {
+		c.log.debugf("Already in barrier %s as %s", name, entry)
+		return
+	}
+	c.log.debugf("Entering barrier %s as %s", name, entry)
+	if _, err := c.zk.Create(ePath, data, zookeeper.EPHEMERAL, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
+		c.fail(fmt.Errorf("could not enter barrier %s as %s: %v", name, entry, err))
 	}
 }
 
@@ -188,199 +554,609 @@ func (c *Coordinator) start(zk *zookeeper.Conn) error {
 		return errors.New("Error moving from NewState to SetupState")
 	}
 	c.zk = zk
-	c.setup()
-	c.register()
+	if err := c.setup(); err != nil {
+		return err
+	}
+	if err := c.register(); err != nil {
+		return err
+	}
+	go c.watchStart()
+	go c.watchPreempt()
+	go c.watchCancel()
+	go c.watchDrain()
 	return nil
 }
 
 func (c *Coordinator) startWork(workId string, data map[string]interface{}) {
+	if err := c.fence.admit(data[WorkField].(string), data); err != nil {
+		c.log.Printf("Refusing work %s: %v", workId, err)
+		if dup, ok := err.(*duplicateStepError); ok {
+			c.replayStep(dup.step)
+		}
+		return
+	}
 	switch data[WorkField].(string) {
 	case LoadWork:
 		p := data["path"].(string)
-		c.graph.Load(p)
-		c.enterBarrier("load", p, "")
+		if c.simulateFailure(0) {
+			return
+		}
+		var err error
+		if c.fromCheckpoint() {
+			err = c.graph.loadCheckpoint(p, c.firstStep())
+		} else {
+			err = c.graph.Load(p)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		c.enterBarrier("load", loadName(p), c.loadEntry(p))
 	case SuperstepWork:
 		step := int(data["step"].(float64))
 
 		c.createBarrier("superstep-"+strconv.Itoa(step), func(m *donut.SafeMap) {
 			c.onStepBarrierChange(step, m)
 		})
+		c.timers.start("superstep-"+strconv.Itoa(step), c.config.StepTimeout, func() {
+			c.onStepTimeout(step)
+		})
 
-		log.Printf("Superstep %d", step)
+		c.log.debugf("Superstep %d", step)
+		c.clock.stepStarted(step)
+		if c.simulateFailure(step) {
+			return
+		}
 		stepData := make(map[string]interface{})
-		stepData["active"], stepData["msgs"], stepData["aggr"] = c.graph.runSuperstep(step)
-		log.Printf("Step %d stats: %d active verts, %d sent messages", step, stepData["active"], stepData["msgs"])
+		start, gcStart := time.Now(), sampleGC()
+		stopStreaming := c.streamBatches()
+		active, msgs, aggr, err := c.graph.runSuperstep(step)
+		if err != nil {
+			stopStreaming()
+			c.fail(err)
+			return
+		}
+		c.simulateLag(step, time.Since(start))
+		stopStreaming()
+		timers := c.graph.takeTimers()
+		stepData["active"], stepData["msgs"] = active, msgs
+		stepData["timers"] = timers
+		c.graph.frontier.take(stepData)
+		stepData["frontierMarked"] = len(c.graph.marked.get(step))
+		stepData["vertices"] = c.graph.vertexCount()
+		stepData["aggr"] = map[string]interface{}{c.config.NodeId: aggr}
+		// keep our own numbers around too so that they survive being condensed
+		// by a group leader
+		self := map[string]interface{}{
+			"active":   active,
+			"msgs":     msgs,
+			"time":     time.Since(start).Seconds(),
+			"vertices": c.graph.vertexCount(),
+			"timers":   timers,
+		}
+		stepData["workers"] = map[string]interface{}{c.config.NodeId: self}
+		if c.graph.mirrors.enabled() {
+			stepData["hot"] = map[string][]string{c.config.NodeId: c.graph.mirrors.hotIds()}
+		}
+		c.log.debugf("Step %d stats: %d active verts, %d sent messages", step, stepData["active"], stepData["msgs"])
+
+		// compute and flush results go into a single summary so each step only
+		// costs one barrier entry per worker
+		flushStart := time.Now()
+		if err := c.pushVectors(step); err != nil {
+			c.fail(err)
+			return
+		}
+		c.flushSpills()
+		c.flushBatches()
+		c.flushEdgeUpdates()
+		c.flushBridge(step)
+		sent, acked, err := c.outbox.drain()
+		if c.config.Profile {
+			c.graph.Count("profile.flush", time.Since(flushStart).Seconds())
+		}
+		if err != nil {
+			c.log.Printf("Failed to deliver %d messages in step %d: %v", sent-acked, step, err)
+		}
+		stepData["sent"], stepData["acked"] = sent, acked
+		if atomic.LoadInt32(&c.preempted) == 1 {
+			stepData["preempt"] = 1
+		}
+		if atomic.LoadInt32(&c.draining) == 1 {
+			stepData["drain"] = map[string]interface{}{c.config.NodeId: 1}
+		}
+		if c.barrierHookFn() != nil {
+			stepData["hook"] = map[string]interface{}{c.config.NodeId: 1}
+		}
+		if joining := c.newcomers(); len(joining) > 0 {
+			stepData["join"] = joining
+		}
+		c.reportQuota(stepData)
+
+		// gc pauses while computing and flushing show up as slow barriers, so
+		// report them with the rest of the step
+		pause, collections := gcStart.since()
+		c.graph.Count("gc.pause", pause.Seconds())
+		c.graph.Count("gc.count", float64(collections))
+		c.graph.Gauge("gc.pause.max", pause.Seconds())
+		self["gcPause"] = pause.Seconds()
+
+		c.graph.localStat.Lock()
+		stepData["counters"], stepData["gauges"] = c.graph.localStat.counters, c.graph.localStat.gauges
+		c.graph.localStat.Unlock()
+
+		c.checkLease()
+		if c.isQuarantined() {
+			c.log.Printf("Quarantined, not entering the barrier for step %d", step)
+			return
+		}
 
 		data, _ := json.Marshal(stepData)
-		c.enterBarrier("superstep-"+strconv.Itoa(step), c.config.NodeId, string(data))
+		summary := &StepSummary{Step: step, Worker: c.config.NodeId, Data: string(data)}
+		c.summaryLock.Lock()
+		c.completed[step] = summary
+		delete(c.completed, step-2)
+		c.summaryLock.Unlock()
+		c.submitSummary(summary)
 	case WriteWork:
 		c.createBarrier("write", func(m *donut.SafeMap) {
 			c.onWriteBarrierChange(m)
 		})
+		c.timers.start("write", c.config.WriteTimeout, c.onWriteTimeout)
 		if err := c.graph.Write(); err != nil {
-			panic(err)
+			c.fail(fmt.Errorf("could not write the results: %v", err))
+			return
+		}
+		if err := c.graph.writeOutputs(); err != nil {
+			c.fail(fmt.Errorf("could not write the outputs: %v", err))
+			return
+		}
+		// entries are by partition, so a worker leaving can't make the
+		// barrier look full
+		c.enterBarrier("write", strconv.Itoa(c.graph.partitionId), c.config.NodeId)
+	}
+}
+
+// summary fields that are keyed by the worker that reported them
+var perWorkerFields = map[string]bool{
+	"aggr":    true,
+	"drain":   true,
+	"hook":    true,
+	"join":    true,
+	"quota":   true,
+	"hot":     true,
+	"workers": true,
+}
+
+// Fold the step summary b into a.  Counters are summed, gauges keep the
+// largest value and per worker fields are unioned.  Both sides are expected
+// to have been through json.
+func mergeSummary(a, b map[string]interface{}) {
+	for k, v := range b {
+		switch v := v.(type) {
+		case float64:
+			sum, _ := a[k].(float64)
+			a[k] = sum + v
+		case map[string]interface{}:
+			if !perWorkerFields[k] && k != "counters" && k != "gauges" && k != "timers" {
+				continue
+			}
+			m, ok := a[k].(map[string]interface{})
+			if !ok {
+				m = make(map[string]interface{})
+				a[k] = m
+			}
+			for name, nv := range v {
+				switch {
+				case perWorkerFields[k]:
+					m[name] = nv
+				case k == "counters" || k == "timers":
+					sum, _ := m[name].(float64)
+					m[name] = sum + nv.(float64)
+				case k == "gauges":
+					if max, ok := m[name].(float64); !ok || nv.(float64) > max {
+						m[name] = nv
+					}
+				}
+			}
+		}
+	}
+}
+
+func summaryFloats(s map[string]interface{}, k string) map[string]float64 {
+	r := make(map[string]float64)
+	if m, ok := s[k].(map[string]interface{}); ok {
+		for name, v := range m {
+			r[name], _ = v.(float64)
 		}
-		c.enterBarrier("write", c.config.NodeId, "")
 	}
+	return r
+}
+
+func summaryInt(s map[string]interface{}, k string) int {
+	v, _ := s[k].(float64)
+	return int(v)
 }
 
 func (c *Coordinator) onStepBarrierChange(step int, m *donut.SafeMap) {
-	if m.Len() == c.workers.Len() {
+	c.progress.report("step", fmt.Sprintf("superstep %d", step), m.Len(), c.barrierSize(), "workers")
+	if m.Len() == c.barrierSize() {
 		defer m.Clear()
 		barrierName := "superstep-" + strconv.Itoa(step)
+		c.timers.stop(barrierName)
 		// the barrier is full, collect information and launch the next step
+		c.graph.globalStat.Lock()
 		c.graph.globalStat.reset()
 		c.graph.globalStat.step = step
+		c.graph.globalStat.Unlock()
 		// collect and unmarshal data for all entries in the barrier
+		total := make(map[string]interface{})
+		summaries := c.takeSummaries(step)
 		lm := m.GetCopy()
 		for k := range lm {
-			if data, _, err := c.zk.Get(path.Join(c.barriersPath, barrierName, k)); err == nil {
-				var info map[string]interface{}
-				if err := json.Unmarshal([]byte(data), &info); err != nil {
-					panic(err)
+			data, ok := summaries[k]
+			if !ok {
+				// the push didn't make it, fall back to the copy in the barrier
+				var err error
+				if data, _, err = c.zk.Get(path.Join(c.barriersPath, barrierName, k)); err != nil {
+					c.fail(fmt.Errorf("could not read the step %d summary of %s: %v", step, k, err))
+					return
+				}
+			}
+			var info map[string]interface{}
+			if err := json.Unmarshal([]byte(data), &info); err != nil {
+				c.fail(fmt.Errorf("bad step %d summary from %s: %v", step, k, err))
+				return
+			}
+			mergeSummary(total, info)
+		}
+		sent, acked := summaryInt(total, "sent"), summaryInt(total, "acked")
+		c.graph.globalStat.Lock()
+		c.graph.globalStat.active = summaryInt(total, "active")
+		c.graph.globalStat.msgs = summaryInt(total, "msgs")
+		c.graph.globalStat.counters = summaryFloats(total, "counters")
+		c.graph.globalStat.gauges = summaryFloats(total, "gauges")
+		c.graph.globalStat.aggr = c.graph.reduceAggregators(total)
+		c.graph.globalStat.Unlock()
+		c.clock.stepDone(step, c.stats.collect(step, total))
+		frontier := c.frontiers.collect(step, total)
+		topology := c.topology.collect(step, c.graph.globalStat.counters)
+		if !topology.empty() {
+			c.log.debugf("Step %d topology: +%d/-%d vertices, +%d/-%d/~%d edges", step, topology.VerticesAdded, topology.VerticesRemoved, topology.EdgesAdded, topology.EdgesRemoved, topology.EdgesUpdated)
+		}
+		if err := c.checkMutationLimits(step, total, topology, summaryInt(total, "vertices")); err != nil {
+			c.log.Println(err)
+			c.audit("fail", "step barrier", err.Error())
+			c.fail(err)
+			return
+		}
+		c.logProfile(step)
+		vertices := summaryInt(total, "vertices")
+		decision := c.runMasterCompute(step, frontier, topology, vertices)
+		c.chooseDirection(step, decision.Direction, frontier, vertices)
+		// a pull step can carry on with nothing active and no messages
+		pulling := atomic.LoadInt32(&c.direction) == int32(Pull) && frontier.Marked > 0
+		checkpointed := c.graph.job.Checkpoint(step)
+		if checkpointed {
+			c.lastCheckpoint = step
+			c.checkpoints = append(c.checkpoints, step)
+			c.retained.add(step)
+		}
+		c.retainCheckpoints()
+		c.persistState(step)
+		if checkpointed {
+			c.checkpointCommitted(step)
+		}
+		if hot, ok := total["hot"].(map[string]interface{}); ok {
+			for w, ids := range hot {
+				for _, id := range ids.([]interface{}) {
+					c.graph.noteHot(id.(string), w == c.config.NodeId, step)
 				}
-				c.graph.globalStat.active += int(info["active"].(float64))
-				c.graph.globalStat.msgs += int(info["msgs"].(float64))
-			} else {
-				panic(err)
 			}
 		}
 		// kill the watcher on this barrier
 		c.watchers[barrierName] <- 1
 		delete(c.watchers, barrierName)
-		if c.graph.globalStat.active == 0 && c.graph.globalStat.msgs == 0 {
-			atomic.StoreInt32(&c.state, WriteState)
-			go c.createWriteWork()
+		if sent != acked {
+			// the next step would run without some of its messages
+			c.fail(fmt.Errorf("step %d lost %d of %d messages", step, sent-acked, sent))
+			return
+		}
+		proceed := func() {
+			if decision.Halt || c.graph.globalStat.active == 0 && c.graph.globalStat.msgs == 0 && !pulling {
+				atomic.StoreInt32(&c.state, WriteState)
+				c.advance(stageWrite, c.createWriteWork)
+			} else if summaryInt(total, "preempt") > 0 {
+				c.savepoint(step)
+			} else if w := c.drainee(total); w != "" {
+				go c.drain(step, w)
+			} else if ws := c.joiners(total); len(ws) > 0 {
+				go c.admit(step, ws)
+			} else if plan := c.planRebalance(step, total); plan != nil {
+				go c.rebalance(step, plan)
+			} else {
+				go c.createStepWork(step + 1)
+			}
+		}
+		hooked := c.hookWorker(total)
+		if c.bridge != nil {
+			if hooked == "" {
+				hooked = c.worker(0)
+			}
+			c.syncBarrier(step, hooked, c.bridgeHook(c.barrierHookFn()), frontier, topology, vertices, c.bridgeProceed(step, proceed))
+		} else if hooked != "" {
+			c.syncBarrier(step, hooked, c.barrierHookFn(), frontier, topology, vertices, proceed)
 		} else {
-			go c.createStepWork(step + 1)
+			proceed()
 		}
-	} else {
-		log.Printf("step barrier change: %d entries out of %d", m.Len(), c.workers.Len())
 	}
 }
 
 func (c *Coordinator) onWorkersChange(m *donut.SafeMap) {
-	log.Println("workers updated")
-	if atomic.LoadInt32(&c.state) > SetupState {
-		// invalidate current step
-		// update partition mapping
-		// roll back to last checkpoint
+	c.log.debugf("workers updated")
+	if atomic.LoadInt32(&c.state) == WriteState {
+		c.checkWriters(m)
+	} else if atomic.LoadInt32(&c.state) > SetupState {
+		c.checkLostWorkers(m)
 	} else {
 		if m.Len() == c.config.InitialWorkers {
 			// go into prepare state
 			if !atomic.CompareAndSwapInt32(&c.state, SetupState, PrepareState) {
-				log.Println("Could not properly move from SetupState to PrepareState")
+				c.log.Println("Could not properly move from SetupState to PrepareState")
 				return
 			}
-			log.Printf("InitialWorkers met, preparing node for work")
-			// everyone is here, create the partition mapping
-			lm := m.RangeLock()
-			var workers []string
-			for k := range lm {
-				workers = append(workers, k)
-			}
-			m.RangeUnlock()
-			sort.Strings(workers)
-			for i := 0; i < len(workers); i++ {
-				c.partitions[i] = workers[i]
-				if workers[i] == c.config.NodeId {
-					c.graph.partitionId = i
-				}
-			}
+			c.log.Printf("InitialWorkers met, preparing node for work")
+			c.advance(stagePlan, func() {
+				c.prepare(m)
+			})
+		}
+	}
+}
 
-			// set up connections to all the other nodes
-			c.cachedWorkerInfo = make(map[string]map[string]interface{})
-			c.rpcClients = make(map[string]*rpc.Client)
-			for _, w := range workers {
-				// pull down worker info for all of the existing workers
-				c.cachedWorkerInfo[w] = c.workerInfo(w)
-				c.rpcClients[w], _ = rpc.DialHTTP("tcp", net.JoinHostPort(c.cachedWorkerInfo[w]["host"].(string), c.cachedWorkerInfo[w]["port"].(string)))
-			}
+// build the partition mapping out of the registered workers, connect to all
+// of them and get loading.  Expects to be in PrepareState.
+func (c *Coordinator) prepare(m *donut.SafeMap) {
+	lm := m.RangeLock()
+	var workers []string
+	for k := range lm {
+		workers = append(workers, k)
+	}
+	m.RangeUnlock()
+	workers = c.config.partitioner().Assign(workers)
+	if stat, err := c.zk.Exists(c.workersPath); err == nil && stat != nil {
+		c.fence.advance(int64(stat.CVersion()))
+	} else {
+		c.log.Printf("Could not read the workers epoch: %v", err)
+	}
+	if c.resume != nil && sameWorkers(c.resume.Partitions, workers) {
+		// everyone came back, so they get their old partitions no matter
+		// where they are listening now
+		workers = make([]string, len(workers))
+		for pid, w := range c.resume.Partitions {
+			workers[pid] = w
+		}
+	}
+	c.partitionsLock.Lock()
+	for i := 0; i < len(workers); i++ {
+		c.partitions[i] = workers[i]
+		if workers[i] == c.config.NodeId {
+			c.graph.partitionId = i
+		}
+	}
+	c.partitionsLock.Unlock()
+	c.assignSlots(workers)
+	c.graph.initPartitionState()
 
-			// go into loadstate
-			if !atomic.CompareAndSwapInt32(&c.state, PrepareState, LoadState) {
-				log.Println("Could not properly move from PrepareState to LoadState")
-				return
-			}
-			go c.createLoadWork()
+	// set up connections to all the other nodes
+	c.clientsLock.Lock()
+	c.cachedWorkerInfo = make(map[string]map[string]interface{})
+	c.rpcClients = make(map[string]*rpc.Client)
+	c.clientsLock.Unlock()
+	for _, w := range workers {
+		// pull down worker info for all of the existing workers
+		if err := c.connect(w); err != nil {
+			c.fail(err)
+			return
 		}
 	}
+	c.negotiate()
+	if c.config.HeartbeatInterval > 0 {
+		kill := make(chan byte, 1)
+		c.watchers["heartbeat"] = kill
+		go c.heartbeat(kill)
+	}
+
+	// go into loadstate
+	if !atomic.CompareAndSwapInt32(&c.state, PrepareState, LoadState) {
+		c.log.Println("Could not properly move from PrepareState to LoadState")
+		return
+	}
+	c.advance(stageLoad, c.createLoadWork)
 }
 
 func (c *Coordinator) info() string {
 	m := make(map[string]interface{})
-	m["host"] = c.config.RPCHost
+	m["host"] = normalizeHost(c.config.RPCHost)
 	m["port"] = c.config.RPCPort
+	m["version"] = Version
+	m["commit"] = Commit
+	m["capabilities"] = c.capabilities()
 
 	info, _ := json.Marshal(m)
 	return string(info)
 }
 
-func (c *Coordinator) workerInfo(id string) (info map[string]interface{}) {
+func (c *Coordinator) workerInfo(id string) (info map[string]interface{}, err error) {
 	raw, _, err := c.zk.Get(path.Join(c.workersPath, id))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("could not look up worker %s: %v", id, err)
 	}
 	if err := json.Unmarshal([]byte(raw), &info); err != nil {
-		panic(err)
+		return nil, fmt.Errorf("bad info for worker %s: %v", id, err)
+	}
+	return info, nil
+}
+
+// look up worker w and open an rpc connection to it
+func (c *Coordinator) connect(w string) error {
+	info, err := c.workerInfo(w)
+	if err != nil {
+		return err
+	}
+	cl, err := c.dial(info["host"].(string), info["port"].(string))
+	if err != nil {
+		return fmt.Errorf("could not connect to worker %s: %v", w, err)
 	}
-	return info
+	c.clientsLock.Lock()
+	defer c.clientsLock.Unlock()
+	c.cachedWorkerInfo[w] = info
+	c.rpcClients[w] = cl
+	return nil
+}
+
+func (c *Coordinator) client(w string) *rpc.Client {
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+	return c.rpcClients[w]
+}
+
+// a copy of the connections to range over
+func (c *Coordinator) clients() map[string]*rpc.Client {
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+	r := make(map[string]*rpc.Client, len(c.rpcClients))
+	for w, cl := range c.rpcClients {
+		r[w] = cl
+	}
+	return r
+}
+
+// the worker holding partition pid
+func (c *Coordinator) worker(pid int) string {
+	c.partitionsLock.RLock()
+	defer c.partitionsLock.RUnlock()
+	return c.partitions[pid]
+}
+
+func (c *Coordinator) numPartitions() int {
+	c.partitionsLock.RLock()
+	defer c.partitionsLock.RUnlock()
+	return len(c.partitions)
+}
+
+// a copy of the partition map to range over or hand out
+func (c *Coordinator) partitionMap() map[int]string {
+	c.partitionsLock.RLock()
+	defer c.partitionsLock.RUnlock()
+	r := make(map[int]string, len(c.partitions))
+	for pid, w := range c.partitions {
+		r[pid] = w
+	}
+	return r
 }
 
 func (c *Coordinator) onLoadBarrierChange(m *donut.SafeMap) {
-	if m.Len() == len(c.graph.job.LoadPaths()) {
-		log.Printf("load complete")
+	c.progress.report("load", "load", m.Len(), len(c.loadPaths()), "paths")
+	if m.Len() == len(c.loadPaths()) {
+		c.log.Printf("load complete")
+		c.timers.stop("load")
 		c.watchers["load"] <- 1
 		delete(c.watchers, "load")
 		if !atomic.CompareAndSwapInt32(&c.state, LoadState, RunState) {
-			log.Println("Could not properly move from LoadState to RunState")
+			c.log.Println("Could not properly move from LoadState to RunState")
 			return
 		}
-		go c.createStepWork(1)
-	} else {
-		log.Printf("Load barrier has %d/%d entries", m.Len(), len(c.graph.job.LoadPaths()))
+		if err := c.checkLoadReports(m.Keys()); err != nil {
+			c.log.Println(err)
+			c.fail(err)
+			return
+		}
+		c.advance(stageCompute, func() {
+			c.restore()
+			c.warnLegacy()
+			c.graph.spillVertices()
+			c.warmUp()
+			c.createStepWork(c.firstStep())
+		})
 	}
 }
 
 func (c *Coordinator) onWriteBarrierChange(m *donut.SafeMap) {
-	if m.Len() == c.workers.Len() {
-		log.Println("Write barrier full, ending job")
-		c.done <- 1
+	if m.Len() == c.numPartitions() {
+		c.log.Println("Write barrier full, ending job")
+		c.timers.stop("write")
+		if g := c.graph; g.partitionId == 0 && g.resultDir != "" {
+			for dir := range g.resultFormats {
+				if err := commitManifest(g, dir); err != nil {
+					c.fail(fmt.Errorf("could not commit the result manifest in %s: %v", dir, err))
+					return
+				}
+				removed, err := removeStaging(dir)
+				if err != nil {
+					c.log.Printf("Could not clean up %s: %v", dir, err)
+				}
+				for _, f := range removed {
+					c.log.Printf("Removed stale result file %s", f)
+				}
+			}
+			if err := c.writeJobSummary(g.resultDir); err != nil {
+				c.log.Printf("Could not write the job summary: %v", err)
+			}
+		}
+		if c.graph.partitionId == 0 {
+			// a StartNow is for this run only, the next one under the same
+			// name waits for its workers again
+			c.removeNode(c.startPath)
+		}
+		if kill, ok := c.watchers["heartbeat"]; ok {
+			kill <- 1
+		}
+		c.advance(stageDone, nil)
 	}
 }
 
 func (c *Coordinator) createWriteWork() {
-	log.Printf("creating work for write %s", c.config.NodeId)
+	c.log.debugf("creating work for write %s", c.config.NodeId)
 	data := make(map[string]interface{})
 	data[c.clusterName] = c.config.NodeId
 	data[WorkField] = WriteWork
+	data["epoch"] = c.fence.current()
 	donut.CreateWork(c.clusterName, c.zk, c.donutConfig, "write-"+c.config.NodeId, data)
 }
 
 func (c *Coordinator) createLoadWork() {
-	log.Println("creating load work")
+	c.log.debugf("creating load work")
 	data := make(map[string]interface{})
 	data[WorkField] = LoadWork
-	paths := c.graph.job.LoadPaths()
+	data["epoch"] = c.fence.current()
+	paths := c.loadPaths()
 	// create the load barrier here since a node might not end up with load work
 	c.createBarrier("load", func(m *donut.SafeMap) {
 		c.onLoadBarrierChange(m)
 	})
+	c.timers.start("load", c.config.LoadTimeout, c.onLoadTimeout)
+	assigned := c.assignLoad(paths)
 	for _, p := range paths {
 		data["path"] = p
-		workName := "load-" + p
+		if w, ok := assigned[p]; ok {
+			data[c.clusterName] = w
+		} else {
+			delete(data, c.clusterName)
+		}
+		workName := "load-" + loadName(p)
 		if err := donut.CreateWork(c.clusterName, c.zk, c.donutConfig, workName, data); err != nil {
 			// XXX should check to make sure its a "node already exists error"
-			log.Printf("Could not create load work for %s: %v", p, err)
+			c.log.Printf("Could not create load work for %s: %v", p, err)
 		}
 	}
 }
 
 func (c *Coordinator) createStepWork(step int) {
-	log.Printf("creating work for superstep %d", step)
+	c.log.debugf("creating work for superstep %d", step)
 	data := make(map[string]interface{})
 	data[c.clusterName] = c.config.NodeId
 	data[WorkField] = SuperstepWork
+	data["epoch"] = c.fence.current()
 	data["step"] = step
 	donut.CreateWork(c.clusterName, c.zk, c.donutConfig, "superstep-"+strconv.Itoa(step)+"-"+c.config.NodeId, data)
 }
@@ -0,0 +1,62 @@
+package waffle
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Vertices that implement ContextVertex get ComputeContext called instead of
+// Compute, with a context that is cancelled once Config.VertexTimeout has
+// passed.  Compute is expected to notice and return early.
+type ContextVertex interface {
+	Vertex
+	ComputeContext(context.Context, *Graph, []Message)
+}
+
+// the vertices that ran past the deadline lately, for Information
+const slowVertexHistory = 32
+
+type slowVertices struct {
+	ids []string
+	sync.Mutex
+}
+
+func (s *slowVertices) add(id string) {
+	s.Lock()
+	defer s.Unlock()
+	s.ids = append(s.ids, id)
+	if len(s.ids) > slowVertexHistory {
+		s.ids = s.ids[len(s.ids)-slowVertexHistory:]
+	}
+}
+
+func (s *slowVertices) information() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string(nil), s.ids...)
+}
+
+// computeWithDeadline runs compute for v under the vertex timeout.  Context
+// vertices that hit it count as cancelled, anything else can only be counted
+// as having overrun.
+func (g *Graph) computeWithDeadline(v Vertex, msgs []Message, timeout time.Duration) {
+	start := time.Now()
+	if cv, ok := v.(ContextVertex); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		cv.ComputeContext(ctx, g, msgs)
+		cancel()
+		if ctx.Err() == context.DeadlineExceeded {
+			g.Count("vertex.cancelled", 1)
+			g.slow.add(v.Id())
+			g.log.Printf("Compute for vertex %s was cancelled after %s", v.Id(), time.Since(start))
+		}
+		return
+	}
+	v.Compute(g, msgs)
+	if d := time.Since(start); d > timeout {
+		g.Count("vertex.overran", 1)
+		g.slow.add(v.Id())
+		g.log.Printf("Compute for vertex %s ran for %s, past its %s deadline", v.Id(), d, timeout)
+	}
+}
@@ -0,0 +1,73 @@
+package waffle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"hash/fnv"
+)
+
+const (
+	defaultDedupBits = 1 << 20
+	dedupHashes      = 4
+)
+
+// bloom is a plain bloom filter using double hashing
+type bloom struct {
+	bits []uint64
+	m    uint64
+}
+
+func newBloom(m int) *bloom {
+	return &bloom{bits: make([]uint64, (m+63)/64), m: uint64(m)}
+}
+
+// testAndAdd adds the item with hashes h1 and h2 and reports whether it was
+// (probably) already there
+func (b *bloom) testAndAdd(h1, h2 uint64) bool {
+	seen := true
+	for i := uint64(0); i < dedupHashes; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			seen = false
+			b.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return seen
+}
+
+func messageHash(m Message) (uint64, uint64, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&m); err != nil {
+		return 0, 0, err
+	}
+	h := fnv.New128a()
+	h.Write([]byte(m.Destination()))
+	h.Write(buf.Bytes())
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1, nil
+}
+
+// duplicate reports whether an identical message has already been sent to
+// the same destination this step.  This is only on for jobs whose messages
+// are idempotent (bfs, components), since a false positive from the filter
+// drops a message that was never sent.
+func (g *Graph) duplicate(m Message, p int) bool {
+	if !g.coordinator.config.DedupMessages {
+		return false
+	}
+	h1, h2, err := messageHash(m)
+	if err != nil {
+		return false
+	}
+	f, ok := g.dedup[p]
+	if !ok {
+		bits := g.coordinator.config.DedupBits
+		if bits <= 0 {
+			bits = defaultDedupBits
+		}
+		f = newBloom(bits)
+		g.dedup[p] = f
+	}
+	return f.testAndAdd(h1, h2)
+}
@@ -0,0 +1,244 @@
+package waffle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// Incremental checkpoints only write the vertices that changed since the
+// previous checkpoint, along with their edges, and the ids of the ones that
+// went away.  What changed is found by checksumming every vertex and its
+// out-edges at each checkpoint, so nothing has to be tracked while
+// computing.  A delta part names the step of the part it builds on, and
+// loading it replays the chain back to the last full part.  Every so many
+// deltas a full part is written again, compacting the chain so the
+// checkpoints before it can go.
+
+const defaultCompact = 8
+
+// a worker's chain of checkpoint parts.  A chain belongs to one run, and
+// only grows once the checkpoint a part was written for has committed.
+type deltaChain struct {
+	run *Coordinator
+	// the partition and step of the last committed part, and its checksums
+	pid, last int
+	sums      map[string]uint64
+	// deltas since the last full part, and its step
+	length, full int
+	// checkpoints retention wanted gone that the chain still needed
+	deferred []int
+	// the part written for a checkpoint that hasn't committed yet
+	pending *deltaPart
+	sync.Mutex
+}
+
+type deltaPart struct {
+	pid, step int
+	full      bool
+	sums      map[string]uint64
+}
+
+// checksums of every vertex in the partition with its out-edges, and of the
+// out-edges of sources that have no vertex
+func (g *Graph) checkpointSums() map[string]uint64 {
+	sums := make(map[string]uint64)
+	sum := func(id string, v Vertex) {
+		h := fnv.New64a()
+		if v != nil {
+			var n [8]byte
+			binary.LittleEndian.PutUint64(n[:], vertexSum(v))
+			h.Write(n[:])
+		}
+		writeCanonical(h, reflect.ValueOf(g.edges[id]))
+		sums[id] = h.Sum64()
+	}
+	g.EachVertex(func(v Vertex) {
+		sum(v.Id(), v)
+	})
+	for src := range g.edges {
+		if _, ok := sums[src]; !ok {
+			sum(src, nil)
+		}
+	}
+	return sums
+}
+
+// plan this partition's part for the checkpoint at step: the ids to write
+// and the ones removed, or nil and nil for a full part.  compact is how many
+// deltas can follow a full part.
+func (d *deltaChain) plan(g *Graph, step, compact int, part *CheckpointPart) (map[string]bool, []string, map[string]uint64) {
+	sums := g.checkpointSums()
+	d.Lock()
+	defer d.Unlock()
+	if compact <= 0 {
+		compact = defaultCompact
+	}
+	if d.run != g.coordinator {
+		// a new run, or one resumed from a checkpoint, has nothing written
+		// by this chain to build on
+		d.run, d.pid, d.last, d.sums = g.coordinator, 0, 0, nil
+		d.length, d.full, d.deferred, d.pending = 0, 0, nil, nil
+	}
+	if d.sums == nil || d.pid != g.partitionId || d.length >= compact {
+		return nil, nil, sums
+	}
+	changed := make(map[string]bool)
+	for id, s := range sums {
+		if old, ok := d.sums[id]; !ok || old != s {
+			changed[id] = true
+		}
+	}
+	var removed []string
+	for id := range d.sums {
+		if _, ok := sums[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	sort.Strings(removed)
+	part.Base = d.last
+	part.Vertices, part.Edges, part.Removed = 0, 0, len(removed)
+	g.EachVertex(func(v Vertex) {
+		if changed[v.Id()] {
+			part.Vertices++
+		}
+	})
+	for src, edges := range g.edges {
+		if changed[src] {
+			part.Edges += len(edges)
+		}
+	}
+	return changed, removed, sums
+}
+
+// note the part written for step, it only counts once the checkpoint commits
+func (d *deltaChain) wrote(pid, step int, full bool, sums map[string]uint64) {
+	d.Lock()
+	defer d.Unlock()
+	d.pending = &deltaPart{pid: pid, step: step, full: full, sums: sums}
+}
+
+// the checkpoint at step has committed, build on its part from now on.
+// Returns the checkpoints retention asked for earlier that nothing needs
+// anymore.
+func (d *deltaChain) commit(step int) (free []int) {
+	d.Lock()
+	defer d.Unlock()
+	p := d.pending
+	if p == nil || p.step != step {
+		return nil
+	}
+	d.pending = nil
+	d.pid, d.last, d.sums = p.pid, step, p.sums
+	if !p.full {
+		d.length++
+		return nil
+	}
+	d.length, d.full = 0, step
+	var kept []int
+	for _, s := range d.deferred {
+		if s < step {
+			free = append(free, s)
+		} else {
+			kept = append(kept, s)
+		}
+	}
+	d.deferred = kept
+	return free
+}
+
+// Persisters with a delta chain hear when a checkpoint commits.
+type checkpointCommitter interface {
+	checkpointCommitted(g *Graph, step int)
+}
+
+func (c *Coordinator) checkpointCommitted(step int) {
+	if cc, ok := c.graph.job.(checkpointCommitter); ok {
+		cc.checkpointCommitted(c.graph, step)
+	}
+}
+
+// whether the checkpoint at step is part of the chain the last part builds
+// on, and has to stay.  Those are put off until the next full part.
+func (d *deltaChain) hold(step int) bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.sums == nil || step < d.full {
+		return false
+	}
+	d.deferred = append(d.deferred, step)
+	return true
+}
+
+// the checkpoint data of one part file
+type checkpointData struct {
+	part     CheckpointPart
+	vertices []Vertex
+	edges    []Edge
+	msgs     []Message
+	removed  []string
+}
+
+// load the part file at step, replaying the deltas it is built from.  read
+// returns the manifest of a step, the path of the file in it and its bytes.
+func replayCheckpoint(step int, file string, read func(step int, file string) (*CheckpointManifest, string, []byte, error)) ([]Vertex, []Edge, []Message, error) {
+	m, path, b, err := read(step, file)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	d, err := decodeCheckpointPart(m, path, file, b)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if d.part.Base == 0 {
+		return d.vertices, d.edges, d.msgs, nil
+	}
+	if d.part.Base >= step {
+		return nil, nil, nil, fmt.Errorf("%s builds on step %d, which doesn't come before it", path, d.part.Base)
+	}
+	baseVertices, baseEdges, _, err := replayCheckpoint(d.part.Base, file, read)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not load what %s builds on: %v", path, err)
+	}
+	vertices := make(map[string]Vertex)
+	for _, v := range baseVertices {
+		vertices[v.Id()] = v
+	}
+	edges := make(map[string][]Edge)
+	for _, e := range baseEdges {
+		edges[e.Source()] = append(edges[e.Source()], e)
+	}
+	for _, id := range d.removed {
+		delete(vertices, id)
+		delete(edges, id)
+	}
+	// a changed vertex comes with all of its edges, none if it has none left
+	for _, v := range d.vertices {
+		vertices[v.Id()] = v
+		delete(edges, v.Id())
+	}
+	for _, e := range d.edges {
+		delete(edges, e.Source())
+	}
+	for _, e := range d.edges {
+		edges[e.Source()] = append(edges[e.Source()], e)
+	}
+
+	ids := make([]string, 0, len(vertices))
+	for id := range vertices {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	vs := make([]Vertex, 0, len(ids))
+	for _, id := range ids {
+		vs = append(vs, vertices[id])
+	}
+	var es []Edge
+	for _, list := range edges {
+		es = append(es, list...)
+	}
+	return vs, es, d.msgs, nil
+}
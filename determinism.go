@@ -0,0 +1,168 @@
+package waffle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+)
+
+// With Config.CheckDeterminism set, each step a sample of the partitions
+// computes every vertex twice from the same vertex and messages: once on a
+// copy with its side effects thrown away, then for real.  A vertex that ends
+// up different, or sends different messages, is counted as
+// determinism.violations and logged.  Recovery replays steps from a
+// checkpoint, which only gives the same answer when Compute does.
+//
+// Disk reserved by the copy is only counted against the quota, never taken.
+// Partition state is shared by every Compute and there is no copy of it to
+// throw away, so jobs that keep one aren't checked.
+type determinismCheck struct {
+	// whether this partition is checked this step
+	sampled bool
+	// computing the copy, nothing it does leaves the graph
+	shadow bool
+	// messages sent by the compute being checked
+	recording bool
+	sent      []Message
+	// disk the copy has reserved, by category
+	reserved map[string]int64
+	// violations logged this step
+	logged int
+}
+
+// violations logged per step before the rest are only counted
+const maxLoggedViolations = 10
+
+// whether partition pid is checked in step, the same answer on every worker
+func sampledForCheck(step, pid int, fraction float64) bool {
+	if fraction <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%d", step, pid)
+	return float64(h.Sum32())/(1<<32) < fraction
+}
+
+func (g *Graph) sampleDeterminism(step int) {
+	sampled := g.partitionState == nil && sampledForCheck(step, g.partitionId, g.coordinator.config.CheckDeterminism)
+	g.determinism = determinismCheck{sampled: sampled}
+	if g.determinism.sampled {
+		g.log.debugf("Checking determinism in step %d", step)
+	}
+}
+
+// whether what compute does right now is being thrown away
+func (g *Graph) shadowing() bool {
+	return g.determinism.shadow
+}
+
+// reserve disk for the copy, against the quota but without taking any
+func (d *determinismCheck) reserveDisk(disk *diskUsage, category string, n int64) error {
+	if err := disk.check(category, d.reserved[category]+n); err != nil {
+		return err
+	}
+	d.reserved[category] += n
+	return nil
+}
+
+func (d *determinismCheck) releaseDisk(category string, n int64) {
+	d.reserved[category] -= n
+}
+
+// note a message compute sent, reporting whether it shouldn't go anywhere
+func (g *Graph) captureMessage(m Message) bool {
+	d := &g.determinism
+	if !d.recording {
+		return false
+	}
+	if c, err := copyMessage(m); err == nil {
+		d.sent = append(d.sent, c)
+	}
+	return d.shadow
+}
+
+func copyMessage(m Message) (Message, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&m); err != nil {
+		return nil, err
+	}
+	var c Message
+	if err := gob.NewDecoder(&buf).Decode(&c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// compute v twice and compare
+func (g *Graph) checkDeterminism(v Vertex, msgs []Message, from []string) {
+	d := &g.determinism
+	vc, err := copyVertex(v)
+	mc := make([]Message, 0, len(msgs))
+	for _, m := range msgs {
+		if err != nil {
+			break
+		}
+		var c Message
+		c, err = copyMessage(m)
+		mc = append(mc, c)
+	}
+	if err != nil {
+		g.log.Printf("Could not copy vertex %s to check it: %v", v.Id(), err)
+		g.runCompute(v, msgs, from)
+		return
+	}
+
+	d.shadow, d.recording, d.sent = true, true, nil
+	d.reserved = make(map[string]int64)
+	g.runCompute(vc, mc, from)
+	shadowSent := d.sent
+	d.shadow, d.sent = false, nil
+	g.runCompute(v, msgs, from)
+	sent := d.sent
+	d.recording, d.sent = false, nil
+
+	var what string
+	if a, b := roundTrip(v), roundTrip(vc); a == nil || b == nil || !reflect.DeepEqual(a, b) {
+		what = "state"
+	} else if !sameMessages(sent, shadowSent) {
+		what = fmt.Sprintf("messages (%d sent, then %d)", len(shadowSent), len(sent))
+	}
+	if what == "" {
+		return
+	}
+	g.Count("determinism.violations", 1)
+	if d.logged < maxLoggedViolations {
+		d.logged++
+		g.log.Printf("Compute isn't deterministic! vertex %s ended up with different %s in step %d from the same input", v.Id(), what, g.localStat.step)
+	}
+}
+
+// v as it comes out of gob, so both sides of a comparison are encoded the
+// same way
+func roundTrip(v Vertex) Vertex {
+	c, _ := copyVertex(v)
+	return c
+}
+
+// whether a and b hold the same messages, in any order
+func sameMessages(a, b []Message) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	used := make([]bool, len(b))
+	for _, m := range a {
+		found := false
+		for i, n := range b {
+			if !used[i] && reflect.DeepEqual(m, n) {
+				used[i], found = true, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,166 @@
+package waffle
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Direction is how a step moves information along edges.  Push steps are the
+// usual ones, vertices send messages along their out-edges.  In pull steps
+// vertices that implement PullVertex are instead handed the sources of their
+// in-edges that were in the last step's frontier, which is a lot less work
+// once the frontier covers much of the graph.  Pulling needs Config.InEdges.
+type Direction int32
+
+const (
+	Push Direction = iota + 1
+	Pull
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Push:
+		return "push"
+	case Pull:
+		return "pull"
+	}
+	return fmt.Sprintf("direction(%d)", int32(d))
+}
+
+// A PullVertex computes in pull steps with its messages and the in-neighbors
+// that were marked as the frontier in the last step.  In push steps it is
+// computed as usual.
+type PullVertex interface {
+	Vertex
+	ComputePull(g *Graph, msgs []Message, from []string)
+}
+
+// the vertices marked as the frontier, by step
+type markedFrontier struct {
+	steps map[int][]string
+	sync.Mutex
+}
+
+func (m *markedFrontier) mark(step int, id string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.steps == nil {
+		m.steps = make(map[int][]string)
+	}
+	m.steps[step] = append(m.steps[step], id)
+}
+
+func (m *markedFrontier) get(step int) []string {
+	m.Lock()
+	defer m.Unlock()
+	return m.steps[step]
+}
+
+func (m *markedFrontier) forget(before int) {
+	m.Lock()
+	defer m.Unlock()
+	for step := range m.steps {
+		if step < before {
+			delete(m.steps, step)
+		}
+	}
+}
+
+// MarkFrontier puts id, a vertex of this partition, in this step's frontier.
+// If the next step pulls, the vertices id has edges to see it as one of the
+// sources they are handed.
+func (g *Graph) MarkFrontier(id string) {
+	if g.shadowing() {
+		return
+	}
+	g.marked.mark(g.localStat.step, id)
+}
+
+// Direction is the direction of the step being computed.
+func (g *Graph) Direction() Direction {
+	if g.pulling {
+		return Pull
+	}
+	return Push
+}
+
+type FrontierRequest struct {
+	Step int
+}
+
+func (c *Coordinator) FetchFrontier(req *FrontierRequest, r *[]string) error {
+	*r = c.graph.marked.get(req.Step)
+	return nil
+}
+
+// get the last step's frontier from everyone if this step pulls
+func (g *Graph) preparePull(step int) error {
+	c := g.coordinator
+	g.marked.forget(step - 1)
+	g.pullSet = nil
+	g.pulling = Direction(atomic.LoadInt32(&c.direction)) == Pull
+	if !g.pulling {
+		return nil
+	}
+	set := make(map[string]bool)
+	for pid, w := range c.partitionMap() {
+		var ids []string
+		if pid == g.partitionId {
+			ids = g.marked.get(step - 1)
+		} else if err := c.client(w).Call("Coordinator.FetchFrontier", &FrontierRequest{step - 1}, &ids); err != nil {
+			return fmt.Errorf("could not fetch the frontier of partition %d: %v", pid, err)
+		}
+		for _, id := range ids {
+			set[id] = true
+		}
+	}
+	g.pullSet = set
+	return nil
+}
+
+// the in-neighbors of id in the last step's frontier
+func (g *Graph) pulledFrom(id string) []string {
+	var from []string
+	for _, src := range g.InEdges(id) {
+		if g.pullSet[src] {
+			from = append(from, src)
+		}
+	}
+	sort.Strings(from)
+	return from
+}
+
+// work out the direction of the next step, from a master compute decision or
+// from how much of the graph the frontier covers
+func (c *Coordinator) chooseDirection(step int, d Direction, frontier FrontierStat, vertices int) {
+	cur := Direction(atomic.LoadInt32(&c.direction))
+	next := cur
+	switch {
+	case d != 0:
+		next = d
+	case c.config.PullFraction > 0 && vertices > 0:
+		covered := float64(frontier.Marked) / float64(vertices)
+		if cur == Pull && covered < c.config.pushFraction() {
+			next = Push
+		} else if cur != Pull && covered > c.config.PullFraction && frontier.Growth >= 1 {
+			next = Pull
+		}
+	}
+	if next == Pull && !c.config.InEdges {
+		c.log.Printf("Can't pull in step %d without Config.InEdges", step+1)
+		next = Push
+	}
+	if next != cur {
+		c.log.Printf("Step %d will %s", step+1, next)
+		atomic.StoreInt32(&c.direction, int32(next))
+	}
+}
+
+func (c *Config) pushFraction() float64 {
+	if c.PushFraction > 0 {
+		return c.PushFraction
+	}
+	return c.PullFraction / 4
+}
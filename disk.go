@@ -0,0 +1,138 @@
+package waffle
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// disk categories for Config.DiskQuotas
+const (
+	DiskSpill       = "spill"
+	DiskCheckpoints = "checkpoints"
+	DiskResults     = "results"
+)
+
+// diskUsage keeps track of the local disk a worker is using by category,
+// against the quotas in the config
+type diskUsage struct {
+	quotas map[string]int64
+	used   map[string]int64
+	sync.Mutex
+}
+
+func newDiskUsage(quotas map[string]int64) *diskUsage {
+	return &diskUsage{quotas: quotas, used: make(map[string]int64)}
+}
+
+// reserve n more bytes in category, failing if that would go over its quota
+func (d *diskUsage) reserve(category string, n int64) error {
+	d.Lock()
+	defer d.Unlock()
+	if err := d.over(category, n); err != nil {
+		return err
+	}
+	d.used[category] += n
+	return nil
+}
+
+// the error reserving n more bytes in category would give, without
+// reserving them
+func (d *diskUsage) check(category string, n int64) error {
+	d.Lock()
+	defer d.Unlock()
+	return d.over(category, n)
+}
+
+func (d *diskUsage) over(category string, n int64) error {
+	if q, ok := d.quotas[category]; ok && q > 0 && d.used[category]+n > q {
+		return fmt.Errorf("%s disk quota of %d bytes exceeded (%d in use, %d wanted)", category, q, d.used[category], n)
+	}
+	return nil
+}
+
+// whether n more bytes would fit in category
+func (d *diskUsage) fits(category string, n int64) bool {
+	d.Lock()
+	defer d.Unlock()
+	q, ok := d.quotas[category]
+	return !ok || q <= 0 || d.used[category]+n <= q
+}
+
+func (d *diskUsage) release(category string, n int64) {
+	d.Lock()
+	defer d.Unlock()
+	d.used[category] -= n
+}
+
+func (d *diskUsage) information() map[string]int64 {
+	d.Lock()
+	defer d.Unlock()
+	info := make(map[string]int64)
+	for k, v := range d.used {
+		info[k] = v
+	}
+	return info
+}
+
+// ReserveDisk accounts for n bytes the job is about to write to local disk
+// for category (DiskCheckpoints, say), failing if that would go over the
+// quota.  ReleaseDisk gives them back.
+func (g *Graph) ReserveDisk(category string, n int64) error {
+	if g.shadowing() {
+		return g.determinism.reserveDisk(g.coordinator.disk, category, n)
+	}
+	return g.coordinator.disk.reserve(category, n)
+}
+
+func (g *Graph) ReleaseDisk(category string, n int64) {
+	if g.shadowing() {
+		g.determinism.releaseDisk(category, n)
+		return
+	}
+	g.coordinator.disk.release(category, n)
+}
+
+// Spill files are unlinked as soon as they are created, so any that are
+// still around were left behind by a worker that died before it got that
+// far.
+func (c *Coordinator) cleanSpillDir() {
+	if c.config.SpillDir == "" {
+		return
+	}
+	stale, err := filepath.Glob(filepath.Join(c.config.SpillDir, "*.spill"))
+	if err != nil {
+		return
+	}
+	for _, f := range stale {
+		if !strings.Contains(filepath.Base(f), "-"+c.config.NodeId+"-") {
+			continue
+		}
+		if err := os.Remove(f); err != nil {
+			c.log.Printf("Could not remove stale spill file %s: %v", f, err)
+			continue
+		}
+		c.log.Printf("Removed stale spill file %s", f)
+	}
+}
+
+// Once the manifest of a checkpoint or result directory is in, every part it
+// lists has been renamed into place, so a *.tmp still in there was left by a
+// worker that died while writing it.  removeStaging takes those out and
+// reports the ones it removed.
+func removeStaging(dir string) ([]string, error) {
+	stale, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	for _, f := range stale {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return removed, err
+		}
+		removed = append(removed, f)
+	}
+	return removed, nil
+}
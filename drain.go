@@ -0,0 +1,386 @@
+package waffle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dforsyth/donut"
+	"launchpad.net/gozk/zookeeper"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// A worker can be drained out of a running job to take its machine away
+// without failing anything.  Runner.Drain, or DrainWorker over rpc, drops a
+// node for the worker under the drain path.  The worker says so in its next
+// step summary, and at that barrier everyone works out the same new home for
+// each of its partitions.  It ships its vertices, edges and the messages
+// waiting for the next step to their new owners, everyone waits in a drain
+// barrier, the remaining workers renumber themselves without it and carry
+// on, and its run returns ErrDrained.  Partitions only move as a whole with
+// Config.NumPartitions set, so draining needs it, and state a job keeps per
+// partition with PartitionStater stays behind with the drained worker.
+
+// ErrDrained is what the run of a drained worker returns.
+var ErrDrained = errors.New("worker was drained out of the job")
+
+// workers that have been drained, or are on their way out
+type drains struct {
+	left map[string]bool
+	sync.Mutex
+}
+
+func (d *drains) add(worker string) {
+	d.Lock()
+	defer d.Unlock()
+	if d.left == nil {
+		d.left = make(map[string]bool)
+	}
+	d.left[worker] = true
+}
+
+func (d *drains) has(worker string) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.left[worker]
+}
+
+type DrainRequest struct {
+	Source string
+	Token  string
+}
+
+// DrainWorker drains the worker it is called on.
+func (c *Coordinator) DrainWorker(req *DrainRequest, r *int) error {
+	if err := c.authorize(req.Source, req.Token, OpDrain); err != nil {
+		return err
+	}
+	*r = 0
+	return c.requestDrain()
+}
+
+func (c *Coordinator) requestDrain() error {
+	if c.config.NumPartitions <= 0 {
+		return errors.New("draining a worker needs Config.NumPartitions")
+	}
+	c.zk.Create(c.drainPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL))
+	if _, err := c.zk.Create(path.Join(c.drainPath, c.config.NodeId), "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil && !zookeeper.IsError(err, zookeeper.ZNODEEXISTS) {
+		return fmt.Errorf("could not create the drain node: %v", err)
+	}
+	return nil
+}
+
+// Drain moves this runner's partitions to the other workers at the next step
+// barrier and takes it out of the job.
+func (r *Runner) Drain() error {
+	return r.listener.coordinator.requestDrain()
+}
+
+// DrainWorker asks the worker listening at host:port to hand its partitions
+// to the others and leave the job.
+func DrainWorker(c *Config, host, port string) error {
+	cl, err := (&Coordinator{config: c}).dial(host, port)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	var r int
+	return cl.Call("Coordinator.DrainWorker", &DrainRequest{Source: c.NodeId, Token: c.Token}, &r)
+}
+
+func (c *Coordinator) watchDrain() {
+	p := path.Join(c.drainPath, c.config.NodeId)
+	for {
+		stat, watch, err := c.zk.ExistsW(p)
+		if err != nil {
+			c.log.Printf("Could not watch %s: %v", p, err)
+			return
+		}
+		if stat != nil {
+			c.log.Printf("Draining, handing our partitions over at the next step barrier")
+			c.audit(OpDrain, "drain node", c.config.NodeId)
+			atomic.StoreInt32(&c.draining, 1)
+			return
+		}
+		<-watch
+	}
+}
+
+// the worker to drain after a step, one at a time and lowest partition first
+func (c *Coordinator) drainee(total map[string]interface{}) string {
+	asked, ok := total["drain"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	if c.numPartitions() < 2 {
+		c.log.Printf("Not draining the last worker in the job")
+		return ""
+	}
+	w := ""
+	for pid := 0; pid < c.numPartitions(); pid++ {
+		if _, ok := asked[c.worker(pid)]; ok {
+			w = c.worker(pid)
+			break
+		}
+	}
+	if w != "" && c.slots == nil {
+		c.log.Printf("Not draining %s, partitions can only move with NumPartitions set", w)
+		return ""
+	}
+	return w
+}
+
+// drain w after step, then wait in the drain barrier for everyone else before
+// the next step
+func (c *Coordinator) drain(step int, w string) {
+	c.drains.add(w)
+	d := c.partitionOf(w)
+	slots := c.drainSlots(d)
+	c.adoptSlots(slots, d)
+	name := "drain-" + strconv.Itoa(step)
+	c.createBarrier(name, func(m *donut.SafeMap) {
+		c.onDrainBarrierChange(step, w, slots, m)
+	})
+	if d == c.graph.partitionId {
+		if err := c.graph.drainTo(step+1, slots); err != nil {
+			err = fmt.Errorf("could not drain partition %d: %v", d, err)
+			c.log.Println(err)
+			c.fail(err)
+			return
+		}
+	}
+	c.enterBarrier(name, c.config.NodeId, "")
+}
+
+func (c *Coordinator) onDrainBarrierChange(step int, w string, slots []int, m *donut.SafeMap) {
+	if m.Len() != c.numPartitions() {
+		return
+	}
+	name := "drain-" + strconv.Itoa(step)
+	if kill, ok := c.watchers[name]; ok {
+		kill <- 1
+		delete(c.watchers, name)
+	}
+	c.removeWorker(w, slots)
+	if w == c.config.NodeId {
+		c.zk.Delete(path.Join(c.drainPath, w), -1)
+		c.zk.Delete(path.Join(c.workersPath, w), -1)
+		c.fail(ErrDrained)
+		return
+	}
+	go c.createStepWork(step + 1)
+}
+
+func (c *Coordinator) partitionOf(w string) int {
+	for pid, pw := range c.partitionMap() {
+		if pw == w {
+			return pid
+		}
+	}
+	c.log.Panicf("%s is not in the partition map", w)
+	return -1
+}
+
+// the hash partitions of every worker once the ones on worker partition d
+// have gone to whoever holds the fewest
+func (c *Coordinator) drainSlots(d int) []int {
+	slots := make([]int, len(c.slots))
+	copy(slots, c.slots)
+	held := make([]int, c.numPartitions())
+	var orphans []int
+	for slot, pid := range slots {
+		if pid == d {
+			orphans = append(orphans, slot)
+			continue
+		}
+		held[pid]++
+	}
+	moveSlots(slots, held, orphans, d)
+	return slots
+}
+
+// take w out of the partition map, closing up the gap it leaves, and adopt
+// the hash partitions it held
+func (c *Coordinator) removeWorker(w string, slots []int) {
+	d := c.partitionOf(w)
+	renumber := make(map[int]int)
+	var workers []string
+	for pid := 0; pid < c.numPartitions(); pid++ {
+		if pid == d {
+			continue
+		}
+		renumber[pid] = len(workers)
+		workers = append(workers, c.worker(pid))
+	}
+	c.partitionsLock.Lock()
+	for pid := range c.partitions {
+		delete(c.partitions, pid)
+	}
+	for pid, pw := range workers {
+		c.partitions[pid] = pw
+	}
+	c.partitionsLock.Unlock()
+	for slot, pid := range slots {
+		c.slots[slot] = renumber[pid]
+	}
+	if w != c.config.NodeId {
+		c.graph.partitionId = renumber[c.graph.partitionId]
+	}
+	c.graph.routes.renumber(renumber)
+	c.graph.mirrors.renumber(renumber)
+	c.heartbeats.forget(w)
+	c.clientsLock.Lock()
+	delete(c.cachedWorkerInfo, w)
+	c.clientsLock.Unlock()
+	c.log.Printf("Drained %s, %d workers left", w, len(workers))
+	c.audit(OpDrain, "drain barrier", w)
+}
+
+// send everything in this partition, with the messages waiting for step, to
+// the partitions that take over its hash partitions in slots
+func (g *Graph) drainTo(step int, slots []int) error {
+	c := g.coordinator
+	to := func(id string) int {
+		return slots[c.config.partitioner().PartitionOf(id, len(slots))]
+	}
+	return g.shipOut(step, to, Migration{Slots: slots, From: g.partitionId})
+}
+
+// send the vertices that to places on other partitions there, with their
+// edges, in-edges and the messages waiting for them in step.  Mutations
+// waiting for the start of step are applied first so nothing is left behind.
+func (g *Graph) shipOut(step int, to func(id string) int, base Migration) error {
+	c := g.coordinator
+	g.applyRemoved()
+	g.applyAdded()
+	g.applyEdgeUpdates()
+	ms := make(map[int]*Migration)
+	get := func(id string) *Migration {
+		pid := to(id)
+		if pid == g.partitionId {
+			return nil
+		}
+		if ms[pid] == nil {
+			m := base
+			m.Step = step
+			ms[pid] = &m
+		}
+		return ms[pid]
+	}
+	var moved []string
+	g.eachVertex(func(v Vertex, cold bool) bool {
+		if m := get(v.Id()); m != nil {
+			m.Vertices = append(m.Vertices, v)
+			moved = append(moved, v.Id())
+		}
+		return true
+	})
+	var movedEdges []string
+	for src, edges := range g.edges {
+		if m := get(src); m != nil {
+			m.Edges = append(m.Edges, edges...)
+			movedEdges = append(movedEdges, src)
+		}
+	}
+	g.inboxLock.Lock()
+	for id, msgs := range g.inbox[step] {
+		if m := get(id); m != nil {
+			m.Messages = append(m.Messages, msgs...)
+			delete(g.inbox[step], id)
+		}
+	}
+	g.inboxLock.Unlock()
+	var movedIn []string
+	g.in.Lock()
+	for id, srcs := range g.in.m {
+		if m := get(id); m != nil {
+			for _, src := range srcs {
+				m.InEdges = append(m.InEdges, [2]string{src, id})
+			}
+			movedIn = append(movedIn, id)
+		}
+	}
+	g.in.Unlock()
+
+	var pids []int
+	for pid := range ms {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	for _, pid := range pids {
+		var r int
+		if err := c.client(c.worker(pid)).Call("Coordinator.SubmitMigration", ms[pid], &r); err != nil {
+			return err
+		}
+		g.log.debugf("Moved %d vertices to partition %d", len(ms[pid].Vertices), pid)
+	}
+	for _, id := range moved {
+		g.dropVertex(id)
+	}
+	for _, id := range movedEdges {
+		delete(g.edges, id)
+	}
+	g.in.Lock()
+	for _, id := range movedIn {
+		delete(g.in.m, id)
+	}
+	g.in.Unlock()
+	return nil
+}
+
+// stop placing anything on worker partition d, which is being drained, so the
+// vertices coming off it stay where they land
+func (c *Coordinator) adoptSlots(slots []int, d int) {
+	copy(c.slots, slots)
+	c.graph.routes.drop(d)
+}
+
+func (r *routes) drop(p int) {
+	r.Lock()
+	defer r.Unlock()
+	for id, rp := range r.m {
+		if rp == p {
+			delete(r.m, id)
+		}
+	}
+}
+
+// point routes at the renumbered partitions, dropping the ones to a
+// partition that is gone so its vertices go where their hash says
+func (r *routes) renumber(pids map[int]int) {
+	r.Lock()
+	defer r.Unlock()
+	for id, p := range r.m {
+		if np, ok := pids[p]; ok {
+			r.m[id] = np
+		} else {
+			delete(r.m, id)
+		}
+	}
+}
+
+// keep wanting the mirrors of the renumbered partitions, the ones from a
+// partition that is gone get asked for again once they show up hot
+func (mc *mirrorCache) renumber(pids map[int]int) {
+	mc.Lock()
+	defer mc.Unlock()
+	wanted := make(map[int]map[string]int)
+	for p, ids := range mc.wanted {
+		if np, ok := pids[p]; ok {
+			wanted[np] = ids
+		}
+	}
+	mc.wanted = wanted
+}
+
+// stop keeping track of a worker that left the job on purpose
+func (h *heartbeats) forget(worker string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.detectors, worker)
+	delete(h.suspected, worker)
+	delete(h.latest, worker)
+	h.left[worker] = true
+}
@@ -0,0 +1,60 @@
+package waffle
+
+import (
+	"encoding/gob"
+)
+
+// Edges with a value, weighted algorithms read it through EachEdge.
+type ValuedEdge interface {
+	Edge
+	EdgeValue() float64
+	SetEdgeValue(float64)
+}
+
+// EdgeBase is a ready made edge with a weight and an optional label, for
+// jobs that don't need an edge type of their own.
+type EdgeBase struct {
+	Src, Dst string
+	Value    float64
+	Label    string
+}
+
+func init() {
+	gob.Register(&EdgeBase{})
+}
+
+func NewEdge(src, dst string, value float64) *EdgeBase {
+	return &EdgeBase{Src: src, Dst: dst, Value: value}
+}
+
+func (e *EdgeBase) Source() string         { return e.Src }
+func (e *EdgeBase) Destination() string    { return e.Dst }
+func (e *EdgeBase) EdgeValue() float64     { return e.Value }
+func (e *EdgeBase) SetEdgeValue(v float64) { e.Value = v }
+
+// EachEdge calls fn with the destination and value of every out edge of id.
+// Edges without a value count as 1.
+func (g *Graph) EachEdge(id string, fn func(dest string, value float64)) {
+	for _, e := range g.edges[id] {
+		v := 1.0
+		if ve, ok := e.(ValuedEdge); ok {
+			v = ve.EdgeValue()
+		}
+		fn(e.Destination(), v)
+	}
+}
+
+// SetEdgeValue sets the value of the edges from src to dst, reporting whether
+// there were any with a value to set
+func (g *Graph) SetEdgeValue(src, dst string, value float64) bool {
+	found := false
+	for _, e := range g.edges[src] {
+		if ve, ok := e.(ValuedEdge); ok && e.Destination() == dst {
+			if !g.shadowing() {
+				ve.SetEdgeValue(value)
+			}
+			found = true
+		}
+	}
+	return found
+}
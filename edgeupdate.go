@@ -0,0 +1,90 @@
+package waffle
+
+import (
+	"net/rpc"
+	"sync"
+)
+
+const counterEdgesUpdated = "topology.edges.updated"
+
+// An EdgeUpdate sets the value of the edges from Src to Dst.
+type EdgeUpdate struct {
+	Src, Dst string
+	Value    float64
+}
+
+// edge updates to send at the end of the step by partition, and the ones
+// received to apply at the start of the next
+type edgeUpdates struct {
+	out     map[int][]EdgeUpdate
+	pending []EdgeUpdate
+	sync.Mutex
+}
+
+func (c *Coordinator) SubmitEdgeUpdates(updates []EdgeUpdate, r *int) error {
+	c.graph.updates.queue(updates)
+	*r = 0
+	return nil
+}
+
+func (u *edgeUpdates) queue(updates []EdgeUpdate) {
+	u.Lock()
+	defer u.Unlock()
+	u.pending = append(u.pending, updates...)
+}
+
+// SetOutEdgeValue sets the value of the edges from src to dst, wherever src
+// lives, at the start of the next step.  Unlike SetEdgeValue it works on
+// any vertex's edges and doesn't change anything under the feet of this
+// step.  When a step sets the same edge more than once, the last update to
+// arrive wins.
+func (g *Graph) SetOutEdgeValue(src, dst string, value float64) {
+	if g.shadowing() {
+		return
+	}
+	g.Count(counterEdgesUpdated, 1)
+	g.noteMutations(1)
+	p := g.determinePartition(src)
+	u := EdgeUpdate{Src: src, Dst: dst, Value: value}
+	if p == g.partitionId {
+		g.updates.queue([]EdgeUpdate{u})
+		return
+	}
+	g.updates.Lock()
+	defer g.updates.Unlock()
+	if g.updates.out == nil {
+		g.updates.out = make(map[int][]EdgeUpdate)
+	}
+	g.updates.out[p] = append(g.updates.out[p], u)
+}
+
+// send the edge updates for other partitions, before the step barrier
+func (c *Coordinator) flushEdgeUpdates() {
+	u := &c.graph.updates
+	u.Lock()
+	out := u.out
+	u.out = nil
+	u.Unlock()
+	for p, updates := range out {
+		cl := c.client(c.worker(p))
+		c.outbox.trackN(0, cl.Go("Coordinator.SubmitEdgeUpdates", updates, new(int), make(chan *rpc.Call, 1)))
+	}
+}
+
+// set the edge values asked for in the last step
+func (g *Graph) applyEdgeUpdates() {
+	g.updates.Lock()
+	pending := g.updates.pending
+	g.updates.pending = nil
+	g.updates.Unlock()
+	for _, u := range pending {
+		for _, e := range g.edges[u.Src] {
+			if ve, ok := e.(ValuedEdge); ok && e.Destination() == u.Dst {
+				ve.SetEdgeValue(u.Value)
+			}
+		}
+	}
+	if len(pending) > 0 {
+		g.log.debugf("updated %d edges", len(pending))
+	}
+}
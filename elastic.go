@@ -0,0 +1,332 @@
+package waffle
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/dforsyth/donut"
+	"launchpad.net/gozk/zookeeper"
+	"net/rpc"
+	"path"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// With Config.Elastic set, workers that show up after the job has started
+// join it instead of giving up.  A joiner registers like anyone else and
+// waits.  The running workers say who they have seen turn up in their step
+// summaries, and at that barrier everyone adds the joiners to the end of the
+// partition map and hands them an even share of the hash partitions, taken
+// from whoever holds the most.  Each worker tells the joiners where the job
+// stands, ships them the vertices they now own along with their edges and
+// waiting messages, and everyone waits in a join barrier before the next
+// step.  Only whole hash partitions move, so joining needs
+// Config.NumPartitions like draining does.
+
+// ErrNotAdmitted is what the run of a joiner returns when the job doesn't
+// take it in within Config.JoinTimeout, because the job has no
+// NumPartitions or the joiner lacks something the job uses, say.
+var ErrNotAdmitted = errors.New("worker was not admitted to the running job")
+
+const defaultJoinTimeout = 10 * time.Minute
+
+// where the job stands after a step, for workers joining it
+type Admission struct {
+	Step           int
+	Epoch          int64
+	Partitions     map[int]string
+	Slots          []int
+	Routes         map[string]int
+	Phase          string
+	Direction      int32
+	Aggregates     map[string]float64
+	LastCheckpoint int
+}
+
+// register as a joiner of a job that is already running
+func (c *Coordinator) join() error {
+	if err := c.checkVersions(); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&c.state, JoinState)
+	if _, err := c.zk.Create(path.Join(c.workersPath, c.config.NodeId), c.info(), zookeeper.EPHEMERAL, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
+		return err
+	}
+	c.log.Printf("Job is already running, joining it at the next step barrier")
+	timeout := c.config.JoinTimeout
+	if timeout <= 0 {
+		timeout = defaultJoinTimeout
+	}
+	c.timers.start("join", timeout, func() {
+		c.admitLock.Lock()
+		defer c.admitLock.Unlock()
+		if atomic.LoadInt32(&c.state) != JoinState {
+			return
+		}
+		c.log.Printf("Not admitted to the job within %v, giving up", timeout)
+		// too late for an admission now
+		atomic.StoreInt32(&c.state, NewState)
+		c.zk.Delete(path.Join(c.workersPath, c.config.NodeId), -1)
+		c.fail(ErrNotAdmitted)
+	})
+	return nil
+}
+
+// the registered workers that aren't in the job yet
+func (c *Coordinator) newcomers() map[string]interface{} {
+	if !c.config.Elastic {
+		return nil
+	}
+	in := make(map[string]bool)
+	for _, w := range c.partitionMap() {
+		in[w] = true
+	}
+	r := make(map[string]interface{})
+	for _, w := range c.workers.Keys() {
+		if !in[w] && !c.drains.has(w) {
+			r[w] = 1
+		}
+	}
+	return r
+}
+
+// the workers to admit after a step, the ones that can do everything the
+// job does
+func (c *Coordinator) joiners(total map[string]interface{}) []string {
+	seen, ok := total["join"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if c.slots == nil {
+		c.log.Printf("Not admitting %d new workers, partitions can only move with NumPartitions set", len(seen))
+		return nil
+	}
+	var ws []string
+	for w := range seen {
+		raw, _, err := c.zk.Get(path.Join(c.workersPath, w))
+		if err != nil {
+			c.log.Printf("Not admitting %s: %v", w, err)
+			continue
+		}
+		var info map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &info); err != nil {
+			c.log.Printf("Not admitting %s, bad registration: %v", w, err)
+			continue
+		}
+		if missing := c.caps.missing(info); len(missing) > 0 {
+			c.log.Printf("Not admitting %s, it can't do %v", w, missing)
+			continue
+		}
+		ws = append(ws, w)
+	}
+	sort.Strings(ws)
+	return ws
+}
+
+// add joiners to the job after step, then wait in the join barrier for
+// everyone before the next step
+func (c *Coordinator) admit(step int, joiners []string) {
+	first := c.numPartitions()
+	for i, w := range joiners {
+		// a joiner we can't reach would leave a hole in the partition map
+		if err := c.connect(w); err != nil {
+			c.fail(fmt.Errorf("could not admit %s: %v", w, err))
+			return
+		}
+		c.partitionsLock.Lock()
+		c.partitions[first+i] = w
+		c.partitionsLock.Unlock()
+	}
+	c.negotiate()
+	c.shareSlots(first)
+	name := "join-" + strconv.Itoa(step)
+	c.createBarrier(name, func(m *donut.SafeMap) {
+		c.onJoinBarrierChange(step, m)
+	})
+	state := c.joinState(step)
+	for _, w := range joiners {
+		var r int
+		if err := c.client(w).Call("Coordinator.AdmitWorker", state, &r); err != nil {
+			err = fmt.Errorf("could not admit %s: %v", w, err)
+			c.log.Println(err)
+			c.fail(err)
+			return
+		}
+	}
+	if err := c.graph.shipOut(step+1, c.graph.determinePartition, Migration{}); err != nil {
+		err = fmt.Errorf("could not move vertices to new workers: %v", err)
+		c.log.Println(err)
+		c.fail(err)
+		return
+	}
+	c.log.Printf("Admitted %v, %d workers now", joiners, c.numPartitions())
+	c.audit("join", "step barrier", fmt.Sprint(joiners))
+	c.enterBarrier(name, c.config.NodeId, "")
+}
+
+// give the workers from partition first on an even share of the hash
+// partitions, each taken from whoever holds the most
+func (c *Coordinator) shareSlots(first int) {
+	held := make([]int, c.numPartitions())
+	for _, pid := range c.slots {
+		held[pid]++
+	}
+	share := len(c.slots) / c.numPartitions()
+	for pid := first; pid < c.numPartitions(); pid++ {
+		for held[pid] < share {
+			most := 0
+			for p := 1; p < first; p++ {
+				if held[p] > held[most] {
+					most = p
+				}
+			}
+			for slot := len(c.slots) - 1; slot >= 0; slot-- {
+				if c.slots[slot] == most {
+					c.slots[slot] = pid
+					break
+				}
+			}
+			held[most]--
+			held[pid]++
+		}
+	}
+}
+
+func (c *Coordinator) joinState(step int) *Admission {
+	g := c.graph
+	s := &Admission{
+		Step:           step,
+		Epoch:          c.fence.current(),
+		Partitions:     make(map[int]string),
+		Slots:          c.slots,
+		Routes:         make(map[string]int),
+		Direction:      atomic.LoadInt32(&c.direction),
+		Aggregates:     make(map[string]float64),
+		LastCheckpoint: c.lastCheckpoint,
+	}
+	for pid, w := range c.partitionMap() {
+		s.Partitions[pid] = w
+	}
+	g.routes.RLock()
+	for id, p := range g.routes.m {
+		s.Routes[id] = p
+	}
+	g.routes.RUnlock()
+	c.phase.RLock()
+	s.Phase = c.phase.name
+	c.phase.RUnlock()
+	g.globalStat.Lock()
+	for name, a := range g.globalStat.aggr {
+		if a, ok := a.(Aggregator); ok {
+			s.Aggregates[name] = a.Value()
+		}
+	}
+	g.globalStat.Unlock()
+	return s
+}
+
+// AdmitWorker takes a joiner into the job.  Every worker already in it calls,
+// only the first call does anything.
+func (c *Coordinator) AdmitWorker(s *Admission, r *int) error {
+	*r = 0
+	c.admitLock.Lock()
+	defer c.admitLock.Unlock()
+	if atomic.LoadInt32(&c.state) != JoinState {
+		return nil
+	}
+	c.timers.stop("join")
+	g := c.graph
+	var workers []string
+	for pid := 0; pid < len(s.Partitions); pid++ {
+		w := s.Partitions[pid]
+		c.partitionsLock.Lock()
+		c.partitions[pid] = w
+		c.partitionsLock.Unlock()
+		workers = append(workers, w)
+		if w == c.config.NodeId {
+			g.partitionId = pid
+		}
+	}
+	c.slots = s.Slots
+	for id, p := range s.Routes {
+		g.routes.set([]string{id}, p)
+	}
+	c.phase.Lock()
+	c.phase.name = s.Phase
+	c.phase.Unlock()
+	atomic.StoreInt32(&c.direction, s.Direction)
+	c.lastCheckpoint = s.LastCheckpoint
+	c.fence.advance(s.Epoch)
+	g.globalStat.Lock()
+	g.globalStat.step = s.Step
+	if g.globalStat.aggr == nil {
+		g.globalStat.aggr = make(map[string]interface{})
+	}
+	for name, v := range s.Aggregates {
+		g.globalStat.aggr[name] = &fixedAggregator{v}
+	}
+	g.globalStat.Unlock()
+	g.localStat.step = s.Step
+
+	c.clientsLock.Lock()
+	c.cachedWorkerInfo = make(map[string]map[string]interface{})
+	c.rpcClients = make(map[string]*rpc.Client)
+	c.clientsLock.Unlock()
+	for _, w := range workers {
+		if err := c.connect(w); err != nil {
+			c.fail(err)
+			return err
+		}
+	}
+	c.negotiate()
+	g.initPartitionState()
+	if c.config.HeartbeatInterval > 0 {
+		kill := make(chan byte, 1)
+		c.watchers["heartbeat"] = kill
+		go c.heartbeat(kill)
+	}
+	atomic.StoreInt32(&c.state, RunState)
+	c.log.Printf("Joined the job as partition %d after step %d", g.partitionId, s.Step)
+
+	// there's nothing to plan or load, go straight to computing
+	step := s.Step
+	go c.advance(stagePlan, func() {
+		c.advance(stageLoad, func() {
+			c.advance(stageCompute, func() {
+				name := "join-" + strconv.Itoa(step)
+				c.createBarrier(name, func(m *donut.SafeMap) {
+					c.onJoinBarrierChange(step, m)
+				})
+				c.enterBarrier(name, c.config.NodeId, "")
+			})
+		})
+	})
+	return nil
+}
+
+func (c *Coordinator) onJoinBarrierChange(step int, m *donut.SafeMap) {
+	if m.Len() != c.numPartitions() {
+		return
+	}
+	name := "join-" + strconv.Itoa(step)
+	if kill, ok := c.watchers[name]; ok {
+		kill <- 1
+		delete(c.watchers, name)
+	}
+	c.log.debugf("Join after step %d done", step)
+	go c.createStepWork(step + 1)
+}
+
+// the capabilities the job uses that a worker registered with info lacks
+func (caps capabilities) missing(info map[string]interface{}) []string {
+	theirs := infoCapabilities(info)
+	var r []string
+	for _, cap := range caps.list() {
+		if !theirs[cap] {
+			r = append(r, cap)
+		}
+	}
+	return r
+}
@@ -0,0 +1,92 @@
+package waffle
+
+import (
+	"sync"
+	"time"
+)
+
+// When several jobs run in the same process they can take turns computing
+// supersteps, weighted by Config.ShareWeight.  Each job is charged the time
+// its steps take divided by its weight and the job that has been charged the
+// least goes next, so a short interactive job gets its steps in between those
+// of a long batch job instead of waiting for it to finish.  Jobs without a
+// weight don't take part.
+
+type fairShare struct {
+	busy bool
+	// weighted compute time charged to each job
+	charged map[string]float64
+	waiting map[string]bool
+	// charge of the last job to get a turn, which is where newcomers start
+	clock float64
+	sync.Mutex
+	cond *sync.Cond
+}
+
+var shares = newFairShare()
+
+func newFairShare() *fairShare {
+	f := &fairShare{
+		charged: make(map[string]float64),
+		waiting: make(map[string]bool),
+	}
+	f.cond = sync.NewCond(&f.Mutex)
+	return f
+}
+
+func (f *fairShare) next() string {
+	var job string
+	for j := range f.waiting {
+		if job == "" || f.charged[j] < f.charged[job] || (f.charged[j] == f.charged[job] && j < job) {
+			job = j
+		}
+	}
+	return job
+}
+
+// acquire blocks until it is job's turn to compute
+func (f *fairShare) acquire(job string) {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.charged[job]; !ok {
+		f.charged[job] = f.clock
+	}
+	f.waiting[job] = true
+	for f.busy || f.next() != job {
+		f.cond.Wait()
+	}
+	delete(f.waiting, job)
+	f.busy = true
+	f.clock = f.charged[job]
+}
+
+func (f *fairShare) release(job string, spent time.Duration, weight float64) {
+	f.Lock()
+	defer f.Unlock()
+	f.charged[job] += spent.Seconds() / weight
+	f.busy = false
+	f.cond.Broadcast()
+}
+
+// forget a job that is done
+func (f *fairShare) remove(job string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.charged, job)
+}
+
+// compute under the fair share scheduler when the job has a weight
+func (g *Graph) computeShared() {
+	c := g.coordinator
+	if c.config.ShareWeight <= 0 {
+		g.compute()
+		return
+	}
+	job := c.config.namespace()
+	shares.acquire(job)
+	start := time.Now()
+	defer func() {
+		shares.release(job, time.Since(start), c.config.ShareWeight)
+	}()
+	g.compute()
+}
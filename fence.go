@@ -0,0 +1,71 @@
+package waffle
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Every piece of work carries the epoch it was created in.  The epoch is the
+// child version of the workers znode when the partition map was built, so it
+// moves forward whenever membership changes and every worker that saw the
+// same membership agrees on it.  Work from an older epoch, or step work we've
+// already run or that skips ahead, is refused so retries and redeliveries
+// can't run a step twice or out of order.
+type fence struct {
+	sync.Mutex
+	epoch    int64
+	lastStep int
+}
+
+var errStaleEpoch = errors.New("work is from a stale epoch")
+
+// returned for step work that has already been started in this epoch
+type duplicateStepError struct {
+	step  int
+	epoch int64
+}
+
+func (e *duplicateStepError) Error() string {
+	return fmt.Sprintf("step %d has already been run in epoch %d", e.step, e.epoch)
+}
+
+func (f *fence) current() int64 {
+	f.Lock()
+	defer f.Unlock()
+	return f.epoch
+}
+
+func (f *fence) advance(epoch int64) {
+	f.Lock()
+	defer f.Unlock()
+	if epoch > f.epoch {
+		f.epoch = epoch
+		f.lastStep = 0
+	}
+}
+
+func (f *fence) admit(work string, data map[string]interface{}) error {
+	f.Lock()
+	defer f.Unlock()
+	epoch, _ := data["epoch"].(float64)
+	if int64(epoch) < f.epoch {
+		return errStaleEpoch
+	}
+	if int64(epoch) > f.epoch {
+		f.epoch = int64(epoch)
+		f.lastStep = 0
+	}
+	if work != SuperstepWork {
+		return nil
+	}
+	step := int(data["step"].(float64))
+	if step <= f.lastStep {
+		return &duplicateStepError{step, f.epoch}
+	}
+	if f.lastStep > 0 && step != f.lastStep+1 {
+		return fmt.Errorf("step %d is out of order, last ran %d", step, f.lastStep)
+	}
+	f.lastStep = step
+	return nil
+}
@@ -0,0 +1,532 @@
+package waffle
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// FilePersister checkpoints a job to the filesystem, ready to embed in a job:
+// it provides Persist, the StatePersister and CheckpointDeleter methods, and
+// CheckpointLoader so a resumed job loads straight from its checkpoint.  Under
+// Dir every checkpoint gets a step directory with a part file per partition
+// (its vertices, edges and the messages waiting for the step), and a
+// manifest recording who wrote each part and its checksum.  Workers on more
+// than one machine need Dir on a filesystem they all see.  With Incremental
+// set most parts only hold what changed since the checkpoint before, see
+// delta.go.
+//
+//	Dir/STATE
+//	Dir/step-000012/MANIFEST
+//	Dir/step-000012/part-00000
+//	Dir/step-000012/part-00000.json
+type FilePersister struct {
+	Dir string
+	// write deltas against the previous checkpoint, with a full part every
+	// Compact checkpoints (8 when 0)
+	Incremental bool
+	Compact     int
+	chain       deltaChain
+}
+
+const (
+	checkpointManifest = "MANIFEST"
+	checkpointState    = "STATE"
+)
+
+// what a part holds, and where it came from
+type CheckpointPart struct {
+	Partition int
+	Worker    string
+	File      string
+	SHA256    string
+	Size      int64
+	Vertices  int
+	Edges     int
+	Messages  int
+	// for a delta, the step of the part it builds on and the number of
+	// vertices removed since
+	Base    int `json:",omitempty"`
+	Removed int `json:",omitempty"`
+	// the codec the file is compressed with, none when empty
+	Codec string `json:",omitempty"`
+}
+
+type CheckpointManifest struct {
+	JobId string
+	Step  int
+	Parts []CheckpointPart
+}
+
+// Jobs that implement CheckpointLoader are resumed by loading the parts of
+// their last checkpoint instead of their LoadPaths.
+type CheckpointLoader interface {
+	CheckpointPaths(step int) ([]string, error)
+	LoadCheckpoint(path string) ([]Vertex, []Edge, []Message, error)
+}
+
+func (p *FilePersister) stepDir(step int) string {
+	return filepath.Join(p.Dir, fmt.Sprintf("step-%06d", step))
+}
+
+// write the file under a temporary name and rename it into place
+func writeFileAtomic(name string, b []byte) error {
+	if err := os.WriteFile(name+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// the manifest entry for this partition's part of the checkpoint for the
+// step about to run, and the messages waiting for it
+func newCheckpointPart(g *Graph) (CheckpointPart, []Message) {
+	step := g.Superstep() + 1
+	part := CheckpointPart{
+		Partition: g.partitionId,
+		Worker:    g.coordinator.config.NodeId,
+		File:      resultPart(g.partitionId),
+		Vertices:  g.vertexCount(),
+	}
+	for _, edges := range g.edges {
+		part.Edges += len(edges)
+	}
+	g.inboxLock.Lock()
+	var msgs []Message
+	for _, queued := range g.inbox[step] {
+		msgs = append(msgs, queued...)
+	}
+	g.inboxLock.Unlock()
+	part.Messages = len(msgs)
+	return part, msgs
+}
+
+// write the part, its vertices, edges and msgs to w.  A delta only has the
+// vertices and edges of the ids in only, and the removed ids last.
+func encodeCheckpointPart(w io.Writer, g *Graph, part *CheckpointPart, msgs []Message, only map[string]bool, removed []string) error {
+	enc := gob.NewEncoder(w)
+	if err := enc.Encode(part); err != nil {
+		return err
+	}
+	var encErr error
+	g.EachVertex(func(v Vertex) {
+		if encErr == nil && (only == nil || only[v.Id()]) {
+			encErr = enc.Encode(&v)
+		}
+	})
+	if encErr != nil {
+		return encErr
+	}
+	for src, edges := range g.edges {
+		if only != nil && !only[src] {
+			continue
+		}
+		for _, e := range edges {
+			if err := enc.Encode(&e); err != nil {
+				return err
+			}
+		}
+	}
+	for _, m := range msgs {
+		if err := enc.Encode(&m); err != nil {
+			return err
+		}
+	}
+	for _, id := range removed {
+		if err := enc.Encode(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write the part to w like encodeCheckpointPart, compressed with the
+// checkpoint codec.  A StreamCodec compresses the part as it's encoded,
+// with any other codec it's encoded in memory first.
+func writeCheckpointPart(w io.Writer, g *Graph, part *CheckpointPart, msgs []Message, only map[string]bool, removed []string) error {
+	codec := g.Codec(CodecCheckpoints)
+	if codec.Name() == "none" {
+		return encodeCheckpointPart(w, g, part, msgs, only, removed)
+	}
+	part.Codec = codec.Name()
+	cw, err := streamWriter(codec, w)
+	if err != nil {
+		return fmt.Errorf("could not compress with %s: %v", part.Codec, err)
+	}
+	if cw != nil {
+		if err := encodeCheckpointPart(cw, g, part, msgs, only, removed); err != nil {
+			cw.Close()
+			return err
+		}
+		return cw.Close()
+	}
+	// codecs that only do whole blocks get the part in one piece
+	var buf bytes.Buffer
+	if err := encodeCheckpointPart(&buf, g, part, msgs, only, removed); err != nil {
+		return err
+	}
+	b, err := codec.Compress(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("could not compress with %s: %v", part.Codec, err)
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// Persist writes this partition's part of the checkpoint for the step about
+// to run.
+func (p *FilePersister) Persist(g *Graph) error {
+	step := g.Superstep() + 1
+	dir := p.stepDir(step)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	part, msgs := newCheckpointPart(g)
+	var only map[string]bool
+	var removed []string
+	var sums map[string]uint64
+	if p.Incremental {
+		only, removed, sums = p.chain.plan(g, step, p.Compact, &part)
+	}
+	name := filepath.Join(dir, part.File)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	if err := writeCheckpointPart(w, g, &part, msgs, only, removed); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	part.Size = fi.Size()
+	part.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if err := g.ReserveDisk(DiskCheckpoints, part.Size); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(&part)
+	if err := writeFileAtomic(name+".json", b); err != nil {
+		return err
+	}
+	if p.Incremental {
+		p.chain.wrote(g.partitionId, step, only == nil, sums)
+	}
+	return nil
+}
+
+func (p *FilePersister) checkpointCommitted(g *Graph, step int) {
+	for _, s := range p.chain.commit(step) {
+		if err := p.deleteCheckpoint(g, s); err != nil {
+			log.Printf("Could not delete checkpoint for step %d: %v", s, err)
+		}
+	}
+}
+
+// PersistState saves the job state, and once a checkpoint has every part in
+// place writes its manifest.
+func (p *FilePersister) PersistState(s *JobState) error {
+	if err := os.MkdirAll(p.Dir, 0755); err != nil {
+		return err
+	}
+	if s.Checkpoint > 0 {
+		if err := p.commitManifest(s); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(p.Dir, checkpointState), b)
+}
+
+func (p *FilePersister) commitManifest(s *JobState) error {
+	dir := p.stepDir(s.Checkpoint)
+	if _, err := os.Stat(filepath.Join(dir, checkpointManifest)); err == nil {
+		return nil
+	}
+	m, err := collectManifest(s, func(file string) ([]byte, error) {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			err = fmt.Errorf("is %s shared by every worker? %v", p.Dir, err)
+		}
+		return b, err
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, checkpointManifest), b); err != nil {
+		return err
+	}
+	removed, err := removeStaging(dir)
+	if err != nil {
+		log.Printf("Could not clean up the checkpoint at step %d: %v", s.Checkpoint, err)
+	}
+	for _, f := range removed {
+		log.Printf("Removed stale checkpoint file %s", f)
+	}
+	return nil
+}
+
+// build the manifest of the checkpoint in s from the sidecars read returns
+func collectManifest(s *JobState, read func(file string) ([]byte, error)) (*CheckpointManifest, error) {
+	m := &CheckpointManifest{JobId: s.JobId, Step: s.Checkpoint}
+	for pid := 0; pid < len(s.Partitions); pid++ {
+		b, err := read(resultPart(pid) + ".json")
+		if err != nil {
+			return nil, fmt.Errorf("checkpoint at step %d is missing partition %d: %v", s.Checkpoint, pid, err)
+		}
+		var part CheckpointPart
+		if err := json.Unmarshal(b, &part); err != nil {
+			return nil, err
+		}
+		m.Parts = append(m.Parts, part)
+	}
+	return m, nil
+}
+
+// LoadState loads the last saved job state, nil if there is none.
+func (p *FilePersister) LoadState(namespace string) (*JobState, error) {
+	b, err := os.ReadFile(filepath.Join(p.Dir, checkpointState))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s JobState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if s.namespace() != namespace {
+		return nil, fmt.Errorf("%s holds the state of job %s, not %s", p.Dir, s.namespace(), namespace)
+	}
+	return &s, nil
+}
+
+// DeleteCheckpoint removes this partition's part of the checkpoint at step,
+// the first partition takes the manifest with it.  Incremental parts that
+// later ones still build on stay until the next full part.
+func (p *FilePersister) DeleteCheckpoint(g *Graph, step int) error {
+	if p.Incremental && p.chain.hold(step) {
+		return nil
+	}
+	return p.deleteCheckpoint(g, step)
+}
+
+func (p *FilePersister) deleteCheckpoint(g *Graph, step int) error {
+	dir := p.stepDir(step)
+	name := filepath.Join(dir, resultPart(g.partitionId))
+	if fi, err := os.Stat(name); err == nil {
+		g.ReleaseDisk(DiskCheckpoints, fi.Size())
+	}
+	for _, f := range []string{name, name + ".json"} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if g.partitionId == 0 {
+		os.Remove(filepath.Join(dir, checkpointManifest))
+	}
+	// only goes once the directory is empty
+	os.Remove(dir)
+	return nil
+}
+
+func (p *FilePersister) manifest(dir string) (*CheckpointManifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, checkpointManifest))
+	if err != nil {
+		return nil, err
+	}
+	var m CheckpointManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("bad checkpoint manifest in %s: %v", dir, err)
+	}
+	return &m, nil
+}
+
+// CheckpointPaths lists the parts of the checkpoint at step.
+func (p *FilePersister) CheckpointPaths(step int) ([]string, error) {
+	dir := p.stepDir(step)
+	m, err := p.manifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint at step %d is incomplete: %v", step, err)
+	}
+	var paths []string
+	for _, part := range m.Parts {
+		paths = append(paths, filepath.Join(dir, part.File))
+	}
+	return paths, nil
+}
+
+// LoadCheckpoint reads a checkpoint part, checking it against the manifest,
+// and replays the parts it builds on when it is a delta.
+func (p *FilePersister) LoadCheckpoint(path string) ([]Vertex, []Edge, []Message, error) {
+	m, err := p.manifest(filepath.Dir(path))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return replayCheckpoint(m.Step, filepath.Base(path), func(step int, file string) (*CheckpointManifest, string, []byte, error) {
+		dir := p.stepDir(step)
+		m, err := p.manifest(dir)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		path := filepath.Join(dir, file)
+		b, err := os.ReadFile(path)
+		return m, path, b, err
+	})
+}
+
+// check the part file at path against its manifest and decode it
+func decodeCheckpointPart(m *CheckpointManifest, path, file string, b []byte) (*checkpointData, error) {
+	var want *CheckpointPart
+	for i := range m.Parts {
+		if m.Parts[i].File == file {
+			want = &m.Parts[i]
+		}
+	}
+	if want == nil {
+		return nil, fmt.Errorf("%s is not in its checkpoint's manifest", path)
+	}
+	sum := sha256.Sum256(b)
+	if hex.EncodeToString(sum[:]) != want.SHA256 {
+		return nil, fmt.Errorf("%s doesn't match its checksum", path)
+	}
+	if want.Codec != "" {
+		codec, err := lookupCodec(want.Codec)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if b, err = codec.Decompress(b); err != nil {
+			return nil, fmt.Errorf("could not decompress %s: %v", path, err)
+		}
+	}
+	dec := gob.NewDecoder(bytes.NewReader(b))
+	var part CheckpointPart
+	if err := dec.Decode(&part); err != nil {
+		return nil, err
+	}
+	d := &checkpointData{part: part}
+	vertices := make([]Vertex, 0, part.Vertices)
+	for i := 0; i < part.Vertices; i++ {
+		var v Vertex
+		if err := dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		vertices = append(vertices, v)
+	}
+	edges := make([]Edge, 0, part.Edges)
+	for i := 0; i < part.Edges; i++ {
+		var e Edge
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		edges = append(edges, e)
+	}
+	msgs := make([]Message, 0, part.Messages)
+	for i := 0; i < part.Messages; i++ {
+		var msg Message
+		if err := dec.Decode(&msg); err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, msg)
+	}
+	for i := 0; i < part.Removed; i++ {
+		var id string
+		if err := dec.Decode(&id); err != nil {
+			return nil, err
+		}
+		d.removed = append(d.removed, id)
+	}
+	d.vertices, d.edges, d.msgs = vertices, edges, msgs
+	return d, nil
+}
+
+// whether this run loads a checkpoint rather than the job's input
+func (c *Coordinator) fromCheckpoint() bool {
+	_, ok := c.graph.job.(CheckpointLoader)
+	return ok && c.resume != nil && c.resume.Checkpoint > 0
+}
+
+// the paths to load, the parts of the checkpoint when resuming from one
+func (c *Coordinator) loadPaths() []string {
+	if c.paths != nil {
+		return c.paths
+	}
+	if c.fromCheckpoint() {
+		paths, err := c.graph.job.(CheckpointLoader).CheckpointPaths(c.resume.Checkpoint)
+		if err != nil {
+			c.fail(fmt.Errorf("could not resume: %v", err))
+			return nil
+		}
+		c.paths = paths
+	} else {
+		c.paths = c.graph.job.LoadPaths()
+	}
+	return c.paths
+}
+
+// load a checkpoint part, sending its messages on for step
+func (g *Graph) loadCheckpoint(path string, step int) error {
+	vertices, edges, msgs, err := g.job.(CheckpointLoader).LoadCheckpoint(path)
+	if err != nil {
+		return fmt.Errorf("could not load checkpoint %s: %v", path, err)
+	}
+	upgraded := 0
+	for _, v := range vertices {
+		v, ok, err := upgradeVertex(v)
+		if err != nil {
+			return fmt.Errorf("could not load checkpoint %s: %v", path, err)
+		}
+		if ok {
+			upgraded++
+		}
+		g.addVertex(v)
+	}
+	if upgraded > 0 {
+		g.log.Printf("Upgraded %d vertices from %s", upgraded, path)
+	}
+	for _, e := range edges {
+		g.addEdge(e)
+	}
+	if err := g.addInEdges(edges); err != nil {
+		return fmt.Errorf("could not send the in-edges from %s: %v", path, err)
+	}
+	for _, m := range msgs {
+		g.addMessage(m, step)
+	}
+	// the messages have to be delivered before we say the load is done
+	c := g.coordinator
+	c.flushSpills()
+	c.flushBatches()
+	if sent, acked, err := c.outbox.drain(); err != nil {
+		return fmt.Errorf("could not deliver %d of %d checkpointed messages: %v", sent-acked, sent, err)
+	}
+	g.log.Printf("done loading checkpoint %s", path)
+	return nil
+}
@@ -0,0 +1,75 @@
+package waffle
+
+import (
+	"sync"
+)
+
+// FrontierStat describes the vertices that computed in a step: how many, how
+// many of them computed for the first time, and how many came back after
+// sitting out at least one step.  Growth is the frontier over the last one.
+type FrontierStat struct {
+	Step        int
+	Frontier    int
+	New         int
+	Reactivated int
+	Growth      float64
+	// vertices put in the frontier with MarkFrontier
+	Marked int
+}
+
+// frontierTracker remembers the last step each vertex computed in, to tell
+// new and reactivated vertices apart.  Only touched from compute.
+type frontierTracker struct {
+	last                         map[string]int
+	computed, fresh, reactivated int
+}
+
+func (f *frontierTracker) note(id string, step int) {
+	if f.last == nil {
+		f.last = make(map[string]int)
+	}
+	f.computed++
+	if prev, ok := f.last[id]; !ok {
+		f.fresh++
+	} else if prev < step-1 {
+		f.reactivated++
+	}
+	f.last[id] = step
+}
+
+// this step's counts for the step summary, starting over for the next
+func (f *frontierTracker) take(stepData map[string]interface{}) {
+	stepData["frontier"] = f.computed
+	stepData["frontierNew"] = f.fresh
+	stepData["frontierReactivated"] = f.reactivated
+	f.computed, f.fresh, f.reactivated = 0, 0, 0
+}
+
+// the cluster's frontier history, built at the step barriers
+type frontierHistory struct {
+	steps []FrontierStat
+	sync.Mutex
+}
+
+func (h *frontierHistory) collect(step int, total map[string]interface{}) FrontierStat {
+	s := FrontierStat{
+		Step:        step,
+		Frontier:    summaryInt(total, "frontier"),
+		New:         summaryInt(total, "frontierNew"),
+		Reactivated: summaryInt(total, "frontierReactivated"),
+		Marked:      summaryInt(total, "frontierMarked"),
+	}
+	h.Lock()
+	defer h.Unlock()
+	if n := len(h.steps); n > 0 && h.steps[n-1].Frontier > 0 {
+		s.Growth = float64(s.Frontier) / float64(h.steps[n-1].Frontier)
+	}
+	h.steps = append(h.steps, s)
+	return s
+}
+
+func (h *frontierHistory) list() []FrontierStat {
+	h.Lock()
+	defer h.Unlock()
+	return append([]FrontierStat(nil), h.steps...)
+}
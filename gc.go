@@ -0,0 +1,40 @@
+package waffle
+
+import (
+	"log"
+	"runtime"
+	"runtime/debug"
+	"time"
+)
+
+// Set up the garbage collector from the config.  With a memory budget the
+// runtime is allowed to grow the heap up to the budget before collecting
+// harder, which keeps collections down while big message batches are in
+// flight.
+func tuneGC(c *Config) {
+	if c.GCPercent != 0 {
+		old := debug.SetGCPercent(c.GCPercent)
+		log.Printf("GOGC set to %d (was %d)", c.GCPercent, old)
+	}
+	if c.MemoryBudget > 0 {
+		debug.SetMemoryLimit(c.MemoryBudget)
+		log.Printf("Memory limit set to %d bytes", c.MemoryBudget)
+	}
+}
+
+type gcSample struct {
+	pauseNs uint64
+	numGC   uint32
+}
+
+func sampleGC() gcSample {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return gcSample{pauseNs: m.PauseTotalNs, numGC: m.NumGC}
+}
+
+// pause time and number of collections since s was taken
+func (s gcSample) since() (time.Duration, int) {
+	now := sampleGC()
+	return time.Duration(now.pauseNs - s.pauseNs), int(now.numGC - s.numGC)
+}
@@ -1,13 +1,22 @@
 package waffle
 
 import (
-	"log"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 )
 
 type stepStat struct {
 	step         int
 	active, msgs int
-	aggr         map[string]interface{}
+	// aggregators by name, this worker's during a step and the reduced ones
+	// after the barrier
+	aggr map[string]interface{}
+	// named stats reported by jobs, counters are summed across workers and
+	// gauges take the largest value
+	counters, gauges map[string]float64
+	sync.Mutex
 }
 
 func (s *stepStat) reset() {
@@ -15,6 +24,8 @@ func (s *stepStat) reset() {
 	s.active = 0
 	s.msgs = 0
 	s.aggr = make(map[string]interface{})
+	s.counters = make(map[string]float64)
+	s.gauges = make(map[string]float64)
 }
 
 type Vertex interface {
@@ -38,49 +49,134 @@ type Graph struct {
 
 	// need to point back to the coordinator so we can send things
 	coordinator *Coordinator
+	log         *logger
 
 	vertices map[string]Vertex
 	edges    map[string][]Edge
-	messages map[string][]Message
+	// messages being delivered in the current step.  Anything sent to us
+	// lands in the inbox under the step it is meant for and gets swapped in
+	// when that step starts, so messages from peers that are already a step
+	// ahead can't leak into this one.
+	messages  map[string][]Message
+	inbox     map[int]map[string][]Message
+	inboxLock sync.Mutex
 
 	// information about the last step
 	localStat  *stepStat
 	globalStat *stepStat
+
+	mirrors *mirrorCache
+	// set up by PartitionStateJob jobs
+	partitionState interface{}
+	// filters of the messages sent this step, by destination partition
+	dedup map[int]*bloom
+
+	snap       *Snapshot
+	snapWanted bool
+	snapLock   sync.Mutex
+	snapCond   *sync.Cond
+	// pages of the partition changed since the last snapshot was cut
+	dirty [snapshotPages]int32
+
+	// set when the job writes its results with WriteResults or a
+	// ResultWriter, the first directory written and the format of each
+	resultDir     string
+	resultFormats map[string]string
+	// vertices that ran past Config.VertexTimeout
+	slow slowVertices
+	// remote messages waiting to be combined
+	outq map[combineKey][]Message
+	// set while computing when Config.Profile is on
+	prof *stepProfile
+	// this step's vector aggregators, and the cluster sums from the last
+	vectors           map[string]Vector
+	aggregatedVectors map[string]Vector
+	// for SampleEdges
+	rng *rand.Rand
+	// vertices over Config.ResidentVertices
+	cold *coldStore
+	// vertices and edges added while running, they join the graph at the
+	// start of the next step
+	added      []Vertex
+	addedEdges []Edge
+	// edges that came with migrated vertices, their in-edges are in place
+	movedEdges []Edge
+	addedLock  sync.Mutex
+	// who computed this step
+	frontier frontierTracker
+	// sources of edges into our vertices, with Config.InEdges
+	in inEdges
+	// vertices marked as the frontier by step, and whether this step pulls
+	marked  markedFrontier
+	pulling bool
+	pullSet map[string]bool
+	// vertices moved off their partitioner's choice by rebalancing
+	routes routes
+	// with Config.CheckDeterminism
+	determinism determinismCheck
+	// this step's Timers
+	timers     map[string]*Timer
+	timersLock sync.Mutex
+	// last reading for MemoryPressure
+	pressure memoryPressure
+	// vertices and edges removed while running
+	removed removals
+	// edge values set while running
+	updates edgeUpdates
+	// mutations asked for by the vertex computing
+	quota mutationQuota
+	// steps in a row with nothing to do, and whether that got us evicted
+	idleSteps int
+	evicted   bool
 }
 
 func newGraph(j Job, c *Coordinator) *Graph {
-	return &Graph{
+	g := &Graph{
 		vertices:    make(map[string]Vertex),
 		edges:       make(map[string][]Edge),
 		messages:    make(map[string][]Message),
+		inbox:       make(map[int]map[string][]Message),
+		dedup:       make(map[int]*bloom),
+		outq:        make(map[combineKey][]Message),
+		vectors:     make(map[string]Vector),
 		job:         j,
 		coordinator: c,
+		log:         c.log,
 		localStat:   &stepStat{},
 		globalStat:  &stepStat{},
+		mirrors:     newMirrorCache(c.config.MirrorThreshold, c.config.MirrorLimit, c.log),
 	}
+	g.snapCond = sync.NewCond(&g.snapLock)
+	return g
 }
 
 func (g *Graph) setStepStats(active, msgs int, aggr map[string]interface{}) {
+	g.globalStat.Lock()
+	defer g.globalStat.Unlock()
 	g.globalStat.active = active
 	g.globalStat.msgs = msgs
 	g.globalStat.aggr = aggr
 }
 
-func (g *Graph) Load(path string) {
+func (g *Graph) Load(path string) error {
 	vertices, edges, err := g.job.Load(path)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("could not load %s: %v", path, err)
 	}
 
-	log.Printf("adding verts from %s", path)
+	g.log.debugf("adding verts from %s", path)
 	for _, v := range vertices {
 		g.addVertex(v)
 	}
-	log.Printf("adding edges from %s", path)
+	g.log.debugf("adding edges from %s", path)
 	for _, e := range edges {
 		g.addEdge(e)
 	}
-	log.Printf("done adding verts and edges from %s", path)
+	if err := g.addInEdges(edges); err != nil {
+		return fmt.Errorf("could not send the in-edges from %s: %v", path, err)
+	}
+	g.log.Printf("done adding verts and edges from %s", path)
+	return nil
 }
 
 func (g *Graph) sendVertex(v Vertex, p int) error {
@@ -90,13 +186,23 @@ func (g *Graph) sendVertex(v Vertex, p int) error {
 func (g *Graph) addVertex(v Vertex) {
 	if p := g.determinePartition(v.Id()); p != g.partitionId {
 		if e := g.sendVertex(v, p); e != nil {
-			log.Panicln(e)
+			g.coordinator.fail(fmt.Errorf("could not send vertex %s to partition %d: %v", v.Id(), p, e))
 		}
 		return
 	}
-	g.vertices[v.Id()] = v
+	if g.running() {
+		g.addedLock.Lock()
+		g.added = append(g.added, v)
+		g.addedLock.Unlock()
+		return
+	}
+	g.putVertex(v)
 }
 
+// Vertices returns the vertices of the partition that are in memory.
+//
+// Deprecated: with Config.ResidentVertices set it misses the ones on disk,
+// use EachVertex.
 func (g *Graph) Vertices() map[string]Vertex {
 	return g.vertices
 }
@@ -115,83 +221,327 @@ func (g *Graph) sendEdge(e Edge, p int) error {
 
 func (g *Graph) addEdge(e Edge) {
 	if p := g.determinePartition(e.Source()); p != g.partitionId {
-		if e := g.sendEdge(e, p); e != nil {
-			log.Panicln(e)
+		if err := g.sendEdge(e, p); err != nil {
+			g.coordinator.fail(fmt.Errorf("could not send an edge of %s to partition %d: %v", e.Source(), p, err))
 		}
 		return
 	}
+	if g.running() {
+		g.addedLock.Lock()
+		g.addedEdges = append(g.addedEdges, e)
+		g.addedLock.Unlock()
+		return
+	}
+	g.edges[e.Source()] = append(g.edges[e.Source()], e)
+}
+
+// add an edge that moved here with its source
+func (g *Graph) moveEdge(e Edge) {
+	if g.running() {
+		g.addedLock.Lock()
+		g.movedEdges = append(g.movedEdges, e)
+		g.addedLock.Unlock()
+		return
+	}
 	g.edges[e.Source()] = append(g.edges[e.Source()], e)
 }
 
-func (g *Graph) sendMessage(m Message, p int) error {
-	return g.coordinator.sendMessage(m, p)
+// the graph can't be changed in place once steps are running
+func (g *Graph) running() bool {
+	return atomic.LoadInt32(&g.coordinator.state) == RunState
 }
 
-func (g *Graph) addMessage(m Message) {
+// add the vertices and edges from the last step
+func (g *Graph) applyAdded() {
+	g.addedLock.Lock()
+	added, edges, moved := g.added, g.addedEdges, g.movedEdges
+	g.added, g.addedEdges, g.movedEdges = nil, nil, nil
+	g.addedLock.Unlock()
+	for _, v := range added {
+		g.putVertex(v)
+	}
+	for _, e := range append(edges, moved...) {
+		g.edges[e.Source()] = append(g.edges[e.Source()], e)
+	}
+	if err := g.addInEdges(edges); err != nil {
+		g.coordinator.fail(fmt.Errorf("could not send the in-edges of %d added edges: %v", len(edges), err))
+	}
+	if len(added)+len(edges) > 0 {
+		g.log.debugf("added %d vertices and %d edges", len(added), len(edges))
+	}
+}
+
+func (g *Graph) sendMessage(m Message, p, step int) error {
+	return g.coordinator.sendMessage(m, p, step)
+}
+
+// add a message to be delivered in step
+func (g *Graph) addMessage(m Message, step int) {
+	if g.prof != nil {
+		if t, ok := g.prof.send.start(); ok {
+			defer g.prof.send.stop(t)
+		}
+	}
 	if p := g.determinePartition(m.Destination()); p != g.partitionId {
-		if e := g.sendMessage(m, p); e != nil {
-			log.Panicln(e)
+		if step == g.localStat.step+1 && g.holdMessage(m) {
+			g.mirrors.noteRemote(m.Destination())
+			return
 		}
+		g.sendRemote(m, p, step)
+		g.mirrors.noteRemote(m.Destination())
 		return
 	}
-	g.messages[m.Destination()] = append(g.messages[m.Destination()], m)
+	g.inboxLock.Lock()
+	defer g.inboxLock.Unlock()
+	q, ok := g.inbox[step]
+	if !ok {
+		q = make(map[string][]Message)
+		g.inbox[step] = q
+	}
+	q[m.Destination()] = append(q[m.Destination()], m)
+}
+
+func (g *Graph) sendRemote(m Message, p, step int) {
+	if e := g.sendMessage(m, p, step); e == errQuarantined {
+		// the rest of the cluster has moved on without us
+		return
+	} else if e != nil {
+		g.coordinator.fail(fmt.Errorf("could not send a message to partition %d: %v", p, e))
+	}
+}
+
+// number of messages waiting in the inbox for future steps
+func (g *Graph) inboxDepth() (n int) {
+	g.inboxLock.Lock()
+	defer g.inboxLock.Unlock()
+	for _, q := range g.inbox {
+		for _, msgs := range q {
+			n += len(msgs)
+		}
+	}
+	return
+}
+
+// swap in the messages for step, dropping the ones from the last step
+func (g *Graph) cycleMessages(step int) {
+	g.inboxLock.Lock()
+	defer g.inboxLock.Unlock()
+	if q, ok := g.inbox[step]; ok {
+		g.messages = q
+		delete(g.inbox, step)
+	} else {
+		g.messages = make(map[string][]Message)
+	}
 }
 
 // TODO: implement
 func (g *Graph) determinePartition(id string) int {
-	sum := 0
-	for _, c := range id {
-		sum += int(c)
+	if p, ok := g.routes.get(id); ok {
+		return p
+	}
+	c := g.coordinator
+	if c.slots != nil {
+		return c.slots[c.config.partitioner().PartitionOf(id, len(c.slots))]
 	}
-	return sum % g.coordinator.workers.Len()
+	return c.config.partitioner().PartitionOf(id, c.numPartitions())
 }
 
 // this can only happen during compute()
 func (g *Graph) SendMessage(msg Message) {
-	// TODO: send stuff
-	g.addMessage(msg)
+	if g.captureMessage(msg) {
+		return
+	}
+	if g.duplicate(msg, g.determinePartition(msg.Destination())) {
+		g.Count("msgs.suppressed", 1)
+		return
+	}
+	g.addMessage(msg, g.localStat.step+1)
 	g.localStat.msgs++
 }
 
+// Mirror returns a read-only copy of the remote vertex id as it stood at the
+// end of the previous superstep.  Only remote vertices that this partition
+// sends at least Config.MirrorThreshold messages to in a step get mirrored, so
+// callers must be prepared to fall back to messaging.
+func (g *Graph) Mirror(id string) (Vertex, bool) {
+	return g.mirrors.get(id)
+}
+
+// record a hot vertex reported at the step barrier.  mine is set when this
+// worker is the one that asked for it.
+func (g *Graph) noteHot(id string, mine bool, step int) {
+	if p := g.determinePartition(id); p == g.partitionId {
+		g.mirrors.markHot(id, step, g.vertex)
+	} else if mine {
+		g.mirrors.want(id, p, step)
+	}
+}
+
+func (g *Graph) refreshMirrors(step int) {
+	wanted := g.mirrors.wantedIds()
+	// before they are replaced, since they've been through a step of compute
+	// since they came
+	if g.verifyingMirrors(step) {
+		for pid, ids := range wanted {
+			g.verifyMirrors(pid, ids)
+		}
+	}
+	for pid, ids := range wanted {
+		vertices, err := g.coordinator.fetchMirrors(pid, step, ids)
+		if err != nil {
+			g.log.Printf("Could not refresh mirrors from partition %d: %v", pid, err)
+			continue
+		}
+		g.mirrors.update(step, vertices)
+	}
+}
+
+// Count adds delta to the named counter for this step.  Counters are summed
+// across all workers at the step barrier.
+func (g *Graph) Count(name string, delta float64) {
+	if g.shadowing() {
+		return
+	}
+	g.localStat.Lock()
+	defer g.localStat.Unlock()
+	g.localStat.counters[name] += delta
+}
+
+// Gauge sets the named gauge for this step.  The cluster wide value of a
+// gauge is the largest one reported by any worker.
+func (g *Graph) Gauge(name string, value float64) {
+	if g.shadowing() {
+		return
+	}
+	g.localStat.Lock()
+	defer g.localStat.Unlock()
+	g.localStat.gauges[name] = value
+}
+
+// Stat returns the cluster wide value of a counter or gauge from the last
+// completed step.
+func (g *Graph) Stat(name string) (float64, bool) {
+	g.globalStat.Lock()
+	defer g.globalStat.Unlock()
+	if v, ok := g.globalStat.counters[name]; ok {
+		return v, true
+	}
+	v, ok := g.globalStat.gauges[name]
+	return v, ok
+}
+
 func (g *Graph) Superstep() int {
 	return g.localStat.step
 }
 
-func (g *Graph) runSuperstep(step int) (int, int, map[string]interface{}) {
+func (g *Graph) runSuperstep(step int) (int, int, map[string]interface{}, error) {
 	if step != g.globalStat.step+1 {
-		panic("bad step")
+		return 0, 0, nil, fmt.Errorf("asked for step %d after step %d", step, g.globalStat.step)
 	}
 
 	if g.job.Checkpoint(step) {
 		if err := g.job.Persist(g); err != nil {
-			panic(err)
+			return 0, 0, nil, fmt.Errorf("could not checkpoint step %d: %v", step, err)
+		}
+		if err := g.checkpointPartitionState(step); err != nil {
+			return 0, 0, nil, fmt.Errorf("could not checkpoint step %d: %v", step, err)
 		}
 	}
 
+	active := g.localStat.active
+	g.localStat.reset()
 	g.localStat.step = step
-	g.localStat.active = 0
-	g.localStat.msgs = 0
-	g.localStat.aggr = make(map[string]interface{})
+	g.sampleDeterminism(step)
+	g.cycleMessages(step)
+	if step > 1 {
+		g.checkIdle(step, active)
+	}
+	g.dedup = make(map[int]*bloom)
+
+	if g.mirrors.enabled() && step > 1 {
+		g.refreshMirrors(step - 1)
+	}
+	if step > 1 {
+		if err := g.pullVectors(step - 1); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	if err := g.preparePull(step); err != nil {
+		return 0, 0, nil, err
+	}
+
+	g.log.debugf("Ready to compute for step %d", step)
+	g.startProfile()
+	g.computeShared()
+	g.flushCombined(step + 1)
+	g.endProfile()
+	g.log.debugf("Done with computation for step %d", step)
 
-	log.Printf("Ready to compute for step %d", step)
-	g.compute()
-	log.Printf("Done with computation for step %d", step)
+	if g.mirrors.enabled() {
+		g.mirrors.publish(step, g.vertex)
+	}
+	g.cutSnapshot(step)
 
-	return g.localStat.active, g.localStat.msgs, g.localStat.aggr
+	return g.localStat.active, g.localStat.msgs, g.localStat.aggr, nil
 }
 
 func (g *Graph) compute() {
-	log.Printf("Computing for %d vertices", len(g.vertices))
+	g.applyRemoved()
+	g.applyAdded()
+	g.applyEdgeUpdates()
+	g.log.debugf("Computing for %d vertices", len(g.vertices))
+	if j, ok := g.job.(BulkFloatJob); ok {
+		g.applyFloats(j)
+	}
+	// vertices with messages go in weighted turns by class
+	first := g.prioritize()
+	done := make(map[string]bool)
+	for _, id := range first {
+		if v, ok := g.vertices[id]; ok {
+			g.computeVertex(v)
+			done[id] = true
+		}
+	}
 	for _, v := range g.vertices {
-		if msgs, ok := g.messages[v.Id()]; ok || v.Active() {
-			if msgs == nil {
-				msgs = make([]Message, 0)
-			}
-			v.Compute(g, msgs)
+		if !done[v.Id()] {
+			g.computeVertex(v)
+		}
+	}
+	g.computeCold()
+}
+
+func (g *Graph) computeVertex(v Vertex) {
+	var from []string
+	if _, ok := v.(PullVertex); ok && g.pulling {
+		from = g.pulledFrom(v.Id())
+	}
+	if msgs, ok := g.messages[v.Id()]; ok || v.Active() || len(from) > 0 {
+		if msgs == nil {
+			msgs = make([]Message, 0)
 		}
-		if v.Active() {
-			g.localStat.active++
+		g.touch(v.Id())
+		g.frontier.note(v.Id(), g.localStat.step)
+		g.reactivate(v, msgs)
+		g.quota.begin(v.Id())
+		if g.determinism.sampled {
+			g.checkDeterminism(v, msgs, from)
+		} else {
+			g.runCompute(v, msgs, from)
 		}
+		g.quota.end()
+	}
+	if v.Active() {
+		g.localStat.active++
+	}
+}
+
+func (g *Graph) runCompute(v Vertex, msgs []Message, from []string) {
+	if pv, ok := v.(PullVertex); ok && g.pulling {
+		pv.ComputePull(g, msgs, from)
+	} else if timeout := g.coordinator.config.VertexTimeout; timeout > 0 {
+		g.computeWithDeadline(v, msgs, timeout)
+	} else {
+		v.Compute(g, msgs)
 	}
 }
 
@@ -200,5 +550,7 @@ func (g *Graph) Write() error {
 }
 
 func (g *Graph) information() map[string]interface{} {
-	return make(map[string]interface{})
+	info := make(map[string]interface{})
+	info["slowVertices"] = g.slow.information()
+	return info
 }
@@ -0,0 +1,100 @@
+package waffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Summary groups keep the step barrier from growing with the cluster.  The
+// workers are split by partition id into groups of Config.SummaryGroupSize
+// and only the group leaders enter the step barrier, carrying a condensed
+// summary for their whole group.
+
+func (c *Coordinator) barrierSize() int {
+	size := c.config.SummaryGroupSize
+	if size <= 0 {
+		// by the partition map rather than who is registered, so a drained
+		// worker on its way out doesn't hold up the barrier
+		return c.numPartitions()
+	}
+	return (c.numPartitions() + size - 1) / size
+}
+
+func (c *Coordinator) groupOf(node string) int {
+	for pid, w := range c.partitionMap() {
+		if w == node {
+			return pid / c.config.SummaryGroupSize
+		}
+	}
+	c.log.Panicf("%s is not in the partition map", node)
+	return -1
+}
+
+func (c *Coordinator) groupLeader(group int) string {
+	return c.worker(group * c.config.SummaryGroupSize)
+}
+
+func (c *Coordinator) groupMembers(group int) int {
+	size := c.config.SummaryGroupSize
+	if rest := c.numPartitions() - group*size; rest < size {
+		return rest
+	}
+	return size
+}
+
+func (c *Coordinator) SubmitGroupSummary(s *StepSummary, r *int) error {
+	c.addGroupSummary(s)
+	*r = 0
+	return nil
+}
+
+// hand our step summary to our group leader
+func (c *Coordinator) submitToGroup(s *StepSummary) {
+	leader := c.groupLeader(c.groupOf(c.config.NodeId))
+	if leader == c.config.NodeId {
+		c.addGroupSummary(s)
+		return
+	}
+	var r int
+	if err := c.client(leader).Call("Coordinator.SubmitGroupSummary", s, &r); err != nil {
+		c.fail(fmt.Errorf("could not submit step %d summary to group leader %s: %v", s.Step, leader, err))
+	}
+}
+
+func (c *Coordinator) addGroupSummary(s *StepSummary) {
+	c.summaryLock.Lock()
+	if _, ok := c.groupSummaries[s.Step]; !ok {
+		c.groupSummaries[s.Step] = make(map[string]string)
+	}
+	c.groupSummaries[s.Step][s.Worker] = s.Data
+	full := len(c.groupSummaries[s.Step]) == c.groupMembers(c.groupOf(c.config.NodeId))
+	c.summaryLock.Unlock()
+
+	if full {
+		go c.commitGroup(s.Step)
+	}
+}
+
+// condense the summaries of everyone in our group and enter the step barrier
+// for all of them
+func (c *Coordinator) commitGroup(step int) {
+	c.summaryLock.Lock()
+	members := c.groupSummaries[step]
+	delete(c.groupSummaries, step)
+	c.summaryLock.Unlock()
+
+	total := make(map[string]interface{})
+	for w, data := range members {
+		var info map[string]interface{}
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			c.fail(fmt.Errorf("bad step %d summary from %s: %v", step, w, err))
+			return
+		}
+		mergeSummary(total, info)
+	}
+	data, _ := json.Marshal(total)
+	c.log.debugf("Condensed step %d summaries for %d workers", step, len(members))
+	c.pushSummary(&StepSummary{Step: step, Worker: c.config.NodeId, Data: string(data)})
+	c.enterBarrier("superstep-"+strconv.Itoa(step), c.config.NodeId, string(data))
+}
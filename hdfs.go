@@ -0,0 +1,363 @@
+package waffle
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HDFS reads files from HDFS through the namenode's WebHDFS api, which
+// redirects reads to a datanode holding the data, one on the same machine
+// when there is one.
+type HDFS struct {
+	// the namenode's http address, say http://namenode:9870
+	NameNode string
+	// the user to act as with simple authentication, none when empty
+	User string
+	// http.DefaultClient when nil
+	Client *http.Client
+}
+
+type hdfsFileStatus struct {
+	PathSuffix string `json:"pathSuffix"`
+	Type       string `json:"type"`
+	Length     int64  `json:"length"`
+}
+
+type hdfsBlock struct {
+	Offset int64    `json:"offset"`
+	Length int64    `json:"length"`
+	Hosts  []string `json:"hosts"`
+	// ip:port of the datanodes
+	Names []string `json:"names"`
+}
+
+type hdfsError struct {
+	RemoteException struct {
+		Exception string `json:"exception"`
+		Message   string `json:"message"`
+	} `json:"RemoteException"`
+}
+
+func (h *HDFS) client() *http.Client {
+	if h.Client == nil {
+		return http.DefaultClient
+	}
+	return h.Client
+}
+
+func (h *HDFS) get(file, op string, q url.Values) (*http.Response, error) {
+	if q == nil {
+		q = make(url.Values)
+	}
+	q.Set("op", op)
+	if h.User != "" {
+		q.Set("user.name", h.User)
+	}
+	u := strings.TrimSuffix(h.NameNode, "/") + "/webhdfs/v1" + (&url.URL{Path: path.Clean("/" + file)}).EscapedPath() + "?" + q.Encode()
+	resp, err := h.client().Get(u)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e hdfsError
+		json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+		return nil, fmt.Errorf("hdfs %s %s: %s %s: %s", op, file, resp.Status, e.RemoteException.Exception, e.RemoteException.Message)
+	}
+	return resp, nil
+}
+
+func (h *HDFS) getJSON(file, op string, v interface{}) error {
+	resp, err := h.get(file, op, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// the files in dir, or just file if it isn't a directory
+func (h *HDFS) list(file string) ([]hdfsFileStatus, error) {
+	var r struct {
+		FileStatuses struct {
+			FileStatus []hdfsFileStatus
+		}
+	}
+	if err := h.getJSON(file, "LISTSTATUS", &r); err != nil {
+		return nil, err
+	}
+	return r.FileStatuses.FileStatus, nil
+}
+
+func (h *HDFS) blocks(file string) ([]hdfsBlock, error) {
+	var r struct {
+		BlockLocations struct {
+			BlockLocation []hdfsBlock
+		}
+	}
+	if err := h.getJSON(file, "GETFILEBLOCKLOCATIONS", &r); err != nil {
+		return nil, err
+	}
+	return r.BlockLocations.BlockLocation, nil
+}
+
+// Open opens file for reading from offset.
+func (h *HDFS) Open(file string, offset int64) (io.ReadCloser, error) {
+	resp, err := h.get(file, "OPEN", url.Values{"offset": {strconv.FormatInt(offset, 10)}})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// HDFSLoader splits the files under Input along their blocks, or smaller,
+// and reads each split with its EdgeListLoader.  It is a LoadAssigner that
+// hands splits to workers on the machines holding their blocks, so embedding
+// it gives a job its LoadPaths, Load and AssignLoad.  Split paths look like
+// hdfs:///graphs/web/part-00000#134217728+134217728.
+type HDFSLoader struct {
+	HDFS *HDFS
+	// files to load, directories are loaded file by file skipping the ones
+	// starting with _ or .
+	Input []string
+	// splits are at most this long, a block when 0
+	SplitSize int64
+	EdgeListLoader
+
+	// where each split's data lives
+	hosts     map[string][]string
+	hostsLock sync.Mutex
+}
+
+type hdfsSplit struct {
+	file           string
+	offset, length int64
+}
+
+func (s hdfsSplit) String() string {
+	return fmt.Sprintf("hdfs://%s#%d+%d", s.file, s.offset, s.length)
+}
+
+func parseHDFSSplit(p string) (hdfsSplit, error) {
+	bad := fmt.Errorf("%s is not an hdfs split", p)
+	i := strings.LastIndex(p, "#")
+	if !strings.HasPrefix(p, "hdfs://") || i < 0 {
+		return hdfsSplit{}, bad
+	}
+	r := strings.SplitN(p[i+1:], "+", 2)
+	if len(r) != 2 {
+		return hdfsSplit{}, bad
+	}
+	s := hdfsSplit{file: p[len("hdfs://"):i]}
+	var err error
+	if s.offset, err = strconv.ParseInt(r[0], 10, 64); err != nil {
+		return hdfsSplit{}, bad
+	}
+	if s.length, err = strconv.ParseInt(r[1], 10, 64); err != nil {
+		return hdfsSplit{}, bad
+	}
+	return s, nil
+}
+
+func (l *HDFSLoader) LoadPaths() []string {
+	var files []string
+	for _, in := range l.Input {
+		statuses, err := l.HDFS.list(in)
+		if err != nil {
+			log.Panicf("Could not list %s: %v", in, err)
+		}
+		for _, st := range statuses {
+			if st.Type != "FILE" || st.Length == 0 || strings.HasPrefix(st.PathSuffix, "_") || strings.HasPrefix(st.PathSuffix, ".") {
+				continue
+			}
+			// listing a file gives it back with no suffix
+			files = append(files, path.Join("/", in, st.PathSuffix))
+		}
+	}
+
+	l.hostsLock.Lock()
+	defer l.hostsLock.Unlock()
+	l.hosts = make(map[string][]string)
+	var paths []string
+	for _, file := range files {
+		blocks, err := l.HDFS.blocks(file)
+		if err != nil {
+			log.Panicf("Could not find the blocks of %s: %v", file, err)
+		}
+		for _, b := range blocks {
+			var hosts []string
+			hosts = append(hosts, b.Hosts...)
+			for _, name := range b.Names {
+				if host, _, err := net.SplitHostPort(name); err == nil {
+					hosts = append(hosts, host)
+				}
+			}
+			size := b.Length
+			if l.SplitSize > 0 && l.SplitSize < size {
+				size = l.SplitSize
+			}
+			for off := b.Offset; off < b.Offset+b.Length; off += size {
+				s := hdfsSplit{file: file, offset: off, length: size}
+				if end := b.Offset + b.Length; off+size > end {
+					s.length = end - off
+				}
+				paths = append(paths, s.String())
+				l.hosts[s.String()] = hosts
+			}
+		}
+	}
+	return paths
+}
+
+// AssignLoad gives each split to the worker with the least assigned so far
+// among those on a machine holding it, and the rest to the least loaded
+// workers overall.
+func (l *HDFSLoader) AssignLoad(paths []string, workers map[string]string) map[string]string {
+	var ids []string
+	onHost := make(map[string][]string)
+	for w, host := range workers {
+		ids = append(ids, w)
+		onHost[host] = append(onHost[host], w)
+	}
+	sort.Strings(ids)
+	for _, ws := range onHost {
+		sort.Strings(ws)
+	}
+	load := make(map[string]int)
+	least := func(candidates []string) string {
+		best := ""
+		for _, w := range candidates {
+			if best == "" || load[w] < load[best] {
+				best = w
+			}
+		}
+		return best
+	}
+
+	l.hostsLock.Lock()
+	defer l.hostsLock.Unlock()
+	assigned := make(map[string]string)
+	var remote []string
+	local := 0
+	for _, p := range paths {
+		var candidates []string
+		for _, host := range l.hosts[p] {
+			candidates = append(candidates, onHost[host]...)
+		}
+		if w := least(candidates); w != "" {
+			assigned[p] = w
+			load[w]++
+			local++
+		} else {
+			remote = append(remote, p)
+		}
+	}
+	for _, p := range remote {
+		if w := least(ids); w != "" {
+			assigned[p] = w
+			load[w]++
+		}
+	}
+	log.Printf("Assigned %d of %d splits to workers holding their data", local, len(paths))
+	return assigned
+}
+
+func (l *HDFSLoader) Load(p string) ([]Vertex, []Edge, error) {
+	s, err := parseHDFSSplit(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	open := func(string) (io.ReadCloser, error) {
+		return l.HDFS.openSplit(s)
+	}
+	return l.EdgeListLoader.load(p, open, l.SkipHeader && s.offset == 0)
+}
+
+// A split's lines are the ones that start in it.  A split that doesn't
+// start the file skips the line it starts in the middle of, which belongs to
+// the split before, and every split reads on past its end to finish its last
+// line.
+type splitReader struct {
+	r   *bufio.Reader
+	c   io.Closer
+	pos int64
+	end int64
+	// whether pos is at the start of a line
+	lineStart bool
+}
+
+func (h *HDFS) openSplit(s hdfsSplit) (io.ReadCloser, error) {
+	start := s.offset
+	if start > 0 {
+		// from the byte before, so a line starting right at the offset
+		// isn't skipped
+		start--
+	}
+	rc, err := h.Open(s.file, start)
+	if err != nil {
+		return nil, err
+	}
+	sr := &splitReader{r: bufio.NewReader(rc), c: rc, pos: start, end: s.offset + s.length, lineStart: true}
+	if s.offset > 0 {
+		skipped, err := sr.r.ReadSlice('\n')
+		for err == bufio.ErrBufferFull {
+			sr.pos += int64(len(skipped))
+			skipped, err = sr.r.ReadSlice('\n')
+		}
+		sr.pos += int64(len(skipped))
+		if err == io.EOF {
+			// the file ends in the line before the split, leaving nothing for it
+			sr.end = sr.pos
+		} else if err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return sr, nil
+}
+
+func (s *splitReader) Read(p []byte) (int, error) {
+	if s.pos >= s.end {
+		if s.lineStart {
+			return 0, io.EOF
+		}
+		// finishing the line that runs past the end
+		for i := range p {
+			b, err := s.r.ReadByte()
+			if err != nil {
+				return i, err
+			}
+			p[i] = b
+			s.pos++
+			if b == '\n' {
+				s.lineStart = true
+				return i + 1, nil
+			}
+		}
+		return len(p), nil
+	}
+	if left := s.end - s.pos; int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := s.r.Read(p)
+	if n > 0 {
+		s.pos += int64(n)
+		s.lineStart = p[n-1] == '\n'
+	}
+	return n, err
+}
+
+func (s *splitReader) Close() error {
+	return s.c.Close()
+}
@@ -0,0 +1,358 @@
+package waffle
+
+import (
+	"errors"
+	"math"
+	"net/rpc"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// number of heartbeat intervals a detector keeps
+	phiWindow = 100
+	// floor for the interval deviation, so a perfectly regular peer doesn't
+	// look dead the moment a beat is a little late
+	phiMinStdDev        = 50 * time.Millisecond
+	defaultPhiThreshold = 8.0
+	// how long a suspected worker has to answer a status call
+	defaultSuspectTimeout = 5 * time.Second
+)
+
+// phiDetector is a phi accrual failure detector (Hayashibara et al).  Rather
+// than declaring a peer dead after a fixed timeout it keeps track of how far
+// apart its heartbeats usually are, so peers that slow down during heavy steps
+// get more slack.
+type phiDetector struct {
+	last      time.Time
+	intervals []float64
+}
+
+func (d *phiDetector) beat(now time.Time) {
+	if !d.last.IsZero() {
+		d.intervals = append(d.intervals, now.Sub(d.last).Seconds())
+		if len(d.intervals) > phiWindow {
+			d.intervals = d.intervals[len(d.intervals)-phiWindow:]
+		}
+	}
+	d.last = now
+}
+
+func (d *phiDetector) phi(now time.Time) float64 {
+	if len(d.intervals) == 0 {
+		return 0
+	}
+	var mean, variance float64
+	for _, i := range d.intervals {
+		mean += i
+	}
+	mean /= float64(len(d.intervals))
+	for _, i := range d.intervals {
+		variance += (i - mean) * (i - mean)
+	}
+	std := math.Max(math.Sqrt(variance/float64(len(d.intervals))), phiMinStdDev.Seconds())
+	// probability that a beat shows up later than this, assuming intervals
+	// are normally distributed
+	later := 0.5 * math.Erfc((now.Sub(d.last).Seconds()-mean)/(std*math.Sqrt2))
+	if later <= 0 {
+		return math.Inf(1)
+	}
+	return -math.Log10(later)
+}
+
+// Workers that miss heartbeats are only suspected at first.  We ask them for
+// their status directly and only confirm the failure if that goes unanswered,
+// since a network blip is a lot cheaper to sit out than moving partitions.  A
+// confirmed failure ends the run, so nobody waits on the failed worker at the
+// next barrier and RunWithRecovery can go back to the last checkpoint.
+type heartbeats struct {
+	sync.Mutex
+	log       *logger
+	detectors map[string]*phiDetector
+	suspected map[string]bool
+	failed    map[string]bool
+	// workers drained out of the job
+	left map[string]bool
+	// what each worker told us in its last beat
+	latest map[string]*HeartbeatInfo
+	// last time we heard from anyone at all
+	lastHeard time.Time
+}
+
+// HeartbeatInfo is what a worker sends with each heartbeat
+type HeartbeatInfo struct {
+	Worker string
+	State  int32
+	Step   int
+	// heap in use, and messages queued up to come in and waiting to be acked
+	HeapBytes     uint64
+	Inbox, Outbox int
+	// local disk in use by category
+	Disk map[string]int64
+}
+
+func newHeartbeats(l *logger) *heartbeats {
+	return &heartbeats{
+		log:       l,
+		detectors: make(map[string]*phiDetector),
+		suspected: make(map[string]bool),
+		failed:    make(map[string]bool),
+		latest:    make(map[string]*HeartbeatInfo),
+		left:      make(map[string]bool),
+	}
+}
+
+func (h *heartbeats) record(hb *HeartbeatInfo) {
+	h.beat(hb.Worker)
+	h.Lock()
+	defer h.Unlock()
+	h.latest[hb.Worker] = hb
+}
+
+func (h *heartbeats) beat(worker string) {
+	h.Lock()
+	defer h.Unlock()
+	if h.left[worker] {
+		return
+	}
+	d, ok := h.detectors[worker]
+	if !ok {
+		d = &phiDetector{}
+		h.detectors[worker] = d
+	}
+	h.lastHeard = time.Now()
+	d.beat(h.lastHeard)
+	if h.suspected[worker] || h.failed[worker] {
+		h.log.Printf("Heard from %s again", worker)
+		delete(h.suspected, worker)
+		delete(h.failed, worker)
+	}
+}
+
+// heardWithin reports whether some worker got a heartbeat through to us in the
+// last d.  Before the first beat arrives there is nothing to go on, so that
+// counts as having heard.
+func (h *heartbeats) heardWithin(d time.Duration) bool {
+	h.Lock()
+	defer h.Unlock()
+	return h.lastHeard.IsZero() || time.Since(h.lastHeard) < d
+}
+
+func (h *heartbeats) clear(worker string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.suspected, worker)
+}
+
+func (h *heartbeats) confirm(worker string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.suspected, worker)
+	h.failed[worker] = true
+}
+
+// check returns the workers that newly crossed the phi threshold, or that
+// haven't been heard from in expiry when that is set
+func (h *heartbeats) check(threshold float64, expiry time.Duration) (failed []string) {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	for w, d := range h.detectors {
+		if h.failed[w] {
+			continue
+		}
+		if h.suspected[w] {
+			continue
+		}
+		if phi := d.phi(now); phi > threshold {
+			h.log.Printf("Suspecting worker %s (phi %.1f)", w, phi)
+		} else if expiry > 0 && now.Sub(d.last) > expiry {
+			h.log.Printf("Suspecting worker %s (silent for %s)", w, now.Sub(d.last))
+		} else {
+			continue
+		}
+		h.suspected[w] = true
+		failed = append(failed, w)
+	}
+	return
+}
+
+func (h *heartbeats) information() map[string]interface{} {
+	h.Lock()
+	defer h.Unlock()
+	now := time.Now()
+	info := make(map[string]interface{})
+	for w, d := range h.detectors {
+		state := "ok"
+		if h.failed[w] {
+			state = "failed"
+		} else if h.suspected[w] {
+			state = "suspect"
+		}
+		wi := map[string]interface{}{
+			"phi":   d.phi(now),
+			"state": state,
+		}
+		if hb, ok := h.latest[w]; ok {
+			wi["phase"] = hb.State
+			wi["step"] = hb.Step
+			wi["heap"] = hb.HeapBytes
+			wi["inbox"] = hb.Inbox
+			wi["outbox"] = hb.Outbox
+			wi["disk"] = hb.Disk
+		}
+		info[w] = wi
+	}
+	return info
+}
+
+type StatusRequest struct {
+	Worker string
+	Token  string
+}
+
+type WorkerStatus struct {
+	State int32
+	Step  int
+	Build BuildInfo
+}
+
+func (c *Coordinator) Status(req *StatusRequest, r *WorkerStatus) error {
+	if err := c.authorize(req.Worker, req.Token, OpStatus); err != nil {
+		return err
+	}
+	r.State = atomic.LoadInt32(&c.state)
+	r.Step = c.graph.Superstep()
+	r.Build = build()
+	return nil
+}
+
+func (c *Coordinator) suspectTimeout() time.Duration {
+	if c.config.SuspectTimeout > 0 {
+		return c.config.SuspectTimeout
+	}
+	return defaultSuspectTimeout
+}
+
+// ask a suspected worker how it's doing, confirming the failure if it doesn't
+// answer in time
+func (c *Coordinator) confirmFailure(worker string) {
+	req := &StatusRequest{Worker: c.config.NodeId, Token: c.config.Token}
+	call := c.client(worker).Go("Coordinator.Status", req, &WorkerStatus{}, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		if call.Error == nil {
+			c.log.Printf("Worker %s answered its status call, keeping it", worker)
+			c.heartbeats.clear(worker)
+			return
+		}
+		c.log.Printf("Status call to %s failed: %v", worker, call.Error)
+	case <-time.After(c.suspectTimeout()):
+		c.log.Printf("Status call to %s timed out", worker)
+	}
+	c.log.Printf("Confirming failure of worker %s", worker)
+	c.heartbeats.confirm(worker)
+	c.audit("fail", "failure detector", worker)
+	for pid, w := range c.partitionMap() {
+		if w == worker && !c.drains.has(w) {
+			c.fail(&WorkerLostError{Worker: w, Partition: pid, Checkpoint: c.lastCheckpoint})
+			return
+		}
+	}
+}
+
+func (c *Coordinator) Heartbeat(hb *HeartbeatInfo, r *int) error {
+	c.heartbeats.record(hb)
+	*r = 0
+	return nil
+}
+
+func (c *Coordinator) heartbeatInfo() *HeartbeatInfo {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return &HeartbeatInfo{
+		Worker:    c.config.NodeId,
+		State:     atomic.LoadInt32(&c.state),
+		Step:      c.graph.Superstep(),
+		HeapBytes: m.HeapInuse,
+		Inbox:     c.graph.inboxDepth(),
+		Outbox:    c.outbox.pending(),
+		Disk:      c.disk.information(),
+	}
+}
+
+// send heartbeats to every other worker until killed, checking on them as we
+// go
+func (c *Coordinator) heartbeat(kill chan byte) {
+	threshold := c.config.PhiThreshold
+	if threshold <= 0 {
+		threshold = defaultPhiThreshold
+	}
+	// a worker starts out with its lease, recovering or not
+	atomic.StoreInt32(&c.quarantined, 0)
+	ticker := time.NewTicker(c.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-kill:
+			return
+		case <-ticker.C:
+		}
+		hb := c.heartbeatInfo()
+		for w, cl := range c.clients() {
+			if w == c.config.NodeId || c.drains.has(w) {
+				continue
+			}
+			// fire and forget, a slow peer is exactly what we're measuring
+			cl.Go("Coordinator.Heartbeat", hb, new(int), make(chan *rpc.Call, 1))
+		}
+		var expiry time.Duration
+		if c.config.MissedBeats > 0 {
+			expiry = time.Duration(c.config.MissedBeats) * c.config.HeartbeatInterval
+		}
+		for _, w := range c.heartbeats.check(threshold, expiry) {
+			go c.confirmFailure(w)
+		}
+		c.checkLease()
+	}
+}
+
+var errQuarantined = errors.New("worker is quarantined")
+
+// A worker holds a lease on the step it is running for as long as heartbeats
+// from its peers keep arriving, or failing that, as long as it can still reach
+// zookeeper.  Peers going quiet while zookeeper answers just means they are the
+// ones in trouble, which is all a worker with a single peer can tell.  If
+// neither has gotten through for Config.LeaseTimeout we are most likely on the
+// wrong side of a network partition, so we stop sending messages and stay out
+// of the barriers rather than coming back later with state from a step
+// everyone else has given up on.
+func (c *Coordinator) leaseValid() bool {
+	if c.config.LeaseTimeout <= 0 || c.heartbeats.heardWithin(c.config.LeaseTimeout) {
+		return true
+	}
+	_, err := c.zk.Exists(c.workersPath)
+	return err == nil
+}
+
+func (c *Coordinator) checkLease() {
+	if !c.leaseValid() && c.quarantine() {
+		c.log.Printf("No heartbeats for %v, quarantining %s", c.config.LeaseTimeout, c.config.NodeId)
+		c.audit("quarantine", "lease", c.config.LeaseTimeout.String())
+		// give up on the run, so the others see us leave and go back to the
+		// last checkpoint rather than waiting on our barrier entries
+		c.fail(&WorkerLostError{Worker: c.config.NodeId, Partition: c.graph.partitionId, Checkpoint: c.lastCheckpoint})
+	}
+}
+
+// quarantine lasts for the rest of the run, the way back into the job is
+// recovery.  Returns true if this call did the quarantining.
+func (c *Coordinator) quarantine() bool {
+	return atomic.CompareAndSwapInt32(&c.quarantined, 0, 1)
+}
+
+func (c *Coordinator) isQuarantined() bool {
+	return atomic.LoadInt32(&c.quarantined) == 1
+}
@@ -0,0 +1,65 @@
+package waffle
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Workers are known to each other by NodeId, host and port are just
+// attributes in the worker info.  When no NodeId is configured we make up a
+// uuid and keep it in Config.IdFile so that a worker that comes back on a
+// different port is still the same node.
+func loadNodeId(c *Config) error {
+	if c.NodeId != "" {
+		return nil
+	}
+	if c.IdFile == "" {
+		return fmt.Errorf("no NodeId or IdFile configured")
+	}
+	if raw, err := ioutil.ReadFile(c.IdFile); err == nil {
+		c.NodeId = strings.TrimSpace(string(raw))
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	id, err := newUUID()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.IdFile, []byte(id+"\n"), 0644); err != nil {
+		return err
+	}
+	c.NodeId = id
+	return nil
+}
+
+// version 4 uuid
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// whether partitions is a mapping over exactly workers
+func sameWorkers(partitions map[int]string, workers []string) bool {
+	if len(partitions) != len(workers) {
+		return false
+	}
+	set := make(map[string]bool)
+	for _, w := range workers {
+		set[w] = true
+	}
+	for pid, w := range partitions {
+		if !set[w] || pid < 0 || pid >= len(workers) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package waffle
+
+import "fmt"
+
+// With Config.EvictIdleSteps set, a partition that has had no active vertices
+// and no messages for that many steps moves all of its vertices out to the
+// cold store, the same one Config.ResidentVertices uses, to free memory
+// through a long convergence tail.  The first messages to arrive bring them
+// back, up to the resident budget.  Edges stay in memory.
+
+// count idle steps, evicting or reloading the partition as needed.  Runs at
+// the start of step, with the messages for it in place and the number of our
+// vertices that were active after the last one.
+func (g *Graph) checkIdle(step, active int) {
+	k := g.coordinator.config.EvictIdleSteps
+	if k <= 0 {
+		return
+	}
+	if len(g.messages) > 0 || active > 0 {
+		g.idleSteps = 0
+		if g.evicted {
+			g.reload(step)
+		}
+		return
+	}
+	g.idleSteps++
+	if g.idleSteps >= k && !g.evicted && len(g.vertices) > 0 {
+		g.evict(step)
+	}
+}
+
+func (g *Graph) evict(step int) {
+	cold := g.coldStore()
+	if cold == nil {
+		return
+	}
+	n := len(g.vertices)
+	for id, v := range g.vertices {
+		if err := cold.put(v); err != nil {
+			g.log.Printf("Could not evict vertex %s, keeping the rest in memory: %v", id, err)
+			return
+		}
+		delete(g.vertices, id)
+	}
+	g.evicted = true
+	g.log.Printf("Partition idle for %d steps, evicted %d vertices before step %d", g.idleSteps, n, step)
+}
+
+func (g *Graph) reload(step int) {
+	g.evicted = false
+	budget := g.coordinator.config.ResidentVertices
+	n := 0
+	for id := range g.cold.index {
+		if budget > 0 && len(g.vertices) >= budget {
+			break
+		}
+		v, err := g.cold.get(id)
+		if err != nil {
+			g.coordinator.fail(fmt.Errorf("could not reload vertex %s: %v", id, err))
+			return
+		}
+		g.vertices[id] = v
+		g.cold.remove(id)
+		n++
+	}
+	if err := g.cold.compact(); err != nil {
+		g.log.Printf("Could not compact the cold vertex store: %v", err)
+	}
+	g.log.Printf("Messages for an idle partition, reloaded %d vertices for step %d", n, step)
+}
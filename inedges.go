@@ -0,0 +1,83 @@
+package waffle
+
+import (
+	"sync"
+)
+
+// With Config.InEdges set every partition also keeps the sources of the
+// edges that point at its vertices.  Edges live with their source, so the
+// in-edges of a load are sent to the partitions that own the destinations
+// before the load counts as done.
+
+// a batch of (source, destination) pairs for the owner of the destinations
+type InEdgeBatch struct {
+	Pairs [][2]string
+}
+
+type inEdges struct {
+	m map[string][]string
+	sync.RWMutex
+}
+
+func (in *inEdges) add(pairs [][2]string) {
+	in.Lock()
+	defer in.Unlock()
+	if in.m == nil {
+		in.m = make(map[string][]string)
+	}
+	for _, p := range pairs {
+		in.m[p[1]] = append(in.m[p[1]], p[0])
+	}
+}
+
+func (in *inEdges) remove(pairs [][2]string) {
+	in.Lock()
+	defer in.Unlock()
+	for _, p := range pairs {
+		kept := in.m[p[1]][:0]
+		for _, src := range in.m[p[1]] {
+			if src != p[0] {
+				kept = append(kept, src)
+			}
+		}
+		in.m[p[1]] = kept
+	}
+}
+
+// InEdges returns the sources of the edges pointing at id, which has to be in
+// this partition.  It's empty unless Config.InEdges is set.
+func (g *Graph) InEdges(id string) []string {
+	g.in.RLock()
+	defer g.in.RUnlock()
+	return g.in.m[id]
+}
+
+func (c *Coordinator) SubmitInEdges(b *InEdgeBatch, r *int) error {
+	c.graph.in.add(b.Pairs)
+	*r = 0
+	return nil
+}
+
+// send the in-edges of a load to the partitions owning their destinations
+func (g *Graph) addInEdges(edges []Edge) error {
+	if !g.coordinator.config.InEdges {
+		return nil
+	}
+	byPartition := make(map[int][][2]string)
+	for _, e := range edges {
+		p := g.determinePartition(e.Destination())
+		byPartition[p] = append(byPartition[p], [2]string{e.Source(), e.Destination()})
+	}
+	c := g.coordinator
+	for p, pairs := range byPartition {
+		if p == g.partitionId {
+			g.in.add(pairs)
+			continue
+		}
+		var r int
+		if err := c.client(c.worker(p)).Call("Coordinator.SubmitInEdges", &InEdgeBatch{pairs}, &r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
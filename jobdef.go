@@ -0,0 +1,173 @@
+package waffle
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// JobDef declares everything that makes up a job in one place.  It is an
+// alternative to implementing Job (and whichever optional interfaces) on a
+// type of your own, with the difference that a JobDef is checked before the
+// job starts, so a missing loader is an error up front rather than a panic
+// halfway through a load.
+type JobDef struct {
+	Id        string
+	LoadPaths []string
+	Load      func(path string) ([]Vertex, []Edge, error)
+	Write     func(*Graph) error
+
+	// optional, a job without a checkpoint func never checkpoints
+	Checkpoint func(step int) bool
+	Persist    func(*Graph) error
+	// optional, see StatePersister
+	PersistState func(*JobState) error
+	LoadState    func(namespace string) (*JobState, error)
+	// optional, see PartitionStateJob
+	PartitionState func(partition int) interface{}
+	// optional, see MasterComputeFn
+	MasterCompute MasterComputeFn
+	// optional, see OutputsJob
+	Outputs map[string]Output
+	// optional, see CombinerJob
+	Combiner func(m Message) Combiner
+
+	// an example of each of the concrete types the job sends between
+	// workers, these get registered with gob
+	Vertex  Vertex
+	Message Message
+	Edge    Edge
+}
+
+func (d *JobDef) Validate() error {
+	var missing []string
+	if d.Id == "" {
+		missing = append(missing, "Id")
+	}
+	if len(d.LoadPaths) == 0 {
+		missing = append(missing, "LoadPaths")
+	}
+	if d.Load == nil {
+		missing = append(missing, "Load")
+	}
+	if d.Write == nil {
+		missing = append(missing, "Write")
+	}
+	if d.Vertex == nil {
+		missing = append(missing, "Vertex")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("job definition is missing %v", missing)
+	}
+	if d.Checkpoint != nil && d.Persist == nil {
+		return errors.New("job definition checkpoints but has no Persist")
+	}
+	if (d.PersistState == nil) != (d.LoadState == nil) {
+		return errors.New("job definition needs both PersistState and LoadState or neither")
+	}
+	return nil
+}
+
+// Job validates d, registers its types and wraps it up as a Job
+func (d *JobDef) Job() (Job, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	gob.Register(d.Vertex)
+	if d.Message != nil {
+		gob.Register(d.Message)
+	}
+	if d.Edge != nil {
+		gob.Register(d.Edge)
+	}
+	// the registry doesn't need to check these again
+	types.Lock()
+	for _, v := range []interface{}{d.Vertex, d.Message, d.Edge} {
+		if v != nil {
+			types.checked[reflect.TypeOf(v)] = nil
+		}
+	}
+	types.Unlock()
+	return &defJob{d}, nil
+}
+
+// RunDef is Run for a JobDef.
+func RunDef(c *Config, d *JobDef) error {
+	j, err := d.Job()
+	if err != nil {
+		return err
+	}
+	Run(c, j)
+	return nil
+}
+
+type defJob struct {
+	d *JobDef
+}
+
+func (j *defJob) Id() string {
+	return j.d.Id
+}
+
+func (j *defJob) LoadPaths() []string {
+	return j.d.LoadPaths
+}
+
+func (j *defJob) Load(path string) ([]Vertex, []Edge, error) {
+	return j.d.Load(path)
+}
+
+func (j *defJob) Checkpoint(step int) bool {
+	return j.d.Checkpoint != nil && j.d.Checkpoint(step)
+}
+
+func (j *defJob) Write(g *Graph) error {
+	return j.d.Write(g)
+}
+
+func (j *defJob) Persist(g *Graph) error {
+	if j.d.Persist == nil {
+		return nil
+	}
+	return j.d.Persist(g)
+}
+
+func (j *defJob) PersistState(s *JobState) error {
+	if j.d.PersistState == nil {
+		return nil
+	}
+	return j.d.PersistState(s)
+}
+
+func (j *defJob) LoadState(namespace string) (*JobState, error) {
+	if j.d.LoadState == nil {
+		return nil, nil
+	}
+	return j.d.LoadState(namespace)
+}
+
+func (j *defJob) NewPartitionState(partition int) interface{} {
+	if j.d.PartitionState == nil {
+		return nil
+	}
+	return j.d.PartitionState(partition)
+}
+
+func (j *defJob) MasterCompute(superstep uint64, aggregates map[string]interface{}, stats StepStats) Decision {
+	if j.d.MasterCompute == nil {
+		return Decision{}
+	}
+	return j.d.MasterCompute(superstep, aggregates, stats)
+}
+
+func (j *defJob) Outputs() map[string]Output {
+	return j.d.Outputs
+}
+
+func (j *defJob) Combiner(m Message) Combiner {
+	if j.d.Combiner == nil {
+		return nil
+	}
+	return j.d.Combiner(m)
+}
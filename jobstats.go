@@ -0,0 +1,162 @@
+package waffle
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// JobStats is where a run spent its time: the wall clock of each stage and
+// step as this worker saw them, and what every worker reported at each step
+// barrier.  Get it from Runner.Stats once the run is over, it is logged when
+// the job ends as well.
+type JobStats struct {
+	Stages []StageTime
+	Steps  []StepTime
+	Total  time.Duration
+}
+
+// StageTime is how long a stage (register, plan, load, compute or write)
+// took from this worker's point of view.
+type StageTime struct {
+	Stage string
+	Time  time.Duration
+}
+
+type StepTime struct {
+	Step int
+	// from this worker starting the step to its barrier filling
+	Wall         time.Duration
+	Active, Msgs int
+	// seconds each worker spent computing
+	Compute map[string]float64
+	// seconds on the job's Timers, over the cluster
+	Timers map[string]float64
+}
+
+type jobClock struct {
+	sync.Mutex
+	started   time.Time
+	stages    []StageTime
+	stepStart map[int]time.Time
+	steps     map[int]time.Duration
+	compute   map[int]map[string]float64
+	// when we finished each step, and the time spent waiting on barriers
+	submitted map[int]time.Time
+	waited    time.Duration
+}
+
+func (k *jobClock) stepSubmitted(step int) {
+	k.Lock()
+	defer k.Unlock()
+	if k.submitted == nil {
+		k.submitted = make(map[int]time.Time)
+	}
+	k.submitted[step] = time.Now()
+}
+
+func (k *jobClock) barrierWait() time.Duration {
+	k.Lock()
+	defer k.Unlock()
+	return k.waited
+}
+
+func (k *jobClock) start() time.Time {
+	k.Lock()
+	defer k.Unlock()
+	k.started = time.Now()
+	return k.started
+}
+
+func (k *jobClock) stage(name string, d time.Duration) {
+	k.Lock()
+	defer k.Unlock()
+	k.stages = append(k.stages, StageTime{name, d})
+}
+
+func (k *jobClock) stepStarted(step int) {
+	k.Lock()
+	defer k.Unlock()
+	if k.stepStart == nil {
+		k.stepStart = make(map[int]time.Time)
+	}
+	k.stepStart[step] = time.Now()
+}
+
+func (k *jobClock) stepDone(step int, workers map[string]*workerStat) {
+	k.Lock()
+	defer k.Unlock()
+	if k.steps == nil {
+		k.steps = make(map[int]time.Duration)
+		k.compute = make(map[int]map[string]float64)
+	}
+	if t, ok := k.stepStart[step]; ok {
+		k.steps[step] = time.Since(t)
+		delete(k.stepStart, step)
+	}
+	if t, ok := k.submitted[step]; ok {
+		k.waited += time.Since(t)
+		delete(k.submitted, step)
+	}
+	compute := make(map[string]float64)
+	for w, st := range workers {
+		compute[w] = st.Time
+	}
+	k.compute[step] = compute
+}
+
+// Stats is where the run spent its time so far.
+func (r *Runner) Stats() *JobStats {
+	c := r.listener.coordinator
+	s := &JobStats{}
+	k := &c.clock
+	k.Lock()
+	s.Stages = append(s.Stages, k.stages...)
+	if !k.started.IsZero() {
+		s.Total = time.Since(k.started)
+	}
+	c.stats.Lock()
+	for _, st := range c.stats.all {
+		s.Steps = append(s.Steps, StepTime{
+			Step:    st.Step,
+			Wall:    k.steps[st.Step],
+			Active:  st.Active,
+			Msgs:    st.Msgs,
+			Compute: k.compute[st.Step],
+			Timers:  st.Timers,
+		})
+	}
+	c.stats.Unlock()
+	k.Unlock()
+	return s
+}
+
+func (s *JobStats) log() {
+	log.Printf("Job took %v", s.Total)
+	for _, st := range s.Stages {
+		log.Printf("  %-8s %v", st.Stage, st.Time)
+	}
+	for _, st := range s.Steps {
+		var slowest string
+		workers := make([]string, 0, len(st.Compute))
+		for w := range st.Compute {
+			workers = append(workers, w)
+		}
+		sort.Strings(workers)
+		for _, w := range workers {
+			if slowest == "" || st.Compute[w] > st.Compute[slowest] {
+				slowest = w
+			}
+		}
+		log.Printf("  step %d: %v, %d active, %d msgs, slowest worker %s computed for %.3fs", st.Step, st.Wall, st.Active, st.Msgs, slowest, st.Compute[slowest])
+		timers := make([]string, 0, len(st.Timers))
+		for name := range st.Timers {
+			timers = append(timers, name)
+		}
+		sort.Strings(timers)
+		for _, name := range timers {
+			log.Printf("    %s %.3fs", name, st.Timers[name])
+		}
+	}
+}
@@ -23,7 +23,13 @@ func (l *waffleListener) OnJoin(zk *zookeeper.Conn) {
 	l.zk = zk
 	l.coordinator.graph = newGraph(l.job, l.coordinator)
 	l.coordinator.donutConfig = l.config
-	if err := l.coordinator.start(zk); err != nil {
+	err := l.coordinator.start(zk)
+	select {
+	case l.coordinator.runner.joined <- err:
+	default:
+		// only the first join is waited on
+	}
+	if err != nil {
 		l.cluster.Shutdown()
 	}
 }
@@ -43,5 +49,15 @@ func (l *waffleListener) OnLeave() {
 }
 
 func (l *waffleListener) Information() map[string]interface{} {
-	return l.coordinator.graph.information()
+	info := l.coordinator.graph.information()
+	info["tenant"] = l.coordinator.config.Tenant
+	info["job"] = l.coordinator.config.JobId
+	info["tags"] = l.coordinator.config.Tags
+	info["stats"] = l.coordinator.stats.information()
+	info["phi"] = l.coordinator.heartbeats.information()
+	info["build"] = build().String()
+	info["codecs"] = l.coordinator.codecs.information()
+	info["versions"] = l.coordinator.versions()
+	info["capabilities"] = l.coordinator.caps.list()
+	return info
 }
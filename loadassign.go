@@ -0,0 +1,41 @@
+package waffle
+
+import (
+	"net/url"
+)
+
+// Jobs that implement LoadAssigner pick which worker loads each path, say to
+// read splits on the machines that hold their data.  workers maps worker ids
+// to their hosts.  Every worker creates the load work, so the assignment has
+// to come out the same everywhere.  Paths left out go to whoever claims them.
+type LoadAssigner interface {
+	AssignLoad(paths []string, workers map[string]string) map[string]string
+}
+
+// paths become zookeeper node names for their work and barrier entries
+func loadName(p string) string {
+	return url.PathEscape(p)
+}
+
+func (c *Coordinator) assignLoad(paths []string) map[string]string {
+	la, ok := c.graph.job.(LoadAssigner)
+	if !ok {
+		return nil
+	}
+	workers := make(map[string]string)
+	c.clientsLock.RLock()
+	for w, info := range c.cachedWorkerInfo {
+		if host, ok := info["host"].(string); ok {
+			workers[w] = host
+		}
+	}
+	c.clientsLock.RUnlock()
+	assigned := la.AssignLoad(paths, workers)
+	for p, w := range assigned {
+		if _, ok := workers[w]; !ok {
+			c.log.Printf("%s was assigned to %s, which isn't a worker", p, w)
+			delete(assigned, p)
+		}
+	}
+	return assigned
+}
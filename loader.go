@@ -0,0 +1,213 @@
+package waffle
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// EdgeListLoader reads plain text edge lists, one "src dst [weight]" per
+// line, and can be used as a job's Load.  Every id that shows up gets a vertex
+// from NewVertex, load paths are spread over the workers like any others.
+type EdgeListLoader struct {
+	// field separator, whitespace when empty
+	Delimiter string
+	// lines starting with this are skipped, "#" when empty
+	Comment    string
+	SkipHeader bool
+	NewVertex  func(id string) Vertex
+	// the registered vertex type to make when NewVertex is nil
+	VertexType string
+	// defaults to an EdgeBase with the weight as its value, 1 when missing
+	NewEdge func(src, dst string, weight float64) Edge
+	// skip lines that don't parse instead of failing the load, writing them
+	// with their line numbers to a <path>.bad file in BadRecordsDir if set
+	SkipBad       bool
+	BadRecordsDir string
+	// lines longer than this are bad records, 16MB when 0
+	MaxLineLength int
+	// opens a load path, os.Open when nil
+	Open func(path string) (io.ReadCloser, error)
+
+	loadReports
+}
+
+const defaultMaxLineLength = 16 << 20
+
+var errLineTooLong = errors.New("line too long")
+
+// readLine reads the next line, reading past the end of lines that are too
+// long so the next call starts on a fresh one
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		if !tooLong {
+			if len(line)+len(chunk) > max {
+				tooLong, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+	return string(line), nil
+}
+
+func (l *EdgeListLoader) fields(line string) []string {
+	if l.Delimiter == "" {
+		return strings.Fields(line)
+	}
+	f := strings.Split(line, l.Delimiter)
+	for i := range f {
+		f[i] = strings.TrimSpace(f[i])
+	}
+	return f
+}
+
+// parse one line, reporting false for lines that hold no edge
+func (l *EdgeListLoader) parse(line string) (src, dst string, weight float64, ok bool, err error) {
+	comment := l.Comment
+	if comment == "" {
+		comment = "#"
+	}
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, comment) {
+		return "", "", 0, false, nil
+	}
+	if !utf8.ValidString(line) || strings.IndexByte(line, 0) >= 0 {
+		return "", "", 0, false, errors.New("line is not text")
+	}
+	f := l.fields(line)
+	if len(f) < 2 || len(f) > 3 || f[0] == "" || f[1] == "" {
+		return "", "", 0, false, fmt.Errorf("expected src, dst and an optional weight, got %d fields", len(f))
+	}
+	weight = 1
+	if len(f) == 3 {
+		if weight, err = strconv.ParseFloat(f[2], 64); err != nil || math.IsNaN(weight) || math.IsInf(weight, 0) {
+			return "", "", 0, false, fmt.Errorf("bad weight %q", f[2])
+		}
+	}
+	return f[0], f[1], weight, true, nil
+}
+
+func (l *EdgeListLoader) Load(path string) ([]Vertex, []Edge, error) {
+	open := l.Open
+	if open == nil {
+		open = func(path string) (io.ReadCloser, error) { return os.Open(path) }
+	}
+	return l.load(path, open, l.SkipHeader)
+}
+
+// load path opened with open, skipping its first line if header is set
+func (l *EdgeListLoader) load(path string, open func(string) (io.ReadCloser, error), header bool) ([]Vertex, []Edge, error) {
+	newVertex := l.NewVertex
+	if newVertex == nil && l.VertexType != "" {
+		if _, err := NewVertexOf(l.VertexType, ""); err != nil {
+			return nil, nil, err
+		}
+		newVertex = func(id string) Vertex {
+			v, _ := NewVertexOf(l.VertexType, id)
+			return v
+		}
+	}
+	if newVertex == nil {
+		return nil, nil, fmt.Errorf("edge list loader has no NewVertex or VertexType")
+	}
+	newEdge := l.NewEdge
+	if newEdge == nil {
+		newEdge = func(src, dst string, w float64) Edge { return NewEdge(src, dst, w) }
+	}
+	f, err := open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	var vertices []Vertex
+	var edges []Edge
+	addVertex := func(id string) {
+		if !seen[id] {
+			seen[id] = true
+			vertices = append(vertices, newVertex(id))
+		}
+	}
+	bad, err := l.openBad(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bad != nil {
+		defer bad.Close()
+	}
+	report := &LoadReport{}
+	defer l.set(path, report)
+	max := l.MaxLineLength
+	if max <= 0 {
+		max = defaultMaxLineLength
+	}
+	r := bufio.NewReader(f)
+	for n := 1; ; n++ {
+		line, err := readLine(r, max)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != errLineTooLong {
+			return nil, nil, err
+		}
+		if n == 1 && header {
+			continue
+		}
+		var src, dst string
+		var weight float64
+		ok := false
+		if err == nil {
+			src, dst, weight, ok, err = l.parse(line)
+		}
+		if err != nil {
+			if !l.SkipBad {
+				return nil, nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			// a bad record is still one, blank lines and comments aren't
+			report.Records++
+			report.Bad++
+			report.sample(fmt.Sprintf("%s:%d: %v", path, n, err))
+			if bad != nil {
+				fmt.Fprintf(bad, "%d: %v: %q\n", n, err, line)
+			}
+			continue
+		}
+		if !ok {
+			continue
+		}
+		report.Records++
+		addVertex(src)
+		addVertex(dst)
+		edges = append(edges, newEdge(src, dst, weight))
+	}
+	return vertices, edges, nil
+}
+
+// the sidecar file bad records from path go to, if any
+func (l *EdgeListLoader) openBad(path string) (*os.File, error) {
+	if !l.SkipBad || l.BadRecordsDir == "" {
+		return nil, nil
+	}
+	return os.Create(filepath.Join(l.BadRecordsDir, filepath.Base(path)+".bad"))
+}
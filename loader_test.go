@@ -0,0 +1,123 @@
+package waffle
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+)
+
+type fuzzVertex struct{ id string }
+
+func (v *fuzzVertex) Id() string                { return v.id }
+func (v *fuzzVertex) Compute(*Graph, []Message) {}
+func (v *fuzzVertex) Active() bool              { return false }
+
+var loaderSeeds = []string{
+	"",
+	"a b\n",
+	"a b 2.5\n",
+	"# comment\n\na b\n",
+	"a\tb\t1e300\n",
+	"a b NaN\n",
+	"a b c d\n",
+	"a,b,3\n",
+	" , ,\n",
+	"a b\r\nc d\r\n",
+	"\x00\xff\xfe\n",
+	"src dst\nx y\n",
+}
+
+func FuzzEdgeListParse(f *testing.F) {
+	for _, s := range loaderSeeds {
+		f.Add(s, "")
+		f.Add(s, ",")
+	}
+	f.Fuzz(func(t *testing.T, line, delim string) {
+		l := &EdgeListLoader{Delimiter: delim}
+		src, dst, weight, ok, err := l.parse(line)
+		if err != nil && ok {
+			t.Fatalf("parse(%q) failed with %v but found an edge", line, err)
+		}
+		if !ok {
+			return
+		}
+		if src == "" || dst == "" {
+			t.Fatalf("parse(%q) found an edge with an empty end: %q -> %q", line, src, dst)
+		}
+		if math.IsNaN(weight) || math.IsInf(weight, 0) {
+			t.Fatalf("parse(%q) found an edge weighing %v", line, weight)
+		}
+	})
+}
+
+func FuzzReadLine(f *testing.F) {
+	for _, s := range loaderSeeds {
+		f.Add(s, 4)
+	}
+	f.Fuzz(func(t *testing.T, in string, max int) {
+		if max <= 0 || max > 1<<16 {
+			return
+		}
+		r := bufio.NewReaderSize(strings.NewReader(in), 16)
+		for i := 0; i <= len(in); i++ {
+			line, err := readLine(r, max)
+			if err == io.EOF {
+				return
+			}
+			if err == errLineTooLong {
+				continue
+			}
+			if err != nil {
+				t.Fatalf("readLine failed on %q: %v", in, err)
+			}
+			if len(line) > max {
+				t.Fatalf("readLine gave %d bytes with a limit of %d", len(line), max)
+			}
+		}
+		t.Fatalf("readLine didn't get to the end of %q", in)
+	})
+}
+
+func FuzzEdgeListLoad(f *testing.F) {
+	for _, s := range loaderSeeds {
+		f.Add([]byte(s), false)
+		f.Add([]byte(s), true)
+	}
+	f.Fuzz(func(t *testing.T, in []byte, header bool) {
+		l := &EdgeListLoader{
+			SkipBad:       true,
+			SkipHeader:    header,
+			MaxLineLength: 64,
+			NewVertex:     func(id string) Vertex { return &fuzzVertex{id} },
+			Open: func(string) (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(in)), nil
+			},
+		}
+		vertices, edges, err := l.Load("fuzz")
+		if err != nil {
+			t.Fatalf("Load with SkipBad failed: %v", err)
+		}
+		ids := make(map[string]bool)
+		for _, v := range vertices {
+			if ids[v.Id()] {
+				t.Fatalf("vertex %q loaded twice", v.Id())
+			}
+			ids[v.Id()] = true
+		}
+		for _, e := range edges {
+			if !ids[e.Source()] || !ids[e.Destination()] {
+				t.Fatalf("edge %q -> %q has no vertex", e.Source(), e.Destination())
+			}
+		}
+		r := l.LoadReport("fuzz")
+		if r == nil {
+			t.Fatal("no load report")
+		}
+		if r.Records != len(edges)+r.Bad {
+			t.Fatalf("%d records with %d edges and %d bad ones", r.Records, len(edges), r.Bad)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package waffle
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+const (
+	// progress summaries and errors
+	LogInfo LogLevel = iota
+	// everything every worker does in every phase
+	LogDebug
+)
+
+// logger is a job's own log, so jobs sharing a process keep their own
+// level and tags
+type logger struct {
+	*log.Logger
+	level LogLevel
+}
+
+func newLogger(c *Config) *logger {
+	prefix := ""
+	if len(c.Tags) > 0 {
+		prefix = "[" + tagString(c.Tags) + "] "
+	}
+	return &logger{
+		Logger: log.New(stdLog{}, prefix, log.Flags()),
+		level:  c.LogLevel,
+	}
+}
+
+// writes to wherever the standard logger is pointed at the time
+type stdLog struct{}
+
+func (stdLog) Write(b []byte) (int, error) {
+	return log.Writer().Write(b)
+}
+
+func (l *logger) debugf(format string, v ...interface{}) {
+	if l.level >= LogDebug {
+		l.Printf(format, v...)
+	}
+}
+
+const defaultProgressInterval = 10 * time.Second
+
+// progress logs how far along a barrier is, at most once per interval for
+// each kind of barrier unless it's complete.  At debug level every change
+// is logged.
+type progress struct {
+	log      *logger
+	interval time.Duration
+	last     map[string]time.Time
+	sync.Mutex
+}
+
+func newProgress(interval time.Duration, l *logger) *progress {
+	if interval == 0 {
+		interval = defaultProgressInterval
+	}
+	return &progress{
+		log:      l,
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+func (p *progress) report(kind, label string, done, total int, what string) {
+	msg := fmt.Sprintf("%s: %d/%d %s done", label, done, total, what)
+	if p.log.level >= LogDebug {
+		p.log.Println(msg)
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	if done < total && now.Sub(p.last[kind]) < p.interval {
+		return
+	}
+	p.last[kind] = now
+	p.log.Println(msg)
+}
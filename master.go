@@ -0,0 +1,140 @@
+package waffle
+
+import (
+	"sync"
+)
+
+// StepStats is what the cluster did in a step, as seen at the barrier.
+type StepStats struct {
+	Step             int
+	Active, Msgs     int
+	Counters, Gauges map[string]float64
+	// vertices in the graph
+	Vertices int
+	// the vertices that computed in the step, and in every step so far
+	Frontier        FrontierStat
+	FrontierHistory []FrontierStat
+	// vertices and edges added and removed in the step, they take effect at
+	// the start of the next one
+	Topology TopologyChange
+}
+
+// Decision is what a MasterComputeFn wants done before the next step.
+type Decision struct {
+	// stop and write results, whether or not vertices are still active
+	Halt bool
+	// aggregator values to use in place of the reduced ones, vertices see
+	// them through Aggregated in the next step
+	Aggregates map[string]float64
+	// the phase vertices see through Graph.Phase, left as is when empty
+	Phase string
+	// the direction of the next step, left to Config.PullFraction when 0
+	Direction Direction
+}
+
+// A MasterComputeFn runs between steps with the reduced aggregator values and
+// the step's stats, for global convergence checks and phase changes.  There
+// is no master, so it runs on every worker with the same inputs and has to
+// come to the same decision everywhere, it can't depend on anything local.
+type MasterComputeFn func(superstep uint64, aggregates map[string]interface{}, stats StepStats) Decision
+
+// Jobs that implement MasterComputer have MasterCompute run between steps,
+// unless the runner was given a MasterComputeFn of its own.
+type MasterComputer interface {
+	MasterCompute(superstep uint64, aggregates map[string]interface{}, stats StepStats) Decision
+}
+
+// SetMasterComputeFn has f run between steps.  It has to be set before the
+// job starts computing.
+func (r *Runner) SetMasterComputeFn(f MasterComputeFn) {
+	r.listener.coordinator.masterCompute = f
+}
+
+// an aggregator whose value was set by a MasterComputeFn
+type fixedAggregator struct{ V float64 }
+
+func (a *fixedAggregator) Submit(float64)          {}
+func (a *fixedAggregator) ReduceInto(b Aggregator) {}
+func (a *fixedAggregator) Value() float64          { return a.V }
+
+type phase struct {
+	name string
+	sync.RWMutex
+}
+
+// Phase is the phase set by the last MasterComputeFn decision, empty until
+// one sets it.
+func (g *Graph) Phase() string {
+	p := &g.coordinator.phase
+	p.RLock()
+	defer p.RUnlock()
+	return p.name
+}
+
+func (c *Coordinator) masterComputeFn() MasterComputeFn {
+	if c.masterCompute != nil {
+		return c.masterCompute
+	}
+	if m, ok := c.graph.job.(MasterComputer); ok {
+		return m.MasterCompute
+	}
+	return nil
+}
+
+// the stats of step that the hooks run with, and the reduced aggregator
+// values
+func (c *Coordinator) stepStats(step int, frontier FrontierStat, topology TopologyChange, vertices int) (map[string]interface{}, StepStats) {
+	g := c.graph
+	g.globalStat.Lock()
+	defer g.globalStat.Unlock()
+	aggregates := make(map[string]interface{})
+	for name, a := range g.globalStat.aggr {
+		if a, ok := a.(Aggregator); ok {
+			aggregates[name] = a.Value()
+		}
+	}
+	stats := StepStats{
+		Step:     step,
+		Active:   g.globalStat.active,
+		Msgs:     g.globalStat.msgs,
+		Counters: g.globalStat.counters,
+		Gauges:   g.globalStat.gauges,
+		Vertices: vertices,
+		Frontier: frontier,
+		Topology: topology,
+	}
+	stats.FrontierHistory = c.frontiers.list()
+	return aggregates, stats
+}
+
+// run the master compute hook for step, with the global stats already
+// collected
+func (c *Coordinator) runMasterCompute(step int, frontier FrontierStat, topology TopologyChange, vertices int) Decision {
+	f := c.masterComputeFn()
+	if f == nil {
+		return Decision{}
+	}
+	g := c.graph
+	aggregates, stats := c.stepStats(step, frontier, topology, vertices)
+	d := f(uint64(step), aggregates, stats)
+
+	if len(d.Aggregates) > 0 {
+		g.globalStat.Lock()
+		for name, v := range d.Aggregates {
+			g.globalStat.aggr[name] = &fixedAggregator{v}
+		}
+		g.globalStat.Unlock()
+	}
+	if d.Phase != "" {
+		c.phase.Lock()
+		if d.Phase != c.phase.name {
+			c.log.Printf("Moving to phase %s after step %d", d.Phase, step)
+		}
+		c.phase.name = d.Phase
+		c.phase.Unlock()
+	}
+	if d.Halt {
+		c.log.Printf("Master compute halted the job after step %d", step)
+	}
+	return d
+}
@@ -0,0 +1,121 @@
+package waffle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// /metrics on Config.StatusAddr serves this worker's numbers in the
+// Prometheus text format, labelled with the job, worker and Config.Tags.
+// Scrapers present the job token or one the ACL grants metrics as a bearer
+// token or in the X-Waffle-Token header, and only denied scrapes are audited.
+
+type metricsWriter struct {
+	w      *bufio.Writer
+	labels string
+}
+
+func (m *metricsWriter) metric(name, kind, help string, value float64) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	fmt.Fprintf(m.w, "%s{%s} %g\n", name, m.labels, value)
+}
+
+// one sample per name, as name="..." labels of a single metric
+func (m *metricsWriter) named(metric, kind, help string, values map[string]float64) {
+	if len(values) == 0 {
+		return
+	}
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", metric, help, metric, kind)
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(m.w, "%s{%s,name=\"%s\"} %g\n", metric, m.labels, escapeLabel(name), values[name])
+	}
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// a tag name made into a label name, anything outside [a-zA-Z0-9_] becomes
+// an underscore and it can't start with a digit
+func labelName(s string) string {
+	b := []byte(s)
+	for i, ch := range b {
+		if !(ch == '_' || ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || i > 0 && ch >= '0' && ch <= '9') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// the labels on every sample: the job, tenant and worker, then Config.Tags
+// in name order.  Tags that would shadow one of ours are left out.
+func (c *Coordinator) metricLabels() string {
+	labels := fmt.Sprintf(`job="%s",tenant="%s",worker="%s"`, escapeLabel(c.config.JobId), escapeLabel(c.config.Tenant), escapeLabel(c.config.NodeId))
+	seen := map[string]bool{"job": true, "tenant": true, "worker": true, "name": true}
+	var names []string
+	for name := range c.config.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		l := labelName(name)
+		if l == "" || seen[l] || strings.HasPrefix(l, "__") {
+			continue
+		}
+		seen[l] = true
+		labels += fmt.Sprintf(`,%s="%s"`, l, escapeLabel(c.config.Tags[name]))
+	}
+	return labels
+}
+
+func (c *Coordinator) writeMetrics(w io.Writer) error {
+	m := &metricsWriter{
+		w:      bufio.NewWriter(w),
+		labels: c.metricLabels(),
+	}
+	m.metric("waffle_state", "gauge", "Coordination state, 0 new to 6 join.", float64(atomic.LoadInt32(&c.state)))
+	if g := c.graph; g != nil {
+		m.metric("waffle_superstep", "gauge", "Step being computed.", float64(g.Superstep()))
+		g.globalStat.Lock()
+		active, msgs := g.globalStat.active, g.globalStat.msgs
+		counters, gauges := g.globalStat.counters, g.globalStat.gauges
+		g.globalStat.Unlock()
+		m.metric("waffle_active_vertices", "gauge", "Active vertices in the cluster after the last step.", float64(active))
+		m.metric("waffle_step_messages", "gauge", "Messages sent in the cluster in the last step.", float64(msgs))
+		m.metric("waffle_vertices", "gauge", "Vertices in this worker's partition.", float64(g.vertexCount()))
+		m.metric("waffle_memory_pressure", "gauge", "Memory in use as a fraction of the memory budget.", g.MemoryPressure())
+		m.metric("waffle_inbox_messages", "gauge", "Messages waiting in the inbox for future steps.", float64(g.inboxDepth()))
+		m.named("waffle_counter", "gauge", "Job counters summed over the cluster in the last step.", counters)
+		m.named("waffle_gauge", "gauge", "Job gauges, the largest over the cluster in the last step.", gauges)
+	}
+	sent, failed := c.outbox.totals()
+	m.metric("waffle_outbox_messages", "gauge", "Messages sent by this worker and not acked yet.", float64(c.outbox.pending()))
+	m.metric("waffle_messages_sent_total", "counter", "Messages this worker has sent.", float64(sent))
+	m.metric("waffle_rpc_failures_total", "counter", "Failed rpc calls carrying messages.", float64(failed))
+	m.metric("waffle_barrier_wait_seconds_total", "counter", "Time spent waiting on step barriers after finishing a step.", c.clock.barrierWait().Seconds())
+	return m.w.Flush()
+}
+
+func (c *Coordinator) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get(tokenHeader)
+	if bearer := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(bearer, "Bearer ") {
+		token = strings.TrimPrefix(bearer, "Bearer ")
+	}
+	if !c.isJobToken(token) && !c.config.ACL.allows(token, OpMetrics) {
+		c.audit(OpMetrics, r.RemoteAddr, "denied")
+		http.Error(w, errDenied.Error(), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	c.writeMetrics(w)
+}
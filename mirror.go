@@ -0,0 +1,226 @@
+package waffle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+)
+
+// mirrorCache tracks remote vertices that this partition sends a lot of
+// messages to and keeps read-only copies of them from the previous superstep.
+// The owning side keeps snapshots of its own vertices that peers have asked
+// to mirror so that it can hand back a consistent value while it is already
+// computing the next step.
+type mirrorCache struct {
+	sync.Mutex
+	log       *logger
+	threshold int
+	// most ids kept in wanted and in hot each
+	limit int
+
+	// remote messages sent to each destination during the current step
+	fanIn map[string]int
+	// remote ids mirrored on this worker, by owning partition, with the last
+	// step they were hot
+	wanted  map[int]map[string]int
+	mirrors map[string]Vertex
+	// the step the mirrors are from
+	from int
+
+	// local ids that some peer mirrors with the last step they were hot, and
+	// their snapshots by step
+	hot       map[string]int
+	published map[int]map[string]Vertex
+}
+
+// ids that haven't been hot for this many steps stop being mirrored
+const mirrorIdleSteps = 8
+
+func newMirrorCache(threshold, limit int, l *logger) *mirrorCache {
+	if limit <= 0 {
+		limit = 10000
+	}
+	return &mirrorCache{
+		log:       l,
+		threshold: threshold,
+		limit:     limit,
+		fanIn:     make(map[string]int),
+		wanted:    make(map[int]map[string]int),
+		mirrors:   make(map[string]Vertex),
+		hot:       make(map[string]int),
+		published: make(map[int]map[string]Vertex),
+	}
+}
+
+func (mc *mirrorCache) enabled() bool {
+	return mc.threshold > 0
+}
+
+func (mc *mirrorCache) noteRemote(id string) {
+	if !mc.enabled() {
+		return
+	}
+	mc.Lock()
+	defer mc.Unlock()
+	mc.fanIn[id]++
+}
+
+// hotIds returns the remote ids that crossed the threshold this step and
+// resets the counters.
+func (mc *mirrorCache) hotIds() (ids []string) {
+	mc.Lock()
+	defer mc.Unlock()
+	for id, n := range mc.fanIn {
+		if n >= mc.threshold {
+			ids = append(ids, id)
+		}
+	}
+	mc.fanIn = make(map[string]int)
+	return
+}
+
+func (mc *mirrorCache) want(id string, pid, step int) {
+	mc.Lock()
+	defer mc.Unlock()
+	if mc.wanted[pid] == nil {
+		mc.wanted[pid] = make(map[string]int)
+	}
+	if _, ok := mc.wanted[pid][id]; !ok && mc.wantedCount() >= mc.limit {
+		return
+	}
+	mc.wanted[pid][id] = step
+}
+
+func (mc *mirrorCache) wantedCount() (n int) {
+	for _, ids := range mc.wanted {
+		n += len(ids)
+	}
+	return
+}
+
+// markHot starts publishing a local vertex.  It's called between steps, so a
+// vertex that just turned hot goes into the snapshot of the step that ended
+// too, otherwise the first refresh on the other side comes back empty.
+func (mc *mirrorCache) markHot(id string, step int, vertex func(id string) (Vertex, bool, bool)) {
+	mc.Lock()
+	defer mc.Unlock()
+	if _, ok := mc.hot[id]; ok {
+		mc.hot[id] = step
+		return
+	}
+	if len(mc.hot) >= mc.limit {
+		return
+	}
+	mc.hot[id] = step
+	snap, ok := mc.published[step]
+	if !ok {
+		return
+	}
+	if v, _, ok := vertex(id); ok {
+		if c, err := copyVertex(v); err == nil {
+			snap[id] = c
+		} else {
+			mc.log.Printf("Could not snapshot vertex %s for mirroring: %v", id, err)
+		}
+	}
+}
+
+// forget the ids that have gone cold, along with our copies of them
+func (mc *mirrorCache) expire(step int) {
+	for id, last := range mc.hot {
+		if step-last > mirrorIdleSteps {
+			delete(mc.hot, id)
+		}
+	}
+	for pid, ids := range mc.wanted {
+		for id, last := range ids {
+			if step-last > mirrorIdleSteps {
+				delete(ids, id)
+				delete(mc.mirrors, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(mc.wanted, pid)
+		}
+	}
+}
+
+func (mc *mirrorCache) get(id string) (Vertex, bool) {
+	mc.Lock()
+	defer mc.Unlock()
+	v, ok := mc.mirrors[id]
+	return v, ok
+}
+
+// copyVertex makes a deep copy of v by round tripping it through gob, which
+// means the concrete type has to be registered just like for the rpc calls.
+func copyVertex(v Vertex) (Vertex, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return nil, err
+	}
+	var c Vertex
+	if err := gob.NewDecoder(&buf).Decode(&c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// publish snapshots the hot local vertices as they stand at the end of step.
+// We keep the previous snapshot around as well since a slow peer may still be
+// asking for it.
+func (mc *mirrorCache) publish(step int, vertex func(id string) (Vertex, bool, bool)) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.expire(step)
+	snap := make(map[string]Vertex)
+	for id := range mc.hot {
+		v, _, ok := vertex(id)
+		if !ok {
+			continue
+		}
+		c, err := copyVertex(v)
+		if err != nil {
+			mc.log.Printf("Could not snapshot vertex %s for mirroring: %v", id, err)
+			continue
+		}
+		snap[id] = c
+	}
+	mc.published[step] = snap
+	delete(mc.published, step-2)
+}
+
+func (mc *mirrorCache) snapshot(step int, ids []string) map[string]Vertex {
+	mc.Lock()
+	defer mc.Unlock()
+	r := make(map[string]Vertex)
+	if snap, ok := mc.published[step]; ok {
+		for _, id := range ids {
+			if v, ok := snap[id]; ok {
+				r[id] = v
+			}
+		}
+	}
+	return r
+}
+
+func (mc *mirrorCache) wantedIds() map[int][]string {
+	mc.Lock()
+	defer mc.Unlock()
+	r := make(map[int][]string)
+	for pid, ids := range mc.wanted {
+		for id := range ids {
+			r[pid] = append(r[pid], id)
+		}
+	}
+	return r
+}
+
+func (mc *mirrorCache) update(step int, vertices map[string]Vertex) {
+	mc.Lock()
+	defer mc.Unlock()
+	mc.from = step
+	for id, v := range vertices {
+		mc.mirrors[id] = v
+	}
+}
@@ -0,0 +1,77 @@
+package waffle
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// With Config.VerifyMirrors set, every so many steps each worker checks the
+// mirrors it holds against the snapshots their owners published.  A mirror
+// is a read-only copy, so one that no longer matches means a Compute changed
+// something it shouldn't have, or the copy didn't survive the trip (a type
+// that doesn't encode all of its state, say, or workers built from different
+// code).  Either way results can't be trusted, so it gets logged, audited and
+// counted as mirror.divergent.
+
+// a checksum of each of the vertices
+func vertexSums(vertices map[string]Vertex) map[string]uint64 {
+	sums := make(map[string]uint64)
+	for id, v := range vertices {
+		sums[id] = vertexSum(v)
+	}
+	return sums
+}
+
+// MirrorSums hands back checksums of the vertices we published for req.Step.
+func (c *Coordinator) MirrorSums(req *MirrorRequest, r *map[string]uint64) error {
+	*r = vertexSums(c.graph.mirrors.snapshot(req.Step, req.Ids))
+	return nil
+}
+
+// the mirrors we have from partition pid, as of the step they came from
+func (mc *mirrorCache) held(ids []string) (map[string]Vertex, int) {
+	mc.Lock()
+	defer mc.Unlock()
+	r := make(map[string]Vertex)
+	for _, id := range ids {
+		if v, ok := mc.mirrors[id]; ok {
+			r[id] = v
+		}
+	}
+	return r, mc.from
+}
+
+func (g *Graph) verifyingMirrors(step int) bool {
+	n := g.coordinator.config.VerifyMirrors
+	return n > 0 && step%n == 0
+}
+
+// check the mirrors held from partition pid against what it published
+func (g *Graph) verifyMirrors(pid int, ids []string) {
+	held, from := g.mirrors.held(ids)
+	if len(held) == 0 || from == 0 {
+		return
+	}
+	c := g.coordinator
+	cl := c.client(c.worker(pid))
+	var theirs map[string]uint64
+	if err := cl.Call("Coordinator.MirrorSums", &MirrorRequest{Step: from, Ids: ids}, &theirs); err != nil {
+		g.log.Printf("Could not verify mirrors from partition %d: %v", pid, err)
+		return
+	}
+	var divergent []string
+	for id, sum := range vertexSums(held) {
+		if s, ok := theirs[id]; ok && s != sum {
+			divergent = append(divergent, id)
+		}
+	}
+	if len(divergent) == 0 {
+		return
+	}
+	sort.Strings(divergent)
+	g.Count("mirror.divergent", float64(len(divergent)))
+	detail := fmt.Sprintf("%d mirrors from partition %d differ from step %d: %s", len(divergent), pid, from, strings.Join(divergent, ", "))
+	g.log.Printf("Mirrors diverged! %s", detail)
+	c.audit("diverge", "mirrors", detail)
+}
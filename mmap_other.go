@@ -0,0 +1,17 @@
+//go:build !darwin && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!freebsd,!linux,!netbsd,!openbsd
+
+package waffle
+
+import (
+	"errors"
+	"os"
+)
+
+func mmap(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("memory mapped spill files are not supported on this platform")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
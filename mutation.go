@@ -0,0 +1,143 @@
+package waffle
+
+import (
+	"fmt"
+	"net/rpc"
+)
+
+// Kinds of Mutation.
+const (
+	MutateAddVertex = iota
+	MutateAddEdge
+	MutateRemoveVertex
+	MutateRemoveEdge
+	MutateSetEdgeValue
+)
+
+// A Mutation is one change for Graph.ApplyMutations, doing what the Graph
+// method of the same name does.  Type is the registered vertex or edge type
+// to add, Id the vertex to add or remove, and Src and Dst the edge to add,
+// remove or set the Value of.
+type Mutation struct {
+	Kind     int
+	Type     string
+	Id       string
+	Src, Dst string
+	Value    float64
+}
+
+// the mutations bound for one partition
+type MutationBatch struct {
+	Vertices []Vertex
+	Edges    []Edge
+	Removal  Removal
+	Updates  []EdgeUpdate
+}
+
+func (c *Coordinator) SubmitMutations(b *MutationBatch, r *int) error {
+	c.graph.applyMutationBatch(b)
+	*r = 0
+	return nil
+}
+
+func (g *Graph) applyMutationBatch(b *MutationBatch) {
+	for _, v := range b.Vertices {
+		g.addVertex(v)
+	}
+	for _, e := range b.Edges {
+		g.addEdge(e)
+	}
+	g.queueRemoval(&b.Removal)
+	if len(b.Updates) > 0 {
+		g.updates.queue(b.Updates)
+	}
+}
+
+// ApplyMutations makes all of ms at once, sending each partition everything
+// bound for it in a single call rather than one per change.  They take
+// effect at the start of the next step like the one at a time kind.  Nothing
+// is applied unless every mutation checks out.
+func (g *Graph) ApplyMutations(ms []Mutation) error {
+	batches := make(map[int]*MutationBatch)
+	batch := func(id string) *MutationBatch {
+		p := g.determinePartition(id)
+		if batches[p] == nil {
+			batches[p] = &MutationBatch{}
+		}
+		return batches[p]
+	}
+	counts := make(map[string]float64)
+	for i, m := range ms {
+		switch m.Kind {
+		case MutateAddVertex:
+			v, err := NewVertexOf(m.Type, m.Id)
+			if err != nil {
+				return fmt.Errorf("mutation %d: %v", i, err)
+			}
+			if err := checkSendable("vertex", v); err != nil {
+				return fmt.Errorf("mutation %d: %v", i, err)
+			}
+			b := batch(m.Id)
+			b.Vertices = append(b.Vertices, v)
+			counts[counterVerticesAdded]++
+		case MutateAddEdge:
+			e, err := NewEdgeOf(m.Type, m.Src, m.Dst)
+			if err != nil {
+				return fmt.Errorf("mutation %d: %v", i, err)
+			}
+			if err := checkSendable("edge", e); err != nil {
+				return fmt.Errorf("mutation %d: %v", i, err)
+			}
+			b := batch(m.Src)
+			b.Edges = append(b.Edges, e)
+			counts[counterEdgesAdded]++
+		case MutateRemoveVertex:
+			if m.Id == "" {
+				return fmt.Errorf("mutation %d removes a vertex with no id", i)
+			}
+			b := batch(m.Id)
+			b.Removal.Vertices = append(b.Removal.Vertices, m.Id)
+			counts[counterVerticesRemoved]++
+		case MutateRemoveEdge:
+			if m.Src == "" || m.Dst == "" {
+				return fmt.Errorf("mutation %d removes an edge without both ends", i)
+			}
+			pair := [2]string{m.Src, m.Dst}
+			b := batch(m.Src)
+			b.Removal.Edges = append(b.Removal.Edges, pair)
+			if g.coordinator.config.InEdges {
+				in := batch(m.Dst)
+				in.Removal.InEdges = append(in.Removal.InEdges, pair)
+			}
+			counts[counterEdgesRemoved]++
+		case MutateSetEdgeValue:
+			if m.Src == "" || m.Dst == "" {
+				return fmt.Errorf("mutation %d sets the value of an edge without both ends", i)
+			}
+			b := batch(m.Src)
+			b.Updates = append(b.Updates, EdgeUpdate{Src: m.Src, Dst: m.Dst, Value: m.Value})
+			counts[counterEdgesUpdated]++
+		default:
+			return fmt.Errorf("mutation %d is of unknown kind %d", i, m.Kind)
+		}
+	}
+	if g.shadowing() {
+		return nil
+	}
+	for name, n := range counts {
+		g.Count(name, n)
+	}
+	g.noteMutations(len(ms))
+
+	c := g.coordinator
+	for p, b := range batches {
+		if p == g.partitionId {
+			g.applyMutationBatch(b)
+			continue
+		}
+		// like messages, these only have to be in before the step barrier
+		cl := c.client(c.worker(p))
+		c.outbox.trackN(0, cl.Go("Coordinator.SubmitMutations", b, new(int), make(chan *rpc.Call, 1)))
+	}
+	return nil
+}
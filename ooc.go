@@ -0,0 +1,285 @@
+package waffle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Partitions with more vertices than Config.ResidentVertices keep the rest on
+// local disk.  Cold vertices are appended to a segment file with an index in
+// memory, and each step only the ones that are active or have messages get
+// paged in, computed and appended again.  The segment is rewritten once most
+// of it is stale.
+//
+// Cold vertices are computed after the resident ones, without regard to
+// message priority.  Anything that walks the whole partition goes through
+// eachVertex, which pages them in as it goes.
+
+type coldEntry struct {
+	off, n int64
+	active bool
+}
+
+type coldStore struct {
+	f     *os.File
+	size  int64
+	dead  int64
+	index map[string]coldEntry
+}
+
+func newColdStore(dir, name string) (*coldStore, error) {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	// like spill files nobody needs to find it again
+	os.Remove(f.Name())
+	return &coldStore{f: f, index: make(map[string]coldEntry)}, nil
+}
+
+func (s *coldStore) put(v Vertex) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&v); err != nil {
+		return err
+	}
+	if _, err := s.f.WriteAt(buf.Bytes(), s.size); err != nil {
+		return err
+	}
+	if old, ok := s.index[v.Id()]; ok {
+		s.dead += old.n
+	}
+	s.index[v.Id()] = coldEntry{off: s.size, n: int64(buf.Len()), active: v.Active()}
+	s.size += int64(buf.Len())
+	return nil
+}
+
+// forget id, its record is dead space until the next compaction
+func (s *coldStore) remove(id string) {
+	if s == nil {
+		return
+	}
+	if e, ok := s.index[id]; ok {
+		s.dead += e.n
+		delete(s.index, id)
+	}
+}
+
+func (s *coldStore) get(id string) (Vertex, error) {
+	e, ok := s.index[id]
+	if !ok {
+		return nil, fmt.Errorf("no cold vertex %s", id)
+	}
+	b := make([]byte, e.n)
+	if _, err := s.f.ReadAt(b, e.off); err != nil {
+		return nil, err
+	}
+	var v Vertex
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// rewrite the segment without the stale records once they are the majority
+func (s *coldStore) compact() error {
+	if s.dead < s.size/2 {
+		return nil
+	}
+	f, err := os.Create(s.f.Name() + ".compact")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	var size int64
+	index := make(map[string]coldEntry, len(s.index))
+	for id, e := range s.index {
+		b := make([]byte, e.n)
+		if _, err := s.f.ReadAt(b, e.off); err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.WriteAt(b, size); err != nil {
+			f.Close()
+			return err
+		}
+		index[id] = coldEntry{off: size, n: e.n, active: e.active}
+		size += e.n
+	}
+	s.f.Close()
+	s.f, s.size, s.dead, s.index = f, size, 0, index
+	return nil
+}
+
+// move vertices over the resident budget out to the cold store, called once
+// the graph is loaded
+func (g *Graph) spillVertices() {
+	c := g.coordinator
+	budget := c.config.ResidentVertices
+	if budget <= 0 || len(g.vertices) <= budget {
+		return
+	}
+	cold := g.coldStore()
+	if cold == nil {
+		return
+	}
+	for id, v := range g.vertices {
+		if len(g.vertices) <= budget {
+			break
+		}
+		if err := cold.put(v); err != nil {
+			g.coordinator.fail(fmt.Errorf("could not spill vertex %s: %v", id, err))
+			return
+		}
+		delete(g.vertices, id)
+	}
+	g.log.Printf("Keeping %d vertices in memory and %d on disk", len(g.vertices), len(cold.index))
+}
+
+// the cold store, created the first time it's needed
+func (g *Graph) coldStore() *coldStore {
+	if g.cold != nil {
+		return g.cold
+	}
+	c := g.coordinator
+	dir := c.config.SpillDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	name := fmt.Sprintf("%s-%s-vertices.cold", strings.Replace(c.config.namespace(), "/", "-", -1), c.config.NodeId)
+	cold, err := newColdStore(dir, name)
+	if err != nil {
+		g.coordinator.fail(fmt.Errorf("could not create the cold vertex store: %v", err))
+		return nil
+	}
+	g.cold = cold
+	return cold
+}
+
+// page in and compute the cold vertices that have anything to do this step
+func (g *Graph) computeCold() {
+	s := g.cold
+	if s == nil {
+		return
+	}
+	var paged int
+	for id, e := range s.index {
+		if _, ok := g.messages[id]; !ok && !e.active {
+			continue
+		}
+		v, err := s.get(id)
+		if err != nil {
+			g.coordinator.fail(fmt.Errorf("could not page in vertex %s: %v", id, err))
+			return
+		}
+		g.computeVertex(v)
+		if err := s.put(v); err != nil {
+			g.coordinator.fail(fmt.Errorf("could not page out vertex %s: %v", id, err))
+			return
+		}
+		paged++
+	}
+	if err := s.compact(); err != nil {
+		g.log.Printf("Could not compact the cold vertex store: %v", err)
+	}
+	g.Count("ooc.paged", float64(paged))
+	g.Gauge("ooc.cold", float64(len(s.index)))
+	g.Gauge("ooc.bytes", float64(s.size))
+}
+
+// EachVertex calls fn with every vertex in the partition, paging in the ones
+// kept on disk.  Changes to paged in vertices are not kept.
+func (g *Graph) EachVertex(fn func(Vertex)) {
+	g.eachVertex(func(v Vertex, cold bool) bool {
+		fn(v)
+		return true
+	})
+}
+
+// call fn with every vertex in the partition, the resident ones first, until
+// it returns false.  Cold vertices are paged in, and changes to them are lost
+// unless they are put back.
+func (g *Graph) eachVertex(fn func(v Vertex, cold bool) bool) {
+	for _, v := range g.vertices {
+		if !fn(v, false) {
+			return
+		}
+	}
+	if g.cold == nil {
+		return
+	}
+	for id := range g.cold.index {
+		v, err := g.cold.get(id)
+		if err != nil {
+			g.coordinator.fail(fmt.Errorf("could not page in vertex %s: %v", id, err))
+			return
+		}
+		if !fn(v, true) {
+			return
+		}
+	}
+}
+
+// call fn with the id of every vertex in the partition, without paging any in
+func (g *Graph) eachId(fn func(id string)) {
+	for id := range g.vertices {
+		fn(id)
+	}
+	if g.cold != nil {
+		for id := range g.cold.index {
+			fn(id)
+		}
+	}
+}
+
+// vertex id, paged in if it is cold
+func (g *Graph) vertex(id string) (v Vertex, cold, ok bool) {
+	if v, ok := g.vertices[id]; ok {
+		return v, false, true
+	}
+	if g.cold == nil {
+		return nil, false, false
+	}
+	if _, ok := g.cold.index[id]; !ok {
+		return nil, false, false
+	}
+	v, err := g.cold.get(id)
+	if err != nil {
+		g.coordinator.fail(fmt.Errorf("could not page in vertex %s: %v", id, err))
+		return nil, false, false
+	}
+	return v, true, true
+}
+
+// put v in the partition, replacing what's there under its id wherever that
+// is kept
+func (g *Graph) putVertex(v Vertex) {
+	g.touch(v.Id())
+	if g.cold != nil {
+		if _, ok := g.cold.index[v.Id()]; ok {
+			if err := g.cold.put(v); err != nil {
+				g.coordinator.fail(fmt.Errorf("could not page out vertex %s: %v", v.Id(), err))
+			}
+			return
+		}
+	}
+	g.vertices[v.Id()] = v
+}
+
+// take id out of the partition, in memory or not
+func (g *Graph) dropVertex(id string) {
+	delete(g.vertices, id)
+	g.cold.remove(id)
+}
+
+// number of vertices in the partition, in memory or not
+func (g *Graph) vertexCount() int {
+	n := len(g.vertices)
+	if g.cold != nil {
+		n += len(g.cold.index)
+	}
+	return n
+}
@@ -0,0 +1,66 @@
+package waffle
+
+import (
+	"fmt"
+	"sort"
+)
+
+// An Output is one of the named results of a job, written by Write into Dir.
+// Write is WriteResults, a ResultWriter's Write, or anything else that writes
+// the partition's part with the same manifest handling.
+type Output struct {
+	Dir   string
+	Write func(g *Graph, dir string) error
+}
+
+// Jobs that implement OutputsJob have each of their outputs written after
+// Write, during the write phase.  Every output gets its own manifest.
+type OutputsJob interface {
+	Outputs() map[string]Output
+}
+
+func (g *Graph) outputs() map[string]Output {
+	if j, ok := g.job.(OutputsJob); ok {
+		return j.Outputs()
+	}
+	return nil
+}
+
+// write the job's named outputs, in name order so every worker goes through
+// them the same way
+func (g *Graph) writeOutputs() error {
+	outputs := g.outputs()
+	var names []string
+	dirs := make(map[string]string)
+	for name, o := range outputs {
+		if o.Dir == "" || o.Write == nil {
+			return fmt.Errorf("output %s needs a Dir and a Write", name)
+		}
+		if other, ok := dirs[o.Dir]; ok {
+			return fmt.Errorf("outputs %s and %s are both written to %s", other, name, o.Dir)
+		}
+		dirs[o.Dir] = name
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o := outputs[name]
+		if err := o.Write(g, o.Dir); err != nil {
+			return fmt.Errorf("could not write output %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// the directory of each named output, for the job summary
+func (g *Graph) outputDirs() map[string]string {
+	outputs := g.outputs()
+	if len(outputs) == 0 {
+		return nil
+	}
+	dirs := make(map[string]string)
+	for name, o := range outputs {
+		dirs[name] = o.Dir
+	}
+	return dirs
+}
@@ -0,0 +1,41 @@
+package waffle
+
+import (
+	"sort"
+)
+
+// A Partitioner decides which partition each vertex lives in and which
+// worker gets which partition.
+type Partitioner interface {
+	// PartitionOf returns the partition, in [0, partitions), vertex id
+	// belongs to
+	PartitionOf(id string, partitions int) int
+	// Assign orders the registered workers so that the worker at index i
+	// gets partition i
+	Assign(workers []string) []string
+}
+
+// HashPartitioner is the default, it spreads vertices by the sum of the
+// characters in their ids and hands out partitions in worker id order.
+type HashPartitioner struct{}
+
+func (HashPartitioner) PartitionOf(id string, partitions int) int {
+	sum := 0
+	for _, c := range id {
+		sum += int(c)
+	}
+	return sum % partitions
+}
+
+func (HashPartitioner) Assign(workers []string) []string {
+	sorted := append([]string(nil), workers...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func (c *Config) partitioner() Partitioner {
+	if c.Partitioner != nil {
+		return c.Partitioner
+	}
+	return HashPartitioner{}
+}
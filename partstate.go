@@ -0,0 +1,34 @@
+package waffle
+
+// Jobs that implement PartitionStateJob get an object of their choosing
+// attached to each partition, for algorithms that keep partition wide
+// structures (a local heap, a bloom filter) next to their vertices.  The
+// state is made once the partition id is known, before anything gets loaded.
+type PartitionStateJob interface {
+	Job
+	NewPartitionState(partition int) interface{}
+}
+
+// Partition state that implements StateCheckpointer gets checkpointed along
+// with the graph, whenever Job.Checkpoint says so.
+type StateCheckpointer interface {
+	CheckpointState(partition, step int) error
+}
+
+func (g *Graph) initPartitionState() {
+	if j, ok := g.job.(PartitionStateJob); ok {
+		g.partitionState = j.NewPartitionState(g.partitionId)
+	}
+}
+
+// PartitionState returns the job's state object for this partition, or nil.
+func (g *Graph) PartitionState() interface{} {
+	return g.partitionState
+}
+
+func (g *Graph) checkpointPartitionState(step int) error {
+	if sc, ok := g.partitionState.(StateCheckpointer); ok {
+		return sc.CheckpointState(g.partitionId, step)
+	}
+	return nil
+}
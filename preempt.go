@@ -0,0 +1,125 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"launchpad.net/gozk/zookeeper"
+	"log"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// A job run with RunPreemptible can be pushed aside by a more important one.
+// Preempt drops a preempt node into the victim's job path.  Workers that see
+// it say so in their next step summary, and at that barrier everyone takes a
+// savepoint and stops.  Once the preempting job calls the release func
+// Preempt returned, the victim picks up again from its savepoint.  The node
+// is ephemeral, so a preempting job that dies without releasing lets the
+// victim go too.
+
+var ErrPreempted = errors.New("job was preempted")
+
+// Preempt asks the job victim runs as to make way, returning a func to call
+// once it may carry on.  Preemption takes effect at the victim's next step
+// barrier, which can be a little while.
+func Preempt(c *Config, victim *Config) (release func() error, err error) {
+	zk, _, err := zookeeper.Dial(c.ZKServers, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	p := path.Join("/", victim.namespace(), PreemptPath)
+	if _, err := zk.Create(p, c.namespace(), zookeeper.EPHEMERAL, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil {
+		zk.Close()
+		return nil, err
+	}
+	return func() error {
+		defer zk.Close()
+		return zk.Delete(p, -1)
+	}, nil
+}
+
+func (c *Coordinator) watchPreempt() {
+	for {
+		stat, watch, err := c.zk.ExistsW(c.preemptPath)
+		if err != nil {
+			c.log.Printf("Could not watch %s: %v", c.preemptPath, err)
+			return
+		}
+		if stat != nil {
+			by, _, _ := c.zk.Get(c.preemptPath)
+			c.log.Printf("Preempted by %s, stopping at the next step barrier", by)
+			c.audit("preempt", by, "")
+			atomic.StoreInt32(&c.preempted, 1)
+			return
+		}
+		<-watch
+	}
+}
+
+// savepoint checkpoints the graph as it stands after step, as if the next
+// step were checkpointing, and stops the job
+func (c *Coordinator) savepoint(step int) {
+	g := c.graph
+	if err := g.job.Persist(g); err != nil {
+		c.fail(fmt.Errorf("could not take a savepoint after step %d: %v", step, err))
+		return
+	}
+	if err := g.checkpointPartitionState(step + 1); err != nil {
+		c.fail(fmt.Errorf("could not take a savepoint after step %d: %v", step, err))
+		return
+	}
+	c.lastCheckpoint = step + 1
+	c.checkpoints = append(c.checkpoints, step+1)
+	c.retained.add(step + 1)
+	c.persistState(step)
+	c.checkpointCommitted(step + 1)
+	c.log.Printf("Took a savepoint after step %d", step)
+	c.fail(ErrPreempted)
+}
+
+// RunPreemptible runs the job, waiting out any preemption and resuming from
+// the savepoint.  The job has to implement StatePersister and load its own
+// checkpoints, as with Resume.
+func RunPreemptible(c *Config, j Job) error {
+	for {
+		state, err := loadState(c, j)
+		if err != nil {
+			return err
+		}
+		r, err := newRunner(c, j, state)
+		if err != nil {
+			return err
+		}
+		err = r.Run(context.Background())
+		r.Close()
+		if err != ErrPreempted {
+			return err
+		}
+		if err := waitPreempt(c); err != nil {
+			return err
+		}
+	}
+}
+
+// wait for the preempt node to go away
+func waitPreempt(c *Config) error {
+	zk, _, err := zookeeper.Dial(c.ZKServers, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer zk.Close()
+	p := path.Join("/", c.namespace(), PreemptPath)
+	for {
+		stat, watch, err := zk.ExistsW(p)
+		if err != nil {
+			return err
+		}
+		if stat == nil {
+			log.Printf("Preemption is over, resuming")
+			return nil
+		}
+		<-watch
+	}
+}
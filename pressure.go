@@ -0,0 +1,52 @@
+package waffle
+
+import (
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// how stale a memory reading MemoryPressure may hand out
+const pressureInterval = 100 * time.Millisecond
+
+var pressureSamples = []metrics.Sample{
+	{Name: "/memory/classes/total:bytes"},
+	{Name: "/memory/classes/heap/released:bytes"},
+}
+
+type memoryPressure struct {
+	sync.Mutex
+	read  time.Time
+	value float64
+}
+
+// memory the runtime holds, counted the way the memory limit counts it
+func memoryInUse() uint64 {
+	s := make([]metrics.Sample, len(pressureSamples))
+	copy(s, pressureSamples)
+	metrics.Read(s)
+	if s[0].Value.Kind() != metrics.KindUint64 || s[1].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return s[0].Value.Uint64() - s[1].Value.Uint64()
+}
+
+// MemoryPressure is how close this worker is to its Config.MemoryBudget, the
+// memory in use as a fraction of the budget.  It passes 1 when the worker is
+// over and the collector is working hard to keep it there.  Compute can use
+// it to back off, say by sending fewer messages, dropping caches or taking
+// shorter walks.  It is always 0 without a budget.
+func (g *Graph) MemoryPressure() float64 {
+	budget := g.coordinator.config.MemoryBudget
+	if budget <= 0 {
+		return 0
+	}
+	p := &g.pressure
+	p.Lock()
+	defer p.Unlock()
+	if time.Since(p.read) > pressureInterval {
+		p.value = float64(memoryInUse()) / float64(budget)
+		p.read = time.Now()
+	}
+	return p.value
+}
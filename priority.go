@@ -0,0 +1,83 @@
+package waffle
+
+import (
+	"sort"
+)
+
+// Messages that implement PrioritizedMessage are delivered ahead of lower
+// priority ones.  Within a vertex the messages handed to Compute are ordered
+// by class.  Vertices are computed, and so send, in weighted turns: each round
+// a class gets as many vertices as its class number plus one, so something
+// like a termination token doesn't end up sitting behind a pile of bulk data,
+// and the bulk data still gets its share instead of waiting on a steady
+// stream of higher class traffic.  Plain messages are class 0.
+type PrioritizedMessage interface {
+	Message
+	Priority() int
+}
+
+func priorityOf(m Message) int {
+	if pm, ok := m.(PrioritizedMessage); ok {
+		return pm.Priority()
+	}
+	return 0
+}
+
+// how many vertices a class gets per round
+func classWeight(class int) int {
+	if class < 0 {
+		return 1
+	}
+	return class + 1
+}
+
+type byPriority []Message
+
+func (p byPriority) Len() int           { return len(p) }
+func (p byPriority) Less(i, j int) bool { return priorityOf(p[i]) > priorityOf(p[j]) }
+func (p byPriority) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// order the messages for this step by class, returning the ids of the
+// vertices that got any in the order they should be computed, or nil if
+// nothing is above class 0
+func (g *Graph) prioritize() []string {
+	byClass := make(map[int][]string)
+	ranked := false
+	for id, msgs := range g.messages {
+		max := 0
+		for _, m := range msgs {
+			if p := priorityOf(m); p > max {
+				max = p
+			}
+		}
+		if max > 0 {
+			sort.Stable(byPriority(msgs))
+			ranked = true
+		}
+		byClass[max] = append(byClass[max], id)
+	}
+	if !ranked {
+		return nil
+	}
+	classes := make([]int, 0, len(byClass))
+	n := 0
+	for class, ids := range byClass {
+		sort.Strings(ids)
+		classes = append(classes, class)
+		n += len(ids)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(classes)))
+	order := make([]string, 0, n)
+	for len(order) < n {
+		for _, class := range classes {
+			ids := byClass[class]
+			k := classWeight(class)
+			if k > len(ids) {
+				k = len(ids)
+			}
+			order = append(order, ids[:k]...)
+			byClass[class] = ids[k:]
+		}
+	}
+	return order
+}
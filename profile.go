@@ -0,0 +1,66 @@
+package waffle
+
+import (
+	"time"
+)
+
+// only one in this many calls gets timed, the rest are assumed to take as
+// long on average
+const profileSampleEvery = 64
+
+type sampler struct {
+	calls int
+	total time.Duration
+}
+
+func (s *sampler) start() (time.Time, bool) {
+	s.calls++
+	if s.calls%profileSampleEvery != 0 {
+		return time.Time{}, false
+	}
+	return time.Now(), true
+}
+
+func (s *sampler) stop(t time.Time) {
+	s.total += time.Since(t) * profileSampleEvery
+}
+
+// stepProfile splits up the time a worker spends in a step between the job's
+// compute, queueing and sending messages, and encoding spilled messages.
+// Flushing is timed by the coordinator.  The totals go out as counters, so
+// the step barrier adds them up for the whole cluster.
+type stepProfile struct {
+	start        time.Time
+	send, encode sampler
+}
+
+func (g *Graph) startProfile() {
+	if !g.coordinator.config.Profile {
+		return
+	}
+	g.prof = &stepProfile{start: time.Now()}
+}
+
+func (g *Graph) endProfile() {
+	p := g.prof
+	if p == nil {
+		return
+	}
+	g.prof = nil
+	total := time.Since(p.start)
+	g.Count("profile.compute", (total - p.send.total).Seconds())
+	g.Count("profile.queue", (p.send.total - p.encode.total).Seconds())
+	g.Count("profile.encode", p.encode.total.Seconds())
+}
+
+func (c *Coordinator) logProfile(step int) {
+	if !c.config.Profile {
+		return
+	}
+	s := func(name string) float64 {
+		v, _ := c.graph.Stat(name)
+		return v
+	}
+	c.log.Printf("Step %d profile: compute %.2fs, queue %.2fs, encode %.2fs, flush %.2fs", step,
+		s("profile.compute"), s("profile.queue"), s("profile.encode"), s("profile.flush"))
+}
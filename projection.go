@@ -0,0 +1,64 @@
+package waffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// ResultWriter writes only part of each vertex, one JSON object per line,
+// instead of the whole gob encoded vertex that WriteResults writes.  Results
+// written this way are for reading elsewhere, they can't be loaded back with
+// LoadResults.
+type ResultWriter struct {
+	// picks what to write for a vertex, nil skips the vertex
+	Projection func(Vertex) map[string]interface{}
+	// used when Projection is nil: exported fields of the vertex struct to
+	// write, "id" is the vertex id.  Fields a vertex doesn't have are left out.
+	Fields []string
+}
+
+// Write writes this partition's projected vertices into dir, for use in a
+// job's Write.  The manifest is committed after the write barrier, like with
+// WriteResults.
+func (rw *ResultWriter) Write(g *Graph, dir string) error {
+	project := rw.Projection
+	if project == nil {
+		if len(rw.Fields) == 0 {
+			return fmt.Errorf("result writer has no Projection or Fields")
+		}
+		project = rw.project
+	}
+	return writePart(g, dir, "projection", func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		var err error
+		g.EachVertex(func(v Vertex) {
+			if err != nil {
+				return
+			}
+			if out := project(v); out != nil {
+				err = enc.Encode(out)
+			}
+		})
+		return err
+	})
+}
+
+func (rw *ResultWriter) project(v Vertex) map[string]interface{} {
+	out := make(map[string]interface{}, len(rw.Fields))
+	s := reflect.Indirect(reflect.ValueOf(v))
+	for _, name := range rw.Fields {
+		if name == "id" {
+			out[name] = v.Id()
+			continue
+		}
+		if s.Kind() != reflect.Struct {
+			continue
+		}
+		if f := s.FieldByName(name); f.IsValid() && f.CanInterface() {
+			out[name] = f.Interface()
+		}
+	}
+	return out
+}
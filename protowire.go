@@ -0,0 +1,351 @@
+package waffle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// The protobuf wire format sends every request and response as a Frame,
+// preceded by its length as a varint, the way protobuf delimited streams
+// are written, so tools in any language can follow the traffic:
+//
+//	message Frame {
+//	  string method = 1;
+//	  uint64 seq = 2;
+//	  string error = 3;
+//	  bytes body = 4;  // one of the messages below
+//	  bytes gob = 5;   // any other body, gob encoded
+//	}
+//	message Int { int64 value = 1; }
+//	message StepSummary { int64 step = 1; string worker = 2; string data = 3; }
+//	message MessageBatch { int64 step = 1; int64 count = 2; string codec = 3; bytes data = 4; }
+//	message RouteUpdate { repeated string ids = 1; int64 partition = 2; }
+//
+// The messages in a MessageBatch are the job's own types and stay gob
+// encoded.  Vertices and edges, which are too, go as gob bodies.
+
+const (
+	protoVarint = 0
+	protoBytes  = 2
+	// frames bigger than this are taken for garbage
+	maxProtoFrame = 1 << 30
+)
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// bodies with a protobuf form
+type protoMessage interface {
+	marshalProto() []byte
+	unmarshalProto([]byte) error
+}
+
+func protoAppendUvarint(b []byte, v uint64) []byte {
+	var n [binary.MaxVarintLen64]byte
+	return append(b, n[:binary.PutUvarint(n[:], v)]...)
+}
+
+func protoAppendVarint(b []byte, field int, v uint64) []byte {
+	b = protoAppendUvarint(b, uint64(field)<<3|protoVarint)
+	return protoAppendUvarint(b, v)
+}
+
+func protoAppendBytes(b []byte, field int, p []byte) []byte {
+	b = protoAppendUvarint(b, uint64(field)<<3|protoBytes)
+	b = protoAppendUvarint(b, uint64(len(p)))
+	return append(b, p...)
+}
+
+func protoAppendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return protoAppendBytes(b, field, []byte(s))
+}
+
+func protoAppendInt(b []byte, field int, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	return protoAppendVarint(b, field, uint64(int64(v)))
+}
+
+// call f with each field of the message in b, v is set for varints and p for
+// length delimited fields.  Fields of other wire types are skipped.
+func protoFields(b []byte, f func(field int, v uint64, p []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		var v uint64
+		var p []byte
+		switch key & 7 {
+		case protoVarint:
+			if v, n = binary.Uvarint(b); n <= 0 {
+				return errProtoTruncated
+			}
+			b = b[n:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errProtoTruncated
+			}
+			p, b = b[n:n+int(l)], b[n+int(l):]
+		case 1:
+			if len(b) < 8 {
+				return errProtoTruncated
+			}
+			b = b[8:]
+			continue
+		case 5:
+			if len(b) < 4 {
+				return errProtoTruncated
+			}
+			b = b[4:]
+			continue
+		default:
+			return fmt.Errorf("protobuf: field %d has unknown wire type %d", field, key&7)
+		}
+		if err := f(field, v, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StepSummary) marshalProto() []byte {
+	b := protoAppendInt(nil, 1, s.Step)
+	b = protoAppendString(b, 2, s.Worker)
+	return protoAppendString(b, 3, s.Data)
+}
+
+func (s *StepSummary) unmarshalProto(b []byte) error {
+	return protoFields(b, func(field int, v uint64, p []byte) error {
+		switch field {
+		case 1:
+			s.Step = int(int64(v))
+		case 2:
+			s.Worker = string(p)
+		case 3:
+			s.Data = string(p)
+		}
+		return nil
+	})
+}
+
+func (m *MessageBatch) marshalProto() []byte {
+	b := protoAppendInt(nil, 1, m.Step)
+	b = protoAppendInt(b, 2, m.Count)
+	b = protoAppendString(b, 3, m.Codec)
+	if len(m.Data) > 0 {
+		b = protoAppendBytes(b, 4, m.Data)
+	}
+	return b
+}
+
+func (m *MessageBatch) unmarshalProto(b []byte) error {
+	return protoFields(b, func(field int, v uint64, p []byte) error {
+		switch field {
+		case 1:
+			m.Step = int(int64(v))
+		case 2:
+			m.Count = int(int64(v))
+		case 3:
+			m.Codec = string(p)
+		case 4:
+			m.Data = append([]byte(nil), p...)
+		}
+		return nil
+	})
+}
+
+func (u *RouteUpdate) marshalProto() []byte {
+	var b []byte
+	for _, id := range u.Ids {
+		b = protoAppendBytes(b, 1, []byte(id))
+	}
+	return protoAppendInt(b, 2, u.Partition)
+}
+
+func (u *RouteUpdate) unmarshalProto(b []byte) error {
+	return protoFields(b, func(field int, v uint64, p []byte) error {
+		switch field {
+		case 1:
+			u.Ids = append(u.Ids, string(p))
+		case 2:
+			u.Partition = int(int64(v))
+		}
+		return nil
+	})
+}
+
+// the Frame fields carrying body
+func encodeProtoBody(b []byte, body interface{}) ([]byte, error) {
+	switch body := body.(type) {
+	case nil:
+		return b, nil
+	case protoMessage:
+		return protoAppendBytes(b, 4, body.marshalProto()), nil
+	case *int:
+		return protoAppendBytes(b, 4, protoAppendInt(nil, 1, *body)), nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return nil, err
+	}
+	return protoAppendBytes(b, 5, buf.Bytes()), nil
+}
+
+func decodeProtoBody(proto, gobbed []byte, body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	if gobbed != nil {
+		return gob.NewDecoder(bytes.NewReader(gobbed)).Decode(body)
+	}
+	switch body := body.(type) {
+	case protoMessage:
+		return body.unmarshalProto(proto)
+	case *int:
+		*body = 0
+		return protoFields(proto, func(field int, v uint64, p []byte) error {
+			if field == 1 {
+				*body = int(int64(v))
+			}
+			return nil
+		})
+	}
+	return fmt.Errorf("protobuf: %T has no protobuf form", body)
+}
+
+// one side of a protobuf connection, reading and writing frames
+type protoConn struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+	w    *bufio.Writer
+	// the body of the frame read last
+	body, gobbed []byte
+	sync.Mutex
+}
+
+func newProtoConn(conn io.ReadWriteCloser) *protoConn {
+	return &protoConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+}
+
+func (pc *protoConn) writeFrame(method string, seq uint64, errText string, body interface{}) error {
+	b := protoAppendString(nil, 1, method)
+	b = protoAppendVarint(b, 2, seq)
+	b = protoAppendString(b, 3, errText)
+	b, err := encodeProtoBody(b, body)
+	if err != nil {
+		return err
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	var n [binary.MaxVarintLen64]byte
+	if _, err := pc.w.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))]); err != nil {
+		return err
+	}
+	if _, err := pc.w.Write(b); err != nil {
+		return err
+	}
+	return pc.w.Flush()
+}
+
+func (pc *protoConn) readFrame() (method string, seq uint64, errText string, err error) {
+	l, err := binary.ReadUvarint(pc.r)
+	if err != nil {
+		return "", 0, "", err
+	}
+	if l > maxProtoFrame {
+		return "", 0, "", fmt.Errorf("protobuf: frame of %d bytes", l)
+	}
+	b := make([]byte, l)
+	if _, err := io.ReadFull(pc.r, b); err != nil {
+		return "", 0, "", err
+	}
+	pc.body, pc.gobbed = nil, nil
+	err = protoFields(b, func(field int, v uint64, p []byte) error {
+		switch field {
+		case 1:
+			method = string(p)
+		case 2:
+			seq = v
+		case 3:
+			errText = string(p)
+		case 4:
+			pc.body = p
+		case 5:
+			pc.gobbed = p
+		}
+		return nil
+	})
+	return method, seq, errText, err
+}
+
+func (pc *protoConn) readBody(body interface{}) error {
+	err := decodeProtoBody(pc.body, pc.gobbed, body)
+	pc.body, pc.gobbed = nil, nil
+	return err
+}
+
+func (pc *protoConn) Close() error {
+	return pc.conn.Close()
+}
+
+type protoClientCodec struct{ *protoConn }
+
+func (c protoClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	return c.writeFrame(r.ServiceMethod, r.Seq, "", body)
+}
+
+func (c protoClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	var err error
+	r.ServiceMethod, r.Seq, r.Error, err = c.readFrame()
+	return err
+}
+
+func (c protoClientCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+type protoServerCodec struct{ *protoConn }
+
+func (c protoServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	var err error
+	r.ServiceMethod, r.Seq, _, err = c.readFrame()
+	return err
+}
+
+func (c protoServerCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c protoServerCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		// whatever net/rpc hands us along with an error means nothing
+		body = nil
+	}
+	return c.writeFrame(r.ServiceMethod, r.Seq, r.Error, body)
+}
+
+type protoWire struct{}
+
+func (protoWire) Name() string { return "protobuf" }
+
+func (protoWire) NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClientWithCodec(protoClientCodec{newProtoConn(conn)})
+}
+
+func (protoWire) ServeConn(server *rpc.Server, conn io.ReadWriteCloser) {
+	server.ServeCodec(protoServerCodec{newProtoConn(conn)})
+}
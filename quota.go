@@ -0,0 +1,126 @@
+package waffle
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Config.MaxMutationsPerVertex caps the vertices and edges a single Compute
+// call can add, remove or update, and Config.MaxGrowth caps how much the
+// graph can grow in a step.  Both are checked at the step barrier, before
+// anything asked for in the step takes effect, and a step over either fails
+// the run with a MutationLimitError instead of letting a runaway algorithm
+// grow the graph until workers run out of memory.
+
+// MutationLimitError is what a run returns when a step mutated more than the
+// limits allow.
+type MutationLimitError struct {
+	Step int
+	// the vertex that went over Config.MaxMutationsPerVertex, where it lives
+	// and how many mutations it asked for
+	Vertex    string
+	Worker    string
+	Mutations int
+	// otherwise how much the step grew the graph, see Config.MaxGrowth
+	Growth float64
+	Limit  float64
+}
+
+func (e *MutationLimitError) Error() string {
+	if e.Vertex != "" {
+		return fmt.Sprintf("vertex %s on %s asked for %d mutations in step %d, more than the %d allowed", e.Vertex, e.Worker, e.Mutations, e.Step, int(e.Limit))
+	}
+	return fmt.Sprintf("step %d grew the graph by %.2f of its vertices, more than the %.2f allowed", e.Step, e.Growth, e.Limit)
+}
+
+// mutations asked for by the vertex computing, and the first vertex of the
+// step to go over its quota
+type mutationQuota struct {
+	vertex    string
+	n         int
+	over      string
+	overCount int
+	sync.Mutex
+}
+
+// start counting for the vertex about to compute
+func (q *mutationQuota) begin(id string) {
+	q.Lock()
+	defer q.Unlock()
+	q.vertex, q.n = id, 0
+}
+
+func (q *mutationQuota) end() {
+	q.Lock()
+	defer q.Unlock()
+	q.vertex, q.n = "", 0
+}
+
+// the vertex over its quota this step and how far, taking it off the books
+func (q *mutationQuota) take() (string, int) {
+	q.Lock()
+	defer q.Unlock()
+	over, n := q.over, q.overCount
+	q.over, q.overCount = "", 0
+	return over, n
+}
+
+// count n mutations against the vertex computing
+func (g *Graph) noteMutations(n int) {
+	limit := g.coordinator.config.MaxMutationsPerVertex
+	if limit <= 0 {
+		return
+	}
+	q := &g.quota
+	q.Lock()
+	defer q.Unlock()
+	if q.vertex == "" {
+		return
+	}
+	q.n += n
+	if q.n > limit && (q.over == "" || q.over == q.vertex) {
+		q.over, q.overCount = q.vertex, q.n
+	}
+}
+
+// the limit the step that just finished went over, if any.  Every worker
+// sees the same summary, so they all fail the same way.
+func (c *Coordinator) checkMutationLimits(step int, total map[string]interface{}, t TopologyChange, vertices int) error {
+	if over, ok := total["quota"].(map[string]interface{}); ok && len(over) > 0 {
+		var workers []string
+		for w := range over {
+			workers = append(workers, w)
+		}
+		sort.Strings(workers)
+		w := workers[0]
+		q, _ := over[w].(map[string]interface{})
+		id, _ := q["vertex"].(string)
+		return &MutationLimitError{
+			Step:      step,
+			Vertex:    id,
+			Worker:    w,
+			Mutations: summaryInt(q, "mutations"),
+			Limit:     float64(c.config.MaxMutationsPerVertex),
+		}
+	}
+	limit := c.config.MaxGrowth
+	if limit <= 0 || vertices == 0 {
+		return nil
+	}
+	growth := float64(t.VerticesAdded-t.VerticesRemoved+t.EdgesAdded-t.EdgesRemoved) / float64(vertices)
+	if growth > limit {
+		return &MutationLimitError{Step: step, Growth: growth, Limit: limit}
+	}
+	return nil
+}
+
+// put the vertex over its quota, if any, into the step summary
+func (c *Coordinator) reportQuota(stepData map[string]interface{}) {
+	if id, n := c.graph.quota.take(); id != "" {
+		c.log.Printf("Vertex %s asked for %d mutations, more than the %d allowed", id, n, c.config.MaxMutationsPerVertex)
+		stepData["quota"] = map[string]interface{}{
+			c.config.NodeId: map[string]interface{}{"vertex": id, "mutations": n},
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package waffle
+
+import (
+	"fmt"
+	"github.com/dforsyth/donut"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Rebalancing moves vertices from the slowest partition to the fastest one
+// between steps when Config.RebalanceSkew is set, and from the largest to the
+// smallest after mutations with Config.RepartitionSkew.  Every worker works out
+// the same plan from the same step summary, the slow partition ships the
+// vertices along with their edges and waiting messages, and everyone waits
+// in a migrate barrier before the next step.  Moved vertices are routed with
+// an override table that every worker keeps, the partitioner still places
+// everything else.
+
+type rebalancePlan struct {
+	from, to int
+	count    int
+}
+
+// vertex routes that override the partitioner
+type routes struct {
+	m map[string]int
+	sync.RWMutex
+}
+
+func (r *routes) get(id string) (int, bool) {
+	r.RLock()
+	defer r.RUnlock()
+	p, ok := r.m[id]
+	return p, ok
+}
+
+func (r *routes) set(ids []string, p int) {
+	r.Lock()
+	defer r.Unlock()
+	if r.m == nil {
+		r.m = make(map[string]int)
+	}
+	for _, id := range ids {
+		r.m[id] = p
+	}
+}
+
+type RouteUpdate struct {
+	Ids       []string
+	Partition int
+}
+
+func (c *Coordinator) SubmitRoutes(u *RouteUpdate, r *int) error {
+	c.graph.routes.set(u.Ids, u.Partition)
+	*r = 0
+	return nil
+}
+
+// vertices moving to another partition, with what they need for step Step
+type Migration struct {
+	Step     int
+	Vertices []Vertex
+	Edges    []Edge
+	Messages []Message
+	InEdges  [][2]string
+	// when the sending partition is being drained, the hash partitions of
+	// every worker without it, so nothing gets sent back
+	Slots []int
+	From  int
+}
+
+func (c *Coordinator) SubmitMigration(m *Migration, r *int) error {
+	g := c.graph
+	if m.Slots != nil {
+		c.adoptSlots(m.Slots, m.From)
+	}
+	for _, v := range m.Vertices {
+		g.addVertex(v)
+	}
+	for _, e := range m.Edges {
+		g.moveEdge(e)
+	}
+	for _, msg := range m.Messages {
+		g.addMessage(msg, m.Step)
+	}
+	g.in.add(m.InEdges)
+	*r = 0
+	return nil
+}
+
+// work out what to move after step from the per worker stats in total,
+// evening out step times first and vertex counts after mutations second
+func (c *Coordinator) planRebalance(step int, total map[string]interface{}) *rebalancePlan {
+	if c.numPartitions() < 2 {
+		return nil
+	}
+	workers, ok := total["workers"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	if p := c.planForTime(step, workers); p != nil {
+		return p
+	}
+	return c.planForSize(step, workers)
+}
+
+func (c *Coordinator) planForTime(step int, workers map[string]interface{}) *rebalancePlan {
+	if c.config.RebalanceSkew <= 0 {
+		return nil
+	}
+	var pids []int
+	for pid := range c.partitionMap() {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	var sum float64
+	slow, fast := -1, -1
+	times := make(map[int]float64)
+	for _, pid := range pids {
+		st, ok := workers[c.worker(pid)].(map[string]interface{})
+		if !ok {
+			// someone's numbers didn't make it, leave things be
+			return nil
+		}
+		t, _ := st["time"].(float64)
+		times[pid] = t
+		sum += t
+		if slow < 0 || t > times[slow] {
+			slow = pid
+		}
+		if fast < 0 || t < times[fast] {
+			fast = pid
+		}
+	}
+	mean := sum / float64(len(pids))
+	if mean == 0 || times[slow]/mean <= c.config.RebalanceSkew {
+		return nil
+	}
+	vertices := summaryInt(workers[c.worker(slow)].(map[string]interface{}), "vertices")
+	// split the difference, assuming time goes with the vertex count
+	count := int(float64(vertices) * (times[slow] - times[fast]) / (2 * times[slow]))
+	if count == 0 {
+		return nil
+	}
+	c.log.Printf("Step %d skewed %.2fx, moving %d vertices from partition %d to %d", step, times[slow]/mean, count, slow, fast)
+	return &rebalancePlan{from: slow, to: fast, count: count}
+}
+
+// split off part of the largest partition into the smallest once mutations
+// have left it more than Config.RepartitionSkew times the mean size
+func (c *Coordinator) planForSize(step int, workers map[string]interface{}) *rebalancePlan {
+	if c.config.RepartitionSkew <= 0 || !c.topology.mutatedSince(c.repartitioned) {
+		return nil
+	}
+	var pids []int
+	for pid := range c.partitionMap() {
+		pids = append(pids, pid)
+	}
+	sort.Ints(pids)
+	sizes := make(map[int]int)
+	sum := 0
+	big, small := -1, -1
+	for _, pid := range pids {
+		st, ok := workers[c.worker(pid)].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		n := summaryInt(st, "vertices")
+		sizes[pid] = n
+		sum += n
+		if big < 0 || n > sizes[big] {
+			big = pid
+		}
+		if small < 0 || n < sizes[small] {
+			small = pid
+		}
+	}
+	// what was asked for in this step only shows in the vertex counts of the
+	// next one, so look again then
+	c.repartitioned = step - 1
+	mean := float64(sum) / float64(len(pids))
+	if mean == 0 || float64(sizes[big])/mean <= c.config.RepartitionSkew {
+		return nil
+	}
+	count := (sizes[big] - sizes[small]) / 2
+	if count == 0 {
+		return nil
+	}
+	c.log.Printf("Partition %d grew to %.2fx the mean after mutations, moving %d vertices to partition %d", big, float64(sizes[big])/mean, count, small)
+	return &rebalancePlan{from: big, to: small, count: count}
+}
+
+// carry out p after step, then wait in the migrate barrier for everyone else
+// before the next step
+func (c *Coordinator) rebalance(step int, p *rebalancePlan) {
+	name := "migrate-" + strconv.Itoa(step)
+	c.createBarrier(name, func(m *donut.SafeMap) {
+		c.onMigrateBarrierChange(step, m)
+	})
+	if p.from == c.graph.partitionId {
+		if err := c.graph.migrate(step+1, p); err != nil {
+			err = fmt.Errorf("could not move vertices to partition %d: %v", p.to, err)
+			c.log.Println(err)
+			c.fail(err)
+			return
+		}
+		c.audit("migrate", name, fmt.Sprintf("%d vertices to partition %d", p.count, p.to))
+	}
+	c.enterBarrier(name, c.config.NodeId, "")
+}
+
+func (c *Coordinator) onMigrateBarrierChange(step int, m *donut.SafeMap) {
+	if m.Len() == c.numPartitions() {
+		name := "migrate-" + strconv.Itoa(step)
+		if kill, ok := c.watchers[name]; ok {
+			kill <- 1
+			delete(c.watchers, name)
+		}
+		c.log.debugf("Migration after step %d done", step)
+		go c.createStepWork(step + 1)
+	}
+}
+
+// send p.count of our vertices, resident ones first, with what they need to
+// compute in step, to p.to.  Routes go out first so that everything that
+// follows lands in the right place.
+func (g *Graph) migrate(step int, p *rebalancePlan) error {
+	c := g.coordinator
+	var ids []string
+	vertices := make(map[string]Vertex)
+	g.eachVertex(func(v Vertex, cold bool) bool {
+		if len(ids) == p.count {
+			return false
+		}
+		ids = append(ids, v.Id())
+		vertices[v.Id()] = v
+		return true
+	})
+	sort.Strings(ids)
+	g.routes.set(ids, p.to)
+	for pid, w := range c.partitionMap() {
+		if pid == g.partitionId {
+			continue
+		}
+		var r int
+		if err := c.client(w).Call("Coordinator.SubmitRoutes", &RouteUpdate{ids, p.to}, &r); err != nil {
+			return err
+		}
+	}
+
+	m := &Migration{Step: step}
+	g.inboxLock.Lock()
+	queued := g.inbox[step]
+	for _, id := range ids {
+		m.Vertices = append(m.Vertices, vertices[id])
+		m.Edges = append(m.Edges, g.edges[id]...)
+		if queued != nil {
+			m.Messages = append(m.Messages, queued[id]...)
+			delete(queued, id)
+		}
+	}
+	g.inboxLock.Unlock()
+	g.in.Lock()
+	for _, id := range ids {
+		for _, src := range g.in.m[id] {
+			m.InEdges = append(m.InEdges, [2]string{src, id})
+		}
+	}
+	g.in.Unlock()
+
+	var r int
+	if err := c.client(c.worker(p.to)).Call("Coordinator.SubmitMigration", m, &r); err != nil {
+		return err
+	}
+	g.in.Lock()
+	for _, id := range ids {
+		g.dropVertex(id)
+		delete(g.edges, id)
+		delete(g.in.m, id)
+	}
+	g.in.Unlock()
+	return nil
+}
@@ -0,0 +1,73 @@
+package waffle
+
+import (
+	"context"
+	"fmt"
+	"github.com/dforsyth/donut"
+	"log"
+)
+
+// A WorkerLostError ends a run when a worker goes away while the graph is
+// being loaded or computed.  Its partition is gone with it, so the job has to
+// go back to its last checkpoint.
+type WorkerLostError struct {
+	Worker     string
+	Partition  int
+	Checkpoint int
+}
+
+func (e *WorkerLostError) Error() string {
+	return fmt.Sprintf("lost worker %s (partition %d), last checkpoint is at step %d", e.Worker, e.Partition, e.Checkpoint)
+}
+
+func (c *Coordinator) checkLostWorkers(workers *donut.SafeMap) {
+	for pid, w := range c.partitionMap() {
+		if workers.Contains(w) || c.drains.has(w) {
+			continue
+		}
+		c.audit("fail", "workers", w)
+		err := &WorkerLostError{Worker: w, Partition: pid, Checkpoint: c.lastCheckpoint}
+		c.log.Println(err)
+		c.fail(err)
+		return
+	}
+}
+
+// runs that lost a worker (for real or in a simulation), or timed out
+// waiting for one, can go back to the last checkpoint
+func recoverable(err error) bool {
+	switch err.(type) {
+	case *WorkerLostError, *StragglerError, *SimulatedFailure:
+		return true
+	}
+	return false
+}
+
+// RunWithRecovery runs the job and, whenever a worker is lost or a phase times
+// out waiting on one, rolls back to the last persisted state and runs it
+// again, up to attempts times.  The lost worker has to be replaced
+// (restarted by a supervisor, say) for the job to get going again, since it
+// waits for Config.InitialWorkers like any run.
+// Jobs need to implement StatePersister and load their own checkpoints, as
+// with Resume.
+func RunWithRecovery(c *Config, j Job, attempts int) error {
+	for attempt := 0; ; attempt++ {
+		state, err := loadState(c, j)
+		if err != nil {
+			return err
+		}
+		r, err := newRunner(c, j, state)
+		if err != nil {
+			return err
+		}
+		err = r.Run(context.Background())
+		r.Close()
+		if err == nil {
+			return nil
+		}
+		if !recoverable(err) || attempt >= attempts {
+			return err
+		}
+		log.Printf("Recovering from %v (attempt %d of %d)", err, attempt+1, attempts)
+	}
+}
@@ -0,0 +1,222 @@
+package waffle
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"github.com/dforsyth/donut"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// The package's own result format: every partition writes its vertices and
+// edges, gob encoded, to its own part file in a directory.  Once every worker
+// has written its part the first partition commits a manifest listing them,
+// so a result without a manifest is one that never finished.  A later job can
+// load the output of an earlier one with ResultPaths and LoadResults, as long
+// as it has the same vertex and edge types registered with gob.
+
+const resultManifest = "MANIFEST"
+
+type ResultManifest struct {
+	JobId string
+	Parts []string
+	// empty for WriteResults parts, "projection" for ResultWriter ones
+	Format string `json:",omitempty"`
+}
+
+type resultHeader struct {
+	Partition int
+	Vertices  int
+	Edges     int
+}
+
+func resultPart(pid int) string {
+	return fmt.Sprintf("part-%05d", pid)
+}
+
+// WriteResults writes this partition's vertices and edges into dir, for use
+// in a job's Write.  The manifest is committed after the write barrier.
+func WriteResults(g *Graph, dir string) error {
+	return writePart(g, dir, "", func(w io.Writer) error {
+		enc := gob.NewEncoder(w)
+		h := resultHeader{Partition: g.partitionId, Vertices: g.vertexCount()}
+		for _, edges := range g.edges {
+			h.Edges += len(edges)
+		}
+		if err := enc.Encode(&h); err != nil {
+			return err
+		}
+		var encErr error
+		g.EachVertex(func(v Vertex) {
+			if encErr == nil {
+				encErr = enc.Encode(&v)
+			}
+		})
+		if encErr != nil {
+			return encErr
+		}
+		for _, edges := range g.edges {
+			for _, e := range edges {
+				if err := enc.Encode(&e); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// write this partition's part file in dir with write, under a temporary name
+// that is renamed once it's all on disk
+func writePart(g *Graph, dir, format string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if g.partitionId == 0 {
+		// whatever was here before is about to be overwritten
+		if err := os.Remove(filepath.Join(dir, resultManifest)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if g.resultDir == "" {
+		g.resultDir = dir
+	}
+	if g.resultFormats == nil {
+		g.resultFormats = make(map[string]string)
+	}
+	g.resultFormats[dir] = format
+	part := filepath.Join(dir, resultPart(g.partitionId))
+	f, err := os.Create(part + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if fi, err := f.Stat(); err == nil {
+		if err := g.ReserveDisk(DiskResults, fi.Size()); err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+		// the part is the job's output from here on, not ours to account for
+		defer g.ReleaseDisk(DiskResults, fi.Size())
+	}
+	return os.Rename(f.Name(), part)
+}
+
+// commitManifest writes the manifest of dir under a temporary name and
+// renames it into place, so it shows up whole or not at all
+func commitManifest(g *Graph, dir string) error {
+	m := ResultManifest{JobId: g.coordinator.config.JobId, Format: g.resultFormats[dir]}
+	for i := 0; i < g.coordinator.numPartitions(); i++ {
+		m.Parts = append(m.Parts, resultPart(i))
+	}
+	b, err := json.Marshal(&m)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, resultManifest+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, resultManifest))
+}
+
+// ResultPaths lists the part files of a result directory, making sure they
+// are all there.  It's meant to be used as a job's LoadPaths.
+func ResultPaths(dir string) ([]string, error) {
+	b, err := os.ReadFile(filepath.Join(dir, resultManifest))
+	if err != nil {
+		return nil, err
+	}
+	var m ResultManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("bad manifest in %s: %v", dir, err)
+	}
+	if m.Format != "" {
+		return nil, fmt.Errorf("result %s of job %s is a %s and can't be loaded", dir, m.JobId, m.Format)
+	}
+	var paths []string
+	for _, p := range m.Parts {
+		path := filepath.Join(dir, p)
+		if _, err := os.Stat(path); err != nil {
+			return nil, fmt.Errorf("result %s of job %s is incomplete: %v", dir, m.JobId, err)
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// LoadResults reads a part file written by WriteResults, for use as a job's
+// Load
+func LoadResults(path string) ([]Vertex, []Edge, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	return readResults(bufio.NewReader(f))
+}
+
+func readResults(r io.Reader) ([]Vertex, []Edge, error) {
+	dec := gob.NewDecoder(r)
+	var h resultHeader
+	if err := dec.Decode(&h); err != nil {
+		return nil, nil, err
+	}
+	vertices := make([]Vertex, 0, h.Vertices)
+	for i := 0; i < h.Vertices; i++ {
+		var v Vertex
+		if err := dec.Decode(&v); err != nil {
+			return nil, nil, err
+		}
+		vertices = append(vertices, v)
+	}
+	edges := make([]Edge, 0, h.Edges)
+	for i := 0; i < h.Edges; i++ {
+		var e Edge
+		if err := dec.Decode(&e); err != nil {
+			return nil, nil, err
+		}
+		edges = append(edges, e)
+	}
+	return vertices, edges, nil
+}
+
+// checkWriters fails the job if a worker left before writing its partition.
+// Nobody else has its graph, so the only way to get the output is to resume
+// from the last checkpoint rather than finish without it.
+func (c *Coordinator) checkWriters(workers *donut.SafeMap) {
+	written, _, err := c.zk.Children(path.Join(c.barriersPath, "write"))
+	if err != nil {
+		c.log.Printf("Could not read the write barrier: %v", err)
+		return
+	}
+	done := make(map[string]bool)
+	for _, pid := range written {
+		done[pid] = true
+	}
+	for pid, w := range c.partitionMap() {
+		if done[strconv.Itoa(pid)] || workers.Contains(w) {
+			continue
+		}
+		c.audit("fail", "write", w)
+		err := fmt.Errorf("worker %s left before writing partition %d, resume from the checkpoint at step %d", w, pid, c.lastCheckpoint)
+		c.log.Println(err)
+		c.fail(err)
+		return
+	}
+}
@@ -0,0 +1,179 @@
+package waffle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+)
+
+// JobState is the coordination state of a job as of a step barrier.
+type JobState struct {
+	JobId          string
+	Tenant         string
+	InitialWorkers int
+	Epoch          int64
+	// last step that finished, and the last step that was checkpointed
+	Step, Checkpoint int
+	Workers          []string
+	Partitions       map[int]string
+	// worker of each of Config.NumPartitions
+	Slots            map[int]string `json:",omitempty"`
+	Counters, Gauges map[string]float64
+	// checkpoints that haven't been cleaned up yet
+	Retained []CheckpointRecord
+	// set by a MasterComputeFn
+	Phase string `json:",omitempty"`
+	// hmac of the rest of the state keyed by the job token, set by sign
+	Signature string
+}
+
+func (s *JobState) mac(key string) (string, error) {
+	unsigned := *s
+	unsigned.Signature = ""
+	b, err := json.Marshal(&unsigned)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *JobState) sign(key string) error {
+	sig, err := s.mac(key)
+	if err != nil {
+		return err
+	}
+	s.Signature = sig
+	return nil
+}
+
+// verify makes sure a loaded state was produced by this job, so a checkpoint
+// path shared with some other job can't get restored by mistake
+func (s *JobState) verify(c *Config) error {
+	if s.JobId != c.JobId || s.Tenant != c.Tenant {
+		return fmt.Errorf("state belongs to job %s/%s, not %s/%s", s.Tenant, s.JobId, c.Tenant, c.JobId)
+	}
+	sig, err := s.mac(c.Token)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.Signature)) {
+		return fmt.Errorf("state for %s is not signed with this job's token", c.JobId)
+	}
+	return nil
+}
+
+// Jobs that implement StatePersister have the coordination state saved at
+// every step barrier, which lets Resume pick a job back up after its
+// processes have been restarted.  The job is responsible for loading its own
+// checkpoint for state.Checkpoint when it is resumed.  LoadState is asked
+// for the state of the job's namespace, Tenant/JobId, or just JobId for jobs
+// without a tenant.
+type StatePersister interface {
+	PersistState(*JobState) error
+	LoadState(namespace string) (*JobState, error)
+}
+
+// where the state came from, to match against what LoadState was asked for
+func (s *JobState) namespace() string {
+	return path.Join(s.Tenant, s.JobId)
+}
+
+// Resume restarts the job from the state it last persisted, falling back to a
+// fresh run if it has none.
+func Resume(c *Config, j Job) error {
+	state, err := loadState(c, j)
+	if err != nil {
+		return err
+	}
+	run(c, j, state)
+	return nil
+}
+
+// loadState loads and checks the job's persisted state, which is nil when
+// there is nothing to resume from
+func loadState(c *Config, j Job) (*JobState, error) {
+	sp, ok := j.(StatePersister)
+	if !ok {
+		log.Printf("%s does not persist its state, starting from scratch", j.Id())
+		return nil, nil
+	}
+	state, err := sp.LoadState(c.namespace())
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		if err := state.verify(c); err != nil {
+			return nil, fmt.Errorf("refusing to resume: %v", err)
+		}
+		log.Printf("Resuming %s from checkpoint at step %d (last finished step %d)", c.JobId, state.Checkpoint, state.Step)
+	}
+	return state, nil
+}
+
+// first step to run, which is right after the last checkpoint on resume
+func (c *Coordinator) firstStep() int {
+	if c.resume != nil && c.resume.Checkpoint > 0 {
+		return c.resume.Checkpoint
+	}
+	return 1
+}
+
+// put back what we need from a persisted state before the first step
+func (c *Coordinator) restore() {
+	s := c.resume
+	if s == nil {
+		return
+	}
+	c.fence.advance(s.Epoch)
+	c.lastCheckpoint = s.Checkpoint
+	c.retained.kept = s.Retained
+	c.graph.globalStat.Lock()
+	c.graph.globalStat.step = c.firstStep() - 1
+	c.graph.globalStat.counters = s.Counters
+	c.graph.globalStat.gauges = s.Gauges
+	c.graph.globalStat.Unlock()
+	c.phase.name = s.Phase
+}
+
+// save the coordination state after a step barrier.  Everyone has the same
+// picture at this point, so only the first partition bothers.
+func (c *Coordinator) persistState(step int) {
+	sp, ok := c.graph.job.(StatePersister)
+	if !ok || c.graph.partitionId != 0 {
+		return
+	}
+	var workers []string
+	for i := 0; i < c.numPartitions(); i++ {
+		workers = append(workers, c.worker(i))
+	}
+	c.graph.globalStat.Lock()
+	state := &JobState{
+		JobId:          c.config.JobId,
+		Tenant:         c.config.Tenant,
+		InitialWorkers: c.config.InitialWorkers,
+		Epoch:          c.fence.current(),
+		Step:           step,
+		Checkpoint:     c.lastCheckpoint,
+		Retained:       c.retained.list(),
+		Workers:        workers,
+		Partitions:     c.partitionMap(),
+		Slots:          c.slotWorkers(),
+		Counters:       c.graph.globalStat.counters,
+		Gauges:         c.graph.globalStat.gauges,
+		Phase:          c.graph.Phase(),
+	}
+	c.graph.globalStat.Unlock()
+	if err := state.sign(c.config.Token); err != nil {
+		c.log.Printf("Could not sign job state for step %d: %v", step, err)
+		return
+	}
+	if err := sp.PersistState(state); err != nil {
+		c.log.Printf("Could not persist job state for step %d: %v", step, err)
+	}
+}
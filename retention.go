@@ -0,0 +1,114 @@
+package waffle
+
+import (
+	"sync"
+	"time"
+)
+
+// Jobs that implement CheckpointDeleter get their old checkpoints cleaned up
+// according to Config.KeepCheckpoints and Config.CheckpointMaxAge.  Every
+// worker deletes its own partition's checkpoints, and the last one is never
+// deleted since it's what a resume would start from.
+type CheckpointDeleter interface {
+	DeleteCheckpoint(g *Graph, step int) error
+}
+
+type CheckpointRecord struct {
+	Step int
+	Time time.Time
+}
+
+type PurgeRequest struct {
+	Worker string
+	Token  string
+	// checkpoints to keep, at least 1
+	Keep int
+	// pass the request on to every other worker
+	Broadcast bool
+}
+
+// checkpoints that are still around, oldest first
+type retention struct {
+	kept []CheckpointRecord
+	sync.Mutex
+}
+
+func (r *retention) add(step int) {
+	r.Lock()
+	defer r.Unlock()
+	r.kept = append(r.kept, CheckpointRecord{Step: step, Time: time.Now()})
+}
+
+func (r *retention) list() []CheckpointRecord {
+	r.Lock()
+	defer r.Unlock()
+	return append([]CheckpointRecord(nil), r.kept...)
+}
+
+// expired takes the checkpoints beyond the newest keep, or older than maxAge,
+// off the list and returns them.  Zero for either means no limit.
+func (r *retention) expired(keep int, maxAge time.Duration) (old []CheckpointRecord) {
+	r.Lock()
+	defer r.Unlock()
+	var kept []CheckpointRecord
+	for i, cp := range r.kept {
+		last := i == len(r.kept)-1
+		tooMany := keep > 0 && len(r.kept)-i > keep
+		tooOld := maxAge > 0 && time.Since(cp.Time) > maxAge
+		if !last && (tooMany || tooOld) {
+			old = append(old, cp)
+		} else {
+			kept = append(kept, cp)
+		}
+	}
+	r.kept = kept
+	return
+}
+
+func (c *Coordinator) deleteCheckpoints(old []CheckpointRecord) {
+	d, ok := c.graph.job.(CheckpointDeleter)
+	if !ok {
+		return
+	}
+	for _, cp := range old {
+		if err := d.DeleteCheckpoint(c.graph, cp.Step); err != nil {
+			c.log.Printf("Could not delete checkpoint for step %d: %v", cp.Step, err)
+			continue
+		}
+		c.log.debugf("Deleted checkpoint for step %d", cp.Step)
+	}
+}
+
+// enforce the retention policy, after a step barrier has confirmed that the
+// newest checkpoint was persisted everywhere
+func (c *Coordinator) retainCheckpoints() {
+	c.deleteCheckpoints(c.retained.expired(c.config.KeepCheckpoints, c.config.CheckpointMaxAge))
+}
+
+// PurgeCheckpoints deletes all but the newest req.Keep checkpoints right away
+func (c *Coordinator) PurgeCheckpoints(req *PurgeRequest, r *int) error {
+	if err := c.authorize(req.Worker, req.Token, OpPurge); err != nil {
+		return err
+	}
+	keep := req.Keep
+	if keep < 1 {
+		keep = 1
+	}
+	c.deleteCheckpoints(c.retained.expired(keep, 0))
+	*r = 0
+	if !req.Broadcast {
+		return nil
+	}
+	fwd := *req
+	fwd.Broadcast = false
+	for w, cl := range c.clients() {
+		if w == c.config.NodeId {
+			continue
+		}
+		var ignored int
+		if err := cl.Call("Coordinator.PurgeCheckpoints", &fwd, &ignored); err != nil {
+			c.log.Printf("Could not purge checkpoints on %s: %v", w, err)
+		}
+	}
+	return nil
+}
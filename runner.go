@@ -0,0 +1,240 @@
+package waffle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/dforsyth/donut"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type stage int
+
+const (
+	stagePlan stage = iota
+	stageLoad
+	stageCompute
+	stageWrite
+	stageDone
+)
+
+var stageNames = []string{"plan", "load", "compute", "write", "done"}
+
+func (s stage) String() string {
+	return stageNames[s]
+}
+
+// the work that starts a stage, handed over once the stage before it is done
+type pendingStage struct {
+	stage stage
+	start func()
+}
+
+// A Runner takes a job through its stages one call at a time, so embedding
+// programs can do their own thing in between (check the loaded graph before
+// computing, say) and get an error back when something goes wrong.  Run just
+// calls all of them in order.  Close the runner when done with it, failed or
+// not.
+type Runner struct {
+	listener *waffleListener
+	cluster  *donut.Cluster
+	ready    chan *pendingStage
+	joined   chan error
+	// the job can't be finished
+	failed  chan error
+	pending *pendingStage
+}
+
+func NewRunner(c *Config, j Job) (*Runner, error) {
+	return newRunner(c, j, nil)
+}
+
+func newRunner(c *Config, j Job, resume *JobState) (*Runner, error) {
+	if err := loadNodeId(c); err != nil {
+		return nil, fmt.Errorf("could not work out a node id: %v", err)
+	}
+	if err := c.checkCodecs(); err != nil {
+		return nil, err
+	}
+	if _, err := lookupWireFormat(c.WireFormat); err != nil {
+		return nil, err
+	}
+	if c.PullFraction > 0 && !c.InEdges {
+		return nil, fmt.Errorf("pulling needs InEdges")
+	}
+	tuneGC(c)
+	if strings.Contains(c.Tenant, "/") {
+		return nil, fmt.Errorf("tenant %q has a slash in it", c.Tenant)
+	}
+	if strings.Contains(c.JobId, "/") {
+		return nil, fmt.Errorf("job id %q has a slash in it", c.JobId)
+	}
+	clusterName := j.Id()
+	if c.Tenant != "" {
+		// escaped whole so no tenant and job can pass for another pair
+		clusterName = url.PathEscape(c.Tenant + "/" + clusterName)
+	}
+	r := &Runner{
+		ready:  make(chan *pendingStage, 1),
+		joined: make(chan error, 1),
+		failed: make(chan error, 1),
+	}
+	listener := &waffleListener{
+		clusterName: clusterName,
+		coordinator: newCoordinator(clusterName, c),
+		job:         j,
+	}
+	listener.coordinator.resume = resume
+	listener.coordinator.runner = r
+	balancer := &waffleBalancer{}
+	config := donut.NewConfig()
+	config.Servers = c.ZKServers
+	config.NodeId = c.NodeId
+	config.Timeout = 1 * 1e9
+
+	cluster := donut.NewCluster(clusterName, config, balancer, listener)
+
+	listener.cluster = cluster
+	// OnLeave shouldn't block if nobody is waiting on it anymore
+	listener.done = make(chan byte, 1)
+	listener.config = config
+	r.listener = listener
+	r.cluster = cluster
+	return r, nil
+}
+
+// advance hands the start of stage s to the runner, which kicks it off when
+// it gets asked for that stage
+func (c *Coordinator) advance(s stage, start func()) {
+	c.runner.ready <- &pendingStage{s, start}
+}
+
+func (r *Runner) await(ctx context.Context, s stage) error {
+	select {
+	case p := <-r.ready:
+		if p.stage != s {
+			return fmt.Errorf("waiting for %s, got %s", s, p.stage)
+		}
+		r.pending = p
+		return nil
+	case err := <-r.failed:
+		return err
+	case <-r.listener.done:
+		return errors.New("left the cluster")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fail gives up on the job, whatever stage the runner is waiting on
+func (c *Coordinator) fail(err error) {
+	select {
+	case c.runner.failed <- err:
+	default:
+		// already failing
+	}
+}
+
+// start stage s and wait for it to finish, which is when next is ready
+func (r *Runner) run(ctx context.Context, s, next stage) error {
+	if r.pending == nil || r.pending.stage != s {
+		return fmt.Errorf("%s is not ready to run", s)
+	}
+	p := r.pending
+	r.pending = nil
+	log.Printf("Starting %s", s)
+	start := time.Now()
+	if p.start != nil {
+		go p.start()
+	}
+	err := r.await(ctx, next)
+	r.listener.coordinator.clock.stage(s.String(), time.Since(start))
+	return err
+}
+
+// Register joins the cluster, registers this worker and waits for everyone
+// else to show up.
+func (r *Runner) Register(ctx context.Context) error {
+	clock := &r.listener.coordinator.clock
+	start := clock.start()
+	defer func() {
+		clock.stage("register", time.Since(start))
+	}()
+	r.cluster.Join()
+	select {
+	case err := <-r.joined:
+		if err != nil {
+			return err
+		}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return r.await(ctx, stagePlan)
+}
+
+// Plan builds the partition map and connects to the other workers.
+func (r *Runner) Plan(ctx context.Context) error {
+	return r.run(ctx, stagePlan, stageLoad)
+}
+
+// Load loads the graph and waits for every load path to be done.
+func (r *Runner) Load(ctx context.Context) error {
+	return r.run(ctx, stageLoad, stageCompute)
+}
+
+// Compute runs supersteps until the graph is done.
+func (r *Runner) Compute(ctx context.Context) error {
+	return r.run(ctx, stageCompute, stageWrite)
+}
+
+// WriteResults writes out the graph and waits for every worker to finish.
+func (r *Runner) WriteResults(ctx context.Context) error {
+	return r.run(ctx, stageWrite, stageDone)
+}
+
+// Close leaves the cluster and tears down everything the runner set up, so
+// that the job can be run again from the same process.  Call it once done
+// with the runner, whether the job finished or a stage returned an error.
+func (r *Runner) Close() {
+	c := r.listener.coordinator
+	c.timers.stopAll()
+	if c.zk != nil {
+		// a StartNow or a cancel is for this run only, the next one under the
+		// same name (a recovery or a resume from preemption, say) waits for
+		// its workers again
+		c.removeNode(c.startPath)
+		c.removeNode(c.cancelPath)
+	}
+	if kill, ok := c.watchers["heartbeat"]; ok {
+		select {
+		case kill <- 1:
+		default:
+		}
+	}
+	for _, cl := range c.clients() {
+		if cl != nil {
+			cl.Close()
+		}
+	}
+	if c.listener != nil {
+		c.listener.Close()
+	}
+	if c.statusListener != nil {
+		c.statusListener.Close()
+	}
+	r.cluster.Shutdown()
+	shares.remove(c.config.namespace())
+}
+
+func (r *Runner) Run(ctx context.Context) error {
+	for _, stage := range []func(context.Context) error{r.Register, r.Plan, r.Load, r.Compute, r.WriteResults} {
+		if err := stage(ctx); err != nil {
+			return err
+		}
+	}
+	r.Stats().log()
+	return nil
+}
@@ -0,0 +1,471 @@
+package waffle
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 is a bucket to load input from and checkpoint to, for workers that
+// don't share a disk.  Requests are signed with AWS signature version 4 and
+// retried with backoff when S3 is throttling or unavailable.  Paths are
+// s3://bucket/key.
+type S3 struct {
+	Bucket string
+	// keys are under this, say "jobs/pagerank/"
+	Prefix string
+	// us-east-1 when empty
+	Region string
+	// https://s3.<Region>.amazonaws.com when empty, set it for other stores
+	// that speak S3.  Buckets are addressed by path.
+	Endpoint string
+	// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	// when empty
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// objects bigger than this are uploaded in parts this size, 16MB when 0
+	// and no smaller than the 5MB S3 allows
+	PartSize int
+	// attempts at each request, 5 when 0
+	Retries int
+	// http.DefaultClient when nil
+	Client *http.Client
+}
+
+const (
+	defaultS3PartSize = 16 << 20
+	minS3PartSize     = 5 << 20
+	defaultS3Retries  = 5
+)
+
+// what S3 said when a request failed
+type S3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	Key        string `xml:"Key"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s %s", e.StatusCode, e.Code, e.Message, e.Key)
+}
+
+func isS3NotFound(err error) bool {
+	e, ok := err.(*S3Error)
+	return ok && e.StatusCode == http.StatusNotFound
+}
+
+func (s *S3) region() string {
+	if s.Region == "" {
+		return "us-east-1"
+	}
+	return s.Region
+}
+
+func (s *S3) endpoint() string {
+	if s.Endpoint == "" {
+		return "https://s3." + s.region() + ".amazonaws.com"
+	}
+	return strings.TrimSuffix(s.Endpoint, "/")
+}
+
+func (s *S3) credentials() (access, secret, token string) {
+	if s.AccessKey != "" {
+		return s.AccessKey, s.SecretKey, s.SessionToken
+	}
+	return os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+}
+
+func (s *S3) partSize() int {
+	if s.PartSize <= 0 {
+		return defaultS3PartSize
+	}
+	if s.PartSize < minS3PartSize {
+		return minS3PartSize
+	}
+	return s.PartSize
+}
+
+func (s *S3) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// the key for name under Prefix
+func (s *S3) key(name string) string {
+	if s.Prefix == "" {
+		return name
+	}
+	return strings.TrimSuffix(s.Prefix, "/") + "/" + strings.TrimPrefix(name, "/")
+}
+
+// Path is the s3:// path of key.
+func (s *S3) Path(key string) string {
+	return "s3://" + s.Bucket + "/" + key
+}
+
+// the key of an s3:// path, a name under Prefix otherwise
+func (s *S3) keyOf(p string) (string, error) {
+	if !strings.HasPrefix(p, "s3://") {
+		return s.key(p), nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(p, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] != s.Bucket {
+		return "", fmt.Errorf("%s is not in bucket %s", p, s.Bucket)
+	}
+	return parts[1], nil
+}
+
+// uri encode s the way signatures want it, leaving slashes alone in paths
+func s3Escape(s string, path bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', path && c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3Query(q url.Values) string {
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range q[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+// sign req with AWS signature version 4
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	access, secret, token := s.credentials()
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if token != "" {
+		req.Header.Set("x-amz-security-token", token)
+		headers = append(headers, "x-amz-security-token")
+	}
+	var canonical strings.Builder
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonical.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	signed := strings.Join(headers, ";")
+	request := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonical.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(request))
+	scope := date + "/" + s.region() + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, s.region())
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		access, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// whether a failed request is worth another go
+func s3Retryable(err error) bool {
+	e, ok := err.(*S3Error)
+	if !ok {
+		// couldn't reach S3 at all
+		return true
+	}
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// how long to wait before the attempt after n, doubling from 100ms up to
+// 10s with some jitter so workers don't all come back at once
+func s3Backoff(n int) time.Duration {
+	d := 100 * time.Millisecond << uint(n)
+	if d > 10*time.Second || d <= 0 {
+		d = 10 * time.Second
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do a request on key, retrying failures that may go away.  The caller
+// closes the body of the response.
+func (s *S3) do(method, key string, q url.Values, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.endpoint())
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket
+	u.RawPath = u.EscapedPath()
+	if key != "" {
+		u.Path += "/" + key
+		u.RawPath += "/" + s3Escape(key, true)
+	}
+	u.RawQuery = s3Query(q)
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+
+	retries := s.Retries
+	if retries <= 0 {
+		retries = defaultS3Retries
+	}
+	for n := 0; ; n++ {
+		var resp *http.Response
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err == nil {
+			req.ContentLength = int64(len(body))
+			s.sign(req, payloadHash, time.Now())
+			resp, err = s.client().Do(req)
+		}
+		if err == nil && resp.StatusCode/100 != 2 {
+			err = s3ResponseError(resp, key)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		if n+1 >= retries || !s3Retryable(err) {
+			return nil, err
+		}
+		wait := s3Backoff(n)
+		log.Printf("s3 %s %s failed, retrying in %v: %v", method, key, wait, err)
+		time.Sleep(wait)
+	}
+}
+
+func s3ResponseError(resp *http.Response, key string) error {
+	defer resp.Body.Close()
+	e := &S3Error{StatusCode: resp.StatusCode, Key: key}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(b, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+// Open opens the object at an s3:// path for reading.
+func (s *S3) Open(p string) (io.ReadCloser, error) {
+	key, err := s.keyOf(p)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Get reads the object at key.
+func (s *S3) Get(key string) ([]byte, error) {
+	resp, err := s.do("GET", key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// Delete removes the object at key, which is fine if it isn't there.
+func (s *S3) Delete(key string) error {
+	resp, err := s.do("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// List lists the keys under prefix.
+func (s *S3) List(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Put writes size bytes from r to key, in a multipart upload when there is
+// more than one part's worth.
+func (s *S3) Put(key string, r io.ReaderAt, size int64) error {
+	partSize := s.partSize()
+	if size <= int64(partSize) {
+		b := make([]byte, size)
+		if _, err := r.ReadAt(b, 0); err != nil && err != io.EOF {
+			return err
+		}
+		resp, err := s.do("PUT", key, nil, b)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	var upload struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&upload)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if err := s.putParts(key, upload.UploadId, r, size); err != nil {
+		// don't leave the parts we did upload lying around
+		if resp, abortErr := s.do("DELETE", key, url.Values{"uploadId": {upload.UploadId}}, nil); abortErr == nil {
+			resp.Body.Close()
+		} else {
+			log.Printf("Could not abort upload of %s: %v", key, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3) putParts(key, uploadId string, r io.ReaderAt, size int64) error {
+	partSize := int64(s.partSize())
+	buf := make([]byte, partSize)
+	var parts []s3Part
+	for off, n := int64(0), 1; off < size; off, n = off+partSize, n+1 {
+		b := buf
+		if size-off < partSize {
+			b = buf[:size-off]
+		}
+		if _, err := r.ReadAt(b, off); err != nil && err != io.EOF {
+			return err
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadId}}
+		resp, err := s.do("PUT", key, q, b)
+		if err != nil {
+			return fmt.Errorf("part %d: %v", n, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, s3Part{PartNumber: n, ETag: resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := s.do("POST", key, url.Values{"uploadId": {uploadId}}, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// completing can fail after S3 has said 200
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("<Error>")) {
+		e := &S3Error{StatusCode: resp.StatusCode, Key: key}
+		xml.Unmarshal(b, e)
+		return e
+	}
+	return nil
+}
+
+// S3Loader loads every object under Input with its EdgeListLoader, and can
+// be embedded in a job for its LoadPaths and Load.
+type S3Loader struct {
+	S3 *S3
+	// under S3.Prefix, the input splits are the objects below it
+	Input string
+	EdgeListLoader
+}
+
+func (l *S3Loader) LoadPaths() []string {
+	prefix := l.S3.key(l.Input)
+	keys, err := l.S3.List(prefix)
+	if err != nil {
+		log.Panicf("Could not list %s: %v", l.S3.Path(prefix), err)
+	}
+	var paths []string
+	for _, key := range keys {
+		// directory markers
+		if !strings.HasSuffix(key, "/") {
+			paths = append(paths, l.S3.Path(key))
+		}
+	}
+	return paths
+}
+
+func (l *S3Loader) Load(path string) ([]Vertex, []Edge, error) {
+	return l.EdgeListLoader.load(path, l.S3.Open, l.SkipHeader)
+}
@@ -0,0 +1,206 @@
+package waffle
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+)
+
+// S3Persister checkpoints a job to S3 the way FilePersister does to a
+// filesystem, with the same layout under S3.Prefix, for workers that don't
+// share a disk.  Parts are written to a temporary file first so big ones can
+// go up in a multipart upload without being held in memory.  Incremental
+// and Compact work as they do for FilePersister.
+type S3Persister struct {
+	S3          *S3
+	Incremental bool
+	Compact     int
+	chain       deltaChain
+}
+
+func (p *S3Persister) stepKey(step int, file string) string {
+	return p.S3.key(fmt.Sprintf("step-%06d/%s", step, file))
+}
+
+// Persist uploads this partition's part of the checkpoint for the step about
+// to run.
+func (p *S3Persister) Persist(g *Graph) error {
+	step := g.Superstep() + 1
+	part, msgs := newCheckpointPart(g)
+	var only map[string]bool
+	var removed []string
+	var sums map[string]uint64
+	if p.Incremental {
+		only, removed, sums = p.chain.plan(g, step, p.Compact, &part)
+	}
+	f, err := os.CreateTemp("", "waffle-checkpoint-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+	if err := writeCheckpointPart(w, g, &part, msgs, only, removed); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	part.Size = fi.Size()
+	part.SHA256 = hex.EncodeToString(h.Sum(nil))
+	if err := p.S3.Put(p.stepKey(step, part.File), f, part.Size); err != nil {
+		return err
+	}
+	b, _ := json.Marshal(&part)
+	if err := p.S3.Put(p.stepKey(step, part.File+".json"), bytes.NewReader(b), int64(len(b))); err != nil {
+		return err
+	}
+	if p.Incremental {
+		p.chain.wrote(g.partitionId, step, only == nil, sums)
+	}
+	return nil
+}
+
+func (p *S3Persister) checkpointCommitted(g *Graph, step int) {
+	for _, s := range p.chain.commit(step) {
+		if err := p.deleteCheckpoint(g, s); err != nil {
+			log.Printf("Could not delete checkpoint for step %d: %v", s, err)
+		}
+	}
+}
+
+// PersistState saves the job state, and once a checkpoint has every part in
+// place writes its manifest.
+func (p *S3Persister) PersistState(s *JobState) error {
+	if s.Checkpoint > 0 {
+		if err := p.commitManifest(s); err != nil {
+			return err
+		}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return p.S3.Put(p.S3.key(checkpointState), bytes.NewReader(b), int64(len(b)))
+}
+
+func (p *S3Persister) commitManifest(s *JobState) error {
+	key := p.stepKey(s.Checkpoint, checkpointManifest)
+	if _, err := p.S3.Get(key); err == nil {
+		return nil
+	} else if !isS3NotFound(err) {
+		return err
+	}
+	m, err := collectManifest(s, func(file string) ([]byte, error) {
+		return p.S3.Get(p.stepKey(s.Checkpoint, file))
+	})
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return p.S3.Put(key, bytes.NewReader(b), int64(len(b)))
+}
+
+// LoadState loads the last saved job state, nil if there is none.
+func (p *S3Persister) LoadState(namespace string) (*JobState, error) {
+	b, err := p.S3.Get(p.S3.key(checkpointState))
+	if isS3NotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var s JobState
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if s.namespace() != namespace {
+		return nil, fmt.Errorf("%s holds the state of job %s, not %s", p.S3.Path(p.S3.key(checkpointState)), s.namespace(), namespace)
+	}
+	return &s, nil
+}
+
+// DeleteCheckpoint removes this partition's part of the checkpoint at step,
+// the first partition takes the manifest with it.  Incremental parts that
+// later ones still build on stay until the next full part.
+func (p *S3Persister) DeleteCheckpoint(g *Graph, step int) error {
+	if p.Incremental && p.chain.hold(step) {
+		return nil
+	}
+	return p.deleteCheckpoint(g, step)
+}
+
+func (p *S3Persister) deleteCheckpoint(g *Graph, step int) error {
+	file := resultPart(g.partitionId)
+	for _, key := range []string{p.stepKey(step, file), p.stepKey(step, file+".json")} {
+		if err := p.S3.Delete(key); err != nil {
+			return err
+		}
+	}
+	if g.partitionId == 0 {
+		return p.S3.Delete(p.stepKey(step, checkpointManifest))
+	}
+	return nil
+}
+
+func (p *S3Persister) manifest(dir string) (*CheckpointManifest, error) {
+	b, err := p.S3.Get(path.Join(dir, checkpointManifest))
+	if err != nil {
+		return nil, err
+	}
+	var m CheckpointManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("bad checkpoint manifest in %s: %v", p.S3.Path(dir), err)
+	}
+	return &m, nil
+}
+
+// CheckpointPaths lists the parts of the checkpoint at step.
+func (p *S3Persister) CheckpointPaths(step int) ([]string, error) {
+	dir := path.Dir(p.stepKey(step, checkpointManifest))
+	m, err := p.manifest(dir)
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint at step %d is incomplete: %v", step, err)
+	}
+	var paths []string
+	for _, part := range m.Parts {
+		paths = append(paths, p.S3.Path(path.Join(dir, part.File)))
+	}
+	return paths, nil
+}
+
+// LoadCheckpoint reads a checkpoint part, checking it against the manifest,
+// and replays the parts it builds on when it is a delta.
+func (p *S3Persister) LoadCheckpoint(s3path string) ([]Vertex, []Edge, []Message, error) {
+	key, err := p.S3.keyOf(s3path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	m, err := p.manifest(path.Dir(key))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return replayCheckpoint(m.Step, path.Base(key), func(step int, file string) (*CheckpointManifest, string, []byte, error) {
+		key := p.stepKey(step, file)
+		m, err := p.manifest(path.Dir(key))
+		if err != nil {
+			return nil, "", nil, err
+		}
+		b, err := p.S3.Get(key)
+		return m, p.S3.Path(key), b, err
+	})
+}
@@ -0,0 +1,29 @@
+package waffle
+
+import (
+	"math/rand"
+	"time"
+)
+
+// SampleEdges picks k of the out edges of vertex id uniformly at random, or
+// all of them if it has k or fewer.  It streams over the edges once
+// (reservoir sampling), so it works just as well for vertices with huge
+// degrees.
+func (g *Graph) SampleEdges(id string, k int) []Edge {
+	edges := g.edges[id]
+	if len(edges) <= k {
+		return append([]Edge(nil), edges...)
+	}
+	if g.rng == nil {
+		g.rng = rand.New(rand.NewSource(time.Now().UnixNano() + int64(g.partitionId)))
+	}
+	sample := make([]Edge, k)
+	for i, e := range edges {
+		if i < k {
+			sample[i] = e
+		} else if j := g.rng.Intn(i + 1); j < k {
+			sample[j] = e
+		}
+	}
+	return sample
+}
@@ -0,0 +1,107 @@
+package waffle
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A Simulation makes a worker misbehave on purpose, so a job's authors can
+// see how it copes with skewed and failing workers before it meets a real
+// cluster.  Give the workers of RunLocal their own, or set one on particular
+// workers with a ClusterConfig.
+type Simulation struct {
+	// compute takes this many times as long as it really does, below 1 is
+	// no slowdown
+	Slowdown float64
+	// added to every step on top of the slowdown
+	Delay time.Duration
+	// steps this worker dies at the start of, as if its machine went away.
+	// Step 0 is the load.  Each fails once, so a recovered run gets past it.
+	FailSteps []int
+
+	failed map[int]bool
+	sync.Mutex
+}
+
+// A SimulatedFailure is how a worker ends a run when its Simulation says it
+// dies.  Like a lost worker the job can recover from it.
+type SimulatedFailure struct {
+	Worker string
+	Step   int
+}
+
+func (e *SimulatedFailure) Error() string {
+	return fmt.Sprintf("simulated failure of worker %s at step %d", e.Worker, e.Step)
+}
+
+// whether the worker is due to die at step, which it only does once
+func (s *Simulation) fails(step int) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, f := range s.FailSteps {
+		if f == step && !s.failed[step] {
+			if s.failed == nil {
+				s.failed = make(map[int]bool)
+			}
+			s.failed[step] = true
+			return true
+		}
+	}
+	return false
+}
+
+// how much longer a step that took elapsed should take
+func (s *Simulation) lag(elapsed time.Duration) time.Duration {
+	if s == nil {
+		return 0
+	}
+	d := s.Delay
+	if s.Slowdown > 1 {
+		d += time.Duration(float64(elapsed) * (s.Slowdown - 1))
+	}
+	return d
+}
+
+// die at step if the simulation says so.  The run ends with the error and
+// never enters the barrier, and once the runner is closed the rest of the
+// workers see this one go.
+func (c *Coordinator) simulateFailure(step int) bool {
+	if !c.config.Simulate.fails(step) {
+		return false
+	}
+	err := &SimulatedFailure{Worker: c.config.NodeId, Step: step}
+	c.log.Println(err)
+	c.fail(err)
+	return true
+}
+
+func (c *Coordinator) simulateLag(step int, elapsed time.Duration) {
+	if d := c.config.Simulate.lag(elapsed); d > 0 {
+		c.log.debugf("Simulating %v of lag in step %d", d, step)
+		time.Sleep(d)
+	}
+}
+
+// RunLocal runs a worker for each of configs in this process, each with its
+// own job from newJob, and recovering from lost workers as RunWithRecovery
+// does.  It returns the first error a worker gave up with.  The workers need
+// their own NodeId and RPCPort, and a ZooKeeper to share.
+func RunLocal(configs []*Config, newJob func() Job, attempts int) error {
+	errs := make(chan error, len(configs))
+	for _, c := range configs {
+		go func(c *Config) {
+			errs <- RunWithRecovery(c, newJob(), attempts)
+		}(c)
+	}
+	var first error
+	for range configs {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,76 @@
+package waffle
+
+import (
+	"sort"
+)
+
+// With Config.NumPartitions set, vertices are hashed into that many
+// partitions no matter how many workers there are, and the partitions are
+// spread over the workers.  Each worker computes the partitions it holds as
+// one.  Where a vertex lives then doesn't hang on the worker count, and a
+// job resumed with a different set of workers only moves the partitions of
+// workers that didn't come back, to whoever holds the fewest.  The
+// assignment is saved in the job state.
+
+// deal out the partitions over the workers, who are in partition order
+func (c *Coordinator) assignSlots(workers []string) {
+	n := c.config.NumPartitions
+	if n <= 0 {
+		return
+	}
+	if n < len(workers) {
+		c.log.Printf("Only %d partitions for %d workers, some workers will have nothing to do", n, len(workers))
+	}
+	pids := make(map[string]int)
+	for pid, w := range workers {
+		pids[w] = pid
+	}
+	c.slots = make([]int, n)
+	held := make([]int, len(workers))
+	var orphans []int
+	for slot := 0; slot < n; slot++ {
+		if c.resume != nil && len(c.resume.Slots) == n {
+			if pid, ok := pids[c.resume.Slots[slot]]; ok {
+				c.slots[slot] = pid
+				held[pid]++
+				continue
+			}
+			orphans = append(orphans, slot)
+			continue
+		}
+		c.slots[slot] = slot % len(workers)
+		held[slot%len(workers)]++
+	}
+	moveSlots(c.slots, held, orphans, -1)
+	if len(orphans) > 0 {
+		c.log.Printf("Moved %d of %d partitions off workers that didn't come back", len(orphans), n)
+	}
+}
+
+// give each orphaned slot to the worker partition holding the fewest, other
+// than gone
+func moveSlots(slots, held, orphans []int, gone int) {
+	sort.Ints(orphans)
+	for _, slot := range orphans {
+		least := -1
+		for pid := range held {
+			if pid != gone && (least < 0 || held[pid] < held[least]) {
+				least = pid
+			}
+		}
+		slots[slot] = least
+		held[least]++
+	}
+}
+
+// the worker of each partition, for the job state
+func (c *Coordinator) slotWorkers() map[int]string {
+	if c.slots == nil {
+		return nil
+	}
+	r := make(map[int]string)
+	for slot, pid := range c.slots {
+		r[slot] = c.worker(pid)
+	}
+	return r
+}
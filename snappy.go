@@ -0,0 +1,177 @@
+package waffle
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// snappyCodec speaks the snappy block format: the length of the data as a
+// uvarint, then literals and copies of earlier bytes.  It trades ratio for
+// speed, finding matches greedily with one hash table probe per byte, and is
+// readable by any other snappy implementation.  There is no framing or
+// checksum, part files have their own and message batches ride on rpc.
+
+var errSnappyCorrupt = errors.New("snappy: corrupt input")
+
+const (
+	snappyBlockSize = 1 << 16
+	snappyTableBits = 14
+	// the most a byte of input can decode to, a three byte copy writes at
+	// most 64 bytes
+	snappyMaxExpansion = 22
+)
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return "snappy" }
+
+func (snappyCodec) Compress(p []byte) ([]byte, error) {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(p)+len(p)/6+32)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(p)))]
+	// copies never reach back past the start of a block, so their offsets
+	// fit in two bytes
+	var table [1 << snappyTableBits]int32
+	for start := 0; start < len(p); start += snappyBlockSize {
+		end := start + snappyBlockSize
+		if end > len(p) {
+			end = len(p)
+		}
+		dst = snappyBlock(dst, p[start:end], &table)
+	}
+	return dst, nil
+}
+
+func snappyBlock(dst, blk []byte, table *[1 << snappyTableBits]int32) []byte {
+	for i := range table {
+		table[i] = 0
+	}
+	hash := func(u uint32) uint32 {
+		return (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+	}
+	lit, s := 0, 0
+	for s+4 <= len(blk) {
+		u := binary.LittleEndian.Uint32(blk[s:])
+		h := hash(u)
+		// table holds positions plus one, so zero is empty
+		cand := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if cand < 0 || binary.LittleEndian.Uint32(blk[cand:]) != u {
+			s++
+			continue
+		}
+		dst = snappyLiteral(dst, blk[lit:s])
+		base := s
+		s, cand = s+4, cand+4
+		for s < len(blk) && blk[s] == blk[cand] {
+			s, cand = s+1, cand+1
+		}
+		dst = snappyCopy(dst, s-cand, s-base)
+		lit = s
+	}
+	return snappyLiteral(dst, blk[lit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	n := uint32(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// a copy of length bytes from offset back, at least 4 long
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
+
+func (snappyCodec) Decompress(p []byte) ([]byte, error) {
+	n, k := binary.Uvarint(p)
+	// the header is only a claim, don't allocate more than the rest could
+	// decode to
+	if k <= 0 || n > 1<<32-1 || n > uint64(len(p)-k)*snappyMaxExpansion {
+		return nil, errSnappyCorrupt
+	}
+	dst := make([]byte, 0, n)
+	for i := k; i < len(p); {
+		tag := p[i]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			x := int(tag >> 2)
+			i++
+			if x >= 60 {
+				size := x - 59
+				if i+size > len(p) {
+					return nil, errSnappyCorrupt
+				}
+				x = 0
+				for j := size - 1; j >= 0; j-- {
+					x = x<<8 | int(p[i+j])
+				}
+				i += size
+			}
+			length = x + 1
+			if length > len(p)-i || uint64(len(dst)+length) > n {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, p[i:i+length]...)
+			i += length
+			continue
+		case 1:
+			if i+2 > len(p) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(p[i+1])
+			i += 2
+		case 2:
+			if i+3 > len(p) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(p[i+1:]))
+			i += 3
+		case 3:
+			if i+5 > len(p) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(p[i+1:]))
+			i += 5
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errSnappyCorrupt
+		}
+		// copies can overlap what they write, so go a byte at a time
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
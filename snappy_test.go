@@ -0,0 +1,100 @@
+package waffle
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func snappyInputs() [][]byte {
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 3*snappyBlockSize+17)
+	r.Read(random)
+	text := bytes.Repeat([]byte("vertex 12345 sends 0.25 to vertex 67890\n"), 4000)
+	return [][]byte{
+		nil,
+		[]byte("a"),
+		[]byte("abcdabcdabcdabcd"),
+		bytes.Repeat([]byte{0}, 1<<20),
+		random,
+		text,
+	}
+}
+
+func TestSnappyRoundTrip(t *testing.T) {
+	var c snappyCodec
+	for _, in := range snappyInputs() {
+		packed, err := c.Compress(in)
+		if err != nil {
+			t.Fatalf("Compress of %d bytes failed: %v", len(in), err)
+		}
+		out, err := c.Decompress(packed)
+		if err != nil {
+			t.Fatalf("Decompress of %d bytes failed: %v", len(in), err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("%d bytes came back as %d different ones", len(in), len(out))
+		}
+	}
+}
+
+func TestSnappyCorrupt(t *testing.T) {
+	var c snappyCodec
+	for _, in := range [][]byte{
+		{},
+		// claims 4GiB with nothing behind it
+		{0xff, 0xff, 0xff, 0xff, 0x0f},
+		// claims more than its one literal
+		{0x10, 0x00, 'a'},
+		// copies from before the start
+		{0x08, 0x01, 0x05, 0x00},
+		// literal runs off the end
+		{0x04, 0x0c, 'a'},
+	} {
+		if out, err := c.Decompress(in); err == nil {
+			t.Errorf("Decompress(%x) = %x, want an error", in, out)
+		}
+	}
+}
+
+func FuzzSnappyRoundTrip(f *testing.F) {
+	for _, in := range snappyInputs() {
+		if len(in) < 1<<12 {
+			f.Add(in)
+		}
+	}
+	f.Fuzz(func(t *testing.T, in []byte) {
+		var c snappyCodec
+		packed, err := c.Compress(in)
+		if err != nil {
+			t.Fatalf("Compress failed: %v", err)
+		}
+		out, err := c.Decompress(packed)
+		if err != nil {
+			t.Fatalf("Decompress failed: %v", err)
+		}
+		if !bytes.Equal(in, out) {
+			t.Fatalf("%x came back as %x", in, out)
+		}
+	})
+}
+
+func FuzzSnappyDecompress(f *testing.F) {
+	var c snappyCodec
+	for _, in := range snappyInputs() {
+		if len(in) < 1<<12 {
+			packed, _ := c.Compress(in)
+			f.Add(packed)
+		}
+	}
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		out, err := c.Decompress(in)
+		if err != nil {
+			return
+		}
+		if len(out) > len(in)*snappyMaxExpansion {
+			t.Fatalf("%d bytes decoded to %d", len(in), len(out))
+		}
+	})
+}
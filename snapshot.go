@@ -0,0 +1,126 @@
+package waffle
+
+import (
+	"hash/fnv"
+	"sync/atomic"
+)
+
+const snapshotPages = 64
+
+func pageOf(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % snapshotPages)
+}
+
+// A Snapshot is a consistent view of a partition as of the end of a step,
+// for inspection and checkpointing while the next step computes.  It is a
+// copy of the partition, cut between steps when nothing is changing, split
+// into pages.  Compute marks a page dirty before it first changes anything in
+// it, and the next cut only copies the dirty pages, sharing the rest with the
+// snapshot before.  Pages are never changed once cut, so readers don't take
+// any locks and never hold up compute.  Snapshots are only cut once someone
+// has asked for one.
+type Snapshot struct {
+	Step  int
+	pages [snapshotPages]map[string]Vertex
+}
+
+func (g *Graph) cutSnapshot(step int) {
+	g.snapLock.Lock()
+	old, wanted := g.snap, g.snapWanted
+	g.snapLock.Unlock()
+	if !wanted {
+		return
+	}
+	var ids [snapshotPages][]string
+	g.eachId(func(id string) {
+		p := pageOf(id)
+		ids[p] = append(ids[p], id)
+	})
+	s := &Snapshot{Step: step}
+	copied := 0
+	for p := range ids {
+		dirty := atomic.SwapInt32(&g.dirty[p], 0) == 1
+		if old != nil && !dirty && samePage(old.pages[p], ids[p]) {
+			s.pages[p] = old.pages[p]
+			continue
+		}
+		page := make(map[string]Vertex, len(ids[p]))
+		for _, id := range ids[p] {
+			v, cold, ok := g.vertex(id)
+			if !ok {
+				continue
+			}
+			if !cold {
+				// paged in vertices are copies already
+				var err error
+				if v, err = copyVertex(v); err != nil {
+					g.log.Printf("Could not copy vertex %s into snapshot: %v", id, err)
+					continue
+				}
+			}
+			page[id] = v
+		}
+		s.pages[p] = page
+		copied++
+	}
+	g.log.debugf("Cut the snapshot of step %d, %d pages copied", step, copied)
+
+	g.snapLock.Lock()
+	g.snap = s
+	g.snapCond.Broadcast()
+	g.snapLock.Unlock()
+}
+
+// whether page holds exactly ids
+func samePage(page map[string]Vertex, ids []string) bool {
+	if len(page) != len(ids) {
+		return false
+	}
+	for _, id := range ids {
+		if _, ok := page[id]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot returns the snapshot of this partition as of the last completed
+// step.  The first call waits for the end of the current step, since
+// snapshots are only cut from then on.
+func (g *Graph) Snapshot() *Snapshot {
+	g.snapLock.Lock()
+	defer g.snapLock.Unlock()
+	g.snapWanted = true
+	for g.snap == nil {
+		g.snapCond.Wait()
+	}
+	return g.snap
+}
+
+// touch has to be called before compute changes the vertex id
+func (g *Graph) touch(id string) {
+	atomic.StoreInt32(&g.dirty[pageOf(id)], 1)
+}
+
+// Vertex returns a copy of vertex id as of the snapshot
+func (s *Snapshot) Vertex(id string) (Vertex, bool) {
+	v, ok := s.pages[pageOf(id)][id]
+	if !ok {
+		return nil, false
+	}
+	c, err := copyVertex(v)
+	return c, err == nil
+}
+
+// Each calls fn with a copy of every vertex in the snapshot
+func (s *Snapshot) Each(fn func(Vertex)) {
+	for _, page := range s.pages {
+		for _, v := range page {
+			if c, err := copyVertex(v); err == nil {
+				fn(c)
+			}
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package waffle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// initial size of a spill file, they double from here as needed
+	spillInitialSize = 1 << 20
+	// once a buffer holds this much we ship it rather than keep growing it
+	spillChunkSize = 64 << 20
+)
+
+// a batch of gob encoded messages that are all delivered in Step
+type MessageBatch struct {
+	Step  int
+	Count int
+	// codec Data is compressed with
+	Codec string
+	Data  []byte
+}
+
+func (c *Coordinator) SubmitMessageBatch(b *MessageBatch, r *int) error {
+	data := b.Data
+	if b.Codec != "" && b.Codec != "none" {
+		// the sender may have fallen back to a codec everyone has
+		codec := Codec(c.codecs.get(c.config, CodecMessages))
+		var err error
+		if b.Codec != c.config.MessageCodec {
+			if codec, err = lookupCodec(b.Codec); err != nil {
+				return fmt.Errorf("batch uses codec %s: %v", b.Codec, err)
+			}
+		}
+		if data, err = codec.Decompress(data); err != nil {
+			return err
+		}
+	}
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	for i := 0; i < b.Count; i++ {
+		var m Message
+		if err := dec.Decode(&m); err != nil {
+			return err
+		}
+		c.graph.addMessage(m, b.Step)
+	}
+	*r = 0
+	return nil
+}
+
+// spillBuffer stages the serialized messages for one partition in a memory
+// mapped file so that a step that sends a huge amount of data doesn't keep it
+// all on the heap.  Buffers are only touched from compute and the flush that
+// follows it, so there is no locking.
+type spillBuffer struct {
+	disk  *diskUsage
+	f     *os.File
+	data  []byte
+	n     int
+	count int
+	step  int
+	enc   *gob.Encoder
+}
+
+func newSpillBuffer(dir, name string, disk *diskUsage) (*spillBuffer, error) {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	// nobody needs to find the file again, the mapping keeps it alive
+	os.Remove(f.Name())
+	b := &spillBuffer{f: f, disk: disk}
+	if err := b.grow(spillInitialSize); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *spillBuffer) grow(size int) error {
+	if err := b.disk.reserve(DiskSpill, int64(size-len(b.data))); err != nil {
+		return err
+	}
+	if err := b.f.Truncate(int64(size)); err != nil {
+		b.disk.release(DiskSpill, int64(size-len(b.data)))
+		return err
+	}
+	if b.data != nil {
+		if err := munmap(b.data); err != nil {
+			return err
+		}
+	}
+	data, err := mmap(b.f, size)
+	if err != nil {
+		return err
+	}
+	b.data = data
+	return nil
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if need := b.n + len(p); need > len(b.data) {
+		size := 2 * len(b.data)
+		for size < need {
+			size *= 2
+		}
+		if err := b.grow(size); err != nil {
+			return 0, err
+		}
+	}
+	copy(b.data[b.n:], p)
+	b.n += len(p)
+	return len(p), nil
+}
+
+func (b *spillBuffer) add(m Message, step int) error {
+	if b.enc == nil {
+		// every batch carries its own type information
+		b.enc = gob.NewEncoder(b)
+		b.step = step
+	}
+	if err := b.enc.Encode(&m); err != nil {
+		return err
+	}
+	b.count++
+	return nil
+}
+
+func (b *spillBuffer) batch() *MessageBatch {
+	return &MessageBatch{Step: b.step, Count: b.count, Data: b.data[:b.n]}
+}
+
+func (b *spillBuffer) reset() {
+	b.n, b.count, b.enc = 0, 0, nil
+}
+
+func (b *spillBuffer) close() {
+	b.disk.release(DiskSpill, int64(len(b.data)))
+	munmap(b.data)
+	b.f.Close()
+}
+
+// stage m for partition pid, shipping the buffer if it has grown large
+func (c *Coordinator) spillMessage(m Message, pid, step int) error {
+	b, ok := c.spills[pid]
+	if !ok {
+		var err error
+		if b, err = newSpillBuffer(c.config.SpillDir, fmt.Sprintf("%s-%s-%d.spill", strings.Replace(c.config.namespace(), "/", "-", -1), c.config.NodeId, pid), c.disk); err != nil {
+			return err
+		}
+		c.spills[pid] = b
+	}
+	// ship what we have rather than grow past the spill quota
+	if b.n > len(b.data)/2 && !c.disk.fits(DiskSpill, int64(len(b.data))) {
+		c.flushSpill(pid, b)
+	}
+	var t time.Time
+	timed := false
+	if p := c.graph.prof; p != nil {
+		t, timed = p.encode.start()
+	}
+	err := b.add(m, step)
+	if timed {
+		c.graph.prof.encode.stop(t)
+	}
+	if err != nil {
+		return err
+	}
+	if b.n >= spillChunkSize {
+		c.flushSpill(pid, b)
+	}
+	return nil
+}
+
+// Ship a spill buffer to its partition.  This waits for the reply since the
+// mapped memory gets reused as soon as we return.
+func (c *Coordinator) flushSpill(pid int, b *spillBuffer) {
+	if b.count == 0 {
+		return
+	}
+	batch := b.batch()
+	codec := c.codecs.get(c.config, CodecMessages)
+	data, err := codec.Compress(batch.Data)
+	if err == nil {
+		batch.Codec, batch.Data = codec.Name(), data
+		var r int
+		err = c.client(c.worker(pid)).Call("Coordinator.SubmitMessageBatch", batch, &r)
+	}
+	if err != nil {
+		c.log.Printf("Could not deliver %d spilled messages to partition %d: %v", b.count, pid, err)
+	}
+	c.outbox.add(b.count, err)
+	b.reset()
+}
+
+func (c *Coordinator) flushSpills() {
+	for pid, b := range c.spills {
+		c.flushSpill(pid, b)
+	}
+}
@@ -0,0 +1,68 @@
+package waffle
+
+import (
+	"fmt"
+	"launchpad.net/gozk/zookeeper"
+	"sync/atomic"
+)
+
+// A job normally starts as soon as Config.InitialWorkers have registered.  An
+// operator can also decide that whoever has registered so far is the whole
+// cluster and start the job right away with StartNow.  That drops a start
+// node into zk which every worker is watching.  It goes away when the run
+// ends, however it ends.
+
+type StartRequest struct {
+	Source string
+	Token  string
+}
+
+func (c *Coordinator) StartNow(req *StartRequest, r *int) error {
+	if err := c.authorize(req.Source, req.Token, OpStart); err != nil {
+		return err
+	}
+	*r = 0
+	if _, err := c.zk.Create(c.startPath, "", 0, zookeeper.WorldACL(zookeeper.PERM_ALL)); err != nil && !zookeeper.IsError(err, zookeeper.ZNODEEXISTS) {
+		return fmt.Errorf("could not create the start node: %v", err)
+	}
+	return nil
+}
+
+// StartNow asks the worker listening at host:port to start its job with the
+// workers that have registered so far.
+func StartNow(c *Config, host, port string) error {
+	cl, err := (&Coordinator{config: c}).dial(host, port)
+	if err != nil {
+		return err
+	}
+	defer cl.Close()
+	var r int
+	return cl.Call("Coordinator.StartNow", &StartRequest{Source: c.NodeId, Token: c.Token}, &r)
+}
+
+func (c *Coordinator) watchStart() {
+	for {
+		stat, watch, err := c.zk.ExistsW(c.startPath)
+		if err != nil {
+			c.log.Printf("Could not watch %s: %v", c.startPath, err)
+			return
+		}
+		if stat != nil {
+			c.startEarly()
+			return
+		}
+		<-watch
+	}
+}
+
+func (c *Coordinator) startEarly() {
+	if !atomic.CompareAndSwapInt32(&c.state, SetupState, PrepareState) {
+		// already on our way
+		return
+	}
+	// StartNow audited the request, not every worker
+	c.log.Printf("Starting early with %d workers", c.workers.Len())
+	c.advance(stagePlan, func() {
+		c.prepare(c.workers)
+	})
+}
@@ -0,0 +1,178 @@
+package waffle
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+const (
+	// number of steps of history kept for each worker
+	workerHistoryLen = 16
+	// a worker is a straggler when it computes this many times longer than
+	// the median worker
+	stragglerFactor = 2.0
+)
+
+type workerStat struct {
+	Step         int
+	Active, Msgs int
+	Vertices     int
+	// seconds spent computing the step, and paused for gc while computing
+	// and flushing it
+	Time, GCPause float64
+	// seconds on the job's Timers
+	Timers map[string]float64 `json:",omitempty"`
+}
+
+// workerStats keeps a bounded history of the per-worker step summaries seen
+// at the step barriers, along with the cluster wide totals.
+type workerStats struct {
+	sync.Mutex
+	history map[string][]*workerStat
+	steps   []*workerStat
+	// every step of the job, for the job summary
+	all []*workerStat
+}
+
+func newWorkerStats() *workerStats {
+	return &workerStats{
+		history: make(map[string][]*workerStat),
+	}
+}
+
+func (s *workerStats) record(worker string, st *workerStat) {
+	s.Lock()
+	defer s.Unlock()
+	h := append(s.history[worker], st)
+	if len(h) > workerHistoryLen {
+		h = h[len(h)-workerHistoryLen:]
+	}
+	s.history[worker] = h
+}
+
+func (s *workerStats) recordStep(st *workerStat) {
+	s.Lock()
+	defer s.Unlock()
+	s.steps = append(s.steps, st)
+	s.all = append(s.all, st)
+	if len(s.steps) > workerHistoryLen {
+		s.steps = s.steps[len(s.steps)-workerHistoryLen:]
+	}
+}
+
+func (s *workerStats) last(worker string, step int) *workerStat {
+	h := s.history[worker]
+	if len(h) == 0 || h[len(h)-1].Step != step {
+		return nil
+	}
+	return h[len(h)-1]
+}
+
+// stragglers returns the workers that took much longer than the median worker
+// to compute step
+func (s *workerStats) stragglers(step int) (slow []string) {
+	s.Lock()
+	defer s.Unlock()
+	var times []float64
+	for w := range s.history {
+		if st := s.last(w, step); st != nil {
+			times = append(times, st.Time)
+		}
+	}
+	if len(times) < 2 {
+		return nil
+	}
+	sort.Float64s(times)
+	median := times[len(times)/2]
+	for w := range s.history {
+		if st := s.last(w, step); st != nil && median > 0 && st.Time > stragglerFactor*median {
+			slow = append(slow, w)
+		}
+	}
+	sort.Strings(slow)
+	return
+}
+
+// eta guesses how many seconds are left in the job by extrapolating the drop
+// in active vertices over the retained steps.  It returns -1 when the active
+// count isn't going down.
+func (s *workerStats) eta() float64 {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.steps) < 2 {
+		return -1
+	}
+	first, last := s.steps[0], s.steps[len(s.steps)-1]
+	n := float64(len(s.steps) - 1)
+	drop := float64(first.Active-last.Active) / n
+	if drop <= 0 {
+		return -1
+	}
+	var total float64
+	for _, st := range s.steps {
+		total += st.Time
+	}
+	return float64(last.Active) / drop * (total / float64(len(s.steps)))
+}
+
+func (s *workerStats) information() map[string]interface{} {
+	info := make(map[string]interface{})
+	s.Lock()
+	workers := make(map[string]interface{})
+	for w, h := range s.history {
+		workers[w] = append([]*workerStat(nil), h...)
+	}
+	info["workers"] = workers
+	info["steps"] = append([]*workerStat(nil), s.steps...)
+	s.Unlock()
+	info["eta"] = s.eta()
+	return info
+}
+
+func summaryTimers(s map[string]interface{}) map[string]float64 {
+	if _, ok := s["timers"]; !ok {
+		return nil
+	}
+	return summaryFloats(s, "timers")
+}
+
+// pull the per worker stats out of a merged step summary
+func (s *workerStats) collect(step int, total map[string]interface{}) map[string]*workerStat {
+	workers, ok := total["workers"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	stats := make(map[string]*workerStat)
+	var slowest float64
+	for w, v := range workers {
+		st := v.(map[string]interface{})
+		ws := &workerStat{
+			Step:   step,
+			Active: summaryInt(st, "active"),
+			Msgs:   summaryInt(st, "msgs"),
+		}
+		ws.Vertices = summaryInt(st, "vertices")
+		ws.Time, _ = st["time"].(float64)
+		ws.GCPause, _ = st["gcPause"].(float64)
+		ws.Timers = summaryTimers(st)
+		if ws.Time > slowest {
+			slowest = ws.Time
+		}
+		s.record(w, ws)
+		stats[w] = ws
+	}
+	// the step takes as long as its slowest worker
+	s.recordStep(&workerStat{
+		Step:     step,
+		Active:   summaryInt(total, "active"),
+		Msgs:     summaryInt(total, "msgs"),
+		Time:     slowest,
+		Vertices: summaryInt(total, "vertices"),
+		Timers:   summaryTimers(total),
+	})
+	if slow := s.stragglers(step); len(slow) > 0 {
+		log.Printf("Stragglers in step %d: %v", step, slow)
+	}
+	return stats
+}
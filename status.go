@@ -0,0 +1,97 @@
+package waffle
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+var stateNames = []string{"new", "setup", "prepare", "load", "run", "write", "join"}
+
+func stateName(state int32) string {
+	if state < 0 || int(state) >= len(stateNames) {
+		return fmt.Sprintf("state %d", state)
+	}
+	return stateNames[state]
+}
+
+// JobStatus is what the status endpoint serves
+type JobStatus struct {
+	JobId  string
+	Tenant string
+	Phase  string
+	Step   int
+	// from the last step barrier
+	Active, Msgs int
+	// worker by partition, and the workers that have been declared dead
+	Partitions map[int]string
+	Failed     []string
+	Steps      []*workerStat
+	Frontier   []FrontierStat
+	Topology   []TopologyChange
+	Eta        float64
+}
+
+func (c *Coordinator) status() *JobStatus {
+	s := &JobStatus{
+		JobId:      c.config.JobId,
+		Tenant:     c.config.Tenant,
+		Phase:      stateName(atomic.LoadInt32(&c.state)),
+		Partitions: c.partitionMap(),
+		Eta:        c.stats.eta(),
+	}
+	if g := c.graph; g != nil {
+		s.Step = g.Superstep()
+		g.globalStat.Lock()
+		s.Active, s.Msgs = g.globalStat.active, g.globalStat.msgs
+		g.globalStat.Unlock()
+	}
+	c.heartbeats.Lock()
+	for w := range c.heartbeats.failed {
+		s.Failed = append(s.Failed, w)
+	}
+	c.heartbeats.Unlock()
+	sort.Strings(s.Failed)
+	c.stats.Lock()
+	s.Steps = append([]*workerStat(nil), c.stats.all...)
+	c.stats.Unlock()
+	s.Frontier = c.frontiers.list()
+	s.Topology = c.topology.list()
+	return s
+}
+
+// serveStatus serves the job status as json on Config.StatusAddr.  Callers
+// present their token in the X-Waffle-Token header.
+func (c *Coordinator) serveStatus() {
+	if c.config.StatusAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.authorize(r.RemoteAddr, r.Header.Get(tokenHeader), OpStatus); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.status()); err != nil {
+			c.log.Printf("Could not send status to %s: %v", r.RemoteAddr, err)
+		}
+	})
+	mux.HandleFunc("/metrics", c.serveMetrics)
+	mux.HandleFunc("/cancel", c.serveCancel)
+	addr, err := normalizeAddr(c.config.StatusAddr)
+	if err != nil {
+		c.log.Printf("Bad status address %s: %v", c.config.StatusAddr, err)
+		return
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		c.log.Printf("Could not serve status on %s: %v", c.config.StatusAddr, err)
+		return
+	}
+	c.statusListener = l
+	go http.Serve(l, mux)
+}
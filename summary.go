@@ -0,0 +1,139 @@
+package waffle
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const jobSummaryFile = "SUMMARY.json"
+
+// JobSummary is written next to the results of a job so that a run can be
+// understood (and repeated) long after its logs are gone.
+type JobSummary struct {
+	JobId    string
+	Tenant   string
+	Tags     map[string]string
+	Finished time.Time
+	Build    BuildInfo
+	// the config minus anything secret
+	Config map[string]interface{}
+	// cluster totals for every step
+	Steps []*workerStat
+	// worker by partition, and what each worker was built from
+	Partitions map[int]string
+	Versions   map[string]string
+	// the checkpoint this run was resumed from, 0 for a fresh run, and the
+	// steps it checkpointed itself
+	ResumedFrom int
+	Checkpoints []int
+	Manifest    string
+	// directories of the job's named outputs
+	Outputs map[string]string `json:",omitempty"`
+	// steps that added or removed vertices or edges
+	Topology []TopologyChange `json:",omitempty"`
+	// records skipped while loading, for jobs that report them
+	Load *LoadReport `json:",omitempty"`
+}
+
+// config fields that never go into a summary, nor do fields by these names in
+// anything the config points to
+var secretFields = map[string]bool{
+	"Token":        true,
+	"AccessKey":    true,
+	"SecretKey":    true,
+	"SessionToken": true,
+	"Password":     true,
+}
+
+func (c *Config) summary() map[string]interface{} {
+	s := summaryFields(reflect.ValueOf(c).Elem())
+	// certificates and keys stay out, and the ACL is only told by what it
+	// grants, its keys are tokens
+	s["TLS"] = c.TLS != nil
+	grants := make([]string, 0, len(c.ACL))
+	for _, ops := range c.ACL {
+		grants = append(grants, strings.Join(ops, ","))
+	}
+	sort.Strings(grants)
+	s["ACL"] = grants
+	return s
+}
+
+// the exported fields of struct v that aren't secret
+func summaryFields(v reflect.Value) map[string]interface{} {
+	s := make(map[string]interface{})
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || secretFields[f.Name] {
+			continue
+		}
+		s[f.Name] = summaryValue(v.Field(i))
+	}
+	return s
+}
+
+// v in a form json can take.  Functions only say whether they are set and
+// interfaces what they hold.
+func summaryValue(v reflect.Value) interface{} {
+	if v.Type() == reflect.TypeOf(time.Duration(0)) {
+		return time.Duration(v.Int()).String()
+	}
+	switch v.Kind() {
+	case reflect.Func:
+		return !v.IsNil()
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return v.Elem().Type().String()
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return summaryValue(v.Elem())
+	case reflect.Struct:
+		return summaryFields(v)
+	}
+	return v.Interface()
+}
+
+// writeJobSummary writes the summary into the result directory once the
+// results are committed
+func (c *Coordinator) writeJobSummary(dir string) error {
+	s := &JobSummary{
+		JobId:       c.config.JobId,
+		Tenant:      c.config.Tenant,
+		Tags:        c.config.Tags,
+		Finished:    time.Now(),
+		Build:       build(),
+		Config:      c.config.summary(),
+		Partitions:  c.partitionMap(),
+		Versions:    c.versions(),
+		Checkpoints: c.checkpoints,
+		Manifest:    filepath.Join(dir, resultManifest),
+		Load:        c.loadReport,
+		Outputs:     c.graph.outputDirs(),
+		Topology:    c.topology.list(),
+	}
+	if c.resume != nil {
+		s.ResumedFrom = c.resume.Checkpoint
+	}
+	c.stats.Lock()
+	s.Steps = append([]*workerStat(nil), c.stats.all...)
+	c.stats.Unlock()
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, jobSummaryFile+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, jobSummaryFile))
+}
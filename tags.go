@@ -0,0 +1,16 @@
+package waffle
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagString renders tags as sorted key=value pairs
+func tagString(tags map[string]string) string {
+	var pairs []string
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
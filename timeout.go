@@ -0,0 +1,153 @@
+package waffle
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// With Config.LoadTimeout, StepTimeout or WriteTimeout set, a barrier that
+// hasn't filled up in time ends the run with a StragglerError naming whoever
+// it was waiting for, rather than waiting forever on a hung worker.  The
+// stragglers are marked failed.  Their partitions only exist on them, so
+// there is nothing to run speculatively elsewhere, the way forward is
+// RunWithRecovery going back to the last checkpoint.
+
+type StragglerError struct {
+	Phase string
+	Step  int
+	// workers, or for loads the paths, that didn't make the barrier
+	Stragglers []string
+	Checkpoint int
+}
+
+func (e *StragglerError) Error() string {
+	what := e.Phase
+	if e.Phase == "superstep" {
+		what = fmt.Sprintf("step %d", e.Step)
+	}
+	return fmt.Sprintf("%s timed out waiting for %v, last checkpoint is at step %d", what, e.Stragglers, e.Checkpoint)
+}
+
+type phaseTimers struct {
+	m map[string]*time.Timer
+	sync.Mutex
+}
+
+func (t *phaseTimers) start(name string, d time.Duration, f func()) {
+	if d <= 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	if t.m == nil {
+		t.m = make(map[string]*time.Timer)
+	}
+	if _, ok := t.m[name]; ok {
+		return
+	}
+	t.m[name] = time.AfterFunc(d, f)
+}
+
+func (t *phaseTimers) stop(name string) {
+	t.Lock()
+	defer t.Unlock()
+	if timer, ok := t.m[name]; ok {
+		timer.Stop()
+		delete(t.m, name)
+	}
+}
+
+func (t *phaseTimers) stopAll() {
+	t.Lock()
+	defer t.Unlock()
+	for name, timer := range t.m {
+		timer.Stop()
+		delete(t.m, name)
+	}
+}
+
+// the entries in a barrier so far
+func (c *Coordinator) barrierEntries(name string) map[string]bool {
+	entries, _, err := c.zk.Children(path.Join(c.barriersPath, name))
+	if err != nil {
+		c.log.Printf("Could not read barrier %s: %v", name, err)
+		return nil
+	}
+	in := make(map[string]bool)
+	for _, e := range entries {
+		in[e] = true
+	}
+	return in
+}
+
+func (c *Coordinator) onLoadTimeout() {
+	in := c.barrierEntries("load")
+	if in == nil {
+		return
+	}
+	var missing []string
+	for _, p := range c.loadPaths() {
+		if !in[loadName(p)] {
+			missing = append(missing, p)
+		}
+	}
+	c.timedOut(&StragglerError{Phase: "load", Stragglers: missing}, false)
+}
+
+func (c *Coordinator) onStepTimeout(step int) {
+	in := c.barrierEntries("superstep-" + strconv.Itoa(step))
+	if in == nil {
+		return
+	}
+	c.summaryLock.Lock()
+	have := c.summaries[step]
+	c.summaryLock.Unlock()
+	var missing []string
+	for _, w := range c.partitionMap() {
+		if in[w] || have[w] != "" {
+			continue
+		}
+		if c.config.SummaryGroupSize > 0 && in[c.groupLeader(c.groupOf(w))] {
+			continue
+		}
+		// with summary groups we can't tell which member held up its
+		// group, so they all count
+		missing = append(missing, w)
+	}
+	c.timedOut(&StragglerError{Phase: "superstep", Step: step, Stragglers: missing}, true)
+}
+
+func (c *Coordinator) onWriteTimeout() {
+	in := c.barrierEntries("write")
+	if in == nil {
+		return
+	}
+	var missing []string
+	for pid, w := range c.partitionMap() {
+		if !in[strconv.Itoa(pid)] {
+			missing = append(missing, w)
+		}
+	}
+	c.timedOut(&StragglerError{Phase: "write", Stragglers: missing}, true)
+}
+
+func (c *Coordinator) timedOut(err *StragglerError, workers bool) {
+	if len(err.Stragglers) == 0 {
+		// it filled up as we looked
+		return
+	}
+	sort.Strings(err.Stragglers)
+	err.Checkpoint = c.lastCheckpoint
+	if workers {
+		for _, w := range err.Stragglers {
+			c.heartbeats.confirm(w)
+			c.audit("fail", err.Phase+" timeout", w)
+		}
+	}
+	c.log.Println(err)
+	c.fail(err)
+}
@@ -0,0 +1,71 @@
+package waffle
+
+import (
+	"time"
+)
+
+// A Timer adds up the time Compute spends in one of its stages over a step,
+// for jobs that want to know where their time goes.  Every worker's totals
+// go into its step summary, the cluster totals into the step stats, the job
+// summary and JobStats.
+//
+//	t := g.Timer("gather")
+//	t.Start()
+//	...
+//	t.Stop()
+type Timer struct {
+	g       *Graph
+	started time.Time
+	total   time.Duration
+}
+
+// Timer returns the named timer for this step.
+func (g *Graph) Timer(name string) *Timer {
+	g.timersLock.Lock()
+	defer g.timersLock.Unlock()
+	if g.timers == nil {
+		g.timers = make(map[string]*Timer)
+	}
+	t, ok := g.timers[name]
+	if !ok {
+		t = &Timer{g: g}
+		g.timers[name] = t
+	}
+	return t
+}
+
+func (t *Timer) Start() {
+	t.started = time.Now()
+}
+
+// Stop adds the time since Start to the timer and returns it.
+func (t *Timer) Stop() time.Duration {
+	if t.started.IsZero() {
+		return 0
+	}
+	d := time.Since(t.started)
+	t.started = time.Time{}
+	if !t.g.shadowing() {
+		t.total += d
+	}
+	return d
+}
+
+// Time times fn.
+func (t *Timer) Time(fn func()) {
+	t.Start()
+	defer t.Stop()
+	fn()
+}
+
+// seconds on each timer this step, starting them over for the next
+func (g *Graph) takeTimers() map[string]float64 {
+	g.timersLock.Lock()
+	defer g.timersLock.Unlock()
+	r := make(map[string]float64)
+	for name, t := range g.timers {
+		r[name] = t.total.Seconds()
+	}
+	g.timers = nil
+	return r
+}
@@ -0,0 +1,164 @@
+package waffle
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Topology changes are the vertices and edges jobs add and remove while
+// running.  They're counted where they're asked for, in the step that asks,
+// and take effect at the start of the next step.
+
+const (
+	counterVerticesAdded   = "topology.vertices.added"
+	counterVerticesRemoved = "topology.vertices.removed"
+	counterEdgesAdded      = "topology.edges.added"
+	counterEdgesRemoved    = "topology.edges.removed"
+)
+
+// TopologyChange counts the mutations asked for in a step across the cluster.
+type TopologyChange struct {
+	Step                           int
+	VerticesAdded, VerticesRemoved int
+	EdgesAdded, EdgesRemoved       int
+	EdgesUpdated                   int
+}
+
+func (t TopologyChange) empty() bool {
+	return t.VerticesAdded+t.VerticesRemoved+t.EdgesAdded+t.EdgesRemoved+t.EdgesUpdated == 0
+}
+
+// the steps that changed the topology
+type topologyHistory struct {
+	steps []TopologyChange
+	sync.Mutex
+}
+
+func (h *topologyHistory) collect(step int, counters map[string]float64) TopologyChange {
+	t := TopologyChange{
+		Step:            step,
+		VerticesAdded:   int(counters[counterVerticesAdded]),
+		VerticesRemoved: int(counters[counterVerticesRemoved]),
+		EdgesAdded:      int(counters[counterEdgesAdded]),
+		EdgesRemoved:    int(counters[counterEdgesRemoved]),
+		EdgesUpdated:    int(counters[counterEdgesUpdated]),
+	}
+	if t.empty() {
+		return t
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.steps = append(h.steps, t)
+	return t
+}
+
+// whether any step after step added or removed vertices
+func (h *topologyHistory) mutatedSince(step int) bool {
+	h.Lock()
+	defer h.Unlock()
+	for i := len(h.steps) - 1; i >= 0 && h.steps[i].Step > step; i-- {
+		if h.steps[i].VerticesAdded+h.steps[i].VerticesRemoved > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *topologyHistory) list() []TopologyChange {
+	h.Lock()
+	defer h.Unlock()
+	return append([]TopologyChange(nil), h.steps...)
+}
+
+// vertices and edges to drop at the start of the next step
+type removals struct {
+	vertices []string
+	edges    [][2]string
+	sync.Mutex
+}
+
+type Removal struct {
+	Vertices []string
+	Edges    [][2]string
+	// in-edges of the removed edges, for the owners of their destinations
+	InEdges [][2]string
+}
+
+func (c *Coordinator) SubmitRemoval(rm *Removal, r *int) error {
+	c.graph.queueRemoval(rm)
+	*r = 0
+	return nil
+}
+
+func (g *Graph) queueRemoval(rm *Removal) {
+	g.removed.Lock()
+	g.removed.vertices = append(g.removed.vertices, rm.Vertices...)
+	g.removed.edges = append(g.removed.edges, rm.Edges...)
+	g.removed.Unlock()
+	if len(rm.InEdges) > 0 {
+		g.in.remove(rm.InEdges)
+	}
+}
+
+func (g *Graph) sendRemoval(p int, rm *Removal) {
+	if p == g.partitionId {
+		g.queueRemoval(rm)
+		return
+	}
+	c := g.coordinator
+	var r int
+	if err := c.client(c.worker(p)).Call("Coordinator.SubmitRemoval", rm, &r); err != nil {
+		c.fail(fmt.Errorf("could not send a removal to partition %d: %v", p, err))
+	}
+}
+
+// RemoveVertex removes the vertex id, wherever it lives, along with its
+// out-edges at the start of the next step.  Edges pointing at it are left
+// alone.
+func (g *Graph) RemoveVertex(id string) {
+	if g.shadowing() {
+		return
+	}
+	g.Count(counterVerticesRemoved, 1)
+	g.noteMutations(1)
+	g.sendRemoval(g.determinePartition(id), &Removal{Vertices: []string{id}})
+}
+
+// RemoveEdge removes the edges from src to dst at the start of the next step.
+func (g *Graph) RemoveEdge(src, dst string) {
+	if g.shadowing() {
+		return
+	}
+	g.Count(counterEdgesRemoved, 1)
+	g.noteMutations(1)
+	pair := [2]string{src, dst}
+	g.sendRemoval(g.determinePartition(src), &Removal{Edges: [][2]string{pair}})
+	if g.coordinator.config.InEdges {
+		g.sendRemoval(g.determinePartition(dst), &Removal{InEdges: [][2]string{pair}})
+	}
+}
+
+// drop what was removed in the last step
+func (g *Graph) applyRemoved() {
+	g.removed.Lock()
+	vertices, edges := g.removed.vertices, g.removed.edges
+	g.removed.vertices, g.removed.edges = nil, nil
+	g.removed.Unlock()
+	for _, id := range vertices {
+		delete(g.vertices, id)
+		delete(g.edges, id)
+		g.in.Lock()
+		delete(g.in.m, id)
+		g.in.Unlock()
+		g.cold.remove(id)
+	}
+	for _, p := range edges {
+		kept := g.edges[p[0]][:0]
+		for _, e := range g.edges[p[0]] {
+			if e.Destination() != p[1] {
+				kept = append(kept, e)
+			}
+		}
+		g.edges[p[0]] = kept
+	}
+}
@@ -0,0 +1,141 @@
+package waffle
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+)
+
+// what the net/rpc http handler answers a CONNECT with
+const rpcConnected = "200 Connected to Go RPC"
+
+// Everything between workers, control calls as well as vertices and messages,
+// goes over the same rpc connections.  When Config.TLS is set both ends of
+// those are wrapped in tls so graph data never crosses the wire in the clear.
+// When Config.Token is set a connection has to present the same token in
+// its CONNECT request, so nobody without it can inject vertices or messages.
+// Control clients can present a token from Config.ACL instead, and only get
+// to make the calls it allows.
+// The CONNECT request also picks the wire format, see WireFormat.
+
+// header the job token travels in
+const tokenHeader = "X-Waffle-Token"
+
+// rpcHandler hands connections presenting the job token to the server, and
+// the ones presenting another token the ACL knows to control, which only has
+// the control calls.  Those still check the operation each call is for.
+func (c *Coordinator) rpcHandler(server, control *rpc.Server) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv := server
+		token := r.Header.Get(tokenHeader)
+		if c.config.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.config.Token)) != 1 {
+			if _, ok := c.config.ACL[token]; !ok {
+				c.audit("rpc", r.RemoteAddr, "denied")
+				http.Error(w, errDenied.Error(), http.StatusForbidden)
+				return
+			}
+			srv = control
+		}
+		wire := r.Header.Get(wireHeader)
+		if wire == "" || wire == "gob" {
+			srv.ServeHTTP(w, r)
+			return
+		}
+		f, err := lookupWireFormat(wire)
+		if err != nil || r.Method != "CONNECT" {
+			// stay on gob, the caller sees there's no answer for its format
+			srv.ServeHTTP(w, r)
+			return
+		}
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			c.log.Printf("rpc hijacking %s: %v", r.RemoteAddr, err)
+			return
+		}
+		io.WriteString(conn, "HTTP/1.0 "+rpcConnected+"\n"+wireHeader+": "+f.Name()+"\n\n")
+		f.ServeConn(srv, conn)
+	})
+}
+
+// the calls a connection with an ACL token rather than the job token can make
+type controlApi struct{ c *Coordinator }
+
+func (a controlApi) StartNow(req *StartRequest, r *int) error {
+	return a.c.StartNow(req, r)
+}
+
+func (a controlApi) CancelJob(req *CancelRequest, r *int) error {
+	return a.c.CancelJob(req, r)
+}
+
+func (a controlApi) DrainWorker(req *DrainRequest, r *int) error {
+	return a.c.DrainWorker(req, r)
+}
+
+func (a controlApi) PurgeCheckpoints(req *PurgeRequest, r *int) error {
+	return a.c.PurgeCheckpoints(req, r)
+}
+
+func (a controlApi) Status(req *StatusRequest, r *WorkerStatus) error {
+	return a.c.Status(req, r)
+}
+
+func (a controlApi) SubmitBridge(b *BridgeBatch, r *int) error {
+	return a.c.SubmitBridge(b, r)
+}
+
+func (c *Coordinator) listen() (net.Listener, error) {
+	l, err := net.Listen("tcp", joinHostPort(c.config.RPCHost, c.config.RPCPort))
+	if err != nil {
+		return nil, err
+	}
+	if c.config.TLS != nil {
+		l = tls.NewListener(l, c.config.TLS)
+	}
+	return l, nil
+}
+
+func (c *Coordinator) dial(host, port string) (*rpc.Client, error) {
+	addr := joinHostPort(host, port)
+	var conn net.Conn
+	var err error
+	if c.config.TLS == nil {
+		conn, err = net.Dial("tcp", addr)
+	} else {
+		conn, err = tls.Dial("tcp", addr, c.config.TLS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// same handshake rpc.DialHTTP does, just over our own connection and
+	// with our token
+	req := "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n"
+	if c.config.Token != "" {
+		req += tokenHeader + ": " + c.config.Token + "\n"
+	}
+	wire := c.config.WireFormat
+	if wire != "" && wire != "gob" {
+		req += wireHeader + ": " + wire + "\n"
+	}
+	io.WriteString(conn, req+"\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status == rpcConnected {
+		// the other end answers with the format it took us up on, if any
+		f, err := lookupWireFormat(resp.Header.Get(wireHeader))
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return f.NewClient(conn), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, &net.OpError{Op: "dial-http", Net: "tcp " + addr, Err: err}
+}
@@ -0,0 +1,157 @@
+package waffle
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// The type registry puts the concrete vertex, message and edge types of a
+// job in one place.  Registering a type registers it with gob, so it can be
+// sent to other workers, and under a name, so vertices can be made from the
+// name during loads and mutations.  Every worker has to register the same
+// types, which is simplest done from an init func.
+var types = struct {
+	vertices map[string]func(id string) Vertex
+	edges    map[string]func(src, dst string) Edge
+	messages map[string]reflect.Type
+	// concrete types we've checked will make it through gob
+	checked map[reflect.Type]error
+	sync.RWMutex
+}{
+	vertices: make(map[string]func(string) Vertex),
+	edges:    make(map[string]func(string, string) Edge),
+	messages: make(map[string]reflect.Type),
+	checked:  make(map[reflect.Type]error),
+}
+
+func registerType(kind, name string, example interface{}) {
+	if name == "" {
+		panic(fmt.Sprintf("%s type with no name", kind))
+	}
+	gob.RegisterName(name, example)
+	types.checked[reflect.TypeOf(example)] = nil
+}
+
+// RegisterVertexType registers the vertices made by f under name.
+func RegisterVertexType(name string, f func(id string) Vertex) {
+	types.Lock()
+	defer types.Unlock()
+	if _, ok := types.vertices[name]; ok {
+		panic(fmt.Sprintf("vertex type %s registered twice", name))
+	}
+	registerType("vertex", name, f(""))
+	types.vertices[name] = f
+}
+
+// RegisterEdgeType registers the edges made by f under name.
+func RegisterEdgeType(name string, f func(src, dst string) Edge) {
+	types.Lock()
+	defer types.Unlock()
+	if _, ok := types.edges[name]; ok {
+		panic(fmt.Sprintf("edge type %s registered twice", name))
+	}
+	registerType("edge", name, f("", ""))
+	types.edges[name] = f
+}
+
+// RegisterMsgType registers the concrete type of m under name.
+func RegisterMsgType(name string, m Message) {
+	types.Lock()
+	defer types.Unlock()
+	if _, ok := types.messages[name]; ok {
+		panic(fmt.Sprintf("message type %s registered twice", name))
+	}
+	registerType("message", name, m)
+	types.messages[name] = reflect.TypeOf(m)
+}
+
+// NewVertexOf makes a vertex of the type registered as name.
+func NewVertexOf(name, id string) (Vertex, error) {
+	types.RLock()
+	f, ok := types.vertices[name]
+	types.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no vertex type %s registered", name)
+	}
+	return f(id), nil
+}
+
+// NewEdgeOf makes an edge of the type registered as name.
+func NewEdgeOf(name, src, dst string) (Edge, error) {
+	types.RLock()
+	f, ok := types.edges[name]
+	types.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no edge type %s registered", name)
+	}
+	return f(src, dst), nil
+}
+
+// RegisteredTypes lists the names of the registered types by kind.
+func RegisteredTypes() map[string][]string {
+	types.RLock()
+	defer types.RUnlock()
+	m := make(map[string][]string)
+	for name := range types.vertices {
+		m["vertex"] = append(m["vertex"], name)
+	}
+	for name := range types.edges {
+		m["edge"] = append(m["edge"], name)
+	}
+	for name := range types.messages {
+		m["message"] = append(m["message"], name)
+	}
+	return m
+}
+
+// check that the concrete type of v can be sent to another worker.  Types
+// gob.Register'ed directly still work, the first value of every other type is
+// encoded once to find out, and the answer is remembered.
+func checkSendable(kind string, v interface{}) error {
+	t := reflect.TypeOf(v)
+	types.RLock()
+	err, ok := types.checked[t]
+	types.RUnlock()
+	if ok {
+		return err
+	}
+	var wrapped struct{ V interface{} }
+	wrapped.V = v
+	if e := gob.NewEncoder(io.Discard).Encode(&wrapped); e != nil {
+		err = fmt.Errorf("%s type %v can't be sent to other workers, register it with Register%sType: %v", kind, t, typeFunc[kind], e)
+	}
+	types.Lock()
+	types.checked[t] = err
+	types.Unlock()
+	return err
+}
+
+var typeFunc = map[string]string{"vertex": "Vertex", "edge": "Edge", "message": "Msg"}
+
+// Graph.NewVertex adds a vertex of the type registered as name during a step.
+// It ends up in whichever partition owns id.
+func (g *Graph) NewVertex(name, id string) error {
+	v, err := NewVertexOf(name, id)
+	if err != nil || g.shadowing() {
+		return err
+	}
+	g.Count(counterVerticesAdded, 1)
+	g.noteMutations(1)
+	g.addVertex(v)
+	return nil
+}
+
+// Graph.NewEdge adds an edge of the type registered as name during a step.
+func (g *Graph) NewEdge(name, src, dst string) error {
+	e, err := NewEdgeOf(name, src, dst)
+	if err != nil || g.shadowing() {
+		return err
+	}
+	g.Count(counterEdgesAdded, 1)
+	g.noteMutations(1)
+	g.addEdge(e)
+	return nil
+}
@@ -0,0 +1,60 @@
+package waffle
+
+import (
+	"encoding/gob"
+	"fmt"
+	"reflect"
+)
+
+// Checkpoints hold vertices under the name their type was registered with,
+// and gob copes on its own with fields that were added or dropped since.
+// When a vertex type changes more than that, keep the old struct around
+// under its old name with RegisterVertexUpgrade, register the new one under
+// a new name, and vertices loaded from an old checkpoint or savepoint go
+// through the upgrade on their way in.  Upgrades chain, so a job can move
+// through several versions of its data model between runs.
+
+// how many upgrades a vertex goes through before they are taken for a cycle
+const maxUpgrades = 32
+
+var upgrades = make(map[reflect.Type]func(Vertex) (Vertex, error))
+
+// RegisterVertexUpgrade has vertices of old's type, checkpointed under name,
+// turned into the current type by f when a checkpoint is loaded.  The name
+// isn't a vertex type to NewVertexOf anymore.
+func RegisterVertexUpgrade(name string, old Vertex, f func(old Vertex) (Vertex, error)) {
+	types.Lock()
+	defer types.Unlock()
+	if _, ok := types.vertices[name]; ok {
+		panic(fmt.Sprintf("vertex type %s is current, it can't be upgraded", name))
+	}
+	t := reflect.TypeOf(old)
+	if _, ok := upgrades[t]; ok {
+		panic(fmt.Sprintf("vertex type %s upgraded twice", name))
+	}
+	gob.RegisterName(name, old)
+	upgrades[t] = f
+}
+
+// upgrade v to the current type if it's of an old one
+func upgradeVertex(v Vertex) (Vertex, bool, error) {
+	upgraded := false
+	for i := 0; i < maxUpgrades; i++ {
+		types.RLock()
+		f, ok := upgrades[reflect.TypeOf(v)]
+		types.RUnlock()
+		if !ok {
+			return v, upgraded, nil
+		}
+		from := reflect.TypeOf(v)
+		var err error
+		if v, err = f(v); err != nil {
+			return nil, false, fmt.Errorf("could not upgrade vertex of type %v: %v", from, err)
+		}
+		if v == nil {
+			return nil, false, fmt.Errorf("upgrading a vertex of type %v gave nothing", from)
+		}
+		upgraded = true
+	}
+	return nil, false, fmt.Errorf("vertex type %v still has upgrades after %d, is there a cycle?", reflect.TypeOf(v), maxUpgrades)
+}
@@ -0,0 +1,206 @@
+package waffle
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Dense vector aggregation for jobs that sum up large vectors (gradients,
+// parameters) every step.  Vectors are cut into chunks and each chunk is
+// summed by the partition that owns it, so no worker has to take in every
+// other worker's whole vector and nothing goes through the json summary.
+// Every worker pulls the summed chunks back at the start of the next step.
+
+const vectorChunkSize = 4096
+
+// Jobs that aggregate vectors list them by name along with their dimension.
+type VectorAggregatorJob interface {
+	Job
+	VectorAggregators() map[string]int
+}
+
+type VectorChunk struct {
+	Step   int
+	Name   string
+	Chunk  int
+	Worker string
+	Data   Vector
+	// set instead of Data when Config.QuantizeVectors is on, Data[i] is
+	// Quantized[i] * Scale
+	Quantized []int8
+	Scale     float32
+}
+
+func quantize(v Vector) ([]int8, float32) {
+	var max float32
+	for _, f := range v {
+		if a := float32(math.Abs(float64(f))); a > max {
+			max = a
+		}
+	}
+	q := make([]int8, len(v))
+	if max == 0 {
+		return q, 0
+	}
+	scale := max / 127
+	for i, f := range v {
+		q[i] = int8(math.Round(float64(f / scale)))
+	}
+	return q, scale
+}
+
+func (ch *VectorChunk) vector() Vector {
+	if ch.Quantized == nil {
+		return ch.Data
+	}
+	v := NewVector(len(ch.Quantized))
+	for i, q := range ch.Quantized {
+		v[i] = float32(q) * ch.Scale
+	}
+	return v
+}
+
+type VectorChunkRequest struct {
+	Step  int
+	Name  string
+	Chunk int
+}
+
+type vectorKey struct {
+	step  int
+	name  string
+	chunk int
+}
+
+// the chunks this partition owns, summed as they come in
+type vectorSums struct {
+	sums map[vectorKey]Vector
+	sync.Mutex
+}
+
+func (s *vectorSums) add(ch *VectorChunk) {
+	v := ch.vector()
+	s.Lock()
+	defer s.Unlock()
+	if s.sums == nil {
+		s.sums = make(map[vectorKey]Vector)
+	}
+	k := vectorKey{ch.Step, ch.Name, ch.Chunk}
+	if sum, ok := s.sums[k]; ok {
+		sum.Add(v)
+		return
+	}
+	s.sums[k] = v.Copy()
+	// the last step's sums are still being fetched, anything older is done
+	for k := range s.sums {
+		if k.step < ch.Step-1 {
+			delete(s.sums, k)
+		}
+	}
+}
+
+func (s *vectorSums) get(k vectorKey) (Vector, bool) {
+	s.Lock()
+	defer s.Unlock()
+	v, ok := s.sums[k]
+	return v, ok
+}
+
+func (c *Coordinator) SubmitVectorChunk(ch *VectorChunk, r *int) error {
+	c.vectorSums.add(ch)
+	*r = 0
+	return nil
+}
+
+func (c *Coordinator) FetchVectorChunk(req *VectorChunkRequest, r *VectorChunk) error {
+	// a chunk nobody aggregated into comes back empty
+	v, _ := c.vectorSums.get(vectorKey{req.Step, req.Name, req.Chunk})
+	r.Step, r.Name, r.Chunk, r.Data = req.Step, req.Name, req.Chunk, v
+	return nil
+}
+
+func (c *Coordinator) chunkOwner(chunk int) string {
+	return c.worker(chunk % c.numPartitions())
+}
+
+// AggregateVector adds v into the named vector aggregator for this step
+func (g *Graph) AggregateVector(name string, v Vector) {
+	if g.shadowing() {
+		return
+	}
+	acc, ok := g.vectors[name]
+	if !ok {
+		j, _ := g.job.(VectorAggregatorJob)
+		if j == nil {
+			g.log.Panicf("No vector aggregator named %s", name)
+		}
+		dim, ok := j.VectorAggregators()[name]
+		if !ok {
+			g.log.Panicf("No vector aggregator named %s", name)
+		}
+		acc = NewVector(dim)
+		g.vectors[name] = acc
+	}
+	acc.Add(v)
+}
+
+// AggregatedVector returns the sum over the whole cluster of the named vector
+// as of the last step.  It goes back to the pool when the next step starts, so
+// copy it to keep it around.
+func (g *Graph) AggregatedVector(name string) (Vector, bool) {
+	v, ok := g.aggregatedVectors[name]
+	return v, ok
+}
+
+// send this step's vectors out to the owners of their chunks
+func (c *Coordinator) pushVectors(step int) error {
+	g := c.graph
+	for name, v := range g.vectors {
+		for chunk, off := 0, 0; off < len(v); chunk, off = chunk+1, off+vectorChunkSize {
+			end := off + vectorChunkSize
+			if end > len(v) {
+				end = len(v)
+			}
+			ch := &VectorChunk{Step: step, Name: name, Chunk: chunk, Worker: c.config.NodeId}
+			if c.config.QuantizeVectors {
+				ch.Quantized, ch.Scale = quantize(v[off:end])
+			} else {
+				ch.Data = v[off:end]
+			}
+			var r int
+			if err := c.client(c.chunkOwner(chunk)).Call("Coordinator.SubmitVectorChunk", ch, &r); err != nil {
+				return fmt.Errorf("could not push chunk %d of vector %s: %v", chunk, name, err)
+			}
+		}
+		v.Release()
+	}
+	g.vectors = make(map[string]Vector)
+	return nil
+}
+
+// pull the summed vectors of step back from the chunk owners
+func (g *Graph) pullVectors(step int) error {
+	j, ok := g.job.(VectorAggregatorJob)
+	if !ok {
+		return nil
+	}
+	c := g.coordinator
+	for _, v := range g.aggregatedVectors {
+		v.Release()
+	}
+	g.aggregatedVectors = make(map[string]Vector)
+	for name, dim := range j.VectorAggregators() {
+		sum := NewVector(dim)
+		for chunk, off := 0, 0; off < dim; chunk, off = chunk+1, off+vectorChunkSize {
+			var r VectorChunk
+			req := &VectorChunkRequest{Step: step, Name: name, Chunk: chunk}
+			if err := c.client(c.chunkOwner(chunk)).Call("Coordinator.FetchVectorChunk", req, &r); err != nil {
+				return fmt.Errorf("could not fetch chunk %d of vector %s: %v", chunk, name, err)
+			}
+			copy(sum[off:], r.Data)
+		}
+		g.aggregatedVectors[name] = sum
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package waffle
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Vector is a fixed dimension float32 vector for embedding style vertex
+// values and messages.  The operations work in place and are written as
+// plain unrolled loops over equal length slices so the compiler can keep
+// them tight.  It gob encodes as raw little endian floats.
+type Vector []float32
+
+var (
+	vectorPools    = make(map[int]*sync.Pool)
+	vectorPoolLock sync.Mutex
+)
+
+func vectorPool(dim int) *sync.Pool {
+	vectorPoolLock.Lock()
+	defer vectorPoolLock.Unlock()
+	p, ok := vectorPools[dim]
+	if !ok {
+		p = &sync.Pool{New: func() interface{} { return make(Vector, dim) }}
+		vectorPools[dim] = p
+	}
+	return p
+}
+
+// NewVector returns a zeroed vector of dim from the pool for that dimension
+func NewVector(dim int) Vector {
+	v := vectorPool(dim).Get().(Vector)
+	v.Zero()
+	return v
+}
+
+// Release hands v back to its pool, v must not be used afterwards
+func (v Vector) Release() {
+	vectorPool(len(v)).Put(v)
+}
+
+func (v Vector) Zero() {
+	for i := range v {
+		v[i] = 0
+	}
+}
+
+func (v Vector) Copy() Vector {
+	c := NewVector(len(v))
+	copy(c, v)
+	return c
+}
+
+// Add adds w to v
+func (v Vector) Add(w Vector) {
+	w = w[:len(v)]
+	i := 0
+	for ; i+4 <= len(v); i += 4 {
+		v[i] += w[i]
+		v[i+1] += w[i+1]
+		v[i+2] += w[i+2]
+		v[i+3] += w[i+3]
+	}
+	for ; i < len(v); i++ {
+		v[i] += w[i]
+	}
+}
+
+// AddScaled adds a*w to v
+func (v Vector) AddScaled(a float32, w Vector) {
+	w = w[:len(v)]
+	i := 0
+	for ; i+4 <= len(v); i += 4 {
+		v[i] += a * w[i]
+		v[i+1] += a * w[i+1]
+		v[i+2] += a * w[i+2]
+		v[i+3] += a * w[i+3]
+	}
+	for ; i < len(v); i++ {
+		v[i] += a * w[i]
+	}
+}
+
+func (v Vector) Scale(a float32) {
+	for i := range v {
+		v[i] *= a
+	}
+}
+
+// Max keeps the larger of v and w in each dimension
+func (v Vector) Max(w Vector) {
+	w = w[:len(v)]
+	for i := range v {
+		if w[i] > v[i] {
+			v[i] = w[i]
+		}
+	}
+}
+
+func (v Vector) Dot(w Vector) float32 {
+	w = w[:len(v)]
+	var s0, s1, s2, s3 float32
+	i := 0
+	for ; i+4 <= len(v); i += 4 {
+		s0 += v[i] * w[i]
+		s1 += v[i+1] * w[i+1]
+		s2 += v[i+2] * w[i+2]
+		s3 += v[i+3] * w[i+3]
+	}
+	for ; i < len(v); i++ {
+		s0 += v[i] * w[i]
+	}
+	return s0 + s1 + s2 + s3
+}
+
+func (v Vector) Norm() float32 {
+	return float32(math.Sqrt(float64(v.Dot(v))))
+}
+
+func (v Vector) GobEncode() ([]byte, error) {
+	b := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b, nil
+}
+
+func (v *Vector) GobDecode(b []byte) error {
+	if len(b)%4 != 0 {
+		return fmt.Errorf("vector encoding has %d bytes", len(b))
+	}
+	w := NewVector(len(b) / 4)
+	for i := range w {
+		w[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	*v = w
+	return nil
+}
+
+// VectorMessage is implemented by messages that carry a vector, so that
+// VectorSum and VectorMax can combine them
+type VectorMessage interface {
+	Message
+	Vector() Vector
+}
+
+// VectorSum combines vector messages to the same vertex by adding them up
+// into the first one, for use from CombinerJob
+type VectorSum struct{}
+
+func (VectorSum) Combine(msgs []Message) []Message {
+	acc := msgs[0].(VectorMessage).Vector()
+	for _, m := range msgs[1:] {
+		acc.Add(m.(VectorMessage).Vector())
+	}
+	return msgs[:1]
+}
+
+// VectorMax combines vector messages by taking the largest value in each
+// dimension, for use from CombinerJob
+type VectorMax struct{}
+
+func (VectorMax) Combine(msgs []Message) []Message {
+	acc := msgs[0].(VectorMessage).Vector()
+	for _, m := range msgs[1:] {
+		acc.Max(m.(VectorMessage).Vector())
+	}
+	return msgs[:1]
+}
@@ -0,0 +1,78 @@
+package waffle
+
+import (
+	"fmt"
+)
+
+// Set when building, e.g.
+//
+//	go build -ldflags "-X waffle.Version=1.2.0 -X waffle.Commit=$(git rev-parse HEAD)"
+var (
+	Version = "dev"
+	Commit  = ""
+)
+
+type BuildInfo struct {
+	Version string
+	Commit  string
+}
+
+func (b BuildInfo) String() string {
+	if b.Commit == "" {
+		return b.Version
+	}
+	return b.Version + " (" + b.Commit + ")"
+}
+
+func build() BuildInfo {
+	return BuildInfo{Version: Version, Commit: Commit}
+}
+
+// SameVersion is a Config.CompatibleVersion that only lets workers built
+// from the same version run together
+func SameVersion(ours, theirs BuildInfo) bool {
+	return ours.Version == theirs.Version
+}
+
+// SameCommit is a Config.CompatibleVersion that only lets workers built
+// from the same commit run together
+func SameCommit(ours, theirs BuildInfo) bool {
+	return ours == theirs
+}
+
+func buildInfo(info map[string]interface{}) BuildInfo {
+	v, _ := info["version"].(string)
+	c, _ := info["commit"].(string)
+	return BuildInfo{Version: v, Commit: c}
+}
+
+// check the workers already registered against the version policy, done
+// while holding the registration lock
+func (c *Coordinator) checkVersions() error {
+	ours := build()
+	for w := range c.workers.GetCopy() {
+		info, err := c.workerInfo(w)
+		if err != nil {
+			return err
+		}
+		theirs := buildInfo(info)
+		if ours != theirs {
+			c.log.Printf("Worker %s is running %s, we are running %s", w, theirs, ours)
+		}
+		if c.config.CompatibleVersion != nil && !c.config.CompatibleVersion(ours, theirs) {
+			return fmt.Errorf("worker %s is running %s which is incompatible with %s", w, theirs, ours)
+		}
+	}
+	return nil
+}
+
+// versions of all the workers, for status
+func (c *Coordinator) versions() map[string]string {
+	v := make(map[string]string)
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+	for w, info := range c.cachedWorkerInfo {
+		v[w] = buildInfo(info).String()
+	}
+	return v
+}
@@ -1,7 +1,10 @@
 package waffle
 
 import (
-	"github.com/dforsyth/donut"
+	"context"
+	"crypto/tls"
+	"log"
+	"time"
 )
 
 type Config struct {
@@ -10,33 +13,180 @@ type Config struct {
 	InitialWorkers   int
 	RPCHost, RPCPort string
 	ZKServers        string
+	// where a generated NodeId is kept when NodeId is left empty
+	IdFile string
+	// tenant the job runs under, jobs are namespaced by tenant and id, neither
+	// of which may have a slash in it
+	Tenant string
+	// machine class, picks the per class settings of a pushed ClusterConfig
+	Class string
+	// token this worker presents on control calls and rpc connections, and
+	// the tokens it accepts.  Workers of a job need to share it.
+	Token string
+	ACL   ACL
+	// when set all rpc between workers, data included, is done over tls
+	TLS *tls.Config
+	// registered wire format to ask other workers for, gob when empty or
+	// when they don't speak it
+	WireFormat string
+	// vertices are hashed into this many partitions, spread over the
+	// workers, so where they live doesn't change with the number of workers.
+	// 0 is a partition per worker.
+	NumPartitions int
+	// let workers that show up once the job is running join it at the next
+	// step barrier.  Needs NumPartitions.  A joiner that isn't admitted
+	// within JoinTimeout (10m when 0) gives up with ErrNotAdmitted.
+	Elastic     bool
+	JoinTimeout time.Duration
+	// remote messages per step to a single vertex before it gets mirrored
+	// locally, 0 disables mirroring
+	MirrorThreshold int
+	// most vertices mirrored here, and most of ours mirrored elsewhere, 10000
+	// when 0
+	MirrorLimit int
+	// check the mirrors every this many steps against the vertices they
+	// mirror, 0 never does
+	VerifyMirrors int
+	// compute each vertex twice in this fraction of the partitions every
+	// step and compare, to catch a Compute that isn't deterministic.  Slow,
+	// for debugging only, and jobs with partition state aren't checked.
+	CheckDeterminism float64
+	// workers per summary group, the first worker in each group collects
+	// and condenses the step summaries of the rest before entering the step
+	// barrier on their behalf.  0 has every worker enter on its own.
+	SummaryGroupSize int
+	// bytes of memory this worker may use, 0 leaves the runtime alone.  See
+	// Graph.MemoryPressure.
+	MemoryBudget int64
+	// GOGC for workers, 0 keeps the default
+	GCPercent int
+	// directory for memory mapped outbound message buffers, when empty
+	// messages are sent in batches of BatchSize (1024 by default), and
+	// partly full batches go out every FlushInterval during a step
+	SpillDir      string
+	BatchSize     int
+	FlushInterval time.Duration
+	// keep the sources of the edges into every vertex, see Graph.InEdges.
+	// Pull steps need them.
+	InEdges bool
+	// switch to pull steps once the marked frontier covers more than this
+	// fraction of the vertices, and back to push below PushFraction
+	// (PullFraction/4 by default).  0 leaves it to master compute.
+	PullFraction, PushFraction float64
+	// move vertices off the slowest partition between steps when it takes
+	// more than this many times the mean step time, 0 never does
+	RebalanceSkew float64
+	// after steps that add or remove vertices, split part of the largest
+	// partition off into the smallest when it has more than this many times
+	// the mean number of vertices.  0 never does.
+	RepartitionSkew float64
+	// mutations a single Compute call may ask for in a step, and the most
+	// vertices and edges a step may add net of removals, as a fraction of
+	// the vertex count.  Going over either fails the run at the step
+	// barrier.  0 is no limit.
+	MaxMutationsPerVertex int
+	MaxGrowth             float64
+	// move every vertex of a partition to disk once it has had no active
+	// vertices and no messages for this many steps.  0 never does.
+	EvictIdleSteps int
+	// give up on a phase whose barrier hasn't filled in this long, naming the
+	// workers it was waiting for.  0 waits forever.
+	LoadTimeout, StepTimeout, WriteTimeout time.Duration
+	// drop messages identical to one already sent to the same vertex this
+	// step, for jobs whose messages are idempotent.  DedupBits sizes the
+	// bloom filter kept per destination partition.
+	DedupMessages bool
+	DedupBits     int
+	// how often workers send each other heartbeats, 0 disables them
+	HeartbeatInterval time.Duration
+	// phi above which a worker is considered dead, defaults to 8
+	PhiThreshold float64
+	// heartbeats a worker can miss in a row before it is suspected no matter
+	// what phi says, 0 leaves it to phi
+	MissedBeats int
+	// how long a suspected worker gets to answer a status call before its
+	// failure is confirmed and the run given up on.  Defaults to 5s.
+	SuspectTimeout time.Duration
+	// how long a worker can go without hearing from any peer or zookeeper
+	// before it quarantines itself and fails the run, 0 disables quarantine
+	LeaseTimeout time.Duration
+	// walk the partition once after loading, before the first step
+	WarmUp bool
+	// LogDebug logs everything each worker does, otherwise barriers are
+	// summarized at most once every ProgressInterval (10s by default)
+	LogLevel         LogLevel
+	ProgressInterval time.Duration
+	// decides whether a worker may join alongside one built from another
+	// version, see SameVersion and SameCommit.  nil allows any mix.
+	CompatibleVersion func(ours, theirs BuildInfo) bool
+	// registered codecs for message batches, for the checkpoint parts
+	// FilePersister and S3Persister write, and for input read through
+	// Graph.Codec.  Peers settle on none when one of them lacks a codec.
+	// Empty is no compression.
+	MessageCodec, CheckpointCodec, LoadCodec string
+	// free form labels (team, experiment, dataset, ...) attached to logs,
+	// Information, audit entries, metrics and the job summary
+	Tags map[string]string
+	// how long a single vertex gets to compute, see ContextVertex.  0 is no
+	// limit.
+	VertexTimeout time.Duration
+	// sample where workers spend each step, reported as profile.* counters
+	// and logged at every step barrier
+	Profile bool
+	// how vertices are spread over partitions and partitions over workers,
+	// every worker has to use the same one.  Defaults to HashPartitioner.
+	Partitioner Partitioner
+	// send vector aggregators as int8 with a scale per chunk, trading
+	// precision for a quarter of the bytes
+	QuantizeVectors bool
+	// share of compute this job gets when other jobs in the same process
+	// have a weight too, 0 opts out of sharing
+	ShareWeight float64
+	// host:port to serve the job status (/status), prometheus metrics
+	// (/metrics) and cancellation (/cancel) on over http, empty for none.
+	// Cancelling takes the job token or an ACL grant.
+	StatusAddr string
+	// bytes of local disk allowed by category (DiskSpill, DiskCheckpoints,
+	// DiskResults), categories that aren't listed are unlimited
+	DiskQuotas map[string]int64
+	// vertices a partition keeps in memory, the rest go to disk in SpillDir
+	// (or the temp dir).  0 keeps them all in memory.
+	ResidentVertices int
+	// how many checkpoints to keep around and for how long, for jobs that
+	// implement CheckpointDeleter.  0 is no limit.
+	KeepCheckpoints  int
+	CheckpointMaxAge time.Duration
+	// fail the load when more records than this, or more than this fraction
+	// of them, had to be skipped.  0 is no limit.
+	MaxBadRecords  int
+	MaxBadFraction float64
+	// slow this worker down or have it fail, to try a job out locally
+	Simulate *Simulation
 }
 
 func Run(c *Config, j Job) {
-	clusterName := j.Id()
-	listener := &waffleListener{
-		clusterName: clusterName,
-		coordinator: newCoordinator(clusterName, c),
-		job:         j,
-	}
-	balancer := &waffleBalancer{}
-	config := donut.NewConfig()
-	config.Servers = c.ZKServers
-	config.NodeId = c.NodeId
-	config.Timeout = 1 * 1e9
-
-	cluster := donut.NewCluster(clusterName, config, balancer, listener)
+	run(c, j, nil)
+}
 
-	listener.cluster = cluster
-	listener.done = make(chan byte)
-	listener.config = config
-	listener.coordinator.done = listener.done
-	cluster.Join()
-	<-listener.done
+func run(c *Config, j Job, resume *JobState) {
+	r, err := newRunner(c, j, resume)
+	if err == nil {
+		err = r.Run(context.Background())
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
 }
 
 const (
+	AuditPath    = "audit"
 	BarriersPath = "barriers"
+	BridgesPath  = "bridges"
+	CancelPath   = "cancel"
+	ConfigPath   = "config"
+	DrainPath    = "drain"
 	LockPath     = "lock"
+	PreemptPath  = "preempt"
+	StartPath    = "start"
 	WorkersPath  = "workers"
 )
@@ -0,0 +1,44 @@
+package waffle
+
+import (
+	"encoding/gob"
+	"io"
+	"time"
+)
+
+// Jobs that keep caches of their own (interned ids, lookup tables, ...) can
+// fill them while the graph is being warmed up.
+type WarmUpJob interface {
+	WarmUp(v Vertex, edges []Edge)
+}
+
+// warmUp walks the whole partition once before the first step so that the
+// first step doesn't pay for faulting pages in and filling caches.  Every
+// vertex and its edges get encoded, which reads all of their data and also
+// sets up the gob type info that sending messages and mirrors needs.
+func (c *Coordinator) warmUp() {
+	if !c.config.WarmUp {
+		return
+	}
+	g := c.graph
+	wj, _ := g.job.(WarmUpJob)
+	enc := gob.NewEncoder(io.Discard)
+	start := time.Now()
+	g.eachVertex(func(v Vertex, cold bool) bool {
+		id := v.Id()
+		if err := enc.Encode(&v); err != nil {
+			c.log.Printf("Could not warm up vertex %s: %v", id, err)
+		}
+		edges := g.edges[id]
+		for _, e := range edges {
+			if err := enc.Encode(&e); err != nil {
+				c.log.Printf("Could not warm up edge %s -> %s: %v", e.Source(), e.Destination(), err)
+			}
+		}
+		if wj != nil {
+			wj.WarmUp(v, edges)
+		}
+		return true
+	})
+	c.log.Printf("Warmed up %d vertices in %s", g.vertexCount(), time.Since(start))
+}
@@ -0,0 +1,65 @@
+package waffle
+
+import (
+	"fmt"
+	"io"
+	"net/rpc"
+	"sync"
+)
+
+// A WireFormat encodes the rpc traffic between workers.  gob, what net/rpc
+// speaks by default, and protobuf are built in, others can be added with
+// RegisterWireFormat.  A worker dialing another asks for Config.WireFormat
+// in its CONNECT request, and the other end says in its answer whether it
+// speaks it.  When it doesn't the connection stays on gob, so workers with
+// different formats, or from before formats could be picked, get along.
+type WireFormat interface {
+	Name() string
+	NewClient(conn io.ReadWriteCloser) *rpc.Client
+	ServeConn(server *rpc.Server, conn io.ReadWriteCloser)
+}
+
+var (
+	wireFormats    = make(map[string]WireFormat)
+	wireFormatLock sync.RWMutex
+)
+
+func RegisterWireFormat(f WireFormat) {
+	wireFormatLock.Lock()
+	defer wireFormatLock.Unlock()
+	wireFormats[f.Name()] = f
+}
+
+func init() {
+	RegisterWireFormat(gobWire{})
+	RegisterWireFormat(protoWire{})
+}
+
+func lookupWireFormat(name string) (WireFormat, error) {
+	if name == "" {
+		name = "gob"
+	}
+	wireFormatLock.RLock()
+	defer wireFormatLock.RUnlock()
+	f, ok := wireFormats[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown wire format %q", name)
+	}
+	return f, nil
+}
+
+// header a connection asks for its wire format in, and the answer comes back
+// in
+const wireHeader = "X-Waffle-Wire"
+
+type gobWire struct{}
+
+func (gobWire) Name() string { return "gob" }
+
+func (gobWire) NewClient(conn io.ReadWriteCloser) *rpc.Client {
+	return rpc.NewClient(conn)
+}
+
+func (gobWire) ServeConn(server *rpc.Server, conn io.ReadWriteCloser) {
+	server.ServeConn(conn)
+}